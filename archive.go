@@ -0,0 +1,86 @@
+package tsar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gfanton/tsar/tsarscript"
+	"golang.org/x/tools/txtar"
+)
+
+// archiveFile returns the parsed header and decoded content of a file from
+// a script's archive.
+func archiveFile(f txtar.File) (tsarscript.FileHeader, []byte, error) {
+	h, err := tsarscript.ParseFileHeader(f.Name)
+	if err != nil {
+		return h, nil, fmt.Errorf("-- %s --: %v", f.Name, err)
+	}
+	data := f.Data
+	if h.Target != "" && len(bytes.TrimSpace(data)) > 0 {
+		return h, nil, fmt.Errorf("-- %s --: symlink cannot have content", f.Name)
+	}
+	if h.Encoding == "base64" {
+		data, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(f.Data)), ""))
+		if err != nil {
+			return h, nil, fmt.Errorf("-- %s --: invalid base64: %v", f.Name, err)
+		}
+	}
+	return h, data, nil
+}
+
+// extractArchive writes the files of the script's archive into the work
+// directory, expanding environment variables in those annotated [expand],
+// or in every text file if the frontmatter sets expand-files.
+func (ts *TestScript) extractArchive(ar *txtar.Archive) error {
+	for _, f := range ar.Files {
+		h, data, err := archiveFile(f)
+		if err != nil {
+			return err
+		}
+		name := ts.mkabs(h.Name)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			return err
+		}
+		if h.Target != "" {
+			if err := os.Symlink(filepath.FromSlash(h.Target), name); err != nil {
+				return err
+			}
+			continue
+		}
+		if h.Expand || (ts.meta.expandFiles && h.Encoding == "") {
+			data = []byte(ts.expandEnvVars(string(data)))
+		}
+		if err := os.WriteFile(name, data, 0666); err != nil {
+			return err
+		}
+		// Set the exact mode, which the umask would otherwise mask.
+		if h.Mode != 0 {
+			if err := os.Chmod(name, h.Mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeArchiveData encodes content for an archive file with header h, in
+// lines of 76 characters for base64.
+func encodeArchiveData(h tsarscript.FileHeader, content []byte) []byte {
+	if h.Encoding != "base64" {
+		return content
+	}
+	enc := base64.StdEncoding.EncodeToString(content)
+	var b strings.Builder
+	for len(enc) > 76 {
+		b.WriteString(enc[:76] + "\n")
+		enc = enc[76:]
+	}
+	if enc != "" {
+		b.WriteString(enc + "\n")
+	}
+	return []byte(b.String())
+}
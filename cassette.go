@@ -0,0 +1,186 @@
+package tsar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ExecMode selects whether exec'd programs run, or are recorded in or
+// replayed from a cassette; see Params.ExecMode.
+type ExecMode string
+
+const (
+	ExecLive   ExecMode = ""       // run programs (the default)
+	ExecRecord ExecMode = "record" // run programs and record their results
+	ExecReplay ExecMode = "replay" // serve results from the cassette
+)
+
+// ParseExecMode parses the name of an ExecMode; "live" and the empty string
+// both mean ExecLive.
+func ParseExecMode(s string) (ExecMode, error) {
+	switch m := ExecMode(s); m {
+	case "live", ExecLive:
+		return ExecLive, nil
+	case ExecRecord, ExecReplay:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown exec mode %q (want live, record or replay)", s)
+}
+
+// cassette holds the recorded execs of a script, in the order they ran.
+type cassette struct {
+	Execs []cassetteExec `json:"execs"`
+
+	mu   sync.Mutex
+	used []bool // replayed entries
+}
+
+// cassetteExec is one recorded program run. The work directory is replaced
+// with $WORK in every field, as it differs between runs.
+type cassetteExec struct {
+	Args     []string `json:"args"`            // program as written, then its arguments
+	Stdin    string   `json:"stdin,omitempty"` // sha256 of the input, if any
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	Combined string   `json:"combined,omitempty"` // if not stdout then stderr
+	Exit     int      `json:"exit"`
+	Error    string   `json:"error,omitempty"` // why it did not exit, if it did not
+}
+
+// cassetteFile returns the cassette of the script: <name>.cassette.json in
+// Params.CassetteDir, or else next to the script.
+func (ts *TestScript) cassetteFile() string {
+	dir := ts.params.CassetteDir
+	if dir == "" {
+		dir = filepath.Dir(ts.file)
+	}
+	base := filepath.Base(ts.file)
+	return filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base))+".cassette.json")
+}
+
+// loadCassette prepares the script's cassette for Params.ExecMode.
+func (ts *TestScript) loadCassette() error {
+	switch ts.params.ExecMode {
+	case ExecRecord:
+		ts.cassette = &cassette{Execs: []cassetteExec{}}
+	case ExecReplay:
+		data, err := os.ReadFile(ts.cassetteFile())
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no cassette %s; record one with exec mode record", ts.cassetteFile())
+		}
+		if err != nil {
+			return err
+		}
+		c := &cassette{}
+		if err := json.Unmarshal(data, c); err != nil {
+			return fmt.Errorf("%s: %v", ts.cassetteFile(), err)
+		}
+		c.used = make([]bool, len(c.Execs))
+		ts.cassette = c
+	}
+	return nil
+}
+
+// writeCassette saves the execs recorded by the script, if recording.
+func (ts *TestScript) writeCassette() error {
+	if ts.params.ExecMode != ExecRecord || ts.cassette == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(ts.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := ts.cassetteFile()
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0666)
+}
+
+// cassetteKey returns the recorded form of a program's arguments and input:
+// the arguments with the work directory replaced and their input's digest.
+// It consumes stdin, returning a reader with the same content.
+func (ts *TestScript) cassetteKey(stdin io.Reader, name string, args []string) ([]string, string, io.Reader, error) {
+	key := make([]string, 0, 1+len(args))
+	for _, arg := range append([]string{name}, args...) {
+		key = append(key, ts.unworkdir(arg))
+	}
+	if stdin == nil {
+		return key, "", nil, nil
+	}
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	sum := sha256.Sum256([]byte(ts.unworkdir(string(data))))
+	return key, hex.EncodeToString(sum[:]), strings.NewReader(string(data)), nil
+}
+
+// unworkdir replaces the work directory in s with $WORK.
+func (ts *TestScript) unworkdir(s string) string {
+	return strings.ReplaceAll(s, ts.workdir, "$WORK")
+}
+
+// record appends a finished program run to the cassette.
+func (ts *TestScript) record(args []string, stdin string, out execOutput, err error) {
+	e := cassetteExec{
+		Args:   args,
+		Stdin:  stdin,
+		Stdout: ts.unworkdir(out.stdout),
+		Stderr: ts.unworkdir(out.stderr),
+		Exit:   exitCode(err),
+	}
+	if combined := ts.unworkdir(out.combined); combined != e.Stdout+e.Stderr {
+		e.Combined = combined
+	}
+	if err != nil && e.Exit < 0 {
+		e.Error = ts.unworkdir(err.Error())
+	}
+	ts.cassette.mu.Lock()
+	ts.cassette.Execs = append(ts.cassette.Execs, e)
+	ts.cassette.mu.Unlock()
+}
+
+// replay returns the result recorded for a program run: the first one not
+// yet replayed with the same arguments and input.
+func (ts *TestScript) replay(args []string, stdin string) (execOutput, error) {
+	c := ts.cassette
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.Execs {
+		if c.used[i] || e.Stdin != stdin || !slices.Equal(e.Args, args) {
+			continue
+		}
+		c.used[i] = true
+		work := func(s string) string { return strings.ReplaceAll(s, "$WORK", ts.workdir) }
+		out := execOutput{stdout: work(e.Stdout), stderr: work(e.Stderr), combined: work(e.Combined)}
+		if e.Combined == "" {
+			out.combined = out.stdout + out.stderr
+		}
+		switch {
+		case e.Error != "":
+			return out, errors.New(work(e.Error))
+		case e.Exit != 0:
+			return out, replayedExit(e.Exit)
+		}
+		return out, nil
+	}
+	return execOutput{}, fmt.Errorf("no recorded run of %q in %s; re-record with exec mode record", strings.Join(args, " "), ts.cassetteFile())
+}
+
+// replayedExit is the error of a replayed program that exited unsuccessfully.
+type replayedExit int
+
+func (e replayedExit) Error() string { return "exit status " + strconv.Itoa(int(e)) }
+
+func (e replayedExit) ExitCode() int { return int(e) }
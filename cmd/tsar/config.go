@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/gfanton/tsar"
+	"github.com/peterbourgon/ff/v4"
+)
+
+func newConfigCommand() *ff.Command {
+	return &ff.Command{
+		Name:      "config",
+		Usage:     "tsar config [DIR]",
+		ShortHelp: "print a project's resolved configuration and check tsar.toml",
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("at most one directory allowed")
+			}
+			dir := "."
+			if len(args) == 1 {
+				dir = args[0]
+			}
+			return printConfig(os.Stdout, dir)
+		},
+	}
+}
+
+// printConfig writes the configuration resolved for the project in dir,
+// with where each value came from, and fails if tsar.toml holds keys
+// outside its schema.
+func printConfig(w io.Writer, dir string) error {
+	cfg, err := tsar.LoadProjectConfig(dir)
+	if err != nil {
+		return err
+	}
+
+	toml := filepath.Join(cfg.Dir(), "tsar.toml")
+	if _, err := os.Stat(toml); err != nil {
+		toml = "none"
+	}
+	fmt.Fprintf(w, "project: %s\ntsar.toml: %s\n\n", cfg.Dir(), toml)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, f := range []struct {
+		key, value string
+	}{
+		{"bin", cfg.BinDir},
+		{"setup", cfg.Setup},
+		{"teardown", cfg.Teardown},
+		{"test.setup", cfg.Test.Setup},
+		{"test.teardown", cfg.Test.Teardown},
+	} {
+		value, source := f.value, string(cfg.Source(f.key))
+		if value == "" {
+			value, source = "-", "unset"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t(%s)\n", f.key, value, source)
+	}
+	for _, ext := range slices.Sorted(maps.Keys(cfg.Interpreters)) {
+		source := "default"
+		if tsar.DefaultInterpreters[ext] != cfg.Interpreters[ext] {
+			source = string(tsar.SourceTOML)
+		}
+		fmt.Fprintf(tw, "interpreters.%q\t%s\t(%s)\n", ext, cfg.Interpreters[ext], source)
+	}
+	tw.Flush()
+
+	if unknown := cfg.UnknownKeys(); len(unknown) > 0 {
+		fmt.Fprintln(w)
+		for _, key := range unknown {
+			fmt.Fprintf(w, "unknown key %s\n", key)
+		}
+		return fmt.Errorf("tsar.toml: %d unknown key(s)", len(unknown))
+	}
+	return nil
+}
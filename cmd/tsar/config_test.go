@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrintConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	toml := "setup = \"init.sh\"\n\n[interpreters]\npy = \"python3 -u\"\n"
+	for name, data := range map[string]string{"tsar.toml": toml, "init.sh": "#!/bin/sh\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b strings.Builder
+	if err := printConfig(&b, dir); err != nil {
+		t.Fatal(err)
+	}
+	// Columns are padded to align, so compare with spaces collapsed.
+	got := strings.Join(strings.Fields(b.String()), " ")
+	for _, want := range []string{
+		"bin " + filepath.Join(dir, "bin") + " (convention)",
+		"setup " + filepath.Join(dir, "init.sh") + " (tsar.toml)",
+		"teardown - (unset)",
+		`interpreters.".py" python3 -u (tsar.toml)`,
+		`interpreters.".sh" /bin/sh (default)`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %q:\n%s", want, b.String())
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "tsar.toml"), []byte("setpu = \"init.sh\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	err := printConfig(&b, dir)
+	if err == nil || err.Error() != "tsar.toml: 1 unknown key(s)" {
+		t.Errorf("printConfig = %v, want unknown key error", err)
+	}
+	if !strings.Contains(b.String(), "unknown key setpu (line 1)") {
+		t.Errorf("output lacks unknown key:\n%s", b.String())
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gfanton/tsar"
+	"github.com/gfanton/tsar/tsarscript"
+	"github.com/peterbourgon/ff/v4"
+)
+
+// newLSPCommand creates the "tsar lsp" subcommand.
+func newLSPCommand() *ff.Command {
+	return &ff.Command{
+		Name:      "lsp",
+		Usage:     "tsar lsp",
+		ShortHelp: "run a language server for .tsar files on stdin/stdout",
+		Exec: func(ctx context.Context, args []string) error {
+			// Dry runs evaluate conditions such as [short].
+			testing.Init()
+			flag.Parse()
+			return newLSPServer(os.Stdin, os.Stdout).serve()
+		},
+	}
+}
+
+// lspServer is a minimal language server speaking JSON-RPC over a stream.
+// Documents are synchronized in full; positions are treated as byte offsets,
+// which matches UTF-16 offsets for ASCII scripts.
+type lspServer struct {
+	r     *bufio.Reader
+	w     io.Writer
+	docs  map[string]string // open documents by URI
+	usage map[string]string // builtin command usage lines
+}
+
+func newLSPServer(r io.Reader, w io.Writer) *lspServer {
+	return &lspServer{
+		r:     bufio.NewReader(r),
+		w:     w,
+		docs:  make(map[string]string),
+		usage: tsar.BuiltinUsage(),
+	}
+}
+
+// ---- Protocol
+
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type textDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+const (
+	severityError      = 1
+	completionFunction = 3
+	completionVariable = 6
+)
+
+// serve handles messages until the client sends "exit" or closes the stream.
+func (s *lspServer) serve() error {
+	for {
+		req, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(req)
+		if req.ID == nil {
+			continue // notification
+		}
+		if err != nil {
+			s.write(map[string]any{"jsonrpc": "2.0", "id": req.ID,
+				"error": map[string]any{"code": -32603, "message": err.Error()}})
+			continue
+		}
+		s.write(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}
+}
+
+// read reads one Content-Length framed message.
+func (s *lspServer) read() (*rpcRequest, error) {
+	length := -1
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("lsp: invalid Content-Length %q", v)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("lsp: missing Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		return nil, err
+	}
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("lsp: %w", err)
+	}
+	return &req, nil
+}
+
+func (s *lspServer) write(msg any) {
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) notify(method string, params any) {
+	s.write(map[string]any{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *lspServer) handle(req *rpcRequest) (any, error) {
+	switch req.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":   1, // full
+				"completionProvider": map[string]any{"triggerCharacters": []string{"$"}},
+				"definitionProvider": true,
+				"hoverProvider":      true,
+			},
+			"serverInfo": map[string]any{"name": "tsar"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		s.update(p.TextDocument.URI, p.TextDocument.Text)
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		var p textDocumentPosition
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]any{
+			"uri": p.TextDocument.URI, "diagnostics": []lspDiagnostic{},
+		})
+	case "textDocument/completion", "textDocument/hover", "textDocument/definition":
+		var p textDocumentPosition
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		text, ok := s.docs[p.TextDocument.URI]
+		if !ok {
+			return nil, nil
+		}
+		switch req.Method {
+		case "textDocument/completion":
+			return s.complete(text, p.Position), nil
+		case "textDocument/hover":
+			return s.hover(text, p.Position), nil
+		default:
+			return s.definition(p.TextDocument.URI, text, p.Position), nil
+		}
+	default:
+		if req.ID != nil {
+			return nil, fmt.Errorf("method not supported: %s", req.Method)
+		}
+	}
+	return nil, nil
+}
+
+// update stores a document's new text and publishes its diagnostics.
+func (s *lspServer) update(uri, text string) {
+	s.docs[uri] = text
+	s.notify("textDocument/publishDiagnostics", map[string]any{
+		"uri": uri, "diagnostics": diagnose(uri, text),
+	})
+}
+
+// ---- Features
+
+// diagnose reports syntax errors, then the problems found by a dry run of the
+// script in its project directory (see tsar.Params.DryRun).
+func diagnose(uri, text string) []lspDiagnostic {
+	diags := []lspDiagnostic{}
+	reported := make(map[int]bool)
+	add := func(line, col int, msg string) {
+		reported[line] = true
+		diags = append(diags, lspDiagnostic{
+			Range:    lspRange{lspPosition{line, col}, lspPosition{line, len(lineAt(text, line))}},
+			Severity: severityError,
+			Source:   "tsar",
+			Message:  msg,
+		})
+	}
+
+	_, err := tsarscript.Parse("", []byte(text))
+	var errs tsarscript.ErrorList
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			add(e.Pos.Line-1, e.Pos.Col-1, e.Msg)
+		}
+	}
+
+	for _, p := range dryRunProblems(uri, text) {
+		if !reported[p.line] {
+			add(p.line, 0, p.msg)
+		}
+	}
+	return diags
+}
+
+type problem struct {
+	line int // 0-based
+	msg  string
+}
+
+var problemLine = regexp.MustCompile(`^script:(\d+): (.*)$`)
+
+// dryRunProblems dry-runs a temporary copy of the document, using the
+// document's directory as the project so its bin/ and tsar.toml apply.
+func dryRunProblems(uri, text string) []problem {
+	dir := "."
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		dir = filepath.Dir(filepath.FromSlash(u.Path))
+	}
+	tmp, err := os.MkdirTemp("", "tsar-lsp-*")
+	if err != nil {
+		return []problem{{0, err.Error()}}
+	}
+	defer os.RemoveAll(tmp)
+	file := filepath.Join(tmp, "script.tsar")
+	if err := os.WriteFile(file, []byte(text), 0666); err != nil {
+		return []problem{{0, err.Error()}}
+	}
+
+	capture := &problemCapture{}
+	params := tsar.Params{Dir: dir, DryRun: true, ContinueOnError: true}
+	if err := tsar.RunFilesStandaloneWithProject(capture, params, file); err != nil && !capture.Failed() {
+		return []problem{{0, err.Error()}}
+	}
+
+	var problems []problem
+	for _, msg := range capture.messages {
+		for _, line := range strings.Split(msg, "\n") {
+			if m := problemLine.FindStringSubmatch(line); m != nil {
+				n, _ := strconv.Atoi(m[1])
+				problems = append(problems, problem{max(n-1, 0), m[2]})
+			}
+		}
+	}
+	return problems
+}
+
+// complete offers environment variables after '$' and builtin command names
+// in command position.
+func (s *lspServer) complete(text string, pos lspPosition) []lspCompletionItem {
+	items := []lspCompletionItem{}
+	line := lineAt(text, pos.Line)
+	before := line[:min(pos.Character, len(line))]
+	word := before[strings.LastIndexAny(before, " \t")+1:]
+
+	if strings.Contains(word, "$") {
+		for _, name := range envNames(text) {
+			items = append(items, lspCompletionItem{Label: name, Kind: completionVariable})
+		}
+		return items
+	}
+
+	// Only the first word of a command, after any condition and "!", names it.
+	rest := strings.TrimSpace(before)
+	if _, r, err := tsarscript.CutCondition(rest); err == nil {
+		rest = r
+	}
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "!"))
+	if strings.ContainsAny(rest, " \t") || strings.HasPrefix(rest, "#") {
+		return items
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.usage)) {
+		items = append(items, lspCompletionItem{Label: name, Kind: completionFunction, Detail: s.usage[name]})
+	}
+	return items
+}
+
+// hover shows the usage line of the builtin command under the cursor.
+func (s *lspServer) hover(text string, pos lspPosition) any {
+	line, arg := argAt(text, pos)
+	if line == nil || arg != &line.Args[0] {
+		return nil
+	}
+	usage, ok := s.usage[arg.Value]
+	if !ok {
+		return nil
+	}
+	return map[string]any{
+		"contents": map[string]any{"kind": "plaintext", "value": usage},
+		"range":    argRange(arg),
+	}
+}
+
+// definition jumps from a file argument to its embedded archive file.
+func (s *lspServer) definition(uri, text string, pos lspPosition) any {
+	_, arg := argAt(text, pos)
+	if arg == nil {
+		return nil
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(arg.Value, "$WORK/"), "./")
+	script, _ := tsarscript.Parse("", []byte(text))
+	for _, f := range script.Files {
+		if filepath.Clean(f.Name) == filepath.Clean(name) {
+			start := lspPosition{f.Pos.Line - 1, 0}
+			return []lspLocation{{URI: uri, Range: lspRange{start, start}}}
+		}
+	}
+	return nil
+}
+
+// argAt returns the command line and argument at pos, if any.
+func argAt(text string, pos lspPosition) (*tsarscript.Line, *tsarscript.Arg) {
+	script, _ := tsarscript.Parse("", []byte(text))
+	if pos.Line >= len(script.Lines) {
+		return nil, nil
+	}
+	line := script.Lines[pos.Line]
+	for i := range line.Args {
+		a := &line.Args[i]
+		if start := a.Pos.Col - 1; pos.Character >= start && pos.Character <= start+len(a.Raw) {
+			return line, a
+		}
+	}
+	return nil, nil
+}
+
+func argRange(a *tsarscript.Arg) lspRange {
+	start := lspPosition{a.Pos.Line - 1, a.Pos.Col - 1}
+	return lspRange{start, lspPosition{start.Line, start.Character + len(a.Raw)}}
+}
+
+// envNames lists the variables a script can expand: the ones tsar sets, the
+// ones the script sets with env or set, and the process environment.
+func envNames(text string) []string {
+	names := map[string]bool{"WORK": true, "PATH": true, "HOME": true, "TMPDIR": true, "exe": true}
+	script, _ := tsarscript.Parse("", []byte(text))
+	for _, l := range script.Lines {
+		if len(l.Args) > 1 && l.Args[0].Value == "set" {
+			names[l.Args[1].Value] = true
+		}
+		if len(l.Args) > 1 && l.Args[0].Value == "env" {
+			for _, a := range l.Args[1:] {
+				if k, _, ok := strings.Cut(a.Value, "="); ok {
+					names[k] = true
+				}
+			}
+		}
+	}
+	for _, kv := range os.Environ() {
+		if k, _, ok := strings.Cut(kv, "="); ok && k != "" {
+			names[k] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(names))
+}
+
+// lineAt returns line n (0-based) of text, or "" past the end.
+func lineAt(text string, n int) string {
+	lines := strings.Split(text, "\n")
+	if n < 0 || n >= len(lines) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[n], "\r")
+}
+
+// problemCapture is a TestingT recording failure messages.
+type problemCapture struct {
+	messages []string
+}
+
+func (t *problemCapture) Skip(args ...any) {}
+func (t *problemCapture) Fatal(args ...any) {
+	t.messages = append(t.messages, fmt.Sprint(args...))
+}
+func (t *problemCapture) Fatalf(format string, args ...any) {
+	t.messages = append(t.messages, fmt.Sprintf(format, args...))
+}
+func (t *problemCapture) Log(args ...any)                 {}
+func (t *problemCapture) Logf(format string, args ...any) {}
+func (t *problemCapture) Failed() bool                    { return len(t.messages) > 0 }
+func (t *problemCapture) Helper()                         {}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lspSession runs an lspServer over the given messages and returns every
+// message it wrote, decoded.
+func lspSession(t *testing.T, messages ...map[string]any) []map[string]any {
+	t.Helper()
+	var in strings.Builder
+	for _, msg := range messages {
+		msg["jsonrpc"] = "2.0"
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	var out strings.Builder
+	if err := newLSPServer(strings.NewReader(in.String()), &out).serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	var replies []map[string]any
+	r := bufio.NewReader(strings.NewReader(out.String()))
+	for {
+		var n int
+		if _, err := fmt.Fscanf(r, "Content-Length: %d\r\n\r\n", &n); err != nil {
+			return replies
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		var reply map[string]any
+		if err := json.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, reply)
+	}
+}
+
+// replyTo returns the response to request id.
+func replyTo(t *testing.T, replies []map[string]any, id float64) map[string]any {
+	t.Helper()
+	for _, r := range replies {
+		if r["id"] == id {
+			return r
+		}
+	}
+	t.Fatalf("no reply to request %v in %v", id, replies)
+	return nil
+}
+
+func at(id int, method, uri string, line, char int) map[string]any {
+	return map[string]any{"id": id, "method": method, "params": map[string]any{
+		"textDocument": map[string]any{"uri": uri},
+		"position":     map[string]any{"line": line, "character": char},
+	}}
+}
+
+func TestLSP(t *testing.T) {
+	dir := t.TempDir()
+	uri := "file://" + filepath.ToSlash(filepath.Join(dir, "a.tsar"))
+	text := "env GREETING=hi\n" +
+		"exec cat input.txt\n" +
+		"stdout 'unclosed\n" +
+		"no-such-program-tsar\n" +
+		"-- input.txt --\n" +
+		"hello\n"
+
+	replies := lspSession(t,
+		map[string]any{"id": 1, "method": "initialize", "params": map[string]any{}},
+		map[string]any{"method": "initialized", "params": map[string]any{}},
+		map[string]any{"method": "textDocument/didOpen", "params": map[string]any{
+			"textDocument": map[string]any{"uri": uri, "languageId": "tsar", "version": 1, "text": text},
+		}},
+		at(2, "textDocument/hover", uri, 1, 2),
+		at(3, "textDocument/definition", uri, 1, 12),
+		at(4, "textDocument/completion", uri, 3, 0),
+		map[string]any{"id": 6, "method": "shutdown"},
+		map[string]any{"method": "exit"},
+	)
+
+	caps := replyTo(t, replies, 1)["result"].(map[string]any)["capabilities"].(map[string]any)
+	if caps["hoverProvider"] != true || caps["definitionProvider"] != true {
+		t.Errorf("capabilities = %v", caps)
+	}
+
+	var diags []any
+	for _, r := range replies {
+		if r["method"] == "textDocument/publishDiagnostics" {
+			diags = r["params"].(map[string]any)["diagnostics"].([]any)
+		}
+	}
+	lines := map[float64]string{}
+	for _, d := range diags {
+		d := d.(map[string]any)
+		line := d["range"].(map[string]any)["start"].(map[string]any)["line"].(float64)
+		lines[line] = d["message"].(string)
+	}
+	if !strings.Contains(lines[2], "unclosed quote") {
+		t.Errorf("line 3 diagnostic = %q, want unclosed quote", lines[2])
+	}
+	if !strings.Contains(lines[3], `"no-such-program-tsar" not found`) {
+		t.Errorf("line 4 diagnostic = %q, want command not found", lines[3])
+	}
+	if len(lines) != 2 {
+		t.Errorf("diagnostics = %v, want 2", lines)
+	}
+
+	hover := replyTo(t, replies, 2)["result"].(map[string]any)["contents"].(map[string]any)
+	if !strings.HasPrefix(hover["value"].(string), "exec ") {
+		t.Errorf("hover = %v, want exec usage", hover)
+	}
+
+	locs := replyTo(t, replies, 3)["result"].([]any)
+	start := locs[0].(map[string]any)["range"].(map[string]any)["start"].(map[string]any)
+	if start["line"] != float64(4) {
+		t.Errorf("definition of input.txt = %v, want line 4", start)
+	}
+
+	var labels []string
+	for _, item := range replyTo(t, replies, 4)["result"].([]any) {
+		labels = append(labels, item.(map[string]any)["label"].(string))
+	}
+	if got := strings.Join(labels, " "); !strings.Contains(got, "exec") || !strings.Contains(got, "stdout") {
+		t.Errorf("command completion = %s", got)
+	}
+}
+
+func TestLSPEnvCompletion(t *testing.T) {
+	uri := "file:///nowhere/b.tsar"
+	text := "env GREETING=hi\nexec echo $\n"
+	replies := lspSession(t,
+		map[string]any{"method": "textDocument/didOpen", "params": map[string]any{
+			"textDocument": map[string]any{"uri": uri, "text": text},
+		}},
+		at(1, "textDocument/completion", uri, 1, 11),
+		at(2, "textDocument/completion", uri, 1, 7),
+	)
+
+	var labels []string
+	for _, item := range replyTo(t, replies, 1)["result"].([]any) {
+		labels = append(labels, item.(map[string]any)["label"].(string))
+	}
+	got := " " + strings.Join(labels, " ") + " "
+	for _, want := range []string{"GREETING", "WORK"} {
+		if !strings.Contains(got, " "+want+" ") {
+			t.Errorf("env completion missing %s: %v", want, labels)
+		}
+	}
+	if items := replyTo(t, replies, 2)["result"].([]any); len(items) != 0 {
+		t.Errorf("completion in argument position = %v, want none", items)
+	}
+}
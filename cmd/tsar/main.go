@@ -5,9 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/gfanton/tsar"
 	"github.com/peterbourgon/ff/v4"
@@ -18,9 +20,45 @@ type config struct {
 	short               bool
 	testWork            bool
 	workdirRoot         string
+	workdirMode         string
 	continueOnError     bool
+	maxFailures         int
+	count               int
+	timeout             time.Duration
 	requireExplicitExec bool
 	requireUniqueNames  bool
+	tags                []string
+	env                 []string
+	passThroughEnv      []string
+	redact              []string
+	summary             string
+	profile             string
+	slowThreshold       time.Duration
+	color               string
+	quiet               bool
+	trace               bool
+	dryRun              bool
+	maxOutputBytes      int
+	normalizeNewlines   bool
+	home                string
+	sharedGoCache       bool
+	goProxyDir          string
+	locale              string
+	timezone            string
+	unknownCondition    string
+	failOnLeaked        bool
+	failOnMissing       bool
+	checkLeaks          bool
+	envDiff             bool
+	artifactDir         string
+	update              bool
+	downloadCache       string
+	compat              bool
+	sandbox             bool
+	captureHTTP         bool
+	execMode            string
+	cassetteDir         string
+	seed                uint64
 }
 
 func (cfg *config) registerFlags(fs *ff.FlagSet) {
@@ -28,14 +66,61 @@ func (cfg *config) registerFlags(fs *ff.FlagSet) {
 	fs.BoolVar(&cfg.short, 's', "short", "run tests in short mode")
 	fs.BoolVar(&cfg.testWork, 0, "test-work", "preserve work directories after tests")
 	fs.StringVar(&cfg.workdirRoot, 'w', "workdir-root", "", "root directory for work directories")
+	fs.StringEnumVar(&cfg.workdirMode, 0, "workdir-mode", "how work directories are provided: temp, tmpfs, pool, or reuse", "temp", "tmpfs", "pool", "reuse")
 	fs.BoolVar(&cfg.continueOnError, 'c', "continue-on-error", "continue executing tests after an error")
+	fs.IntVar(&cfg.maxFailures, 0, "max-failures", 0, "stop after this many failed scripts (0 means use --continue-on-error)")
+	fs.IntVar(&cfg.count, 0, "count", 1, "run each script this many times, in fresh work directories, and report pass rates")
+	fs.DurationVar(&cfg.timeout, 0, "timeout", 0, "bound the whole run, killing in-flight scripts (0 means no limit)")
 	fs.BoolVar(&cfg.requireExplicitExec, 'e', "require-explicit-exec", "require explicit 'exec' for command execution")
 	fs.BoolVar(&cfg.requireUniqueNames, 'u', "require-unique-names", "require unique test names")
+	fs.StringListVar(&cfg.tags, 0, "tags", "only run scripts with one of these frontmatter tags (repeatable, comma-separated)")
+	fs.StringVar(&cfg.downloadCache, 0, "download-cache", "", "directory caching files fetched by download -sha256 (default: user cache dir)")
+	fs.StringVar(&cfg.summary, 0, "summary", "", "write a JSON summary of per-script results to this file")
+	fs.StringVar(&cfg.profile, 0, "profile", "", "write the wall time of every command, aggregated, to this file (.json or .csv)")
+	fs.DurationVar(&cfg.slowThreshold, 0, "slow-threshold", 0, "mark scripts and commands running longer than this in the output and summary (0 means off)")
+	fs.StringVar(&cfg.artifactDir, 0, "artifact-dir", "", "save output too large to log (e.g. of failing cmp) under this directory")
+	fs.StringEnumVar(&cfg.color, 0, "color", "color status markers: auto, always, or never", "auto", "always", "never")
+	fs.BoolVar(&cfg.quiet, 'q', "quiet", "only print failures and the final summary")
+	fs.BoolVar(&cfg.trace, 'x', "trace", "log each script line as it executes (implies --verbose)")
+	fs.BoolVar(&cfg.update, 0, "update", "rewrite mismatching tree manifests in the scripts' archives")
+	fs.BoolVar(&cfg.compat, 0, "compat", "run go-internal testscript files (.txt, .txtar) with its semantics")
+	fs.BoolVar(&cfg.sandbox, 0, "sandbox", "run exec'd programs in new Linux namespaces, with only the work directory writable")
+	fs.BoolVar(&cfg.captureHTTP, 0, "capture-http", "record the HTTP(S) requests of exec'd programs through a proxy, for requested")
+	fs.StringEnumVar(&cfg.execMode, 0, "exec-mode", "run exec'd programs (live), also record their results in cassettes (record), or serve them from cassettes (replay)", "live", "record", "replay")
+	fs.StringVar(&cfg.cassetteDir, 0, "cassette-dir", "", "directory of the --exec-mode cassettes (default: each script's directory)")
+	fs.Uint64Var(&cfg.seed, 0, "seed", 0, "seed the random values of every script (TSAR_SEED) with this (0 means random)")
+	fs.BoolVar(&cfg.dryRun, 'n', "dry-run", "check scripts for problems without executing them")
+	fs.StringEnumVar(&cfg.unknownCondition, 0, "unknown-condition", "what to do with unknown conditions: fail, skip-line, or skip-script", "fail", "skip-line", "skip-script")
+	fs.BoolVar(&cfg.failOnLeaked, 0, "fail-on-leaked-background", "fail scripts that end with background commands they never waited for")
+	fs.BoolVar(&cfg.failOnMissing, 0, "fail-on-missing-requires", "fail, rather than skip, scripts requiring programs missing from PATH")
+	fs.BoolVar(&cfg.checkLeaks, 0, "check-leaks", "fail scripts that leave goroutines, file descriptors or temp files behind")
+	fs.BoolVar(&cfg.envDiff, 0, "env-diff", "log how a failing script's environment changed, and where")
+	fs.StringListVar(&cfg.env, 0, "env", "add KEY=VALUE to every script's environment (repeatable)")
+	fs.StringListVar(&cfg.passThroughEnv, 0, "pass-through-env", "copy host environment variables matching NAME, a glob such as AWS_*, into every script (repeatable, comma-separated)")
+	fs.StringListVar(&cfg.redact, 0, "redact", "mask the value of environment variable NAME, or the matches of a regular expression, as [REDACTED] in logs and failures (repeatable)")
+	fs.StringEnumVar(&cfg.home, 0, "home", "home directory of scripts: none (/no-home), temp (writable, under $WORK), or host", "none", "temp", "host")
+	fs.BoolVar(&cfg.sharedGoCache, 0, "shared-go-cache", "share GOCACHE and GOMODCACHE between scripts and runs, keeping GOPATH per script")
+	fs.StringVar(&cfg.goProxyDir, 0, "go-proxy-dir", "", "serve the Go module fixtures of this directory to scripts through GOPROXY")
+	fs.StringVar(&cfg.locale, 0, "locale", "", "LANG and LC_ALL of every script (default C)")
+	fs.StringVar(&cfg.timezone, 0, "timezone", "", "TZ of every script (default UTC)")
+	fs.BoolVar(&cfg.normalizeNewlines, 0, "normalize-newlines", "turn \\r\\n line endings into \\n in program output and files before matching")
+	fs.IntVar(&cfg.maxOutputBytes, 0, "max-output-bytes", 0, "keep at most this many bytes of each exec's stdout and stderr (0 means 16 MiB, negative means no limit)")
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// Commands run in their own process groups, out of reach of a terminal
+	// interrupt, so the first one cancels the run to stop them; the next
+	// one kills tsar.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		signal.Stop(sig)
+		cancel(fmt.Errorf("interrupted by %v", s))
+	}()
 
 	tsCmd := NewCommand()
 
@@ -55,11 +140,18 @@ func NewCommand() *ff.Command {
 
 	return &ff.Command{
 		Name:  "tsar",
-		Usage: "tsar [FLAGS] SUBCOMMAND ...",
+		Usage: "tsar [FLAGS] TARGET...",
 		Flags: fs,
 		Exec: func(ctx context.Context, args []string) error {
 			return execTestRunner(ctx, &cfg, args)
 		},
+		Subcommands: []*ff.Command{
+			newConfigCommand(),
+			newLSPCommand(),
+			newRecordCommand(),
+			newStressCommand(),
+			newWorkdirsCommand(),
+		},
 	}
 }
 
@@ -68,92 +160,252 @@ func execTestRunner(ctx context.Context, cfg *config, args []string) error {
 		return fmt.Errorf("at least one argument required")
 	}
 
-	target := args[0]
+	if cfg.trace {
+		cfg.verbose = true
+	}
 
-	// Determine if target is a file or directory
-	info, err := os.Stat(target)
+	// Resolve every target (files, directories, globs) before running anything
+	files, err := collectTargets(args, tsar.Params{Compat: cfg.compat}.ScriptExtensions())
 	if err != nil {
-		return fmt.Errorf("cannot access %s: %w", target, err)
+		return err
+	}
+	if err := checkUniqueNames(files, tsar.Params{RequireUniqueNames: cfg.requireUniqueNames, Compat: cfg.compat}); err != nil {
+		return err
 	}
 
-	// Initialize testing framework with minimal os.Args
-	oldArgs := os.Args
-	defer func() { os.Args = oldArgs }()
-	os.Args = []string{"tsar"}
-	flag.Parse()
-	testing.Init()
+	defer initTesting(cfg.short, cfg.verbose)()
 
-	// Set up test flags after testing.Init()
-	if cfg.short {
-		flag.Set("test.short", "true")
+	workdirMode, err := tsar.ParseWorkdirMode(cfg.workdirMode)
+	if err != nil {
+		return err
 	}
-
-	if cfg.verbose {
-		flag.Set("test.v", "true")
+	unknownCondition, err := tsar.ParseUnknownConditionPolicy(cfg.unknownCondition)
+	if err != nil {
+		return err
 	}
+	execMode, err := tsar.ParseExecMode(cfg.execMode)
+	if err != nil {
+		return err
+	}
+	home, err := tsar.ParseHomeMode(cfg.home)
+	if err != nil {
+		return err
+	}
+
+	colored := useColor(cfg.color, os.Stdout)
 
 	// Create parameters for testscript
 	params := tsar.Params{
+		Context:             ctx,
 		TestWork:            cfg.testWork,
 		WorkdirRoot:         cfg.workdirRoot,
+		WorkdirMode:         workdirMode,
 		ContinueOnError:     cfg.continueOnError,
+		MaxFailures:         cfg.maxFailures,
+		Count:               cfg.count,
 		RequireExplicitExec: cfg.requireExplicitExec,
 		RequireUniqueNames:  cfg.requireUniqueNames,
+		Trace:               cfg.trace,
+		DryRun:              cfg.dryRun,
+		UpdateScripts:       cfg.update,
+		MaxOutputBytes:      cfg.maxOutputBytes,
+		NormalizeNewlines:   cfg.normalizeNewlines,
+		Env:                 cfg.env,
+		Home:                home,
+		SharedGoCache:       cfg.sharedGoCache,
+		GoProxyDir:          cfg.goProxyDir,
+		Locale:              cfg.locale,
+		Timezone:            cfg.timezone,
+		UnknownCondition:    unknownCondition,
+		Color:               colored,
+		ArtifactDir:         cfg.artifactDir,
+		DownloadCache:       cfg.downloadCache,
+		Compat:              cfg.compat,
+		Sandbox:             cfg.sandbox,
+		CaptureHTTP:         cfg.captureHTTP,
+		ExecMode:            execMode,
+		CassetteDir:         cfg.cassetteDir,
+		Seed:                cfg.seed,
+
+		FailOnLeakedBackground: cfg.failOnLeaked,
+		FailOnMissingRequires:  cfg.failOnMissing,
+		CheckLeaks:             cfg.checkLeaks,
+		EnvDiff:                cfg.envDiff,
+		Redact:                 cfg.redact,
+	}
+	for _, tags := range cfg.tags {
+		params.Tags = append(params.Tags, strings.Split(tags, ",")...)
+	}
+	for _, names := range cfg.passThroughEnv {
+		params.PassThroughEnv = append(params.PassThroughEnv, strings.Split(names, ",")...)
 	}
 
 	// Create a testResultCapture to capture test results
+	color := painter(colored)
 	runner := &testResultCapture{
 		verbose: cfg.verbose,
+		painter: color,
+	}
+	report := &reporter{
+		w:       os.Stdout,
+		painter: color,
+		quiet:   cfg.quiet,
+		verbose: cfg.verbose,
+		start:   time.Now(),
+	}
+	if !cfg.verbose && isTerminal(os.Stdout) {
+		report.progress = newProgress(os.Stdout, len(files)*max(cfg.count, 1))
+		report.progress.run(200 * time.Millisecond)
+		runner.print = report.print
+		params.OnStart = report.progress.scriptStarted
 	}
 
-	absPath, err := filepath.Abs(target)
-	if err != nil {
-		return fmt.Errorf("cannot get absolute path for %s: %w", target, err)
+	var events []func(tsar.Event)
+	var slow *slowRecorder
+	if cfg.slowThreshold > 0 {
+		slow = newSlowRecorder(cfg.slowThreshold)
+		report.slow = slow
+		events = append(events, slow.event)
+	}
+	var summary *summaryRecorder
+	if cfg.summary != "" {
+		summary = newSummaryRecorder(cfg.testWork || cfg.workdirRoot != "")
+		summary.slow = slow
+	}
+	var profile *profileRecorder
+	if cfg.profile != "" {
+		profile = &profileRecorder{}
+		events = append(events, profile.record)
+	}
+	if len(events) > 0 {
+		params.Events = func(e tsar.Event) {
+			for _, f := range events {
+				f(e)
+			}
+		}
+	}
+	// Failed scripts, by file, counted across groups for --max-failures;
+	// with --count, a script counts once whichever of its runs failed.
+	failed := make(map[string]bool)
+	params.OnResult = func(res tsar.ScriptResult) {
+		if res.Status == tsar.StatusFail {
+			failed[res.File] = true
+		}
+		report.result(res)
+		if summary != nil {
+			summary.record(res)
+		}
+		slow.done(res)
 	}
 
-	if !info.IsDir() {
-		// Single file execution
-		if !strings.HasSuffix(target, ".tsar") {
-			return fmt.Errorf("file must have .tsar extension: %s", target)
+	var deadline time.Time
+	if cfg.timeout > 0 {
+		deadline = time.Now().Add(cfg.timeout)
+	}
+
+	// Each directory is its own project (bin/, setup.sh, tsar.toml), so
+	// files are run grouped by directory, sharing one runner and deadline.
+	var runErr error
+	for _, group := range groupByDir(files) {
+		if !deadline.IsZero() {
+			params.Timeout = time.Until(deadline)
+			if params.Timeout <= 0 {
+				runErr = fmt.Errorf("run timed out after %v", cfg.timeout)
+				break
+			}
+		}
+		if cfg.maxFailures > 0 {
+			// Each group gets what is left of the budget of failures.
+			params.MaxFailures = cfg.maxFailures - len(failed)
+		}
+		params.Dir = group.dir
+		if err := tsar.RunFilesStandaloneWithProject(runner, params, group.files...); err != nil {
+			if runErr == nil {
+				runErr = err
+			}
+			if cfg.maxFailures > 0 && len(failed) >= cfg.maxFailures {
+				break
+			}
+			if !cfg.continueOnError && cfg.maxFailures == 0 {
+				break
+			}
 		}
+	}
 
-		params.Dir = filepath.Dir(absPath)
-		return tsar.RunFilesStandaloneWithProject(runner, params, absPath)
+	report.finish()
+	if summary != nil {
+		if err := summary.write(cfg.summary); err != nil && runErr == nil {
+			runErr = err
+		}
+	}
+	if profile != nil {
+		if err := profile.write(cfg.profile); err != nil && runErr == nil {
+			runErr = err
+		}
 	}
+	return runErr
+}
 
-	// Directory execution
-	params.Dir = absPath
-	return tsar.RunStandaloneWithProject(runner, params)
+// initTesting initializes the testing flags, which conditions such as
+// [short] read, and returns a function restoring os.Args.
+func initTesting(short, verbose bool) (restore func()) {
+	oldArgs := os.Args
+	os.Args = []string{"tsar"}
+	flag.Parse()
+	testing.Init()
+
+	// Set up test flags after testing.Init()
+	if short {
+		flag.Set("test.short", "true")
+	}
+	if verbose {
+		flag.Set("test.v", "true")
+	}
+	return func() { os.Args = oldArgs }
 }
 
 // testResultCapture implements TestingT to capture test results
 type testResultCapture struct {
 	failed  bool
 	verbose bool
+	painter painter
+	print   func(func()) // wraps output, e.g. around a progress line; may be nil
 }
 
 func (t *testResultCapture) Skip(args ...any) {
 	if t.verbose {
-		fmt.Print("SKIP: ")
+		fmt.Print(t.painter.status(tsar.StatusSkip), ": ")
 		fmt.Println(args...)
 	}
 }
 
 func (t *testResultCapture) Fatal(args ...any) {
 	t.failed = true
-	fmt.Print("FAIL: ")
-	fmt.Println(args...)
+	t.output(func() {
+		fmt.Print(t.painter.status(tsar.StatusFail), ": ")
+		fmt.Println(args...)
+	})
 	// Don't exit here like testing.T does, just mark as failed
 }
 
 func (t *testResultCapture) Fatalf(format string, args ...any) {
 	t.failed = true
-	fmt.Print("FAIL: ")
-	fmt.Printf(format, args...)
-	fmt.Println()
+	t.output(func() {
+		fmt.Print(t.painter.status(tsar.StatusFail), ": ")
+		fmt.Printf(format, args...)
+		fmt.Println()
+	})
 	// Don't exit here like testing.T does, just mark as failed
 }
 
+func (t *testResultCapture) output(f func()) {
+	if t.print != nil {
+		t.print(f)
+		return
+	}
+	f()
+}
+
 func (t *testResultCapture) Log(args ...any) {
 	if t.verbose {
 		fmt.Println(args...)
@@ -162,8 +414,7 @@ func (t *testResultCapture) Log(args ...any) {
 
 func (t *testResultCapture) Logf(format string, args ...any) {
 	if t.verbose {
-		fmt.Printf(format, args...)
-		fmt.Print("\n")
+		fmt.Println(t.painter.markLine(fmt.Sprintf(format, args...)))
 	}
 }
 
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gfanton/tsar"
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// useColor resolves a --color mode against the output file.
+func useColor(mode string, f *os.File) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(f)
+}
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// painter colors status markers when enabled.
+type painter bool
+
+func (p painter) paint(color, s string) string {
+	if !p {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+// status returns the colored marker for a script status.
+func (p painter) status(status tsar.ScriptStatus) string {
+	switch status {
+	case tsar.StatusPass:
+		return p.paint(ansiGreen, "PASS")
+	case tsar.StatusFail:
+		return p.paint(ansiRed, "FAIL")
+	default:
+		return p.paint(ansiYellow, "SKIP")
+	}
+}
+
+// markLine colors the status word in the runner's "--- PASS: name" lines.
+func (p painter) markLine(line string) string {
+	for _, status := range []tsar.ScriptStatus{tsar.StatusPass, tsar.StatusFail, tsar.StatusSkip} {
+		word := strings.ToUpper(string(status))
+		if rest, ok := strings.CutPrefix(line, "--- "+word+":"); ok {
+			return "--- " + p.status(status) + ":" + rest
+		}
+	}
+	return line
+}
+
+// reporter prints one status line per script and a final tally.
+type reporter struct {
+	w       io.Writer
+	painter painter
+	quiet   bool // only report failed scripts
+	verbose bool // the runner already logs per-script status lines
+	start   time.Time
+
+	progress *progress // live status line; nil when disabled
+
+	slow        *slowRecorder // marks slow scripts and commands; nil when disabled
+	slowScripts []string      // "name (duration)" of each slow script
+
+	count int           // runs of each script with --count
+	runs  []*scriptRuns // outcomes of each script's runs, if count > 1
+
+	passed, failed, skipped int
+}
+
+// scriptRuns tallies the runs of a script for --count.
+type scriptRuns struct {
+	file, name              string
+	passed, failed, skipped int
+}
+
+// result is suitable for tsar.Params.OnResult.
+func (r *reporter) result(res tsar.ScriptResult) {
+	switch res.Status {
+	case tsar.StatusPass:
+		r.passed++
+	case tsar.StatusFail:
+		r.failed++
+	case tsar.StatusSkip:
+		r.skipped++
+	}
+	if r.progress != nil {
+		r.progress.scriptDone(res.Status == tsar.StatusFail)
+	}
+	if res.Run > 0 {
+		r.tallyRun(res)
+	}
+	slow, slowCommands := r.slow.script(res)
+	mark := ""
+	if slow {
+		r.slowScripts = append(r.slowScripts, fmt.Sprintf("%s (%.2fs)", res.Name, res.Duration.Seconds()))
+		mark = " " + r.painter.paint(ansiYellow, "SLOW")
+	}
+	if r.verbose || (r.quiet && res.Status != tsar.StatusFail) {
+		return
+	}
+	r.print(func() {
+		fmt.Fprintf(r.w, "--- %s: %s (%.2fs)%s\n", r.painter.status(res.Status), res.Name, res.Duration.Seconds(), mark)
+		for _, cmd := range slowCommands {
+			fmt.Fprintf(r.w, "    slow: script:%d: %s (%.2fs)\n", cmd.Line, cmd.Command, cmd.Duration.Seconds())
+		}
+		for _, sec := range res.Sections {
+			if r.quiet && sec.Status != tsar.StatusFail {
+				continue
+			}
+			fmt.Fprintf(r.w, "    --- %s: %s/%s (%.2fs)\n", r.painter.status(sec.Status), res.Name, sec.Name, sec.Duration.Seconds())
+		}
+	})
+}
+
+// tallyRun counts a run of a script run --count times.
+func (r *reporter) tallyRun(res tsar.ScriptResult) {
+	i := slices.IndexFunc(r.runs, func(s *scriptRuns) bool { return s.file == res.File })
+	if i < 0 {
+		name := strings.TrimSuffix(res.Name, fmt.Sprintf("#%d", res.Run))
+		r.runs = append(r.runs, &scriptRuns{file: res.File, name: name})
+		i = len(r.runs) - 1
+	}
+	switch s := r.runs[i]; res.Status {
+	case tsar.StatusPass:
+		s.passed++
+	case tsar.StatusFail:
+		s.failed++
+	case tsar.StatusSkip:
+		s.skipped++
+	}
+}
+
+// print runs f, keeping any progress line out of the way.
+func (r *reporter) print(f func()) {
+	if r.progress != nil {
+		r.progress.write(f)
+		return
+	}
+	f()
+}
+
+// finish prints the final tally.
+func (r *reporter) finish() {
+	if r.progress != nil {
+		r.progress.finish()
+	}
+	if len(r.slowScripts) > 0 {
+		fmt.Fprintf(r.w, "%s %d script(s) took longer than %v: %s\n", r.painter.paint(ansiYellow, "SLOW"),
+			len(r.slowScripts), r.slow.threshold, strings.Join(r.slowScripts, ", "))
+	}
+	for _, s := range r.runs {
+		status := tsar.StatusPass
+		if s.failed > 0 {
+			status = tsar.StatusFail
+		}
+		total := s.passed + s.failed + s.skipped
+		fmt.Fprintf(r.w, "%s %s: %d/%d runs passed (%.0f%%)\n", r.painter.status(status), s.name,
+			s.passed, total, 100*float64(s.passed)/float64(total))
+	}
+	status := tsar.StatusPass
+	if r.failed > 0 {
+		status = tsar.StatusFail
+	}
+	fmt.Fprintf(r.w, "%s %d passed, %d failed, %d skipped (%.2fs)\n",
+		r.painter.status(status), r.passed, r.failed, r.skipped, time.Since(r.start).Seconds())
+}
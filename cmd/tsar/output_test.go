@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gfanton/tsar"
+)
+
+func TestReporter(t *testing.T) {
+	results := []tsar.ScriptResult{
+		{Name: "a", Status: tsar.StatusPass, Duration: 10 * time.Millisecond},
+		{Name: "b", Status: tsar.StatusFail, Sections: []tsar.SectionResult{
+			{Name: "build", Status: tsar.StatusPass},
+			{Name: "check", Status: tsar.StatusFail},
+		}},
+		{Name: "c", Status: tsar.StatusSkip},
+	}
+	tests := []struct {
+		name  string
+		quiet bool
+		color painter
+		want  []string
+	}{
+		{"default", false, false, []string{
+			"--- PASS: a (0.01s)",
+			"--- FAIL: b (0.00s)",
+			"    --- PASS: b/build (0.00s)",
+			"    --- FAIL: b/check (0.00s)",
+			"--- SKIP: c (0.00s)",
+			"FAIL 1 passed, 1 failed, 1 skipped",
+		}},
+		{"quiet", true, false, []string{
+			"--- FAIL: b (0.00s)",
+			"    --- FAIL: b/check (0.00s)",
+			"FAIL 1 passed, 1 failed, 1 skipped",
+		}},
+		{"color", true, true, []string{
+			"--- \x1b[31mFAIL\x1b[0m: b (0.00s)",
+			"    --- \x1b[31mFAIL\x1b[0m: b/check (0.00s)",
+			"\x1b[31mFAIL\x1b[0m 1 passed, 1 failed, 1 skipped",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			r := &reporter{w: &out, painter: tt.color, quiet: tt.quiet, start: time.Now()}
+			for _, res := range results {
+				r.result(res)
+			}
+			r.finish()
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(tt.want), out.String())
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("line %d = %q, want prefix %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestReporterSlow(t *testing.T) {
+	var out strings.Builder
+	slow := newSlowRecorder(time.Second)
+	r := &reporter{w: &out, slow: slow, start: time.Now()}
+	for _, e := range []tsar.Event{
+		{Kind: tsar.EventCommandEnd, File: "a.tsar", Line: 2, Args: []string{"exec", "go", "build"}, Duration: 1500 * time.Millisecond},
+		{Kind: tsar.EventCommandEnd, File: "a.tsar", Line: 3, Neg: true, Args: []string{"exec", "true"}, Duration: time.Millisecond},
+	} {
+		slow.event(e)
+	}
+	for _, res := range []tsar.ScriptResult{
+		{Name: "a", File: "a.tsar", Status: tsar.StatusPass, Duration: 2 * time.Second},
+		{Name: "b", File: "b.tsar", Status: tsar.StatusPass, Duration: 10 * time.Millisecond},
+	} {
+		r.result(res)
+		slow.done(res)
+	}
+	r.finish()
+
+	want := []string{
+		"--- PASS: a (2.00s) SLOW",
+		"    slow: script:2: exec go build (1.50s)",
+		"--- PASS: b (0.01s)",
+		"SLOW 1 script(s) took longer than 1s: a (2.00s)",
+		"PASS 2 passed, 0 failed, 0 skipped",
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), out.String())
+	}
+	for i, want := range want {
+		if !strings.HasPrefix(lines[i], want) {
+			t.Errorf("line %d = %q, want prefix %q", i, lines[i], want)
+		}
+	}
+}
+
+func TestPainterMarkLine(t *testing.T) {
+	p := painter(true)
+	if got, want := p.markLine("--- PASS: name"), "--- \x1b[32mPASS\x1b[0m: name"; got != want {
+		t.Errorf("markLine = %q, want %q", got, want)
+	}
+	if got := p.markLine("=== RUN   name"); got != "=== RUN   name" {
+		t.Errorf("markLine changed an unrelated line: %q", got)
+	}
+}
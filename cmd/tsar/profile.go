@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gfanton/tsar"
+)
+
+// profileTop is how many of the slowest commands the --profile report lists.
+const profileTop = 10
+
+// profileReport is the aggregated report written by --profile.
+type profileReport struct {
+	TotalMS   float64          `json:"total_ms"`
+	Commands  int              `json:"commands"`
+	Slowest   []commandProfile `json:"slowest"`
+	ByCommand []groupProfile   `json:"by_command"`
+	Scripts   []groupProfile   `json:"scripts"`
+}
+
+// commandProfile is one command run.
+type commandProfile struct {
+	Script string   `json:"script"`
+	File   string   `json:"file"`
+	Line   int      `json:"line"`
+	Args   []string `json:"args"`
+	Status string   `json:"status"`
+	MS     float64  `json:"duration_ms"`
+}
+
+// groupProfile aggregates the commands of one type, or of one script.
+type groupProfile struct {
+	Name    string  `json:"name"`
+	Count   int     `json:"count"`
+	TotalMS float64 `json:"total_ms"`
+	MaxMS   float64 `json:"max_ms"`
+}
+
+// profileRecorder records the wall time of every command for --profile.
+type profileRecorder struct {
+	commands []commandProfile
+	types    []string // commandType of each command
+}
+
+// record is suitable for tsar.Params.Events.
+func (r *profileRecorder) record(e tsar.Event) {
+	if e.Kind != tsar.EventCommandEnd {
+		return
+	}
+	r.commands = append(r.commands, commandProfile{
+		Script: e.Script,
+		File:   e.File,
+		Line:   e.Line,
+		Args:   e.Args,
+		Status: string(e.Status),
+		MS:     milliseconds(e.Duration),
+	})
+	r.types = append(r.types, commandType(e.Args))
+}
+
+// commandType groups commands for the report: by name, and exec by the
+// program it runs, as in "exec go".
+func commandType(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	if args[0] != "exec" {
+		return args[0]
+	}
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "-timeout" || args[i] == "-umask" || args[i] == "-user":
+			i++
+		case !strings.HasPrefix(args[i], "-"):
+			return "exec " + filepath.Base(args[i])
+		}
+	}
+	return "exec"
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// report aggregates the recorded commands.
+func (r *profileRecorder) report() profileReport {
+	rep := profileReport{
+		Commands:  len(r.commands),
+		Slowest:   []commandProfile{},
+		ByCommand: []groupProfile{},
+		Scripts:   []groupProfile{},
+	}
+	byType := make(map[string]*groupProfile)
+	byScript := make(map[string]*groupProfile)
+	add := func(groups map[string]*groupProfile, name string, ms float64) {
+		g, ok := groups[name]
+		if !ok {
+			g = &groupProfile{Name: name}
+			groups[name] = g
+		}
+		g.Count++
+		g.TotalMS += ms
+		g.MaxMS = max(g.MaxMS, ms)
+	}
+	for i, c := range r.commands {
+		rep.TotalMS += c.MS
+		add(byType, r.types[i], c.MS)
+		add(byScript, c.File, c.MS)
+	}
+	for _, g := range byType {
+		rep.ByCommand = append(rep.ByCommand, *g)
+	}
+	for file, g := range byScript {
+		g.Name = r.scriptName(file)
+		rep.Scripts = append(rep.Scripts, *g)
+	}
+	byTotal := func(a, b groupProfile) int {
+		return cmp.Or(cmp.Compare(b.TotalMS, a.TotalMS), strings.Compare(a.Name, b.Name))
+	}
+	slices.SortFunc(rep.ByCommand, byTotal)
+	slices.SortFunc(rep.Scripts, byTotal)
+
+	rep.Slowest = append(rep.Slowest, r.commands...)
+	slices.SortStableFunc(rep.Slowest, func(a, b commandProfile) int {
+		return cmp.Compare(b.MS, a.MS)
+	})
+	rep.Slowest = rep.Slowest[:min(len(rep.Slowest), profileTop)]
+	return rep
+}
+
+// scriptName returns the name of the script in file, qualified by its
+// directory when scripts with that name live in several directories.
+func (r *profileRecorder) scriptName(file string) string {
+	var name string
+	for _, c := range r.commands {
+		if c.File == file {
+			name = c.Script
+			break
+		}
+	}
+	for _, c := range r.commands {
+		if c.Script == name && c.File != file {
+			return filepath.Join(filepath.Base(filepath.Dir(file)), name)
+		}
+	}
+	return name
+}
+
+// write writes the report to path, as CSV if it ends in .csv and as
+// indented JSON otherwise.
+func (r *profileRecorder) write(path string) error {
+	rep := r.report()
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		data = rep.csv()
+	} else {
+		var err error
+		if data, err = json.MarshalIndent(rep, "", "  "); err != nil {
+			return fmt.Errorf("encode profile: %w", err)
+		}
+		data = append(data, '\n')
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write profile: %w", err)
+	}
+	return nil
+}
+
+// csv renders the report as one table: the report column says whether a
+// row is one of the slowest commands, a command type or a script.
+func (rep profileReport) csv() []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	w.Write([]string{"report", "name", "line", "command", "count", "total_ms", "max_ms"})
+	for _, c := range rep.Slowest {
+		w.Write([]string{"slowest", c.Script, strconv.Itoa(c.Line), strings.Join(c.Args, " "), "1", ms(c.MS), ms(c.MS)})
+	}
+	for _, g := range rep.ByCommand {
+		w.Write([]string{"command", g.Name, "", "", strconv.Itoa(g.Count), ms(g.TotalMS), ms(g.MaxMS)})
+	}
+	for _, g := range rep.Scripts {
+		w.Write([]string{"script", g.Name, "", "", strconv.Itoa(g.Count), ms(g.TotalMS), ms(g.MaxMS)})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gfanton/tsar"
+)
+
+func TestProfileReport(t *testing.T) {
+	var r profileRecorder
+	for _, e := range []tsar.Event{
+		{Kind: tsar.EventCommandStart, Script: "a", File: "x/a.tsar", Line: 1, Args: []string{"exec", "go", "build"}},
+		{Kind: tsar.EventCommandEnd, Script: "a", File: "x/a.tsar", Line: 1, Args: []string{"exec", "go", "build"}, Duration: 3 * time.Second},
+		{Kind: tsar.EventCommandEnd, Script: "a", File: "x/a.tsar", Line: 2, Args: []string{"exec", "-timeout", "1s", "/bin/sleep", "1"}, Duration: time.Second},
+		{Kind: tsar.EventCommandEnd, Script: "b", File: "x/b.tsar", Line: 1, Args: []string{"exec", "go", "test"}, Duration: 2 * time.Second},
+		{Kind: tsar.EventCommandEnd, Script: "b", File: "x/b.tsar", Line: 2, Args: []string{"stdout", "ok"}, Duration: time.Millisecond},
+		{Kind: tsar.EventCommandEnd, Script: "a", File: "y/a.tsar", Line: 1, Args: []string{"cd", "dir"}, Duration: 2 * time.Millisecond},
+	} {
+		r.record(e)
+	}
+
+	rep := r.report()
+	if rep.Commands != 5 || rep.TotalMS != 6003 {
+		t.Errorf("commands, total = %d, %v; want 5, 6003", rep.Commands, rep.TotalMS)
+	}
+	var slowest []int
+	for _, c := range rep.Slowest {
+		slowest = append(slowest, int(c.MS))
+	}
+	if want := []int{3000, 2000, 1000, 2, 1}; !slices.Equal(slowest, want) {
+		t.Errorf("slowest = %v, want %v", slowest, want)
+	}
+	var types, scripts []string
+	for _, g := range rep.ByCommand {
+		types = append(types, g.Name)
+	}
+	for _, g := range rep.Scripts {
+		scripts = append(scripts, g.Name)
+	}
+	if want := []string{"exec go", "exec sleep", "cd", "stdout"}; !slices.Equal(types, want) {
+		t.Errorf("by command = %v, want %v", types, want)
+	}
+	if want := []string{"x/a", "b", "y/a"}; !slices.Equal(scripts, want) {
+		t.Errorf("scripts = %v, want %v", scripts, want)
+	}
+	if g := rep.ByCommand[0]; g.Count != 2 || g.MaxMS != 3000 {
+		t.Errorf("exec go = %+v, want 2 commands, max 3000ms", g)
+	}
+
+	csv := string(rep.csv())
+	for _, want := range []string{
+		"report,name,line,command,count,total_ms,max_ms\n",
+		"slowest,a,1,exec go build,1,3000.000,3000.000\n",
+		"command,exec go,,,2,5000.000,3000.000\n",
+		"script,x/a,,,2,4000.000,3000.000\n",
+	} {
+		if !strings.Contains(csv, want) {
+			t.Errorf("csv missing %q:\n%s", want, csv)
+		}
+	}
+}
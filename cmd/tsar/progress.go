@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// progress keeps a live status line at the bottom of a terminal while
+// scripts run non-verbosely. Other output must go through write so the line
+// is cleared first and redrawn afterwards.
+type progress struct {
+	w     io.Writer
+	total int
+	start time.Time
+
+	mu      sync.Mutex
+	done    int
+	failed  int
+	current string
+	stop    chan struct{}
+}
+
+func newProgress(w io.Writer, total int) *progress {
+	return &progress{w: w, total: total, start: time.Now()}
+}
+
+// run redraws the line periodically until finish is called.
+func (p *progress) run(interval time.Duration) {
+	p.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.draw()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// scriptStarted is suitable for tsar.Params.OnStart.
+func (p *progress) scriptStarted(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = name
+	p.draw()
+}
+
+// scriptDone records a finished script.
+func (p *progress) scriptDone(failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if failed {
+		p.failed++
+	}
+	p.current = ""
+	p.draw()
+}
+
+// write runs f with the status line cleared; the line is redrawn after.
+func (p *progress) write(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	f()
+	p.draw()
+}
+
+// finish stops redrawing and removes the status line.
+func (p *progress) finish() {
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+}
+
+func (p *progress) clear() {
+	fmt.Fprint(p.w, "\r\x1b[K")
+}
+
+func (p *progress) draw() {
+	p.clear()
+	fmt.Fprintf(p.w, "[%d/%d] %s", p.done, p.total, time.Since(p.start).Truncate(100*time.Millisecond))
+	if p.failed > 0 {
+		fmt.Fprintf(p.w, ", %d failed", p.failed)
+	}
+	if p.current != "" {
+		fmt.Fprintf(p.w, " running %s", p.current)
+	}
+}
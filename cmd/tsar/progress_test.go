@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	var out strings.Builder
+	p := newProgress(&out, 3)
+
+	p.scriptStarted("first")
+	if got := lastLine(out.String()); !strings.HasPrefix(got, "[0/3] ") || !strings.HasSuffix(got, " running first") {
+		t.Errorf("line after start = %q", got)
+	}
+
+	p.scriptDone(true)
+	p.scriptStarted("second")
+	if got := lastLine(out.String()); !strings.Contains(got, "[1/3]") || !strings.Contains(got, "1 failed running second") {
+		t.Errorf("line after failure = %q", got)
+	}
+
+	out.Reset()
+	p.write(func() { out.WriteString("message\n") })
+	if got := out.String(); !strings.HasPrefix(got, "\r\x1b[Kmessage\n") {
+		t.Errorf("write output = %q, want the status line cleared before the message", got)
+	}
+
+	out.Reset()
+	p.finish()
+	if got := out.String(); got != "\r\x1b[K" {
+		t.Errorf("finish output = %q, want the status line cleared", got)
+	}
+}
+
+// lastLine returns the text drawn after the last carriage-return clear.
+func lastLine(s string) string {
+	i := strings.LastIndex(s, "\r\x1b[K")
+	return s[i+len("\r\x1b[K"):]
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/peterbourgon/ff/v4"
+	"golang.org/x/tools/txtar"
+)
+
+// recordOptions configures a "tsar record" session.
+type recordOptions struct {
+	seed  string // directory copied into $WORK and embedded in the script
+	shell string // runs each command line
+	keep  bool   // keep the work directory
+}
+
+func newRecordCommand() *ff.Command {
+	var (
+		opts   recordOptions
+		output string
+	)
+	fs := ff.NewFlagSet("record")
+	fs.StringVar(&output, 'o', "output", "", "write the draft script to this file (default: stdout)")
+	fs.StringVar(&opts.seed, 0, "dir", "", "copy this directory into $WORK and embed its files in the script")
+	fs.StringVar(&opts.shell, 0, "shell", "/bin/sh", "shell running each command")
+	fs.BoolVar(&opts.keep, 0, "keep", "keep the work directory after the session")
+	return &ff.Command{
+		Name:      "record",
+		Usage:     "tsar record [FLAGS]",
+		ShortHelp: "record a shell session in a fresh $WORK as a draft .tsar script",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 {
+				return fmt.Errorf("record takes no arguments")
+			}
+			script, err := recordSession(ctx, os.Stdin, os.Stderr, opts)
+			if err != nil {
+				return err
+			}
+			if output == "" {
+				_, err = os.Stdout.Write(script)
+				return err
+			}
+			if err := os.WriteFile(output, script, 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "wrote %s\n", output)
+			return nil
+		},
+	}
+}
+
+// recordSession reads command lines from in until EOF or "exit", running
+// each in a fresh work directory and echoing prompts and output to term,
+// and returns a draft script reproducing the session: an exec line per
+// command, with assertions on its output and exit status.
+func recordSession(ctx context.Context, in io.Reader, term io.Writer, opts recordOptions) ([]byte, error) {
+	work, err := os.MkdirTemp("", "tsar-record-")
+	if err != nil {
+		return nil, err
+	}
+	if opts.keep {
+		fmt.Fprintf(term, "work directory: %s\n", work)
+	} else {
+		defer os.RemoveAll(work)
+	}
+	// Outputs mention the resolved path, as in a macOS temp dir.
+	if resolved, err := filepath.EvalSymlinks(work); err == nil {
+		work = resolved
+	}
+	r := &sessionRecorder{work: work, shell: opts.shell}
+	if opts.seed != "" {
+		if r.seed, err = seedWork(opts.seed, work); err != nil {
+			return nil, err
+		}
+	}
+
+	sc := bufio.NewScanner(in)
+	for {
+		fmt.Fprintf(term, "tsar:%s$ ", path.Join("$WORK", r.cwd))
+		if !sc.Scan() {
+			fmt.Fprintln(term)
+			break
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "exit" {
+			break
+		}
+		if err := r.run(ctx, line, term); err != nil {
+			fmt.Fprintf(term, "tsar record: %v\n", err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return r.script(), nil
+}
+
+// sessionRecorder turns the commands of a session into script lines.
+type sessionRecorder struct {
+	work  string
+	cwd   string // slash-separated, relative to work
+	shell string
+	n     int // commands run
+
+	lines []string
+	seed  []txtar.File // files copied into the work directory
+	want  []txtar.File // expected outputs too long for a regexp
+}
+
+// run runs one command line and records it.
+func (r *sessionRecorder) run(ctx context.Context, line string, term io.Writer) error {
+	switch {
+	case line == "":
+		return nil
+	case strings.HasPrefix(line, "#"):
+		r.lines = append(r.lines, line)
+		return nil
+	}
+	if fields := strings.Fields(line); fields[0] == "cd" && len(fields) <= 2 {
+		dir := "."
+		if len(fields) == 2 {
+			dir = fields[1]
+		}
+		next := path.Clean(path.Join(r.cwd, filepath.ToSlash(dir)))
+		if path.IsAbs(dir) || next == ".." || strings.HasPrefix(next, "../") {
+			return fmt.Errorf("cd: %s is outside $WORK", dir)
+		}
+		if info, err := os.Stat(filepath.Join(r.work, filepath.FromSlash(next))); err != nil || !info.IsDir() {
+			return fmt.Errorf("cd: %s: not a directory", dir)
+		}
+		if next == "." {
+			next = ""
+		}
+		r.cwd = next
+		r.lines = append(r.lines, "cd "+quoteWord(path.Join("$WORK", next)))
+		return nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, r.shell, "-c", line)
+	cmd.Dir = filepath.Join(r.work, filepath.FromSlash(r.cwd))
+	cmd.Env = append(os.Environ(), "WORK="+r.work, "PWD="+cmd.Dir)
+	cmd.Stdout = io.MultiWriter(&stdout, term)
+	cmd.Stderr = io.MultiWriter(&stderr, term)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return err
+	}
+	r.n++
+
+	command := "exec " + commandWords(line)
+	if exitErr != nil {
+		command = "! " + command
+	}
+	r.lines = append(r.lines, "", command)
+	if exitErr != nil && exitErr.ExitCode() != 1 {
+		r.lines = append(r.lines, "status "+strconv.Itoa(exitErr.ExitCode()))
+	}
+	r.assert("stdout", stdout.String())
+	r.assert("stderr", stderr.String())
+	return nil
+}
+
+// maxRegexpOutput bounds the output asserted with a regexp rather than a
+// file compared with cmp.
+const maxRegexpOutput = 120
+
+// assert records an assertion on a command's output: a regexp matching
+// short output, or else a cmp with an expected file. The work directory is
+// written as $WORK.
+func (r *sessionRecorder) assert(stream, out string) {
+	if out == "" {
+		return
+	}
+	if len(out) <= maxRegexpOutput && strings.Count(out, "\n") <= 3 && !strings.Contains(out, "$") {
+		re := regexp.QuoteMeta(out)
+		re = strings.ReplaceAll(re, regexp.QuoteMeta(r.work), "$WORK")
+		re = strings.ReplaceAll(re, "\n", `\n`)
+		if !strings.HasSuffix(out, "\n") {
+			re += "$"
+		}
+		r.lines = append(r.lines, stream+" "+quotePattern("^"+re))
+		return
+	}
+	if !strings.HasSuffix(out, "\n") {
+		// An archive file always ends in a newline: check the start only.
+		first, _, _ := strings.Cut(out, "\n")
+		if strings.Contains(first, "$") {
+			r.lines = append(r.lines, "# "+stream+" not asserted: it contains $ and no final newline")
+			return
+		}
+		r.lines = append(r.lines, stream+" "+quotePattern("^"+regexp.QuoteMeta(first)))
+		return
+	}
+	name := fmt.Sprintf("want/%d.%s", r.n, stream)
+	cmp := "cmp"
+	if strings.Contains(out, r.work) && !strings.Contains(out, "$") {
+		out, cmp = strings.ReplaceAll(out, r.work, "$WORK"), "cmpenv"
+	}
+	r.want = append(r.want, txtar.File{Name: name, Data: []byte(out)})
+	r.lines = append(r.lines, cmp+" "+stream+" "+name)
+}
+
+// script returns the draft script: the recorded lines, then the expected
+// outputs and the seed files as its archive.
+func (r *sessionRecorder) script() []byte {
+	comment := "# Recorded by tsar record; review the assertions before committing.\n"
+	for _, line := range r.lines {
+		comment += line + "\n"
+	}
+	ar := &txtar.Archive{Comment: []byte(comment)}
+	ar.Files = append(ar.Files, r.want...)
+	ar.Files = append(ar.Files, r.seed...)
+	return txtar.Format(ar)
+}
+
+// shellWord matches command words that need neither a shell nor quoting.
+var shellWord = regexp.MustCompile(`^[A-Za-z0-9_./,:@%+=-]+$`)
+
+// commandWords returns the words of an exec line running a command line:
+// its fields if it is a plain command, or else sh -c and the line.
+func commandWords(line string) string {
+	fields := strings.Fields(line)
+	plain := !strings.Contains(fields[0], "=")
+	for _, f := range fields {
+		plain = plain && shellWord.MatchString(f)
+	}
+	if !plain {
+		return "sh -c " + quoteWord(line)
+	}
+	return strings.Join(fields, " ")
+}
+
+// quoteWord quotes s as a single script word.
+func quoteWord(s string) string {
+	switch {
+	case s != "" && !strings.ContainsAny(s, " \t'\"#"):
+		return s
+	case !strings.Contains(s, "'"):
+		return "'" + s + "'"
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// quotePattern quotes a regexp, always, so it reads as one.
+func quotePattern(re string) string {
+	if strings.Contains(re, "'") {
+		return quoteWord(re)
+	}
+	return "'" + re + "'"
+}
+
+// seedWork copies the regular files of dir into work and returns them as
+// archive files, base64-encoded if binary and with their mode if executable.
+func seedWork(dir, work string) ([]txtar.File, error) {
+	var files []txtar.File
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(work, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if info.Mode()&0111 != 0 {
+			name += fmt.Sprintf(" %04o", info.Mode().Perm())
+		}
+		if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+			name += " [base64]"
+			enc := base64.StdEncoding.EncodeToString(data)
+			var b bytes.Buffer
+			for len(enc) > 76 {
+				b.WriteString(enc[:76] + "\n")
+				enc = enc[76:]
+			}
+			if enc != "" {
+				b.WriteString(enc + "\n")
+			}
+			data = b.Bytes()
+		}
+		files = append(files, txtar.File{Name: name, Data: data})
+		return nil
+	})
+	return files, err
+}
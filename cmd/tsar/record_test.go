@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gfanton/tsar"
+)
+
+func TestRecordSession(t *testing.T) {
+	seed := t.TempDir()
+	if err := os.WriteFile(filepath.Join(seed, "greet.sh"), []byte("#!/bin/sh\necho \"hello, $1\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	session := strings.Join([]string{
+		"# a comment is kept",
+		"./greet.sh world",
+		"mkdir sub",
+		"cd sub",
+		"pwd",
+		"echo 'it''s' | tr a-z A-Z",
+		"printf 'no newline'",
+		"seq 1 40",
+		"echo oops >&2; exit 3",
+		"cd /",
+		"exit",
+		"echo never run",
+	}, "\n")
+	var term strings.Builder
+	script, err := recordSession(context.Background(), strings.NewReader(session), &term, recordOptions{seed: seed, shell: "/bin/sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# a comment is kept\n",
+		"exec ./greet.sh world\nstdout '^hello, world\\n'\n",
+		"cd $WORK/sub\n",
+		"stdout '^$WORK/sub\\n'\n",
+		"exec sh -c \"echo 'it''s' | tr a-z A-Z\"\nstdout '^ITS\\n'\n",
+		"stdout '^no newline$'\n",
+		"cmp stdout want/6.stdout\n",
+		"! exec sh -c 'echo oops >&2; exit 3'\nstatus 3\nstderr '^oops\\n'\n",
+		"-- want/6.stdout --\n1\n2\n",
+		"-- greet.sh 0755 --\n#!/bin/sh\necho \"hello, $1\"\n",
+	} {
+		if !strings.Contains(string(script), want) {
+			t.Errorf("script does not contain %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(string(script), "never run") {
+		t.Errorf("script has commands after exit:\n%s", script)
+	}
+	if !strings.Contains(term.String(), "cd: / is outside $WORK") {
+		t.Errorf("terminal output = %q, want cd error", term.String())
+	}
+
+	// The draft passes when run.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "draft.tsar"), script, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tsar.RunStandalone(t, tsar.Params{Dir: dir})
+}
+
+func TestRecordSessionEOF(t *testing.T) {
+	script, err := recordSession(context.Background(), strings.NewReader("true"), io.Discard, recordOptions{shell: "/bin/sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(script), "\nexec true\n") {
+		t.Errorf("script:\n%s", script)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gfanton/tsar"
+)
+
+// slowCommand is a command that ran longer than --slow-threshold.
+type slowCommand struct {
+	Line     int
+	Command  string
+	Duration time.Duration
+}
+
+// slowRecorder collects the commands of running scripts that exceed a
+// threshold, for --slow-threshold.
+type slowRecorder struct {
+	threshold time.Duration
+	commands  map[string][]slowCommand // by script file
+}
+
+func newSlowRecorder(threshold time.Duration) *slowRecorder {
+	return &slowRecorder{threshold: threshold, commands: make(map[string][]slowCommand)}
+}
+
+// event is suitable for tsar.Params.Events.
+func (r *slowRecorder) event(e tsar.Event) {
+	if e.Kind != tsar.EventCommandEnd || e.Duration <= r.threshold {
+		return
+	}
+	cmd := strings.Join(e.Args, " ")
+	if e.Neg {
+		cmd = "! " + cmd
+	}
+	r.commands[e.File] = append(r.commands[e.File], slowCommand{Line: e.Line, Command: cmd, Duration: e.Duration})
+}
+
+// script reports whether a finished script was slow, and its slow commands.
+// A nil recorder reports nothing.
+func (r *slowRecorder) script(res tsar.ScriptResult) (bool, []slowCommand) {
+	if r == nil {
+		return false, nil
+	}
+	return res.Duration > r.threshold, r.commands[res.File]
+}
+
+// done forgets the slow commands of a finished script.
+func (r *slowRecorder) done(res tsar.ScriptResult) {
+	if r != nil {
+		delete(r.commands, res.File)
+	}
+}
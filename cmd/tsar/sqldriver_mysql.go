@@ -0,0 +1,6 @@
+//go:build mysql
+
+package main
+
+// The sql builtin finds its drivers in database/sql's registry.
+import _ "github.com/go-sql-driver/mysql"
@@ -0,0 +1,6 @@
+//go:build postgres
+
+package main
+
+// The sql builtin finds its drivers in database/sql's registry.
+import _ "github.com/lib/pq"
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package main
+
+// The sql builtin finds its drivers in database/sql's registry.
+import _ "modernc.org/sqlite"
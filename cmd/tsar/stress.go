@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gfanton/tsar"
+	"github.com/peterbourgon/ff/v4"
+)
+
+// stressOptions configures a "tsar stress" run.
+type stressOptions struct {
+	parallel int
+	duration time.Duration // stop after this long; 0 means at the first failure only
+	timeout  time.Duration // bounds each run
+	seed     uint64        // TSAR_SEED of every run if nonzero, else random
+	root     string        // directory of the work directories; "" means the temp directory
+	short    bool
+	tick     time.Duration // interval of the progress lines
+}
+
+func newStressCommand() *ff.Command {
+	opts := stressOptions{tick: 5 * time.Second}
+	fs := ff.NewFlagSet("stress")
+	fs.IntVar(&opts.parallel, 'p', "parallel", runtime.NumCPU(), "number of runs at a time")
+	fs.DurationVar(&opts.duration, 0, "duration", 0, "stop after this long without failure (0 means no limit)")
+	fs.DurationVar(&opts.timeout, 0, "timeout", 10*time.Minute, "fail a run that takes longer than this")
+	fs.Uint64Var(&opts.seed, 0, "seed", 0, "set TSAR_SEED to this in every run, to reproduce a failure (0 means random)")
+	fs.StringVar(&opts.root, 'w', "workdir-root", "", "root directory for work directories")
+	fs.BoolVar(&opts.short, 's', "short", "run in short mode")
+	return &ff.Command{
+		Name:      "stress",
+		Usage:     "tsar stress [FLAGS] SCRIPT",
+		ShortHelp: "run a script over and over, in parallel, until it fails",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("one script required")
+			}
+			if opts.parallel < 1 {
+				return fmt.Errorf("--parallel must be at least 1")
+			}
+			defer initTesting(opts.short, false)()
+			_, err := stress(ctx, os.Stdout, args[0], opts)
+			return err
+		},
+	}
+}
+
+// stressRun is the outcome of one run of a stressed script.
+type stressRun struct {
+	n      int64 // from 1
+	seed   uint64
+	result tsar.ScriptResult
+	output string // everything the run logged
+}
+
+// stress runs file with opts.parallel runs at a time until one fails, the
+// duration elapses or ctx is done, printing progress to w. It returns the
+// failed run, whose work directory is kept; those of the other runs are
+// removed. The project of file is prepared once, so its global setup and
+// teardown run once for the whole session.
+func stress(ctx context.Context, w io.Writer, file string, opts stressOptions) (_ *stressRun, err error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	base, cleanup, err := tsar.PrepareProject(tsar.Params{
+		Context:     ctx,
+		Dir:         filepath.Dir(file),
+		TestWork:    true,
+		WorkdirRoot: opts.root,
+		Timeout:     opts.timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { cleanup(err != nil) }()
+	limit := ctx
+	if opts.duration > 0 {
+		var stop context.CancelFunc
+		limit, stop = context.WithTimeout(ctx, opts.duration)
+		defer stop()
+	}
+
+	var (
+		runs, failures atomic.Int64
+		mu             sync.Mutex
+		failed         *stressRun
+		runErr         error
+	)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range opts.parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for limit.Err() == nil {
+				n := runs.Add(1)
+				seed := opts.seed
+				if seed == 0 {
+					seed = rand.Uint64()
+				}
+				run, err := stressOnce(base, file, n, seed)
+				mu.Lock()
+				switch {
+				case ctx.Err() != nil:
+					// Killed by another run's failure, or by an interrupt.
+					runs.Add(-1)
+					if run != nil && run.result.Status == tsar.StatusFail {
+						os.RemoveAll(run.result.WorkDir)
+					}
+				case err != nil:
+					if runErr == nil {
+						runErr = err
+					}
+					cancel()
+				case run.result.Status == tsar.StatusFail:
+					failures.Add(1)
+					if failed == nil {
+						failed = run
+					}
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(opts.tick)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-ticker.C:
+			fmt.Fprintf(w, "%v: %d runs so far, %d failures\n", time.Since(start).Round(time.Second), runs.Load(), failures.Load())
+		}
+	}
+
+	elapsed := time.Since(start).Round(time.Millisecond)
+	switch {
+	case runErr != nil:
+		return nil, runErr
+	case failed != nil:
+		fmt.Fprintf(w, "\n%s\n", strings.TrimRight(failed.output, "\n"))
+		fmt.Fprintf(w, "\nrun %d failed after %d runs in %v\n", failed.n, runs.Load(), elapsed)
+		fmt.Fprintf(w, "work directory: %s\n", failed.result.WorkDir)
+		fmt.Fprintf(w, "seed: %d (rerun with tsar stress --seed %d %s)\n", failed.seed, failed.seed, file)
+		return failed, fmt.Errorf("%s failed after %d runs", failed.result.Name, runs.Load())
+	case parent.Err() != nil:
+		fmt.Fprintf(w, "%d runs, no failures in %v\n", runs.Load(), elapsed)
+		return nil, context.Cause(parent)
+	}
+	fmt.Fprintf(w, "%d runs, no failures in %v\n", runs.Load(), elapsed)
+	return nil, nil
+}
+
+// stressOnce runs file once as run n, with the prepared params p, the given
+// TSAR_SEED and TSAR_STRESS_RUN set to n. The work directory is kept if the
+// run fails.
+func stressOnce(p tsar.Params, file string, n int64, seed uint64) (*stressRun, error) {
+	run := &stressRun{n: n, seed: seed}
+	t := &stressT{}
+	p.Seed = seed
+	setup := p.Setup
+	p.Setup = func(env *tsar.Env) error {
+		if setup != nil {
+			if err := setup(env); err != nil {
+				return err
+			}
+		}
+		env.Setenv("TSAR_STRESS_RUN", strconv.FormatInt(n, 10))
+		return nil
+	}
+	p.OnResult = func(res tsar.ScriptResult) {
+		run.result = res
+		if res.Status != tsar.StatusFail {
+			os.RemoveAll(res.WorkDir)
+		}
+	}
+	tsar.RunFilesStandalone(t, p, file)
+	run.output = t.out.String()
+	switch {
+	case run.result.Status == "":
+		// The script did not run: report why.
+		return nil, errors.New(strings.TrimSpace(run.output))
+	case run.result.Status == tsar.StatusSkip:
+		return run, fmt.Errorf("%s was skipped, nothing to stress; tsar -v %s shows why", run.result.Name, file)
+	}
+	return run, nil
+}
+
+// stressT records the output of a run, printed if it fails.
+type stressT struct {
+	out    strings.Builder
+	failed bool
+}
+
+func (t *stressT) Skip(args ...any) { fmt.Fprintln(&t.out, args...) }
+
+func (t *stressT) Fatal(args ...any) {
+	t.failed = true
+	fmt.Fprintln(&t.out, "FAIL: "+fmt.Sprint(args...))
+}
+
+func (t *stressT) Fatalf(format string, args ...any) {
+	t.failed = true
+	fmt.Fprintf(&t.out, "FAIL: "+format+"\n", args...)
+}
+
+func (t *stressT) Log(args ...any) { fmt.Fprintln(&t.out, args...) }
+
+func (t *stressT) Logf(format string, args ...any) { fmt.Fprintf(&t.out, format+"\n", args...) }
+
+func (t *stressT) Failed() bool { return t.failed }
+
+func (t *stressT) Helper() {}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStress(t *testing.T) {
+	dir, root := t.TempDir(), t.TempDir()
+	flaky := filepath.Join(dir, "flaky.tsar")
+	if err := os.WriteFile(flaky, []byte("exec test $TSAR_STRESS_RUN -lt 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	opts := stressOptions{parallel: 1, root: root, tick: time.Hour}
+	run, err := stress(context.Background(), &out, flaky, opts)
+	if err == nil || run == nil {
+		t.Fatalf("stress succeeded:\n%s", out.String())
+	}
+	if run.n != 4 {
+		t.Errorf("run %d failed, want 4", run.n)
+	}
+	for _, want := range []string{"run 4 failed after 4 runs", "work directory: " + run.result.WorkDir, "--seed " + strconv.FormatUint(run.seed, 10)} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	// Only the failing run's work directory is kept.
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || filepath.Join(root, entries[0].Name()) != run.result.WorkDir {
+		t.Errorf("kept %v, want only %s", entries, run.result.WorkDir)
+	}
+
+	seeded := filepath.Join(dir, "seeded.tsar")
+	if err := os.WriteFile(seeded, []byte("exec echo $TSAR_SEED\nstdout '^42\\n'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	opts = stressOptions{parallel: 2, duration: 200 * time.Millisecond, seed: 42, root: root, tick: time.Hour}
+	if _, err := stress(context.Background(), &out, seeded, opts); err != nil {
+		t.Fatalf("stress: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "runs, no failures") {
+		t.Errorf("output:\n%s", out.String())
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("passing runs kept their work directories: %v", entries)
+	}
+}
+
+func TestStressProject(t *testing.T) {
+	dir, root := t.TempDir(), t.TempDir()
+	for name, content := range map[string]string{
+		// The global scripts log their runs, and bin/ wrappers are on PATH.
+		"setup.sh":     "echo setup >> log.txt\n",
+		"teardown.sh":  "echo teardown $TSAR_STATUS >> log.txt\n",
+		"bin/greet":    "#!/bin/sh\necho hello\n",
+		"project.tsar": "exec greet\nstdout hello\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out strings.Builder
+	opts := stressOptions{parallel: 4, duration: 200 * time.Millisecond, root: root, tick: time.Hour}
+	if _, err := stress(context.Background(), &out, filepath.Join(dir, "project.tsar"), opts); err != nil {
+		t.Fatalf("stress: %v\n%s", err, out.String())
+	}
+	log, err := os.ReadFile(filepath.Join(dir, "log.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "setup\nteardown pass\n"; string(log) != want {
+		t.Errorf("log.txt = %q, want %q: the global scripts run once per session", log, want)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gfanton/tsar"
+)
+
+// runSummary is the machine-readable report written by --summary.
+type runSummary struct {
+	Passed     int             `json:"passed"`
+	Failed     int             `json:"failed"`
+	Skipped    int             `json:"skipped"`
+	DurationMS int64           `json:"duration_ms"`
+	Scripts    []scriptSummary `json:"scripts"`
+}
+
+type scriptSummary struct {
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	Run         int    `json:"run,omitempty"`
+	Status      string `json:"status"`
+	DurationMS  int64  `json:"duration_ms"`
+	WorkDir     string `json:"workdir,omitempty"`
+	Failure     string `json:"failure,omitempty"`
+	FailureLine int    `json:"failure_line,omitempty"`
+
+	Sections  []sectionSummary `json:"sections,omitempty"`
+	Artifacts []string         `json:"artifacts,omitempty"`
+
+	// Slow and SlowCommands mark a script, and its commands, that ran
+	// longer than --slow-threshold.
+	Slow         bool                 `json:"slow,omitempty"`
+	SlowCommands []slowCommandSummary `json:"slow_commands,omitempty"`
+}
+
+type slowCommandSummary struct {
+	Line       int    `json:"line"`
+	Command    string `json:"command"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type sectionSummary struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// summaryRecorder accumulates script results for the --summary report.
+type summaryRecorder struct {
+	start        time.Time
+	keepWorkDirs bool          // work directories are only reported if preserved
+	slow         *slowRecorder // nil without --slow-threshold
+	summary      runSummary
+}
+
+func newSummaryRecorder(keepWorkDirs bool) *summaryRecorder {
+	return &summaryRecorder{
+		start:        time.Now(),
+		keepWorkDirs: keepWorkDirs,
+		summary:      runSummary{Scripts: []scriptSummary{}},
+	}
+}
+
+// record is suitable for tsar.Params.OnResult.
+func (r *summaryRecorder) record(res tsar.ScriptResult) {
+	switch res.Status {
+	case tsar.StatusPass:
+		r.summary.Passed++
+	case tsar.StatusFail:
+		r.summary.Failed++
+	case tsar.StatusSkip:
+		r.summary.Skipped++
+	}
+	s := scriptSummary{
+		Name:        res.Name,
+		File:        res.File,
+		Run:         res.Run,
+		Status:      string(res.Status),
+		DurationMS:  res.Duration.Milliseconds(),
+		Failure:     res.Failure,
+		FailureLine: res.FailureLine,
+	}
+	if r.keepWorkDirs {
+		s.WorkDir = res.WorkDir
+	}
+	var slowCommands []slowCommand
+	s.Slow, slowCommands = r.slow.script(res)
+	for _, cmd := range slowCommands {
+		s.SlowCommands = append(s.SlowCommands, slowCommandSummary{
+			Line:       cmd.Line,
+			Command:    cmd.Command,
+			DurationMS: cmd.Duration.Milliseconds(),
+		})
+	}
+	for _, sec := range res.Sections {
+		s.Sections = append(s.Sections, sectionSummary{
+			Name:       sec.Name,
+			Status:     string(sec.Status),
+			DurationMS: sec.Duration.Milliseconds(),
+		})
+	}
+	// Artifacts saved in the work directory went with it.
+	for _, path := range res.Artifacts {
+		if _, err := os.Stat(path); err == nil {
+			s.Artifacts = append(s.Artifacts, path)
+		}
+	}
+	r.summary.Scripts = append(r.summary.Scripts, s)
+}
+
+// write writes the summary as indented JSON to path.
+func (r *summaryRecorder) write(path string) error {
+	r.summary.DurationMS = time.Since(r.start).Milliseconds()
+	data, err := json.MarshalIndent(r.summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode summary: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("write summary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gfanton/tsar"
+)
+
+// scriptGroup is a set of scripts sharing a directory, and thus a project.
+type scriptGroup struct {
+	dir   string
+	files []string
+}
+
+// collectTargets expands command-line targets into absolute script paths.
+// A target may be a script file with one of the extensions exts, a directory
+// (all such scripts in it), or a shell-style glob matching either. Files are
+// returned in argument order without duplicates.
+func collectTargets(args []string, exts []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(file string) error {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return fmt.Errorf("cannot get absolute path for %s: %w", file, err)
+		}
+		if !seen[abs] {
+			seen[abs] = true
+			files = append(files, abs)
+		}
+		return nil
+	}
+
+	for _, arg := range args {
+		matches := []string{arg}
+		if _, err := os.Stat(arg); err != nil && strings.ContainsAny(arg, "*?[") {
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %w", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", arg)
+			}
+		}
+
+		for _, target := range matches {
+			info, err := os.Stat(target)
+			if err != nil {
+				return nil, fmt.Errorf("cannot access %s: %w", target, err)
+			}
+			if !info.IsDir() {
+				if !slices.Contains(exts, filepath.Ext(target)) {
+					return nil, fmt.Errorf("file must have %s extension: %s", strings.Join(exts, " or "), target)
+				}
+				if err := add(target); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			var scripts []string
+			for _, ext := range exts {
+				matches, err := filepath.Glob(filepath.Join(target, "*"+ext))
+				if err != nil {
+					return nil, err
+				}
+				scripts = append(scripts, matches...)
+			}
+			slices.Sort(scripts)
+			if len(scripts) == 0 {
+				return nil, fmt.Errorf("no test script files found in %s", target)
+			}
+			for _, script := range scripts {
+				if err := add(script); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// checkUniqueNames reports an error if two scripts share a test name,
+// even when they come from different directories, and either must have a
+// unique one; see tsar.Params.RequiresUniqueName.
+func checkUniqueNames(files []string, p tsar.Params) error {
+	seen := make(map[string]string)
+	for _, file := range files {
+		base := filepath.Base(file)
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+		if prev, ok := seen[name]; !ok {
+			seen[name] = file
+		} else if p.RequiresUniqueName(prev) || p.RequiresUniqueName(file) {
+			return fmt.Errorf("duplicate test name %q: %s and %s", name, prev, file)
+		}
+	}
+	return nil
+}
+
+// groupByDir groups files by directory, in order of first appearance.
+func groupByDir(files []string) []scriptGroup {
+	var groups []scriptGroup
+	index := make(map[string]int)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		i, ok := index[dir]
+		if !ok {
+			i = len(groups)
+			index[dir] = i
+			groups = append(groups, scriptGroup{dir: dir})
+		}
+		groups[i].files = append(groups[i].files, file)
+	}
+	return groups
+}
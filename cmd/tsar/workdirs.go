@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gfanton/tsar"
+	"github.com/peterbourgon/ff/v4"
+)
+
+func newWorkdirsCommand() *ff.Command {
+	var root string
+	fs := ff.NewFlagSet("workdirs")
+	fs.StringVar(&root, 'w', "workdir-root", "", "directory holding the work directories (default: the temp directories)")
+
+	var (
+		printDir  bool
+		olderThan time.Duration
+		dryRun    bool
+	)
+	openFS := ff.NewFlagSet("open").SetParent(fs)
+	openFS.BoolVar(&printDir, 'p', "print", "print the directory instead of starting a shell in it")
+	cleanFS := ff.NewFlagSet("clean").SetParent(fs)
+	cleanFS.DurationVar(&olderThan, 0, "older-than", 24*time.Hour, "only remove directories of scripts that finished longer ago than this")
+	cleanFS.BoolVar(&dryRun, 'n', "dry-run", "list the directories that would be removed")
+
+	return &ff.Command{
+		Name:      "workdirs",
+		Usage:     "tsar workdirs list|open|clean [FLAGS]",
+		ShortHelp: "list, open or remove the work directories kept by --test-work",
+		Flags:     fs,
+		Subcommands: []*ff.Command{
+			{
+				Name:      "list",
+				Usage:     "tsar workdirs list [FLAGS] [SCRIPT]",
+				ShortHelp: "list kept work directories, most recent first",
+				Flags:     ff.NewFlagSet("list").SetParent(fs),
+				Exec: func(ctx context.Context, args []string) error {
+					if len(args) > 1 {
+						return fmt.Errorf("at most one script allowed")
+					}
+					infos, err := tsar.ListWorkdirs(root)
+					if err != nil {
+						return err
+					}
+					if len(args) == 1 {
+						infos = filterWorkdirs(infos, args[0])
+					}
+					printWorkdirs(os.Stdout, infos, time.Now())
+					return nil
+				},
+			},
+			{
+				Name:      "open",
+				Usage:     "tsar workdirs open [FLAGS] SCRIPT|RUN|DIR",
+				ShortHelp: "start a shell in the latest work directory of a script or run",
+				Flags:     openFS,
+				Exec: func(ctx context.Context, args []string) error {
+					if len(args) != 1 {
+						return fmt.Errorf("one script, run or directory required")
+					}
+					infos, err := tsar.ListWorkdirs(root)
+					if err != nil {
+						return err
+					}
+					matches := filterWorkdirs(infos, args[0])
+					if len(matches) == 0 {
+						return fmt.Errorf("no kept work directory for %s", args[0])
+					}
+					dir := matches[0].Dir
+					if printDir {
+						fmt.Println(dir)
+						return nil
+					}
+					return openShell(ctx, dir)
+				},
+			},
+			{
+				Name:      "clean",
+				Usage:     "tsar workdirs clean [FLAGS]",
+				ShortHelp: "remove kept work directories older than --older-than",
+				Flags:     cleanFS,
+				Exec: func(ctx context.Context, args []string) error {
+					if len(args) > 0 {
+						return fmt.Errorf("clean takes no arguments")
+					}
+					infos, err := tsar.ListWorkdirs(root)
+					if err != nil {
+						return err
+					}
+					return cleanWorkdirs(os.Stdout, infos, time.Now().Add(-olderThan), dryRun)
+				},
+			},
+		},
+		Exec: func(ctx context.Context, args []string) error {
+			return fmt.Errorf("subcommand required: list, open or clean")
+		},
+	}
+}
+
+// filterWorkdirs returns the directories of a script, given by name or
+// file, of a run, or the directory itself.
+func filterWorkdirs(infos []tsar.WorkdirInfo, what string) []tsar.WorkdirInfo {
+	abs, _ := filepath.Abs(what)
+	var matches []tsar.WorkdirInfo
+	for _, info := range infos {
+		if info.Script == what || info.Run == what || info.File == abs || info.Dir == abs {
+			matches = append(matches, info)
+		}
+	}
+	return matches
+}
+
+// printWorkdirs writes a table of work directories.
+func printWorkdirs(w io.Writer, infos []tsar.WorkdirInfo, now time.Time) {
+	if len(infos) == 0 {
+		fmt.Fprintln(w, "no kept work directories")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FINISHED\tSTATUS\tRUN\tSCRIPT\tDIR")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%s ago\t%s\t%s\t%s\t%s\n", age(now.Sub(info.Finished)), info.Status, info.Run, info.Script, info.Dir)
+	}
+	tw.Flush()
+}
+
+// age formats a duration coarsely, as in "45s", "3m", "2h" or "5d".
+func age(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// cleanWorkdirs removes the directories of scripts that finished before
+// cutoff, or only lists them for a dry run.
+func cleanWorkdirs(w io.Writer, infos []tsar.WorkdirInfo, cutoff time.Time, dryRun bool) error {
+	removed := 0
+	for _, info := range infos {
+		if !info.Finished.Before(cutoff) {
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(w, "would remove %s (%s)\n", info.Dir, info.Script)
+			continue
+		}
+		if err := os.RemoveAll(info.Dir); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "removed %s (%s)\n", info.Dir, info.Script)
+		removed++
+	}
+	if !dryRun {
+		fmt.Fprintf(w, "removed %d of %d work directories\n", removed, len(infos))
+	}
+	return nil
+}
+
+// openShell runs an interactive shell in dir, with $WORK set to it.
+func openShell(ctx context.Context, dir string) error {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	fmt.Fprintf(os.Stderr, "opening %s in %s; exit the shell to return\n", filepath.Base(shell), dir)
+	cmd := exec.CommandContext(ctx, shell)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "WORK="+dir, "PWD="+dir)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// The shell's exit status is that of the last command run in it.
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); err != nil && !errors.As(err, &exitErr) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gfanton/tsar"
+)
+
+func TestWorkdirs(t *testing.T) {
+	dir, root := t.TempDir(), t.TempDir()
+	for name, script := range map[string]string{
+		"pass": "exec true\n",
+		"fail": "exec false\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name+".tsar"), []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tsar.RunStandalone(&failureT{}, tsar.Params{Dir: dir, WorkdirRoot: root, ContinueOnError: true})
+	// Directories without an index are not work directories of tsar.
+	if err := os.Mkdir(filepath.Join(root, "other"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := tsar.ListWorkdirs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("got %d work directories, want 2: %+v", len(infos), infos)
+	}
+	status := map[string]tsar.ScriptStatus{}
+	for _, info := range infos {
+		status[info.Script] = info.Status
+		if !strings.HasPrefix(filepath.Base(info.Dir), "tsar-"+info.Script+"-") {
+			t.Errorf("work directory %s is not named after %s", info.Dir, info.Script)
+		}
+		if info.Run != infos[0].Run {
+			t.Errorf("runs %q and %q differ", info.Run, infos[0].Run)
+		}
+	}
+	if status["pass"] != tsar.StatusPass || status["fail"] != tsar.StatusFail {
+		t.Errorf("statuses = %v", status)
+	}
+
+	var out strings.Builder
+	printWorkdirs(&out, filterWorkdirs(infos, "fail"), time.Now())
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "0s ago    fail") {
+		t.Errorf("list fail:\n%s", out.String())
+	}
+	if got := filterWorkdirs(infos, filepath.Join(dir, "pass.tsar")); len(got) != 1 || got[0].Script != "pass" {
+		t.Errorf("filter by file = %+v", got)
+	}
+
+	out.Reset()
+	if err := cleanWorkdirs(&out, infos, time.Now().Add(-time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "removed 0 of 2") {
+		t.Errorf("clean recent:\n%s", out.String())
+	}
+	out.Reset()
+	if err := cleanWorkdirs(&out, infos, time.Now().Add(time.Second), false); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := tsar.ListWorkdirs(root); len(infos) != 0 || !strings.Contains(out.String(), "removed 2 of 2") {
+		t.Errorf("clean all: %d left\n%s", len(infos), out.String())
+	}
+	if _, err := os.Stat(filepath.Join(root, "other")); err != nil {
+		t.Errorf("clean removed an unrelated directory: %v", err)
+	}
+}
+
+// failureT is a tsar.TestingT that only records whether a script failed.
+type failureT struct{ failed bool }
+
+func (t *failureT) Skip(args ...any)                  {}
+func (t *failureT) Fatal(args ...any)                 { t.failed = true }
+func (t *failureT) Fatalf(format string, args ...any) { t.failed = true }
+func (t *failureT) Log(args ...any)                   {}
+func (t *failureT) Logf(format string, args ...any)   {}
+func (t *failureT) Failed() bool                      { return t.failed }
+func (t *failureT) Helper()                           {}
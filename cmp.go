@@ -0,0 +1,489 @@
+package tsar
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around each change.
+	diffContext = 3
+
+	// maxInlineDiff bounds the diff lines a failing cmp logs; the rest are
+	// dropped and the full actual content is saved as an artifact.
+	maxInlineDiff = 200
+
+	// maxHexRows bounds the differing rows a failing cmp of binary content
+	// logs.
+	maxHexRows = 32
+
+	// hexRowSize is the number of bytes per hex dump row.
+	hexRowSize = 8
+
+	// maxDiffEdits bounds the work spent finding a minimal diff; inputs that
+	// differ more are shown as entirely replaced.
+	maxDiffEdits = 1000
+)
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiCyan  = "\x1b[36m"
+)
+
+func (ts *TestScript) cmdCmp(neg bool, args []string) {
+	ts.compare(neg, args, false)
+}
+
+func (ts *TestScript) cmdCmpenv(neg bool, args []string) {
+	ts.compare(neg, args, true)
+}
+
+// compare implements cmp and cmpenv: the first file holds the actual
+// content and may be stdout or stderr, the second the expected content.
+// Flags normalize both first: -crlf turns \r\n line endings into \n, -b
+// collapses runs of spaces and tabs into one space, and -w drops trailing
+// whitespace from each line.
+func (ts *TestScript) compare(neg bool, args []string, env bool) {
+	name := args[0]
+	var norm cmpNorm
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-crlf":
+			norm.crlf = true
+		case "-b":
+			norm.blanks = true
+		case "-w":
+			norm.trailing = true
+		default:
+			ts.t.Fatalf("script:%d: %s: unknown flag %s", ts.lineno, name, args[0])
+			return
+		}
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: %s [-w] [-b] [-crlf] file1 file2", ts.lineno, name)
+		return
+	}
+	name1, name2 := args[0], args[1]
+	text1, err := ts.readCmpFile(name1)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+		return
+	}
+	text2, err := ts.readCmpFile(name2)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+		return
+	}
+	if env {
+		text2 = ts.expandEnvVars(text2)
+	}
+	text1, text2 = norm.apply(text1), norm.apply(text2)
+
+	if neg {
+		if text1 == text2 {
+			ts.t.Fatalf("script:%d: %s and %s do not differ", ts.lineno, name1, name2)
+		}
+		return
+	}
+	if text1 == text2 {
+		return
+	}
+
+	var summary, out string
+	var cut int
+	if isBinary(text1) || isBinary(text2) {
+		summary, out, cut = hexDiff(text1, text2, ts.params.Color, maxHexRows)
+	} else {
+		d := newLineDiff(name1, text1, name2, text2)
+		summary = d.summary()
+		out, cut = d.render(ts.params.Color, maxInlineDiff)
+	}
+	msg := fmt.Sprintf("script:%d: %s and %s differ (%s):\n%s", ts.lineno, name1, name2, summary, out)
+	if all := (cmpNorm{true, true, true}); all.apply(text1) == all.apply(text2) {
+		msg += "they differ only in whitespace or line endings, which cmp -w, -b and -crlf ignore\n"
+	}
+	if cut > 0 {
+		msg += fmt.Sprintf("[... %d more diff lines ...]\n", cut)
+		if path, err := ts.saveArtifact(name1, text1); err != nil {
+			msg += fmt.Sprintf("saving %s: %v\n", name1, err)
+		} else {
+			msg += fmt.Sprintf("full %s saved to %s\n", name1, path)
+		}
+	}
+	ts.t.Fatalf("%s", strings.TrimSuffix(msg, "\n"))
+}
+
+// cmpNorm is the normalization cmp flags apply to the texts compared.
+type cmpNorm struct {
+	crlf     bool // -crlf: \r\n line endings become \n
+	blanks   bool // -b: runs of spaces and tabs become one space
+	trailing bool // -w: trailing whitespace is dropped from each line
+}
+
+// blankRuns matches the runs of spaces and tabs cmp -b collapses.
+var blankRuns = regexp.MustCompile(`[ \t]+`)
+
+func (n cmpNorm) apply(text string) string {
+	if n.crlf {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+	}
+	if n.blanks {
+		text = blankRuns.ReplaceAllString(text, " ")
+	}
+	if n.trailing {
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRightFunc(line, unicode.IsSpace)
+		}
+		text = strings.Join(lines, "\n")
+	}
+	return text
+}
+
+// readCmpFile returns the content of a cmp operand: the last command's
+// stdout or stderr, or a file relative to the current directory, with its
+// line endings normalized by Params.NormalizeNewlines.
+func (ts *TestScript) readCmpFile(name string) (string, error) {
+	switch name {
+	case "stdout":
+		return ts.stdout, nil
+	case "stderr":
+		return ts.stderr, nil
+	}
+	data, err := os.ReadFile(ts.mkabs(name))
+	if err != nil {
+		return "", err
+	}
+	return ts.normalizeNewlines(string(data)), nil
+}
+
+// normalizeNewlines turns \r\n line endings into \n in text read for
+// matching, with Params.NormalizeNewlines.
+func (ts *TestScript) normalizeNewlines(text string) string {
+	if !ts.params.NormalizeNewlines {
+		return text
+	}
+	return strings.ReplaceAll(text, "\r\n", "\n")
+}
+
+// normalizeOutput applies normalizeNewlines to captured exec output.
+func (ts *TestScript) normalizeOutput(out execOutput) execOutput {
+	return execOutput{
+		stdout:   ts.normalizeNewlines(out.stdout),
+		stderr:   ts.normalizeNewlines(out.stderr),
+		combined: ts.normalizeNewlines(out.combined),
+	}
+}
+
+// saveArtifact writes content that is too large to log to a file named
+// after the current line, under Params.ArtifactDir or else
+// $WORK/.tsar/artifacts, and records it in the script's result.
+func (ts *TestScript) saveArtifact(name, content string) (string, error) {
+	dir := filepath.Join(ts.workdir, ".tsar", "artifacts")
+	if ts.params.ArtifactDir != "" {
+		dir = filepath.Join(ts.params.ArtifactDir, ts.name)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%03d-%s.actual", ts.lineno, filepath.Base(name)))
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		return "", err
+	}
+	ts.artifacts = append(ts.artifacts, path)
+	return path, nil
+}
+
+// isBinary reports whether content looks like binary data rather than text:
+// it holds a NUL byte or is not valid UTF-8.
+func isBinary(s string) bool {
+	return strings.IndexByte(s, 0) >= 0 || !utf8.ValidString(s)
+}
+
+// hexDiff compares binary contents hexRowSize bytes at a time and renders
+// each row that differs as its offset, then the expected and the actual
+// bytes in hex and as printable ASCII. At most limit rows are rendered;
+// hexDiff also returns how many were left out.
+func hexDiff(actual, expected string, color bool, limit int) (summary, out string, cut int) {
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return code + s + ansiReset
+	}
+	// column renders one side of a row, highlighting bytes that differ
+	// from the other side.
+	column := func(side, other string, off int, code string) string {
+		var hex, text strings.Builder
+		for i := off; i < off+hexRowSize; i++ {
+			if i > off {
+				hex.WriteByte(' ')
+			}
+			if i >= len(side) {
+				hex.WriteString("  ")
+				text.WriteByte(' ')
+				continue
+			}
+			c := side[i]
+			h, t := fmt.Sprintf("%02x", c), "."
+			if c >= 0x20 && c < 0x7f {
+				t = string(c)
+			}
+			if i >= len(other) || other[i] != c {
+				h, t = paint(code, h), paint(code, t)
+			}
+			hex.WriteString(h)
+			text.WriteString(t)
+		}
+		return hex.String() + " |" + text.String() + "|"
+	}
+
+	first, rows := -1, 0
+	lines := []string{fmt.Sprintf("%-8s  %-*s  %s", "offset", hexRowSize*3+hexRowSize+2, "expected", "actual")}
+	for off := 0; off < max(len(actual), len(expected)); off += hexRowSize {
+		a := actual[min(off, len(actual)):min(off+hexRowSize, len(actual))]
+		e := expected[min(off, len(expected)):min(off+hexRowSize, len(expected))]
+		if a == e {
+			continue
+		}
+		if first < 0 {
+			first = off
+			for first < len(actual) && first < len(expected) && actual[first] == expected[first] {
+				first++
+			}
+		}
+		rows++
+		if rows > limit {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%08x  %s  %s", off,
+			column(expected, actual, off, ansiGreen),
+			column(actual, expected, off, ansiRed)))
+	}
+	summary = fmt.Sprintf("binary, %d bytes, want %d; first difference at offset %#x", len(actual), len(expected), first)
+	return summary, strings.Join(lines, "\n") + "\n", max(rows-limit, 0)
+}
+
+// diffKind is the role of a line in a diff.
+type diffKind byte
+
+const (
+	diffSame   diffKind = ' '
+	diffRemove diffKind = '-'
+	diffAdd    diffKind = '+'
+)
+
+// diffOp is one line of a diff: a line of a (diffSame, diffRemove) or of b
+// (diffAdd), with its index in each input it belongs to.
+type diffOp struct {
+	kind diffKind
+	a, b int
+}
+
+// lineDiff is a line-by-line diff of two texts.
+type lineDiff struct {
+	name1, name2 string
+	a, b         []string
+	ops          []diffOp
+}
+
+func newLineDiff(name1, text1, name2, text2 string) *lineDiff {
+	d := &lineDiff{name1: name1, name2: name2, a: splitLines(text1), b: splitLines(text2)}
+	d.ops = diffLines(d.a, d.b)
+	return d
+}
+
+// splitLines splits text into lines, keeping their newlines so that a
+// missing final newline shows up as a difference.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// summary counts the lines removed from the first text and added by the
+// second.
+func (d *lineDiff) summary() string {
+	var added, removed int
+	for _, op := range d.ops {
+		switch op.kind {
+		case diffAdd:
+			added++
+		case diffRemove:
+			removed++
+		}
+	}
+	return fmt.Sprintf("%d line(s) removed, %d added", removed, added)
+}
+
+// render formats the diff as unified hunks, numbering each line by its
+// position in the first and second text. At most limit lines are rendered;
+// render also returns how many were left out.
+func (d *lineDiff) render(color bool, limit int) (string, int) {
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return code + s + ansiReset
+	}
+	width := len(fmt.Sprint(max(len(d.a), len(d.b))))
+
+	var lines []string
+	lines = append(lines, paint(ansiRed, "--- "+d.name1), paint(ansiGreen, "+++ "+d.name2))
+	for _, h := range d.hunks() {
+		first := h[0]
+		na, nb := 0, 0
+		for _, op := range h {
+			if op.kind != diffAdd {
+				na++
+			}
+			if op.kind != diffRemove {
+				nb++
+			}
+		}
+		lines = append(lines, paint(ansiCyan, fmt.Sprintf("@@ -%d,%d +%d,%d @@", first.a+1, na, first.b+1, nb)))
+		for _, op := range h {
+			numA, numB := "", ""
+			var text string
+			switch op.kind {
+			case diffSame:
+				numA, numB, text = fmt.Sprint(op.a+1), fmt.Sprint(op.b+1), d.a[op.a]
+			case diffRemove:
+				numA, text = fmt.Sprint(op.a+1), d.a[op.a]
+			case diffAdd:
+				numB, text = fmt.Sprint(op.b+1), d.b[op.b]
+			}
+			line := fmt.Sprintf("%*s %*s %c %s", width, numA, width, numB, op.kind, strings.TrimSuffix(text, "\n"))
+			switch op.kind {
+			case diffRemove:
+				line = paint(ansiRed, line)
+			case diffAdd:
+				line = paint(ansiGreen, line)
+			}
+			lines = append(lines, line)
+			if !strings.HasSuffix(text, "\n") {
+				lines = append(lines, `\ No newline at end of file`)
+			}
+		}
+	}
+
+	cut := 0
+	if len(lines) > limit {
+		cut = len(lines) - limit
+		lines = lines[:limit]
+	}
+	return strings.Join(lines, "\n") + "\n", cut
+}
+
+// hunks groups the diff's changes with up to diffContext unchanged lines
+// around each, merging changes whose context would overlap.
+func (d *lineDiff) hunks() [][]diffOp {
+	var hunks [][]diffOp
+	start, end := -1, -1 // the current hunk is ops[start:end]
+	for i, op := range d.ops {
+		if op.kind == diffSame {
+			continue
+		}
+		lo := max(i-diffContext, 0)
+		if start >= 0 && lo > end {
+			hunks = append(hunks, d.ops[start:end])
+			start = -1
+		}
+		if start < 0 {
+			start = lo
+		}
+		end = min(i+1+diffContext, len(d.ops))
+	}
+	if start >= 0 {
+		hunks = append(hunks, d.ops[start:end])
+	}
+	return hunks
+}
+
+// diffLines computes a minimal line diff of a and b with Myers' algorithm,
+// giving up after maxDiffEdits edits and replacing a with b wholesale.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int // trace[d] holds v[-d-1..d+1] before round d
+	for d := 0; d <= n+m && d <= maxDiffEdits; d++ {
+		trace = append(trace, slices.Clone(v[offset-d-1:offset+d+2]))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, n, m)
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, n+m)
+	for i := range a {
+		ops = append(ops, diffOp{diffRemove, i, 0})
+	}
+	for j := range b {
+		ops = append(ops, diffOp{diffAdd, n, j})
+	}
+	return ops
+}
+
+// backtrack walks the Myers trace back from (n, m) to recover the edits.
+func backtrack(trace [][]int, n, m int) []diffOp {
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{diffSame, x, y})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{diffAdd, x, y})
+		} else {
+			x--
+			ops = append(ops, diffOp{diffRemove, x, y})
+		}
+	}
+	slices.Reverse(ops)
+	return ops
+}
@@ -0,0 +1,183 @@
+package tsar
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gfanton/tsar/tsarscript"
+)
+
+// ScriptExtensions returns the file extensions of the test scripts run from
+// p.Dir: p.Extensions if set, otherwise .tsar, plus .txt and .txtar with
+// p.Compat.
+func (p Params) ScriptExtensions() []string {
+	if len(p.Extensions) > 0 {
+		return p.Extensions
+	}
+	if p.Compat {
+		return []string{".tsar", ".txt", ".txtar"}
+	}
+	return []string{".tsar"}
+}
+
+// compatEnv returns the variables testscript defines beyond tsar's own.
+func compatEnv() []string {
+	return []string{
+		"/=" + string(os.PathSeparator),
+		":=" + string(os.PathListSeparator),
+		"$=$",
+		"devnull=" + os.DevNull,
+	}
+}
+
+// splitCompat splits a script line with testscript's rules: words are
+// separated by blanks, only single quotes quote, a doubled quote inside them
+// standing for itself, # outside quotes starts a comment, and variables are
+// expanded in each unquoted part of a word, so their values are never split.
+// Unlike Split, quoted empty words are kept.
+func (ts *TestScript) splitCompat(line string) ([]string, error) {
+	var (
+		args   []string
+		word   strings.Builder
+		inWord bool // a word has started, possibly empty if quoted
+		quoted bool
+		start  = -1 // start of the current unquoted part
+	)
+	unquoted := func(end int) {
+		if start >= 0 {
+			word.WriteString(ts.expandEnvVars(line[start:end]))
+			start = -1
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if quoted {
+			if c != '\'' {
+				word.WriteByte(c)
+				continue
+			}
+			if i+1 < len(line) && line[i+1] == '\'' {
+				word.WriteByte('\'')
+				i++
+				continue
+			}
+			quoted = false
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\r', '#':
+			unquoted(i)
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+			if c == '#' {
+				return args, nil
+			}
+		case '\'':
+			unquoted(i)
+			inWord, quoted = true, true
+		default:
+			if start < 0 {
+				start = i
+			}
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted argument")
+	}
+	unquoted(len(line))
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// cutConditionsCompat strips the leading conditions of a line, as in
+// "[linux] [!short] exec foo", and reports whether they all hold.
+func (ts *TestScript) cutConditionsCompat(line string) (ok bool, rest string, err error) {
+	for strings.HasPrefix(line, "[") {
+		var cond string
+		cond, line, err = tsarscript.CutCondition(line)
+		if err != nil {
+			return false, "", err
+		}
+		holds, err := ts.condition(cond)
+		if err != nil {
+			if ts.unknownCondition(err) {
+				return false, "", nil
+			}
+			return false, "", err
+		}
+		if !holds {
+			return false, "", nil
+		}
+	}
+	return true, line, nil
+}
+
+// matchCompat implements stdout, stderr and grep as testscript does:
+// "name [-count=N] pattern [file]", where the pattern is a multi-line
+// regexp and -count requires exactly N matches.
+func (ts *TestScript) matchCompat(neg bool, args []string, text string) {
+	name := args[0]
+	args = args[1:]
+	count := 0
+	if len(args) > 0 && strings.HasPrefix(args[0], "-count=") {
+		if neg {
+			ts.t.Fatalf("script:%d: %s: cannot use -count= with negated match", ts.lineno, name)
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(args[0], "-count="))
+		if err != nil || n < 1 {
+			ts.t.Fatalf("script:%d: %s: bad %s", ts.lineno, name, args[0])
+			return
+		}
+		count = n
+		args = args[1:]
+	}
+	want, usage := 1, ""
+	if name == "grep" {
+		want, usage = 2, " file"
+	}
+	if len(args) != want {
+		ts.t.Fatalf("script:%d: usage: %s [-count=N] pattern%s", ts.lineno, name, usage)
+		return
+	}
+	pattern := args[0]
+	re, err := regexp.Compile("(?m)" + pattern)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %s: invalid pattern %q: %v", ts.lineno, name, pattern, err)
+		return
+	}
+	source := name
+	if name == "grep" {
+		source = args[1]
+		data, err := os.ReadFile(ts.mkabs(args[1]))
+		if err != nil {
+			ts.t.Fatalf("script:%d: grep: %v", ts.lineno, err)
+			return
+		}
+		text = ts.normalizeNewlines(string(data))
+	}
+
+	if neg {
+		if loc := re.FindStringIndex(text); loc != nil {
+			ts.t.Fatalf("script:%d: unexpected match for %#q found in %s: %s", ts.lineno, pattern, source, text[loc[0]:loc[1]])
+		}
+		return
+	}
+	if !re.MatchString(text) {
+		ts.t.Fatalf("script:%d: no match for %#q found in %s\n[%s]\n%s", ts.lineno, pattern, source, filepath.Base(source), text)
+		return
+	}
+	if n := len(re.FindAllString(text, -1)); count > 0 && n != count {
+		ts.t.Fatalf("script:%d: have %d matches for %#q in %s, want %d", ts.lineno, n, pattern, source, count)
+	}
+}
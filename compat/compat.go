@@ -0,0 +1,226 @@
+// Package compat adapts tsar to the API of go-internal's testscript package,
+// so that custom commands, Setup functions and conditions written against
+// github.com/rogpeppe/go-internal/testscript can be reused unchanged: import
+// this package under the name testscript and run the existing suite.
+//
+//	import testscript "github.com/gfanton/tsar/compat"
+//
+//	func TestScripts(t *testing.T) {
+//		testscript.Run(t, testscript.Params{
+//			Dir:  "testdata/script",
+//			Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
+//				"sleep": cmdSleep,
+//			},
+//		})
+//	}
+//
+// Scripts run with tsar's Params.Compat semantics.
+package compat
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gfanton/tsar"
+)
+
+// Params holds the parameters of a call to Run, as in testscript.
+type Params struct {
+	// Dir is the directory holding the test scripts: every .txt, .txtar
+	// and .tsar file in it.
+	Dir string
+
+	// Files lists the test scripts to run when Dir is empty.
+	Files []string
+
+	// Setup is called, if non-nil, to complete the setup of each script.
+	Setup func(*Env) error
+
+	// Condition is called, if non-nil, to evaluate conditions the builtin
+	// ones do not cover.
+	Condition func(cond string) (bool, error)
+
+	// Cmds holds custom commands. Unlike tsar commands, they are passed
+	// the arguments without the command name.
+	Cmds map[string]func(ts *TestScript, neg bool, args []string)
+
+	// TestWork keeps work directories after the scripts end.
+	TestWork bool
+
+	// WorkdirRoot is the directory within which work directories are
+	// created. Setting it implies TestWork.
+	WorkdirRoot string
+
+	// UpdateScripts rewrites mismatching archive files in the scripts; see
+	// tsar's Params.UpdateScripts.
+	UpdateScripts bool
+
+	// RequireUniqueNames fails the run if two scripts have the same name.
+	RequireUniqueNames bool
+
+	// ContinueOnError keeps running scripts after one fails.
+	ContinueOnError bool
+
+	// Deadline, if non-zero, bounds the whole run.
+	Deadline time.Time
+
+	// RequireExplicitExec and IgnoreMissedCoverage exist for source
+	// compatibility: compat mode always requires exec, and tsar does not
+	// collect coverage.
+	RequireExplicitExec  bool
+	IgnoreMissedCoverage bool
+}
+
+// Env holds the environment of a script being set up, as in testscript.
+type Env struct {
+	// WorkDir is the script's work directory ($WORK).
+	WorkDir string
+
+	// Vars holds the initial environment, in "KEY=VALUE" form.
+	Vars []string
+
+	// Values holds arbitrary values for the script's commands; see
+	// TestScript.Value.
+	Values map[any]any
+
+	env *tsar.Env
+	t   testing.TB
+}
+
+// Getenv returns the value of an environment variable in Vars.
+func (e *Env) Getenv(key string) string {
+	e.env.Values = e.Vars
+	return e.env.Getenv(key)
+}
+
+// Setenv sets an environment variable in Vars.
+func (e *Env) Setenv(key, value string) {
+	e.env.Values = e.Vars
+	e.env.Setenv(key, value)
+	e.Vars = e.env.Values
+}
+
+// Defer arranges for f to be called when the script ends.
+func (e *Env) Defer(f func()) {
+	e.env.Defer(f)
+}
+
+// T returns the test running the scripts.
+func (e *Env) T() testing.TB {
+	return e.t
+}
+
+// TestScript is the state of a running script, as passed to custom
+// commands.
+type TestScript struct {
+	ts     *tsar.TestScript
+	values map[any]any
+}
+
+// Check fails the script if err is not nil.
+func (ts *TestScript) Check(err error) {
+	if err != nil {
+		ts.Fatalf("%v", err)
+	}
+}
+
+// Chdir changes the script's current directory.
+func (ts *TestScript) Chdir(dir string) { ts.ts.Chdir(dir) }
+
+// Defer arranges for f to be called when the script ends.
+func (ts *TestScript) Defer(f func()) { ts.ts.Defer(f) }
+
+// Exec runs a program, saving its stdout and stderr for later commands. A
+// failure is returned rather than failing the script.
+func (ts *TestScript) Exec(command string, args ...string) error {
+	return ts.ts.Exec(command, args...)
+}
+
+// Fatalf fails the script with a formatted message.
+func (ts *TestScript) Fatalf(format string, args ...any) { ts.ts.Fatalf(format, args...) }
+
+// Getenv returns the value of a variable in the script's environment.
+func (ts *TestScript) Getenv(key string) string { return ts.ts.Getenv(key) }
+
+// Logf logs a formatted message.
+func (ts *TestScript) Logf(format string, args ...any) { ts.ts.Logf(format, args...) }
+
+// MkAbs returns file as an absolute path, relative to the current
+// directory.
+func (ts *TestScript) MkAbs(file string) string { return ts.ts.MkAbs(file) }
+
+// ReadFile returns the contents of a file, or of the last command's stdout
+// or stderr for the names "stdout" and "stderr".
+func (ts *TestScript) ReadFile(file string) string {
+	switch file {
+	case "stdout":
+		return ts.ts.Stdout()
+	case "stderr":
+		return ts.ts.Stderr()
+	}
+	return ts.ts.ReadFile(file)
+}
+
+// Setenv sets a variable in the script's environment.
+func (ts *TestScript) Setenv(key, value string) { ts.ts.Setenv(key, value) }
+
+// Value returns the value stored under key in Env.Values by Setup.
+func (ts *TestScript) Value(key any) any { return ts.values[key] }
+
+// scripts maps each running script's work directory to the values its
+// Setup stored, for TestScript.Value.
+var scripts sync.Map
+
+// Run runs the scripts in p.Dir, or p.Files, as subtests of t.
+func Run(t *testing.T, p Params) {
+	tp, cancel := p.tsarParams(t)
+	defer cancel()
+	tsar.Run(t, tp)
+}
+
+// tsarParams converts p to tsar parameters.
+func (p Params) tsarParams(t testing.TB) (tsar.Params, context.CancelFunc) {
+	tp := tsar.Params{
+		Dir:                p.Dir,
+		Files:              p.Files,
+		Compat:             true,
+		Condition:          p.Condition,
+		TestWork:           p.TestWork,
+		WorkdirRoot:        p.WorkdirRoot,
+		UpdateScripts:      p.UpdateScripts,
+		RequireUniqueNames: p.RequireUniqueNames,
+		ContinueOnError:    p.ContinueOnError,
+		Context:            context.Background(),
+	}
+	cancel := context.CancelFunc(func() {})
+	if !p.Deadline.IsZero() {
+		tp.Context, cancel = context.WithDeadline(tp.Context, p.Deadline)
+	}
+
+	tp.Setup = func(env *tsar.Env) error {
+		e := &Env{WorkDir: env.WorkDir, Vars: env.Values, Values: make(map[any]any), env: env, t: t}
+		scripts.Store(env.WorkDir, e.Values)
+		env.Defer(func() { scripts.Delete(env.WorkDir) })
+		if p.Setup != nil {
+			if err := p.Setup(e); err != nil {
+				return err
+			}
+		}
+		env.Values = e.Vars
+		return nil
+	}
+
+	if len(p.Cmds) > 0 {
+		tp.Commands = make(map[string]func(*tsar.TestScript, bool, []string), len(p.Cmds))
+		for name, cmd := range p.Cmds {
+			tp.Commands[name] = func(ts *tsar.TestScript, neg bool, args []string) {
+				values, _ := scripts.Load(ts.Getenv("WORK"))
+				v, _ := values.(map[any]any)
+				cmd(&TestScript{ts: ts, values: v}, neg, args[1:])
+			}
+		}
+	}
+	return tp, cancel
+}
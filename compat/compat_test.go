@@ -0,0 +1,47 @@
+package compat
+
+import (
+	"strings"
+	"testing"
+)
+
+type valueKey struct{}
+
+func TestRun(t *testing.T) {
+	deferred := 0
+	t.Cleanup(func() {
+		if deferred != 1 {
+			t.Errorf("Env.Defer functions ran %d times, want 1", deferred)
+		}
+	})
+	Run(t, Params{
+		Dir: "testdata",
+		Setup: func(env *Env) error {
+			env.Values[valueKey{}] = "from setup"
+			env.Setenv("GREETING", "hello")
+			env.Defer(func() { deferred++ })
+			return nil
+		},
+		Cmds: map[string]func(ts *TestScript, neg bool, args []string){
+			"greet": func(ts *TestScript, neg bool, args []string) {
+				err := ts.Exec("echo", append([]string{ts.Getenv("GREETING") + ","}, args...)...)
+				if len(args) == 0 {
+					err = ts.Exec("sh", "-c", "echo usage: greet name >&2; exit 1")
+				}
+				if neg {
+					if err == nil {
+						ts.Fatalf("greet succeeded unexpectedly")
+					}
+					return
+				}
+				ts.Check(err)
+			},
+			"value": func(ts *TestScript, neg bool, args []string) {
+				ts.Check(ts.Exec("echo", ts.Value(valueKey{}).(string)))
+			},
+			"readout": func(ts *TestScript, neg bool, args []string) {
+				ts.Check(ts.Exec("echo", "read: "+strings.TrimSpace(ts.ReadFile("stdout"))))
+			},
+		},
+	})
+}
@@ -0,0 +1,50 @@
+package tsar
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCompat(t *testing.T) {
+	Run(t, Params{Dir: "testdata/compat", Compat: true})
+}
+
+func TestCompatFiles(t *testing.T) {
+	var ran []string
+	RunStandalone(&testResultCapture{}, Params{
+		Files:    []string{"testdata/compat/match.txtar"},
+		Compat:   true,
+		OnResult: func(r ScriptResult) { ran = append(ran, r.Name) },
+	})
+	if !slices.Equal(ran, []string{"match"}) {
+		t.Errorf("ran %v, want [match]", ran)
+	}
+}
+
+func TestSplitCompat(t *testing.T) {
+	ts := &TestScript{envMap: map[string]string{"X": "a b", "E": ""}}
+	for line, want := range map[string][]string{
+		`exec echo hi`:        {"exec", "echo", "hi"},
+		`echo 'a  b' c`:       {"echo", "a  b", "c"},
+		`echo 'it''s'`:        {"echo", "it's"},
+		`echo "x y"`:          {"echo", `"x`, `y"`},
+		`echo $X`:             {"echo", "a b"},
+		`echo '$X'`:           {"echo", "$X"},
+		`echo pre'$X'$X`:      {"echo", "pre$Xa b"},
+		`echo '' $E end`:      {"echo", "", "", "end"},
+		`echo a # comment 'x`: {"echo", "a"},
+		`echo a#b`:            {"echo", "a"},
+	} {
+		got, err := ts.splitCompat(line)
+		if err != nil {
+			t.Errorf("splitCompat(%q): %v", line, err)
+			continue
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("splitCompat(%q) = %q, want %q", line, got, want)
+		}
+	}
+	if _, err := ts.splitCompat(`echo 'open`); err == nil {
+		t.Errorf("splitCompat of an unterminated quote succeeded")
+	}
+}
@@ -20,6 +20,11 @@ To invoke the tests, call [Run]:
 
 The package scans the directory for files with .tsar suffix and runs each
 one as a separate subtest.
+With [Params].Parallel, they run as parallel subtests. [RunT] runs scripts
+as subtests of any [SubtestRunner], such as a custom harness. With
+[Params].Count (--count), each script runs that many times, in fresh work
+directories, and its pass rate is logged, to reproduce intermittent
+failures.
 
 A script is a text file executed line-by-line. It can contain commands,
 comments (lines starting with #), conditional execution, and embedded
@@ -32,25 +37,98 @@ Any command can be prefixed with ! to expect failure:
 	! exec false
 	! http GET $SERVER/missing
 
+A ? prefix runs a command best-effort: a failure is logged and ignored.
+
+	? exec pkill my-test-server
+
 # Commands
 
 The following built-in commands are available:
 
+	assert <a> ==|!=|<|<=|>|>= <b>          Compare values (numerically if both are numbers)
 	cd <dir>                                Change directory
-	cp <src> <dst>                          Copy file
-	env [key=value]                         Set/print environment variables
+	pushd <dir>                             Change directory like cd, saving the current one
+	popd                                    Return to the directory saved by the matching pushd
+	check [!] <cmd> [args...]               Soft assertion: record failure, keep running
+	eventually [-t d] [-every d] [!] <cmd>  Re-run a command until it passes or the timeout expires
+	chmod <perm> <file>...                  Set permission bits (octal)
+	cp <src>... <dst>                       Copy files (src may be stdout or stderr)
+	env [key=value...|pattern...]           Set or print (sorted) environment variables
+	env -u <key>...                         Remove environment variables
+	env push|pop                            Save the whole environment, or restore the last one saved
 	envfile <file>                          Load key=value pairs from file into env
 	exec <cmd> [args...]                    Execute external command
-	exists <file>                           Check that file exists
-	grep <pattern> <file>                   Check that file contains pattern
+	exec -umask 077 -user nobody <cmd>      Execute with a file mode creation mask, or as a user (root only)
+	exec -sandbox <cmd>                     Execute in new Linux namespaces, with only $WORK writable
+	exists <file>                           Check that file (or one matching a glob) exists
+	grep [flags] <pattern> <file>...        Check that a file (or one matching a glob) contains pattern;
+	                                        -i ignores case, -m is multiline, -count=N counts all matches
+	head|tail [-n N] <file> [out]           Keep the first or last N lines (default 10) of file, stdout or stderr
+	json -o <var> <path> [file]             Set var to the value at a jq-style path of JSON (default: stdout)
+	json <path> [file] [<op> <value>]       Compare the value at path like assert, or check there is one
+	yaml [-o <var>] <path> [file] ...       Like json, for YAML
 	logfile <file>                          Register file to dump on test failure
 	mkdir <dir>...                          Create directories
+	mocksmtp start|assert|stop ...          Run an SMTP sink and check the messages it received (see Email)
+	path prepend|append <dir>...            Add directories to PATH (OS-aware, deduplicated)
+	rand int <min> <max> <var>              Set var to a seeded random integer (also rand hex <digits> <var>)
+	randstr <var> [length]                  Set var to a unique lowercase alphanumeric string (default 12 long)
+	requires <program>...                   Skip the test unless every program is on PATH
+	replace <pattern> <repl> <file>...      Replace regexp matches in files in place (see Normalizing Output)
 	rm <file>...                            Remove files/directories
+	sort|uniq <file> [out]                  Sort lines by byte value, or drop repeated adjacent ones
+	section <name>                          Group the following commands into a named sub-test
+	set <name> [value]                      Set a script-local variable (expanded, not exported)
 	skip [message]                          Skip the test
+	sql [-dsn <var>] <query> [args...]      Query the database of $DATABASE_URL into stdout (also <op> <value>)
 	stop                                    Stop test execution
+	tcp connect|send|expect|close ...       Talk to a raw TCP server (see TCP Commands)
+	umask <mode>                            Set the file mode creation mask of programs run later
+	uuid <var>                              Set var to a new random UUID
 	wait [name...]                          Wait for background commands
+	waitstable <file> [quiet-period]        Wait until file exists and stops changing (also -timeout d)
 	stdout <pattern>                        Assert last command stdout contains pattern
 	stderr <pattern>                        Assert last command stderr contains pattern
+	output <pattern>                        Assert last command stdout+stderr (interleaved) contains pattern
+	status <code>                           Assert exit status of the last exec (also $exit)
+	cmp [-w] [-b] [-crlf] <file1> <file2>   Assert files are identical (file1 may be stdout or stderr);
+	                                        -w ignores trailing whitespace, -b collapses blanks, -crlf \r\n
+	cmpenv <file1> <file2>                  Like cmp, expanding env vars in file2
+	sha256 <file> <hex>                     Assert a file's digest (also md5, sha1)
+	filesize <file> <size>|[min]..[max]     Assert a file's size (KB, MB, GB, KiB, MiB, GiB)
+	fstat <file> <check>...                 Assert metadata: type=, mode=, exec, newer=, newer-than=
+	newer <file1> <file2>                   Assert file1 was modified after file2 (negated: was not)
+	tree [-mode] [-size] <dir> <manifest>   Assert a directory's recursive listing matches a manifest
+
+rm, cp, exists, chmod, grep and replace expand glob patterns, such as
+build/*.o, in their file arguments; a pattern matching nothing is an error,
+unless a file has it as its literal name.
+
+# Normalizing Output
+
+Commands that rewrite files, or the last command's stdout and stderr, make
+nondeterministic outputs comparable with cmp, portably. replace replaces the
+matches of a regexp in place; \1 to \9 in the replacement refer to groups,
+which $1 cannot, as it is expanded as a variable:
+
+	replace 'took \d+ms' 'took Nms' build.log
+	replace '(\w+)@example\.com' '<\1>' out/*.txt
+
+A pattern that matches nothing fails. head and tail keep the first or last
+-n lines, 10 by default, of a file, stdout or stderr: as stdout, or written
+to an output file:
+
+	exec mytool migrate
+	tail -n 1 stdout
+	stdout '^migrated 42 tables\n$'
+
+sort, which sorts lines by byte value whatever the locale, and uniq, which
+drops the lines repeating the one before them, take the same arguments and
+canonicalize outputs whose order varies:
+
+	exec mytool run -workers 4
+	sort stdout
+	cmp stdout want.txt
 
 # HTTP Commands
 
@@ -68,6 +146,7 @@ with -body.
 	httpbody FILE                            Write last HTTP response body to file
 	httpstatus CODE                         Assert last HTTP response status code
 	httpheader NAME VALUE                   Assert last HTTP response header contains value
+	httpmode live|record|replay             Record responses into the script, or replay them
 
 Example:
 
@@ -85,6 +164,149 @@ Example:
 	http POST $SERVER/upload -upload file=photo.jpg
 	httpstatus 200
 
+With httpmode record, the responses to the http commands that follow are
+written into the script, when it ends, as a .tsar/http.cassette archive file;
+with httpmode replay, they are served from it without network access,
+matched by method, URL and request body digest.
+
+	download URL <dest> [-sha256 HEX]
+
+Fetches URL into dest. With -sha256, the content must have that digest and
+is cached by it in [Params].DownloadCache, so re-runs need no network.
+
+	fileserver start DIR VAR
+
+Serves DIR, relative to the work directory, over HTTP on a free port of
+127.0.0.1 until the script ends, and sets VAR to its URL, so download and
+fetch behavior can be tested against fixtures embedded in the script.
+
+	gitserver start DIR VAR
+
+Serves the git repositories of DIR, relative to the work directory, over
+git's smart HTTP protocol until the script ends, and sets VAR to its URL:
+DIR/NAME is cloned from $VAR/NAME, and accepts pushes. Subdirectories that
+are not repositories yet become ones, with their files committed on main
+by a fixed author and date, so that hashes are reproducible. It needs git.
+
+	goproxy start DIR
+
+Serves the Go module fixtures of DIR, relative to the work directory, as a
+module proxy until the script ends, and sets GOPROXY to its URL and
+GONOSUMDB to *, so that go get and go mod download resolve modules without
+the network. Each fixture is a directory named after the escaped module
+path, with slashes replaced by underscores, and the version, such as
+example.com_hello_v1.0.0; its .mod file is the go.mod served by the proxy,
+defaulting to its go.mod file, an optional .info file its version info, and
+its other files the module's content. [Params].GoProxyDir serves a
+directory of fixtures, which may also be txtar archives, to every script.
+
+	dns HOST ADDRESS
+
+Makes HOST resolve to ADDRESS (host, host:port or URL), like an entry of
+[Params].HostAliases, so scripts can use realistic URLs against test servers.
+The http commands dial the address directly; exec'd programs get
+HTTP_PROXY and HTTPS_PROXY pointing at a local proxy that does.
+
+	requested [-count N] PATTERN
+
+With [Params].CaptureHTTP (or a capture-http directive), the proxy is set
+for every exec'd program and records its requests; requested matches
+PATTERN against lines "METHOD URL STATUS". With -count, exactly N must
+match; negated, none may. HTTPS is decrypted with certificates from a CA
+generated per run, written to $WORK/.tsar/proxy-ca.pem and set in
+SSL_CERT_FILE, CURL_CA_BUNDLE, REQUESTS_CA_BUNDLE, NODE_EXTRA_CA_CERTS and
+TSAR_PROXY_CA. Clients usually bypass proxies for loopback addresses, so
+use host aliases for test servers.
+
+# TCP Commands
+
+	tcp connect [-timeout D] HOST:PORT [&name&]
+	tcp send [-n] DATA... [&name&]
+	tcp expect [-timeout D] PATTERN [&name&]
+	tcp close [&name&]
+
+Test line-based daemons and other non-HTTP servers. tcp connect opens a
+connection, named like a background command (default tcp), through the dns
+aliases; negated, it asserts that nothing accepts connections there. tcp
+send writes its arguments with Go escapes such as \r\n interpreted, and a
+newline unless -n. tcp expect reads until the data received since the last
+expect matches PATTERN (within 10s by default), consumes it up to the end
+of the match and saves it as stdout; negated, it asserts that nothing
+matching arrives in time. Connections are closed when the script ends.
+
+	tcp connect $REDIS_ADDR &redis&
+	tcp send 'PING\r' &redis&
+	tcp expect '^\+PONG\r\n' &redis&
+
+# Email
+
+	mocksmtp start [&name&]
+	mocksmtp assert [-count N] [-from ADDR] [-to ADDR] [-subject PATTERN] [-body PATTERN] [&name&]
+	mocksmtp stop [&name&]
+
+mocksmtp start runs an in-process SMTP server that accepts every message,
+with any credentials, and exports its address as $SMTP_ADDR, $SMTP_HOST
+and $SMTP_PORT; a server named with &name& uses the upper-cased name
+instead of SMTP. mocksmtp assert checks that a received message has the
+given envelope sender and recipient and matches the subject and body
+patterns, and saves its body as stdout. With -count, exactly N must match;
+negated, none may. Bodies are decoded, keeping the text parts of multipart
+messages:
+
+	mocksmtp start
+	exec myapp reset-password --smtp $SMTP_ADDR ann@example.com
+	mocksmtp assert -to ann@example.com -subject '^Reset your password$'
+	stdout 'token=\w+'
+
+# SSH
+
+	sshserver start [&name&]
+	sshserver stop [&name&]
+
+sshserver start runs an in-process SSH server on a free port of 127.0.0.1,
+and exports its address as $SSH_ADDR, $SSH_HOST and $SSH_PORT, or with the
+upper-cased &name& instead of SSH. It accepts, for any user, the script's
+throwaway client key: $SSH_IDENTITY is its private key file, also served by
+the agent at $SSH_AUTH_SOCK, and $SSH_KNOWN_HOSTS lists the host keys of
+the servers. Commands run with sh in the work directory, and the SFTP
+subsystem, used by sftp and scp, serves the work directory as /:
+
+	sshserver start
+	exec ssh -F none -o UserKnownHostsFile=$SSH_KNOWN_HOSTS -p $SSH_PORT tsar@$SSH_HOST 'cat config.toml'
+	stdout 'debug = true'
+
+# Git Repositories
+
+	gitinit DIR [MESSAGE]
+	gitcommit DIR MESSAGE
+
+gitinit makes DIR a git repository, on branch main, with its files
+committed, and gitcommit commits all the changes of one; both save the hash
+of the commit as stdout. Commits have a fixed author and date and ignore the
+user's git configuration, so that their hashes are the same on every run:
+
+	gitinit project
+	cp v2/main.go project/main.go
+	gitcommit project 'release v2'
+	exec mytool changelog project
+
+# Recording Proxies
+
+	recproxy start UPSTREAM VAR [&name&]
+	recproxy assert [-count N] [-method M] [-path PATTERN] [-header 'Name: PATTERN']... [-body PATTERN] [-status CODE] [&name&]
+
+recproxy start runs a reverse proxy to UPSTREAM, a real or mock server,
+on a free port until the script ends, and sets VAR to its URL; point the
+program under test at it instead of the upstream. recproxy assert checks
+that a forwarded request has the method and response status and matches
+the patterns for its path and query, header values and body, and saves
+its body as stdout. With -count, exactly N must match; negated, none may:
+
+	recproxy start $API API_URL
+	exec mycli --endpoint $API_URL sync
+	recproxy assert -count 1 -method POST -path '^/v1/items$' -header 'Authorization: ^Bearer '
+	! recproxy assert -method DELETE
+
 # Repeat Command
 
 	repeat [-all] COUNT exec <cmd> [args...]
@@ -101,6 +323,33 @@ written to stderr for assertion:
 	stderr "6/9 passed"
 	stderr "3/9 failed"
 
+# Redirection
+
+The exec command supports shell-style output redirection. Output is written
+to files in $WORK in addition to being captured for stdout/stderr assertions:
+
+	exec mytool generate >out.txt 2>err.txt
+	exec mytool log >>all.txt
+
+A file can be fed to the command's standard input with <:
+
+	exec mytool parse <input.json
+
+Only bare operators redirect: quoted words such as '<html>' are arguments.
+
+# Output Limits
+
+[Params].MaxOutputBytes bounds how much of each command's stdout and stderr
+is kept, 16 MiB by default. Longer output keeps its first and last halves
+around a "[... N bytes truncated ...]" marker, in logs and for later
+assertions. In verbose mode, exec output is logged line by line as it arrives.
+
+# Line Endings
+
+[Params].NormalizeNewlines turns \r\n line endings into \n in the output of
+exec'd programs and in the files cmp, grep and the other matching commands
+read, so that scripts written on Unix pass on Windows.
+
 # Background Execution
 
 Commands can be run in the background by appending &name:
@@ -109,6 +358,114 @@ Commands can be run in the background by appending &name:
 	exec curl http://localhost:8080
 	wait srv
 
+Each exec'd command runs in its own process group, which is stopped as a
+whole on timeout or interrupt; processes left behind when a command exits are
+killed on Linux, macOS and the BSDs. Background commands left running when
+the script ends are killed the same way, and their output is logged. Set
+[Params].FailOnLeakedBackground to fail scripts that leave any.
+
+waitstable waits for a file a background command writes asynchronously:
+until it exists and its size and modification time have not changed for
+the quiet period (500ms by default), within -timeout (30s by default):
+
+	exec myserver --log server.log &srv
+	waitstable server.log 1s
+	grep 'listening on' server.log
+
+# Recording and Replaying Programs
+
+With [Params].ExecMode set to [ExecRecord], the stdout, stderr and exit code
+of every exec'd program are saved to a cassette, <script>.cassette.json in
+[Params].CassetteDir or next to the script, keyed by the arguments and a
+digest of the input. With [ExecReplay], programs are not run: each exec gets
+the recorded result, and fails if there is none. The work directory is stored
+as $WORK. Files written by programs are not replayed, and background commands
+always run.
+
+# JSON and YAML Values
+
+The json command reads a JSON file, or the last command's stdout, such as the
+body of an http response, and takes the value at a jq-style path of .key,
+["key"] and [index] steps (negative indexes count from the end). With -o it
+sets an env var to it, for later commands; strings are taken as they are,
+other values as compact JSON:
+
+	http POST $API/login -body creds.json
+	json -o TOKEN .token
+	http GET $API/items -header "Authorization: Bearer $TOKEN"
+	json .items[0].price < 10
+	! json .items[0].deleted
+
+The yaml command does the same for YAML, such as Kubernetes manifests; a
+stream of several documents is an array of them, as in .[1].kind.
+
+# Database Assertions
+
+The sql command runs a query against the database of $DATABASE_URL, or of
+the env var named by -dsn, and saves its rows as stdout, tab-separated, with
+NULL for nulls. A trailing operator and value compare its single value, and
+"! sql" asserts that it returns no rows:
+
+	env DATABASE_URL=sqlite://app.db
+	exec myapp migrate
+	sql 'SELECT count(*) FROM users WHERE name = ?' ann == 1
+	! sql 'SELECT 1 FROM users WHERE deleted'
+
+The DSN's scheme selects a driver registered with database/sql: postgres
+(whole URL), mysql (the driver's DSN after mysql://) or sqlite (a path
+relative to $WORK). The tsar command includes drivers with the sqlite,
+postgres and mysql build tags.
+
+# Random Values
+
+Each script has a random seed in $TSAR_SEED, random unless [Params].Seed
+(--seed) sets it, from which rand and $RANDOM (an integer from 0 to 32767,
+new at each use, unless RANDOM is set) draw their values:
+
+	rand int 1 100 PORT_OFFSET
+	rand hex 16 TOKEN
+	exec myapp --token $TOKEN --id $RANDOM
+
+A failed script that used random values reports its seed; setting TSAR_SEED
+to it, in [Params].Setup or with --seed, reproduces the same values.
+
+uuid and randstr, meant for unique names such as those of resources created
+on real services, do not use the seed, so that parallel runs do not collide:
+
+	randstr SUFFIX
+	exec aws s3 mb s3://test-$SUFFIX
+
+# Sections
+
+The section command groups the commands that follow it, up to the next
+section, into a named sub-test: a t.Run subtest under go test, and a
+name/section line in CLI output. A skip inside a section skips only the rest
+of that section.
+
+# Soft Assertions
+
+The check prefix runs a command as a soft assertion: a failure is logged and
+the script continues. All failed checks are reported when the script ends:
+
+	exec mytool report
+	check stdout 'total: 42'
+	check ! stderr warning
+
+# Eventual Assertions
+
+The eventually prefix re-runs a command until it passes, every 250ms (or
+-every) for up to 30s (or -t), for state that converges asynchronously.
+The logs and output of the passing attempt are kept; on timeout, the last
+failure is reported:
+
+	exec myserver &srv
+	eventually -t 10s http GET $SERVER/health
+	eventually ! exists server.lock
+
+Only the wrapped command is re-run: stdout and stderr check the output of
+the last command, so wrap the command that reads the state, such as http,
+exec, grep or sql.
+
 # Conditional Execution
 
 Lines can be prefixed with conditions in square brackets:
@@ -116,9 +473,35 @@ Lines can be prefixed with conditions in square brackets:
 	[!windows] mkdir unix-only-dir
 	[short] skip "skipping in short mode"
 
-Built-in conditions: short, windows, darwin, linux.
+Built-in conditions: short, windows, darwin, linux, root.
 Prefix with ! to negate: [!short].
 
+An unknown condition fails the script unless [Params].UnknownCondition says to
+skip the line or the whole script. A custom [Params].Condition reports one by
+returning an error wrapping [ErrUnknownCondition].
+
+# Frontmatter
+
+Comment lines of the form "# tsar:key=value" at the top of a script, before
+its first command, declare per-script settings:
+
+	# tsar:timeout=1m          Fail the script if it runs longer than this
+	# tsar:tags=slow,net       Labels selected with Params.Tags or --tags
+	# tsar:skip-on=windows     Skip the script when any listed condition holds
+	# tsar:requires docker jq  Skip the script unless these programs are on PATH
+	# tsar:save-output         Save each exec's output to $WORK/.tsar/out/NNN.stdout
+	                           and NNN.stderr (also Params.SaveOutput)
+	# tsar:explicit-exec=false Override Params.RequireExplicitExec
+	# tsar:unique-names=false  Override Params.RequireUniqueNames
+	# tsar:expand-files        Expand ${VAR} in embedded text files when extracting them
+	# tsar:sandbox             Run every program in new namespaces (also Params.Sandbox)
+	# tsar:capture-http        Record programs' HTTP requests (also Params.CaptureHTTP)
+
+Required programs are looked up in the test PATH, after Setup, before the
+first command runs; the skip message lists every missing one. With
+[Params].FailOnMissingRequires (--fail-on-missing-requires) the script fails
+instead.
+
 # Embedded Files
 
 Scripts can contain embedded files using txtar format:
@@ -129,6 +512,26 @@ Scripts can contain embedded files using txtar format:
 	-- input.txt --
 	hello world
 
+Annotations after a file name change how it is extracted: the content of a
+file marked "-- logo.png [base64] --" is decoded from base64, so binary
+fixtures can be embedded, and "-- bin/run.sh 0755 --" sets the file's
+permissions so it can be run directly. A header "-- name -> target --"
+creates a symlink instead of a file. In a file marked [expand], ${VAR}
+references are expanded on extraction, with the environment the script
+starts with (after [Params].Setup).
+
+With [Params].UpdateScripts, a tree command whose manifest does not match
+rewrites that embedded file in the script instead of failing.
+
+# Failure Messages
+
+A failing command's message is followed by the script lines around it, with a
+caret under the command, and the command line after env expansion. A failing
+cmp or cmpenv reports a unified diff with line numbers, colored if
+[Params].Color is set; when it is too long to log, the full content is saved
+under [Params].ArtifactDir and listed in [ScriptResult].Artifacts. Binary content (a NUL byte or invalid
+UTF-8) is reported as a bounded hex dump of the differing rows instead.
+
 # Custom Commands
 
 Register custom commands via [Params].Commands:
@@ -140,6 +543,42 @@ Register custom commands via [Params].Commands:
 		},
 	})
 
+Commands can find out where they run with [TestScript.Name],
+[TestScript.ScriptFile], [TestScript.WorkDir] and [TestScript.Lineno].
+
+# Work Directories
+
+Each script runs in an empty work directory. [Params].WorkdirMode selects how
+those are provided: fresh temporary directories ([WorkdirTemp], the default),
+the same on a memory-backed filesystem ([WorkdirTmpfs]), directories emptied
+and reused across the scripts of a run ([WorkdirPool]), or one directory
+emptied before each script and locked against other runs ([WorkdirReuse]).
+
+Directories kept with [Params].TestWork are named after their script and
+record it, its run, when it finished and its status in .tsar/workdir.json;
+[ListWorkdirs] reads them, and "tsar workdirs list|open|clean" lists them,
+starts a shell in one, or removes those older than --older-than.
+
+# Script Environment
+
+Scripts start with WORK, the host's PATH, HOME set to /no-home, a temporary
+directory under $WORK/tmp, exe (.exe on Windows) and TSAR_SEED. LANG and
+LC_ALL are C and TZ is UTC, for output that doesn't depend on the machine;
+[Params].Locale and [Params].Timezone change them. [Params].Home gives
+scripts a writable home directory, $WORK/home, with XDG_CONFIG_HOME,
+XDG_CACHE_HOME and XDG_DATA_HOME in it, with [HomeTemp], or the user's own
+with [HomeHost].
+
+[Params].SharedGoCache shares GOCACHE and GOMODCACHE between scripts and
+runs, so that go build inside scripts doesn't rebuild everything each time;
+GOPATH stays per script. [Params].PassThroughEnv copies the host variables
+matching its names or patterns, such as AWS_*, and [Params].Env adds
+KEY=VALUE entries, overriding them all.
+
+[Params].Redact masks secrets as [REDACTED] in everything scripts log and in
+their failure messages: the values of the variables it names, and the
+matches of its other entries, regular expressions such as ghp_\w+.
+
 # Setup
 
 Use [Params].Setup to inject environment variables (e.g., server URLs):
@@ -153,16 +592,105 @@ Use [Params].Setup to inject environment variables (e.g., server URLs):
 		},
 	})
 
+# Execution Events
+
+Set [Params].Events to receive an [Event] as each script starts and ends
+([EventScriptStart], [EventScriptEnd]) and around each command
+([EventCommandStart], [EventCommandEnd]), with its expanded arguments,
+duration, status and output sizes, for custom reporters and metrics.
+
+# Leak Checks
+
+Set [Params].CheckLeaks to fail scripts that leave goroutines, open file
+descriptors or temporary files behind; the report names the custom commands
+the script ran.
+
+# Environment Diffs
+
+Set [Params].EnvDiff to log, when a script fails, each environment variable
+it added, removed or changed relative to the environment tsar started it
+with, and the script line (or Params.Setup) that last changed it.
+
+# Other Script Formats
+
+Set [Params].Parser to run files in other formats on the same engine. A
+[Parser] converts a matching file into a txtar archive whose comment holds the
+script lines; [Run] and [RunStandalone] collect matching files from Dir along
+with *.tsar files.
+
+# testscript Compatibility
+
+Set [Params].Compat to run scripts written for go-internal's testscript with
+its semantics: single-quote-only quoting where a doubled quote stands for
+itself, # comments anywhere outside quotes, per-word variable expansion, several
+conditions per line, multi-line stdout, stderr and grep regexps with
+-count=N, no exec redirections, explicit exec, and $/, $:, $$ and $devnull.
+Compat also runs .txt and .txtar files from Dir; see [Params].Extensions and
+[Params].Files.
+
+Package github.com/gfanton/tsar/compat mirrors testscript's Params, Env and
+TestScript types on top of tsar, so custom commands written for testscript
+can be reused by changing an import.
+
+# Parsing Scripts
+
+Package github.com/gfanton/tsar/tsarscript parses scripts into a syntax tree
+(lines, conditions, arguments with positions, archive files) without running
+them, for formatters, linters and editors.
+
 # Command-line Tool
 
 The tsar command provides a standalone way to run test scripts:
 
 	tsar testdata/              # Run all .tsar files in directory
 	tsar testdata/example.tsar  # Run specific file
+	tsar 'testdata/api_*.tsar' integration/  # Multiple targets and globs
 	tsar --verbose testdata/    # Verbose output
 
-Flags: -v/--verbose, -s/--short, --test-work, -w/--workdir-root,
--c/--continue-on-error, -e/--require-explicit-exec, -u/--require-unique-names.
+Flags: -v/--verbose, -s/--short, --test-work, -w/--workdir-root, --workdir-mode,
+-c/--continue-on-error, --max-failures, --count, --timeout, -e/--require-explicit-exec, -u/--require-unique-names,
+--tags, --summary, --slow-threshold, --profile, --artifact-dir, --download-cache, --color, -q/--quiet, -x/--trace, --compat, --sandbox, --capture-http, --exec-mode,
+--cassette-dir, --seed, -n/--dry-run, --update,
+--unknown-condition, --fail-on-leaked-background, --fail-on-missing-requires, --check-leaks,
+--env-diff, --max-output-bytes, --normalize-newlines, --home, --shared-go-cache,
+--go-proxy-dir, --env, --pass-through-env, --redact, --locale, --timezone.
+
+With --dry-run (Params.DryRun), scripts are parsed, conditions evaluated and
+commands resolved against the builtins, custom commands, archive files and
+test PATH, without executing anything.
+
+With --slow-threshold DURATION, scripts and commands that run longer than
+DURATION are marked in the output and in the --summary report.
+
+With --profile FILE, the wall time of every command is recorded and an
+aggregated report is written to FILE (CSV for a .csv file, JSON otherwise): the
+slowest commands, the time by command type, and the time per script.
+
+"tsar config [DIR]" prints the resolved project configuration, with whether
+each value came from tsar.toml or convention, and fails on unknown tsar.toml
+keys.
+
+Scripts in the project's bin directory are callable by name without their
+extension, run by the interpreter for it (/bin/sh, python3, node, ruby, or
+one set in tsar.toml's [interpreters] table) or by their #! line.
+
+Per-test hooks get TSAR_TEST_NAME, TSAR_SCRIPT_FILE and TSAR_WORK in their
+environment, and teardown hooks, per-test or global, get TSAR_STATUS (pass,
+fail or skip).
+
+"tsar record" runs the command lines it reads, each with /bin/sh, in a fresh
+work directory (a copy of --dir, if given), and on exit writes a draft script:
+exec lines with stdout, stderr and status assertions, expected outputs too
+long for a regexp and the --dir files as archive files.
+
+"tsar stress SCRIPT" runs a script over and over, -p at a time, until a run
+fails or --duration elapses. Each run gets a fresh work directory and
+TSAR_STRESS_RUN and TSAR_SEED in its environment; the failed run's output,
+kept work directory and seed are printed, and --seed reruns with that seed.
+
+"tsar lsp" runs a minimal language server on stdin/stdout, with diagnostics
+(syntax errors and dry-run problems), completion of builtin commands and env
+vars, go-to-definition for embedded archive files, and hover help.
 
 Environment variables with TSAR_ prefix are also supported.
 
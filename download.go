@@ -0,0 +1,174 @@
+package tsar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cmdDownload fetches a URL into a file. With -sha256, the content must have
+// that digest, and it is kept in Params.DownloadCache so later runs copy it
+// from disk instead of fetching it again.
+func (ts *TestScript) cmdDownload(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: download does not support negation", ts.lineno)
+		return
+	}
+	var pos []string
+	var want string
+	for i := 1; i < len(args); i++ {
+		if args[i] == "-sha256" {
+			if i+1 >= len(args) {
+				ts.t.Fatalf("script:%d: download: -sha256 requires a digest", ts.lineno)
+				return
+			}
+			i++
+			want = strings.ToLower(args[i])
+			if len(want) != hex.EncodedLen(sha256.Size) {
+				ts.t.Fatalf("script:%d: download: %q is not a sha256 digest", ts.lineno, args[i])
+				return
+			}
+			continue
+		}
+		pos = append(pos, args[i])
+	}
+	if len(pos) != 2 {
+		ts.t.Fatalf("script:%d: usage: download URL dest [-sha256 hex]", ts.lineno)
+		return
+	}
+	url, dest := pos[0], ts.mkabs(pos[1])
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		ts.t.Fatalf("script:%d: download: %v", ts.lineno, err)
+		return
+	}
+
+	cache := ts.downloadCache()
+	if want != "" && cache != "" {
+		if ok := copyCached(filepath.Join(cache, want), dest, want); ok {
+			ts.t.Logf("download %s: cached", url)
+			return
+		}
+	}
+
+	got, err := ts.fetch(url, dest)
+	if err != nil {
+		ts.t.Fatalf("script:%d: download %s: %v", ts.lineno, url, err)
+		return
+	}
+	if want == "" {
+		ts.t.Logf("download %s: sha256 %s (add -sha256 to check and cache it)", url, got)
+		return
+	}
+	if got != want {
+		os.Remove(dest)
+		ts.t.Fatalf("script:%d: download %s: sha256 is %s, want %s", ts.lineno, url, got, want)
+		return
+	}
+	if cache != "" {
+		if err := storeCached(cache, want, dest); err != nil {
+			ts.t.Logf("download %s: not cached: %v", url, err)
+		}
+	}
+}
+
+// downloadCache returns the download cache directory, or "" if there is
+// none.
+func (ts *TestScript) downloadCache() string {
+	if ts.params.DownloadCache != "" {
+		return ts.params.DownloadCache
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "tsar", "downloads")
+}
+
+// fetch writes the body of a successful GET of url to dest and returns its
+// SHA-256 digest.
+func (ts *TestScript) fetch(url, dest string) (string, error) {
+	req, err := http.NewRequestWithContext(ts.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ts.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyCached copies a cache entry to dest, reporting whether it existed and
+// still had the digest it is named after. A corrupt entry is removed.
+func copyCached(entry, dest, sum string) bool {
+	src, err := os.Open(entry)
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+	f, err := os.Create(dest)
+	if err != nil {
+		return false
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || hex.EncodeToString(h.Sum(nil)) != sum {
+		os.Remove(entry)
+		return false
+	}
+	return true
+}
+
+// storeCached adds a downloaded file to the cache under its digest. It
+// writes a temporary file and renames it, so concurrent scripts never see a
+// partial entry.
+func storeCached(cache, sum, src string) error {
+	if err := os.MkdirAll(cache, 0777); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(cache, sum+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(cache, sum))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package tsar
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/txtar"
+)
+
+// dryRun checks the script without executing it: every line that would run
+// must parse, its conditions must be known, and its command must resolve to
+// a builtin, a custom command, or a program found in the archive or the
+// test PATH. All problems are reported together in a single failure.
+func (ts *TestScript) dryRun(ar *txtar.Archive, script string) {
+	files := make(map[string]bool)
+	var problems []string
+	if ar != nil {
+		for _, f := range ar.Files {
+			h, _, err := archiveFile(f)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			files[filepath.Clean(h.Name)] = true
+		}
+	}
+
+	commands := 0
+	for script != "" {
+		var line string
+		line, script = getLine(script)
+		ts.lineno++
+		_, args, err := ts.splitLine(line)
+		if ts.stopped {
+			return
+		}
+		if err == nil && len(args) > 0 {
+			commands++
+			err = ts.checkCommand(args, files)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("script:%d: %v", ts.lineno, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		ts.t.Fatalf("dry run: %d problem(s):\n%s", len(problems), strings.Join(problems, "\n"))
+		return
+	}
+	ts.t.Logf("dry run: %d command(s) ok", commands)
+}
+
+// checkCommand resolves a parsed command line the way cmdExec would.
+func (ts *TestScript) checkCommand(args []string, files map[string]bool) error {
+	switch cmd := args[0]; {
+	case cmd == "exec":
+		_, args, err := cutExecFlags(args)
+		if err != nil {
+			return err
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("usage: %s", execUsage)
+		}
+		return ts.checkProgram(args[1], files)
+	case cmd == "check" || cmd == "?":
+		args = args[1:]
+		if len(args) > 0 && args[0] == "!" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("usage: %s [!] command [args...]", cmd)
+		}
+		return ts.checkCommand(args, files)
+	case cmd == "eventually":
+		args = args[1:]
+		for len(args) > 1 && (args[0] == "-t" || args[0] == "-every") {
+			args = args[2:]
+		}
+		if len(args) > 0 && args[0] == "!" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("usage: eventually [-t duration] [-every duration] [!] command [args...]")
+		}
+		return ts.checkCommand(args, files)
+	case cmd == "repeat":
+		i := 1
+		for i < len(args) && strings.HasPrefix(args[i], "-") {
+			if args[i] != "-all" {
+				i++
+			}
+			i++
+		}
+		// Skip the count; the rest is the repeated command.
+		if i+1 >= len(args) {
+			return fmt.Errorf("usage: repeat [-all] [-parallel N] [-timeout duration] COUNT COMMAND...")
+		}
+		return ts.checkCommand(args[i+1:], files)
+	case ts.builtin[cmd] != nil, ts.user != nil && ts.user[cmd] != nil:
+		return nil
+	case ts.params.RequireExplicitExec:
+		return fmt.Errorf("unknown command %q", cmd)
+	default:
+		return ts.checkProgram(cmd, files)
+	}
+}
+
+// checkProgram reports whether an exec target can be found: a path must name
+// an archive file or an existing file, and a bare name must be on the test
+// PATH.
+func (ts *TestScript) checkProgram(name string, files map[string]bool) error {
+	if !strings.ContainsRune(name, filepath.Separator) && !strings.ContainsRune(name, '/') {
+		if _, err := ts.lookPath(name); err != nil {
+			return fmt.Errorf("command %q not found: %v", name, err)
+		}
+		return nil
+	}
+	path := ts.mkabs(name)
+	if rel, err := filepath.Rel(ts.workdir, path); err == nil && files[rel] {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("program %q not found in archive", name)
+	}
+	return nil
+}
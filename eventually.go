@@ -0,0 +1,116 @@
+package tsar
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// cmdEventually re-runs a command until it succeeds or a timeout expires,
+// for assertions on state that converges: files being written, services
+// starting, rows being replicated.
+func (ts *TestScript) cmdEventually(neg bool, args []string) {
+	usage := "usage: eventually [-t duration] [-every duration] [!] command [args...]"
+	if neg {
+		ts.t.Fatalf("script:%d: eventually: negate the command instead: eventually ! command", ts.lineno)
+		return
+	}
+	args = args[1:]
+	timeout, every := 30*time.Second, 250*time.Millisecond
+	for len(args) > 0 && (args[0] == "-t" || args[0] == "-every") {
+		if len(args) < 2 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			ts.t.Fatalf("script:%d: eventually: invalid %s duration %q", ts.lineno, args[0], args[1])
+			return
+		}
+		if args[0] == "-t" {
+			timeout = d
+		} else {
+			every = d
+		}
+		args = args[2:]
+	}
+	if len(args) > 0 && args[0] == "!" {
+		neg = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+
+	parent := ts.t
+	defer func() { ts.t = parent }()
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for attempt := 1; ; attempt++ {
+		try := &attemptT{parent: parent}
+		ts.t = try
+		ts.cmdExec(neg, args)
+		ts.t = parent
+		if !try.failed {
+			try.flush()
+			if attempt > 1 {
+				ts.t.Logf("eventually: passed on attempt %d after %v", attempt, time.Since(start).Round(time.Millisecond))
+			}
+			return
+		}
+		wait := min(every, time.Until(deadline))
+		if wait <= 0 {
+			try.flush()
+			ts.t.Fatalf("script:%d: eventually: still failing after %v (%d attempts): %s", ts.lineno, timeout, attempt, try.failure)
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-ts.ctx.Done():
+			try.flush()
+			ts.t.Fatalf("script:%d: eventually: %v after %d attempts: %s", ts.lineno, context.Cause(ts.ctx), attempt, try.failure)
+			return
+		}
+	}
+}
+
+// attemptT runs one attempt of an eventually command: it records the first
+// failure instead of failing the script, and holds back the logs, so that
+// only those of the attempt that ends the command are shown.
+type attemptT struct {
+	parent  TestingT
+	failed  bool
+	failure string
+	logs    []string
+}
+
+func (at *attemptT) Skip(args ...any)                  { at.parent.Skip(args...) }
+func (at *attemptT) Fatal(args ...any)                 { at.fail(fmt.Sprint(args...)) }
+func (at *attemptT) Fatalf(format string, args ...any) { at.fail(fmt.Sprintf(format, args...)) }
+func (at *attemptT) Log(args ...any)                   { at.logs = append(at.logs, fmt.Sprint(args...)) }
+func (at *attemptT) Logf(format string, args ...any) {
+	at.logs = append(at.logs, fmt.Sprintf(format, args...))
+}
+func (at *attemptT) Failed() bool { return at.failed }
+func (at *attemptT) Helper()      { at.parent.Helper() }
+
+func (at *attemptT) fail(msg string) {
+	if !at.failed {
+		at.failed = true
+		// The command's line is that of eventually, reported by it.
+		_, at.failure, _ = strings.Cut(msg, ": ")
+		if !strings.HasPrefix(msg, "script:") {
+			at.failure = msg
+		}
+	}
+}
+
+// flush logs what the attempt held back.
+func (at *attemptT) flush() {
+	for _, msg := range at.logs {
+		at.parent.Log(msg)
+	}
+	at.logs = nil
+}
@@ -0,0 +1,395 @@
+package tsar
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// digests maps the digest commands to their hash functions.
+var digests = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// cmdDigest implements md5, sha1 and sha256: it checks the digest of a file,
+// or of stdout or stderr, against a hex string, streaming the file so that
+// large artifacts need not be held in memory.
+func (ts *TestScript) cmdDigest(neg bool, args []string) {
+	name := args[0]
+	if len(args) != 3 {
+		ts.t.Fatalf("script:%d: usage: %s file hex", ts.lineno, name)
+		return
+	}
+	h := digests[name]()
+	want := strings.ToLower(args[2])
+	if len(want) != hex.EncodedLen(h.Size()) {
+		ts.t.Fatalf("script:%d: %s: %q is not a %s digest", ts.lineno, name, args[2], name)
+		return
+	}
+
+	switch args[1] {
+	case "stdout":
+		io.WriteString(h, ts.stdout)
+	case "stderr":
+		io.WriteString(h, ts.stderr)
+	default:
+		f, err := os.Open(ts.mkabs(args[1]))
+		if err != nil {
+			ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+			return
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+			return
+		}
+	}
+
+	got := hex.EncodeToString(h.Sum(nil))
+	if neg {
+		if got == want {
+			ts.t.Fatalf("script:%d: %s of %s is %s unexpectedly", ts.lineno, name, args[1], got)
+		}
+		return
+	}
+	if got != want {
+		ts.t.Fatalf("script:%d: %s of %s is %s, want %s", ts.lineno, name, args[1], got, want)
+	}
+}
+
+// cmdFilesize checks a file's size against an exact size or a range
+// "min..max", either end of which may be omitted. Sizes accept decimal
+// (KB, MB, GB) and binary (KiB, MiB, GiB) unit suffixes.
+func (ts *TestScript) cmdFilesize(neg bool, args []string) {
+	if len(args) != 3 {
+		ts.t.Fatalf("script:%d: usage: filesize file size|[min]..[max]", ts.lineno)
+		return
+	}
+	lo, hi, err := parseSizeRange(args[2])
+	if err != nil {
+		ts.t.Fatalf("script:%d: filesize: %v", ts.lineno, err)
+		return
+	}
+	file := ts.mkabs(args[1])
+	info, err := os.Stat(file)
+	if err != nil {
+		ts.t.Fatalf("script:%d: filesize: %v", ts.lineno, err)
+		return
+	}
+	size := info.Size()
+	in := size >= lo && (hi < 0 || size <= hi)
+	if in == neg {
+		if neg {
+			ts.t.Fatalf("script:%d: size of %s is %d bytes, unexpectedly within %s", ts.lineno, args[1], size, args[2])
+		} else {
+			ts.t.Fatalf("script:%d: size of %s is %d bytes, want %s", ts.lineno, args[1], size, args[2])
+		}
+	}
+}
+
+// parseSizeRange parses "size" or "[min]..[max]"; hi is -1 for no upper
+// bound.
+func parseSizeRange(s string) (lo, hi int64, err error) {
+	loStr, hiStr, isRange := strings.Cut(s, "..")
+	if !isRange {
+		n, err := parseSize(s)
+		return n, n, err
+	}
+	hi = -1
+	if loStr != "" {
+		if lo, err = parseSize(loStr); err != nil {
+			return 0, 0, err
+		}
+	}
+	if hiStr != "" {
+		if hi, err = parseSize(hiStr); err != nil {
+			return 0, 0, err
+		}
+		if hi < lo {
+			return 0, 0, fmt.Errorf("empty range %q", s)
+		}
+	}
+	return lo, hi, nil
+}
+
+// sizeUnits lists the accepted size suffixes, longest first so that "KiB"
+// is not taken for "B".
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"B", 1},
+}
+
+// parseSize parses a byte count with an optional unit suffix.
+func parseSize(s string) (int64, error) {
+	num, factor := s, int64(1)
+	for _, u := range sizeUnits {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			num, factor = n, u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(factor)), nil
+}
+
+// cmdFstat checks a file's metadata. Each argument after the file is a
+// check that must hold:
+//
+//	type=file|dir|symlink  kind of file (symlinks are not followed)
+//	mode=PERM              permission bits, in octal
+//	exec                   executable by someone
+//	newer=FILE             modified after FILE
+//	newer-than=DURATION    modified within the last DURATION
+//
+// With negation, the command fails only if every check holds.
+func (ts *TestScript) cmdFstat(neg bool, args []string) {
+	if len(args) < 3 {
+		ts.t.Fatalf("script:%d: usage: fstat file check...", ts.lineno)
+		return
+	}
+	info, err := os.Lstat(ts.mkabs(args[1]))
+	if err != nil {
+		ts.t.Fatalf("script:%d: fstat: %v", ts.lineno, err)
+		return
+	}
+
+	var failed []string
+	for _, check := range args[2:] {
+		ok, desc, err := ts.fstatCheck(info, check)
+		if err != nil {
+			ts.t.Fatalf("script:%d: fstat: %v", ts.lineno, err)
+			return
+		}
+		if !ok {
+			failed = append(failed, desc)
+		}
+	}
+	if neg {
+		if len(failed) == 0 {
+			ts.t.Fatalf("script:%d: %s unexpectedly matches %s", ts.lineno, args[1], strings.Join(args[2:], " "))
+		}
+		return
+	}
+	if len(failed) > 0 {
+		ts.t.Fatalf("script:%d: %s: %s", ts.lineno, args[1], strings.Join(failed, "; "))
+	}
+}
+
+// fstatCheck evaluates one fstat check against info, describing the
+// mismatch if it does not hold.
+func (ts *TestScript) fstatCheck(info os.FileInfo, check string) (ok bool, desc string, err error) {
+	key, value, _ := strings.Cut(check, "=")
+	switch key {
+	case "type":
+		var got string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			got = "symlink"
+		case info.IsDir():
+			got = "dir"
+		case info.Mode().IsRegular():
+			got = "file"
+		default:
+			got = "other"
+		}
+		if value != "file" && value != "dir" && value != "symlink" {
+			return false, "", fmt.Errorf("invalid type %q (want file, dir or symlink)", value)
+		}
+		return got == value, fmt.Sprintf("type is %s, want %s", got, value), nil
+	case "mode":
+		want, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || want > 0777 {
+			return false, "", fmt.Errorf("invalid mode %q", value)
+		}
+		got := info.Mode().Perm()
+		return got == os.FileMode(want), fmt.Sprintf("mode is %#o, want %#o", got, want), nil
+	case "exec":
+		return info.Mode().Perm()&0111 != 0, fmt.Sprintf("mode %#o is not executable", info.Mode().Perm()), nil
+	case "newer":
+		ref, err := os.Stat(ts.mkabs(value))
+		if err != nil {
+			return false, "", err
+		}
+		return info.ModTime().After(ref.ModTime()), fmt.Sprintf("modified %v, not after %s (%v)", info.ModTime(), value, ref.ModTime()), nil
+	case "newer-than":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid duration %q", value)
+		}
+		age := time.Since(info.ModTime())
+		return age < d, fmt.Sprintf("modified %v ago, not within %v", age.Round(time.Millisecond), d), nil
+	}
+	return false, "", fmt.Errorf("unknown check %q", check)
+}
+
+// cmdNewer checks that file1 was modified after file2, or, negated, that it
+// was not, as when a build should have left an output alone.
+func (ts *TestScript) cmdNewer(neg bool, args []string) {
+	if len(args) != 3 {
+		ts.t.Fatalf("script:%d: usage: newer file1 file2", ts.lineno)
+		return
+	}
+	var mtimes [2]time.Time
+	for i, file := range args[1:] {
+		info, err := os.Stat(ts.mkabs(file))
+		if err != nil {
+			ts.t.Fatalf("script:%d: newer: %v", ts.lineno, err)
+			return
+		}
+		mtimes[i] = info.ModTime()
+	}
+	newer := mtimes[0].After(mtimes[1])
+	switch {
+	case newer && neg:
+		ts.t.Fatalf("script:%d: %s (modified %v) is unexpectedly newer than %s (modified %v)", ts.lineno, args[1], mtimes[0], args[2], mtimes[1])
+	case !newer && !neg:
+		ts.t.Fatalf("script:%d: %s (modified %v) is not newer than %s (modified %v)", ts.lineno, args[1], mtimes[0], args[2], mtimes[1])
+	}
+}
+
+// cmdWaitstable waits until a file exists and its size and modification
+// time have not changed for a quiet period, such as a log or artifact a
+// background process is still writing.
+func (ts *TestScript) cmdWaitstable(neg bool, args []string) {
+	usage := "usage: waitstable [-timeout duration] file [quiet-period]"
+	if neg {
+		ts.t.Fatalf("script:%d: waitstable does not support negation", ts.lineno)
+		return
+	}
+	args = args[1:]
+	timeout := 30 * time.Second
+	if len(args) > 0 && args[0] == "-timeout" {
+		if len(args) < 2 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			ts.t.Fatalf("script:%d: waitstable: invalid timeout %q", ts.lineno, args[1])
+			return
+		}
+		timeout, args = d, args[2:]
+	}
+	if len(args) < 1 || len(args) > 2 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	quiet := 500 * time.Millisecond
+	if len(args) == 2 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			ts.t.Fatalf("script:%d: waitstable: invalid quiet period %q", ts.lineno, args[1])
+			return
+		}
+		quiet = d
+	}
+	file := ts.mkabs(args[0])
+	interval := min(quiet/5, 100*time.Millisecond)
+
+	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last os.FileInfo
+	var since time.Time // when the file last changed
+	for {
+		info, err := os.Stat(file)
+		switch {
+		case err != nil:
+			last = nil
+		case last == nil || info.Size() != last.Size() || !info.ModTime().Equal(last.ModTime()):
+			last, since = info, time.Now()
+		case time.Since(since) >= quiet:
+			ts.t.Logf("%s stable at %d bytes after %v", args[0], info.Size(), time.Since(start).Round(time.Millisecond))
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			if last == nil {
+				ts.t.Fatalf("script:%d: waitstable: %s did not appear within %v", ts.lineno, args[0], timeout)
+			} else {
+				ts.t.Fatalf("script:%d: waitstable: %s still changing after %v (%d bytes, last change %v ago)", ts.lineno, args[0], timeout, last.Size(), time.Since(since).Round(time.Millisecond))
+			}
+			return
+		case <-ts.ctx.Done():
+			ts.t.Fatalf("script:%d: waitstable: %v", ts.lineno, context.Cause(ts.ctx))
+			return
+		}
+	}
+}
+
+// globFiles returns the absolute paths of files, expanding the glob patterns
+// among them, such as build/*.o. A pattern matching nothing is an error,
+// unless a file has its literal name.
+func (ts *TestScript) globFiles(files []string) ([]string, error) {
+	var paths []string
+	for _, file := range files {
+		abs := ts.mkabs(file)
+		if !strings.ContainsAny(file, "*?[") {
+			paths = append(paths, abs)
+			continue
+		}
+		matches, err := filepath.Glob(abs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", file, err)
+		}
+		if len(matches) == 0 {
+			if _, err := os.Lstat(abs); err != nil {
+				return nil, fmt.Errorf("no files match %s", file)
+			}
+			matches = []string{abs}
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// cmdChmod sets the permission bits of files.
+func (ts *TestScript) cmdChmod(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: chmod does not support negation", ts.lineno)
+		return
+	}
+	if len(args) < 3 {
+		ts.t.Fatalf("script:%d: usage: chmod perm file...", ts.lineno)
+		return
+	}
+	perm, err := strconv.ParseUint(args[1], 8, 32)
+	if err != nil || perm&^0777 != 0 {
+		ts.t.Fatalf("script:%d: chmod: invalid mode %q: want octal permissions such as 0755", ts.lineno, args[1])
+		return
+	}
+	files, err := ts.globFiles(args[2:])
+	if err != nil {
+		ts.t.Fatalf("script:%d: chmod: %v", ts.lineno, err)
+		return
+	}
+	for _, file := range files {
+		if err := os.Chmod(file, os.FileMode(perm)); err != nil {
+			ts.t.Fatalf("script:%d: chmod: %v", ts.lineno, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package tsar
+
+import (
+	"net"
+	"net/http"
+	"os"
+)
+
+// cmdFileserver serves a directory of the work directory over HTTP on a
+// free port until the script ends, and sets a variable to its URL.
+func (ts *TestScript) cmdFileserver(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: fileserver does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 4 || args[1] != "start" || !isVarName(args[3]) {
+		ts.t.Fatalf("script:%d: usage: fileserver start dir VAR_URL", ts.lineno)
+		return
+	}
+	dir := ts.mkabs(args[2])
+	if info, err := os.Stat(dir); err != nil {
+		ts.t.Fatalf("script:%d: fileserver: %v", ts.lineno, err)
+		return
+	} else if !info.IsDir() {
+		ts.t.Fatalf("script:%d: fileserver: %s is not a directory", ts.lineno, args[2])
+		return
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ts.t.Fatalf("script:%d: fileserver: %v", ts.lineno, err)
+		return
+	}
+	srv := &http.Server{Handler: http.FileServer(http.Dir(dir))}
+	go srv.Serve(ln)
+	ts.Defer(func() { srv.Close() })
+	ts.Setenv(args[3], "http://"+ln.Addr().String())
+}
@@ -0,0 +1,140 @@
+package tsar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// frontmatterPrefix marks a directive comment in a script's frontmatter.
+const frontmatterPrefix = "# tsar:"
+
+// frontmatter holds the directives declared by "# tsar:" comment lines at the
+// top of a script, before its first command.
+type frontmatter struct {
+	timeout  time.Duration // bound on the whole script; 0 means none
+	tags     []string      // free-form labels matched against Params.Tags
+	skipOn   []string      // conditions; the script is skipped if any holds
+	requires []string      // programs that must be on PATH; see missingTools
+
+	saveOutput  bool // write each exec's output to $WORK/.tsar/out
+	expandFiles bool // expand ${VAR} in archive files when extracting them
+	sandbox     bool // run programs in new namespaces; see Params.Sandbox
+	captureHTTP bool // record programs' HTTP requests; see Params.CaptureHTTP
+
+	explicitExec *bool // overrides Params.RequireExplicitExec, if set
+	uniqueNames  *bool // overrides Params.RequireUniqueNames, if set
+}
+
+// parseFrontmatter parses the leading comment block of a script. Only blank
+// lines and comments may precede the directives; parsing stops at the first
+// command line. Directives take the form "# tsar:key=value" or
+// "# tsar:key value...".
+func parseFrontmatter(script string) (*frontmatter, error) {
+	fm := &frontmatter{}
+	lineno := 0
+	for script != "" {
+		var line string
+		line, script = getLine(script)
+		lineno++
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line[0] != '#' {
+			break
+		}
+		if !strings.HasPrefix(line, frontmatterPrefix) {
+			continue
+		}
+
+		directive := strings.TrimSpace(strings.TrimPrefix(line, frontmatterPrefix))
+		key, value, ok := strings.Cut(directive, "=")
+		if !ok {
+			key, value, _ = strings.Cut(directive, " ")
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := fm.set(key, value); err != nil {
+			return nil, fmt.Errorf("script:%d: tsar:%s: %w", lineno, key, err)
+		}
+	}
+	return fm, nil
+}
+
+// set applies a single directive.
+func (fm *frontmatter) set(key, value string) error {
+	switch key {
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		fm.timeout = d
+	case "tags":
+		fm.tags = append(fm.tags, splitList(value)...)
+	case "skip-on":
+		fm.skipOn = append(fm.skipOn, splitList(value)...)
+	case "requires":
+		fm.requires = append(fm.requires, splitList(value)...)
+	case "save-output":
+		on, err := parseFlag(value)
+		if err != nil {
+			return err
+		}
+		fm.saveOutput = on
+	case "expand-files":
+		on, err := parseFlag(value)
+		if err != nil {
+			return err
+		}
+		fm.expandFiles = on
+	case "sandbox":
+		on, err := parseFlag(value)
+		if err != nil {
+			return err
+		}
+		fm.sandbox = on
+	case "capture-http":
+		on, err := parseFlag(value)
+		if err != nil {
+			return err
+		}
+		fm.captureHTTP = on
+	case "explicit-exec":
+		on, err := parseFlag(value)
+		if err != nil {
+			return err
+		}
+		fm.explicitExec = &on
+	case "unique-names":
+		on, err := parseFlag(value)
+		if err != nil {
+			return err
+		}
+		fm.uniqueNames = &on
+	default:
+		return fmt.Errorf("unknown directive")
+	}
+	return nil
+}
+
+// parseFlag parses the value of a boolean directive; a bare directive means
+// true.
+func parseFlag(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean %q", value)
+	}
+	return on, nil
+}
+
+// splitList splits a comma- or space-separated list, dropping empty items.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
@@ -0,0 +1,172 @@
+package tsar
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFrontmatter(t *testing.T) {
+	script := strings.Join([]string{
+		"# A description comment is allowed before directives.",
+		"",
+		"# tsar:timeout=90s",
+		"# tsar:tags=slow,net",
+		"# tsar:tags docker",
+		"# tsar:skip-on=windows",
+		"# tsar:requires git, jq",
+		"# tsar:save-output",
+		"# tsar:explicit-exec=false",
+		"# tsar:unique-names",
+		"# tsar:expand-files",
+		"# tsar:sandbox",
+		"exec true",
+		"# tsar:timeout=1s",
+	}, "\n")
+
+	fm, err := parseFrontmatter(script)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fm.timeout != 90*time.Second {
+		t.Errorf("timeout = %v, want 90s (directives after the first command are ignored)", fm.timeout)
+	}
+	if want := []string{"slow", "net", "docker"}; !slices.Equal(fm.tags, want) {
+		t.Errorf("tags = %v, want %v", fm.tags, want)
+	}
+	if want := []string{"windows"}; !slices.Equal(fm.skipOn, want) {
+		t.Errorf("skipOn = %v, want %v", fm.skipOn, want)
+	}
+	if want := []string{"git", "jq"}; !slices.Equal(fm.requires, want) {
+		t.Errorf("requires = %v, want %v", fm.requires, want)
+	}
+	if !fm.saveOutput {
+		t.Error("saveOutput = false, want true for a bare directive")
+	}
+	if fm.explicitExec == nil || *fm.explicitExec {
+		t.Errorf("explicitExec = %v, want false", fm.explicitExec)
+	}
+	if fm.uniqueNames == nil || !*fm.uniqueNames {
+		t.Errorf("uniqueNames = %v, want true", fm.uniqueNames)
+	}
+	if !fm.expandFiles {
+		t.Error("expandFiles = false, want true")
+	}
+	if !fm.sandbox {
+		t.Error("sandbox = false, want true")
+	}
+}
+
+func TestParseFrontmatterErrors(t *testing.T) {
+	for _, script := range []string{
+		"# tsar:unknown=1\n",
+		"# tsar:timeout=soon\n",
+		"# tsar:timeout=-1s\n",
+		"# tsar:save-output=maybe\n",
+		"# tsar:explicit-exec=strict\n",
+	} {
+		if _, err := parseFrontmatter(script); err == nil {
+			t.Errorf("parseFrontmatter(%q): expected error", script)
+		}
+	}
+}
+
+func TestFrontmatter(t *testing.T) {
+	Run(t, Params{Dir: "testdata/frontmatter"})
+}
+
+func TestFrontmatterTimeout(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test_slow.tsar")
+	writeFile(t, file, []byte("# tsar:timeout=200ms\nexec sleep 10\n"), 0644)
+
+	start := time.Now()
+	runner := &testResultCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir}, file)
+	if !runner.Failed() {
+		t.Fatal("expected failure when the script exceeds its timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("script ran for %v, want it to be stopped near its 200ms timeout", elapsed)
+	}
+}
+
+func TestFrontmatterTags(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test_tagged.tsar")
+	writeFile(t, file, []byte("# tsar:tags=slow\nexec false\n"), 0644)
+
+	// A script without a matching tag is skipped rather than run.
+	runner := &testResultCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir, Tags: []string{"fast"}}, file)
+	if runner.Failed() {
+		t.Fatal("expected script without a matching tag to be skipped")
+	}
+
+	runner = &testResultCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir, Tags: []string{"slow"}}, file)
+	if !runner.Failed() {
+		t.Fatal("expected script with a matching tag to run")
+	}
+}
+
+func TestFrontmatterRequires(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test_requires.tsar")
+	writeFile(t, file, []byte("# tsar:requires=sh,tsar-missing-a tsar-missing-b\nexec false\n"), 0644)
+
+	// Missing programs skip the script, listing all of them.
+	runner := &logRecorder{}
+	RunFilesStandalone(runner, Params{Dir: dir}, file)
+	if runner.failed {
+		t.Fatal("expected script with missing required programs to be skipped")
+	}
+	logs := strings.Join(runner.logs, "\n")
+	if want := "missing required program(s) on PATH: tsar-missing-a, tsar-missing-b"; !strings.Contains(logs, want) {
+		t.Errorf("logs missing %q:\n%s", want, logs)
+	}
+
+	capture := &logCapture{}
+	RunFilesStandalone(capture, Params{Dir: dir, FailOnMissingRequires: true}, file)
+	if len(capture.fatals) != 1 || !strings.HasPrefix(capture.fatals[0], "tsar:requires: missing required program(s) on PATH: tsar-missing-a, tsar-missing-b") {
+		t.Errorf("fatals = %q, want missing requires failure", capture.fatals)
+	}
+}
+
+func TestFrontmatterUniqueNames(t *testing.T) {
+	dir := t.TempDir()
+	mkdirAll(t, filepath.Join(dir, "a"))
+	mkdirAll(t, filepath.Join(dir, "b"))
+	relaxed := filepath.Join(dir, "a", "test_dup.tsar")
+	plain := filepath.Join(dir, "b", "test_dup.tsar")
+	writeFile(t, relaxed, []byte("# tsar:unique-names=false\nexec true\n"), 0644)
+	writeFile(t, plain, []byte("exec true\n"), 0644)
+
+	// A name is shared only when no script requires it unique.
+	runner := &logCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir}, relaxed, plain)
+	if runner.failed {
+		t.Fatalf("without RequireUniqueNames: fatals = %q", runner.fatals)
+	}
+	runner = &logCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir, RequireUniqueNames: true}, relaxed, plain)
+	if want := `duplicate test name "test_dup"`; len(runner.fatals) == 0 || runner.fatals[0] != want {
+		t.Errorf("with RequireUniqueNames: fatals = %q, want %q first", runner.fatals, want)
+	}
+
+	writeFile(t, plain, []byte("# tsar:unique-names=false\nexec true\n"), 0644)
+	runner = &logCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir, RequireUniqueNames: true}, relaxed, plain)
+	if runner.failed {
+		t.Fatalf("both opted out: fatals = %q", runner.fatals)
+	}
+
+	writeFile(t, plain, []byte("# tsar:unique-names\nexec true\n"), 0644)
+	runner = &logCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir}, relaxed, plain)
+	if want := `duplicate test name "test_dup"`; len(runner.fatals) == 0 || runner.fatals[0] != want {
+		t.Errorf("one opted in: fatals = %q, want %q first", runner.fatals, want)
+	}
+}
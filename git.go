@@ -0,0 +1,144 @@
+package tsar
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitEnv fixes the identity and dates of the commits tsar makes, and keeps
+// the user's configuration out, so that their hashes are the same on every
+// run and machine.
+var gitEnv = []string{
+	"GIT_AUTHOR_NAME=tsar",
+	"GIT_AUTHOR_EMAIL=tsar@example.com",
+	"GIT_AUTHOR_DATE=2000-01-01T00:00:00Z",
+	"GIT_COMMITTER_NAME=tsar",
+	"GIT_COMMITTER_EMAIL=tsar@example.com",
+	"GIT_COMMITTER_DATE=2000-01-01T00:00:00Z",
+	"GIT_CONFIG_NOSYSTEM=1",
+	"GIT_CONFIG_GLOBAL=" + os.DevNull,
+}
+
+// git runs git, found in the script's PATH, in dir with the script's
+// environment and gitEnv, and returns its stdout.
+func (ts *TestScript) git(dir string, args ...string) (string, error) {
+	gitPath, err := ts.lookPath("git")
+	if err != nil {
+		return "", fmt.Errorf("git: %v", err)
+	}
+	cmd := exec.CommandContext(ts.ctx, gitPath, append([]string{"-c", "init.defaultBranch=main", "-c", "commit.gpgSign=false"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(append([]string(nil), ts.env...), gitEnv...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v\n%s%s", strings.Join(args, " "), err, out, stderr.Bytes())
+	}
+	return string(out), nil
+}
+
+// isGitRepo reports whether dir is a git repository, bare or not.
+func isGitRepo(dir string) bool {
+	for _, name := range []string{".git", "HEAD"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// gitCommit commits all the changes of the repository dir, and returns the
+// hash of the commit.
+func (ts *TestScript) gitCommit(dir, message string) (string, error) {
+	if _, err := ts.git(dir, "add", "-A"); err != nil {
+		return "", err
+	}
+	if _, err := ts.git(dir, "commit", "-q", "--allow-empty", "-m", message); err != nil {
+		return "", err
+	}
+	return ts.git(dir, "rev-parse", "HEAD")
+}
+
+// gitInit makes dir a git repository with its files committed on branch
+// main, and returns the hash of the commit.
+func (ts *TestScript) gitInit(dir, message string) (string, error) {
+	if _, err := ts.git(dir, "init", "-q"); err != nil {
+		return "", err
+	}
+	return ts.gitCommit(dir, message)
+}
+
+// initFixtureRepo makes dir a git repository like gitinit, unless it is
+// one already.
+func (ts *TestScript) initFixtureRepo(dir string) error {
+	if isGitRepo(dir) {
+		return nil
+	}
+	_, err := ts.gitInit(dir, "initial commit")
+	return err
+}
+
+// cmdGitinit makes a directory of the work directory a git repository,
+// committing its files with a fixed author and date so that the hash of
+// the commit, saved as stdout, is the same on every run.
+func (ts *TestScript) cmdGitinit(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: gitinit does not support negation", ts.lineno)
+		return
+	}
+	if len(args) < 2 || len(args) > 3 {
+		ts.t.Fatalf("script:%d: usage: gitinit dir [message]", ts.lineno)
+		return
+	}
+	message := "initial commit"
+	if len(args) == 3 {
+		message = args[2]
+	}
+	dir := ts.mkabs(args[1])
+	if info, err := os.Stat(dir); err != nil {
+		ts.t.Fatalf("script:%d: gitinit: %v", ts.lineno, err)
+		return
+	} else if !info.IsDir() {
+		ts.t.Fatalf("script:%d: gitinit: %s is not a directory", ts.lineno, args[1])
+		return
+	}
+	if isGitRepo(dir) {
+		ts.t.Fatalf("script:%d: gitinit: %s is already a git repository; commit to it with gitcommit", ts.lineno, args[1])
+		return
+	}
+	hash, err := ts.gitInit(dir, message)
+	if err != nil {
+		ts.t.Fatalf("script:%d: gitinit: %v", ts.lineno, err)
+		return
+	}
+	ts.stdout, ts.stderr = hash, ""
+}
+
+// cmdGitcommit commits all the changes of a git repository of the work
+// directory, like gitinit, saving the hash of the commit as stdout.
+func (ts *TestScript) cmdGitcommit(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: gitcommit does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 3 {
+		ts.t.Fatalf("script:%d: usage: gitcommit dir message", ts.lineno)
+		return
+	}
+	dir := ts.mkabs(args[1])
+	if !isGitRepo(dir) {
+		ts.t.Fatalf("script:%d: gitcommit: %s is not a git repository; create it with gitinit", ts.lineno, args[1])
+		return
+	}
+	hash, err := ts.gitCommit(dir, args[2])
+	if err != nil {
+		ts.t.Fatalf("script:%d: gitcommit: %v", ts.lineno, err)
+		return
+	}
+	ts.stdout, ts.stderr = hash, ""
+}
@@ -0,0 +1,72 @@
+package tsar
+
+import (
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"path/filepath"
+)
+
+// cmdGitserver serves the repositories of a directory of the work
+// directory over git's smart HTTP protocol until the script ends, and sets
+// a variable to its URL: repository dir/name is cloned from $VAR/name.
+// Subdirectories that are not repositories yet become ones, with their
+// files committed.
+func (ts *TestScript) cmdGitserver(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: gitserver does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 4 || args[1] != "start" || !isVarName(args[3]) {
+		ts.t.Fatalf("script:%d: usage: gitserver start dir VAR_URL", ts.lineno)
+		return
+	}
+	gitPath, err := ts.lookPath("git")
+	if err != nil {
+		ts.t.Fatalf("script:%d: gitserver: %v", ts.lineno, err)
+		return
+	}
+	dir := ts.mkabs(args[2])
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		ts.t.Fatalf("script:%d: gitserver: %v", ts.lineno, err)
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := ts.initFixtureRepo(filepath.Join(dir, e.Name())); err != nil {
+			ts.t.Fatalf("script:%d: gitserver: %s: %v", ts.lineno, e.Name(), err)
+			return
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ts.t.Fatalf("script:%d: gitserver: %v", ts.lineno, err)
+		return
+	}
+	// Pushes are accepted too, updating the work tree of non-bare
+	// repositories so that scripts can check what was pushed. The hooks
+	// and helpers git runs are found in the script's PATH.
+	handler := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Dir:  dir,
+		Env: append([]string{
+			"PATH=" + ts.envMap["PATH"],
+			"GIT_PROJECT_ROOT=" + dir,
+			"GIT_HTTP_EXPORT_ALL=1",
+			"GIT_CONFIG_COUNT=2",
+			"GIT_CONFIG_KEY_0=http.receivepack",
+			"GIT_CONFIG_VALUE_0=true",
+			"GIT_CONFIG_KEY_1=receive.denyCurrentBranch",
+			"GIT_CONFIG_VALUE_1=updateInstead",
+		}, gitEnv...),
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	ts.Defer(func() { srv.Close() })
+	ts.Setenv(args[3], "http://"+ln.Addr().String())
+}
@@ -0,0 +1,30 @@
+package tsar
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// goCacheEnv returns the Go environment of scripts with
+// Params.SharedGoCache: GOCACHE and GOMODCACHE in a directory shared by all
+// scripts and runs, and GOPATH in the work directory.
+func (ts *TestScript) goCacheEnv() ([]string, error) {
+	if !ts.params.SharedGoCache {
+		return nil, nil
+	}
+	root := filepath.Join(os.TempDir(), "tsar-go")
+	if dir, err := os.UserCacheDir(); err == nil {
+		root = filepath.Join(dir, "tsar", "go")
+	}
+	build, mod := filepath.Join(root, "build"), filepath.Join(root, "mod")
+	for _, dir := range []string{build, mod} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	}
+	return []string{
+		"GOCACHE=" + build,
+		"GOMODCACHE=" + mod,
+		"GOPATH=" + filepath.Join(ts.workdir, "gopath"),
+	}, nil
+}
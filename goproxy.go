@@ -0,0 +1,259 @@
+package tsar
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/txtar"
+)
+
+// proxyModTime is the time reported for module versions whose fixture has
+// no .info file.
+const proxyModTime = "2000-01-01T00:00:00Z"
+
+// A goProxy serves module fixtures as a Go module proxy, for tools that
+// resolve modules to run without the network.
+type goProxy struct {
+	srv     *http.Server
+	url     string
+	modules map[string][]*proxyModule // by path, in semver order
+}
+
+// A proxyModule is a version of a module served by a goProxy. Its files are
+// those of the module, plus .mod, its go.mod file for the proxy, and
+// optionally .info, its version info.
+type proxyModule struct {
+	path, version string
+	files         []txtar.File
+}
+
+// loadProxyModules reads the module fixtures of dir. Each one is named
+// after the escaped module path, with slashes replaced by underscores, and
+// the version: example.com_!hello_v1.0.0 holds version v1.0.0 of
+// example.com/Hello. It is either a txtar archive, with a .txt or .txtar
+// extension, or a directory.
+func loadProxyModules(dir string) (map[string][]*proxyModule, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	modules := make(map[string][]*proxyModule)
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() {
+			name = strings.TrimSuffix(strings.TrimSuffix(name, ".txtar"), ".txt")
+			if name == e.Name() {
+				continue
+			}
+		}
+		i := strings.LastIndex(name, "_v")
+		if i < 0 {
+			return nil, fmt.Errorf("module fixture %s: want name <path>_<version>", e.Name())
+		}
+		modPath, err := module.UnescapePath(strings.ReplaceAll(name[:i], "_", "/"))
+		if err == nil {
+			var version string
+			if version, err = module.UnescapeVersion(name[i+1:]); err == nil {
+				err = module.Check(modPath, version)
+			}
+			if err == nil {
+				m := &proxyModule{path: modPath, version: version}
+				m.files, err = readFixtureFiles(filepath.Join(dir, e.Name()), e.IsDir())
+				modules[modPath] = append(modules[modPath], m)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("module fixture %s: %v", e.Name(), err)
+		}
+	}
+	for _, versions := range modules {
+		slices.SortFunc(versions, func(a, b *proxyModule) int { return semver.Compare(a.version, b.version) })
+	}
+	return modules, nil
+}
+
+// readFixtureFiles returns the files of a module fixture, a txtar archive
+// or a directory.
+func readFixtureFiles(name string, isDir bool) ([]txtar.File, error) {
+	if !isDir {
+		ar, err := txtar.ParseFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return ar.Files, nil
+	}
+	var files []txtar.File
+	err := filepath.WalkDir(name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(name, path)
+		files = append(files, txtar.File{Name: filepath.ToSlash(rel), Data: data})
+		return nil
+	})
+	return files, err
+}
+
+// startGoProxy starts a module proxy for the fixtures of dir on a loopback
+// port.
+func startGoProxy(dir string) (*goProxy, error) {
+	modules, err := loadProxyModules(dir)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &goProxy{modules: modules, url: "http://" + ln.Addr().String()}
+	p.srv = &http.Server{Handler: http.HandlerFunc(p.serveHTTP)}
+	go p.srv.Serve(ln)
+	return p, nil
+}
+
+// env returns the environment entries resolving modules through p, without
+// checking the fixtures against the checksum database.
+func (p *goProxy) env() []string {
+	return []string{"GOPROXY=" + p.url, "GONOSUMDB=*"}
+}
+
+// serveHTTP implements the GOPROXY protocol: $module/@v/list,
+// $module/@v/$version.info, .mod and .zip, and $module/@latest.
+func (p *goProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	escPath, query, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/@")
+	modPath, err := module.UnescapePath(escPath)
+	versions := p.modules[modPath]
+	if !ok || err != nil || len(versions) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if query == "v/list" {
+		for _, m := range versions {
+			if semver.Prerelease(m.version) == "" {
+				fmt.Fprintln(w, m.version)
+			}
+		}
+		return
+	}
+	var m *proxyModule
+	var ext string
+	if query == "latest" {
+		m, ext = versions[len(versions)-1], ".info"
+	} else {
+		escVersion, ok := strings.CutPrefix(query, "v/")
+		ext = path.Ext(escVersion)
+		version, err := module.UnescapeVersion(strings.TrimSuffix(escVersion, ext))
+		if !ok || err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		for _, v := range versions {
+			if v.version == version {
+				m = v
+			}
+		}
+	}
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch ext {
+	case ".info":
+		data := m.file(".info")
+		if data == nil {
+			data, _ = json.Marshal(struct{ Version, Time string }{m.version, proxyModTime})
+		}
+		w.Write(data)
+	case ".mod":
+		data := m.file(".mod")
+		if data == nil {
+			data = m.file("go.mod")
+		}
+		if data == nil {
+			data = []byte("module " + m.path + "\n")
+		}
+		w.Write(data)
+	case ".zip":
+		data, err := m.zip()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// file returns the data of the named fixture file, or nil.
+func (m *proxyModule) file(name string) []byte {
+	for _, f := range m.files {
+		if f.Name == name {
+			return f.Data
+		}
+	}
+	return nil
+}
+
+// zip returns the module zip of m: its files but .mod and .info, under the
+// module@version/ prefix.
+func (m *proxyModule) zip() ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range m.files {
+		if f.Name == ".mod" || f.Name == ".info" {
+			continue
+		}
+		w, err := zw.Create(m.path + "@" + m.version + "/" + f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cmdGoproxy serves module fixtures of the work directory as a Go module
+// proxy until the script ends, pointing GOPROXY at it.
+func (ts *TestScript) cmdGoproxy(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: goproxy does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 3 || args[1] != "start" {
+		ts.t.Fatalf("script:%d: usage: goproxy start dir", ts.lineno)
+		return
+	}
+	p, err := startGoProxy(ts.mkabs(args[2]))
+	if err != nil {
+		ts.t.Fatalf("script:%d: goproxy: %v", ts.lineno, err)
+		return
+	}
+	ts.Defer(func() { p.srv.Close() })
+	for _, kv := range p.env() {
+		k, v, _ := strings.Cut(kv, "=")
+		ts.Setenv(k, v)
+	}
+}
@@ -0,0 +1,73 @@
+package tsar
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// HomeMode selects the home directory of scripts; see Params.Home.
+type HomeMode string
+
+const (
+	// HomeNone sets HOME to /no-home, which does not exist, so that
+	// programs cannot read or write the user's files. It is the default.
+	HomeNone HomeMode = ""
+
+	// HomeTemp gives each script an empty, writable home directory,
+	// $WORK/home, for programs that must write configuration or caches.
+	// XDG_CONFIG_HOME, XDG_CACHE_HOME and XDG_DATA_HOME are set to its
+	// .config, .cache and .local/share directories, which are created.
+	HomeTemp HomeMode = "temp"
+
+	// HomeHost keeps the home directory of the user running tsar.
+	HomeHost HomeMode = "host"
+)
+
+// ParseHomeMode parses the name of a HomeMode; "none" and the empty string
+// both mean HomeNone.
+func ParseHomeMode(s string) (HomeMode, error) {
+	switch m := HomeMode(s); m {
+	case "none", HomeNone:
+		return HomeNone, nil
+	case HomeTemp, HomeHost:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown home mode %q (want none, temp or host)", s)
+}
+
+// xdgDirs maps the XDG base directory variables set with HomeTemp to their
+// directories under the home directory, as they default to.
+var xdgDirs = []struct{ name, dir string }{
+	{"XDG_CONFIG_HOME", ".config"},
+	{"XDG_CACHE_HOME", ".cache"},
+	{"XDG_DATA_HOME", filepath.Join(".local", "share")},
+}
+
+// homeEnv returns the environment entries of the script's home directory
+// per Params.Home, creating it for HomeTemp along with its XDG base
+// directories.
+func (ts *TestScript) homeEnv() ([]string, error) {
+	switch ts.params.Home {
+	case HomeTemp:
+		home := filepath.Join(ts.workdir, "home")
+		env := []string{homeEnvName() + "=" + home}
+		for _, x := range xdgDirs {
+			dir := filepath.Join(home, x.dir)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+			env = append(env, x.name+"="+dir)
+		}
+		return env, nil
+	case HomeHost:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		return []string{homeEnvName() + "=" + home}, nil
+	case HomeNone:
+		return []string{homeEnvName() + "=/no-home"}, nil
+	}
+	return nil, fmt.Errorf("unknown home mode %q", ts.params.Home)
+}
@@ -0,0 +1,103 @@
+package tsar
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// hostAliases maps host names to the addresses a script's connections to
+// them go to; see Params.HostAliases and the dns command. It is shared with
+// the goroutines of the alias proxy.
+type hostAliases struct {
+	mu sync.Mutex
+	m  map[string]string // lower-cased host → host or host:port
+}
+
+// reset replaces the aliases with those of m.
+func (a *hostAliases) reset(m map[string]string) error {
+	a.mu.Lock()
+	a.m = nil
+	a.mu.Unlock()
+	for host, target := range m {
+		if err := a.set(host, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set makes host resolve to target: an address, with or without a port, or
+// a URL such as a test server's.
+func (a *hostAliases) set(host, target string) error {
+	if host == "" || strings.ContainsAny(host, ":/") {
+		return fmt.Errorf("invalid host name %q", host)
+	}
+	addr := target
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%s: invalid address %q", host, target)
+		}
+		addr = u.Host
+	}
+	if addr == "" || strings.ContainsAny(addr, "/ ") {
+		return fmt.Errorf("%s: invalid address %q", host, target)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.m == nil {
+		a.m = make(map[string]string)
+	}
+	a.m[strings.ToLower(host)] = addr
+	return nil
+}
+
+// empty reports whether no alias is set.
+func (a *hostAliases) empty() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.m) == 0
+}
+
+// resolve returns the address to dial for addr, a "host:port" pair. An
+// alias without a port keeps the port of addr.
+func (a *hostAliases) resolve(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	a.mu.Lock()
+	target, ok := a.m[strings.ToLower(host)]
+	a.mu.Unlock()
+	if !ok {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(strings.Trim(target, "[]"), port)
+}
+
+// dialContext dials addr, or the address its host is aliased to.
+func (a *hostAliases) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, a.resolve(addr))
+}
+
+func (ts *TestScript) cmdDNS(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: dns does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 3 {
+		ts.t.Fatalf("script:%d: usage: dns host address", ts.lineno)
+		return
+	}
+	if err := ts.aliases.set(args[1], args[2]); err != nil {
+		ts.t.Fatalf("script:%d: dns: %v", ts.lineno, err)
+	}
+}
@@ -0,0 +1,244 @@
+package tsar
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// httpCassetteFile is the archive file holding a script's recorded HTTP
+// interactions; see httpmode.
+const httpCassetteFile = ".tsar/http.cassette"
+
+// httpCassette is the transport of the http commands while httpmode records
+// or replays: it forwards requests to base and records the responses, or
+// serves them from the interactions recorded before.
+type httpCassette struct {
+	base   http.RoundTripper
+	replay bool
+
+	mu           sync.Mutex
+	interactions []httpInteraction
+	used         []bool // replayed interactions
+}
+
+// httpInteraction is one recorded request and its response, a line of the
+// cassette.
+type httpInteraction struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Body       string      `json:"body,omitempty"` // sha256 of the request body, if any
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Response   string      `json:"response,omitempty"`
+	Response64 string      `json:"response_base64,omitempty"` // for binary responses
+}
+
+func (c *httpCassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	digest := ""
+	if req.Body != nil && req.Body != http.NoBody {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			sum := sha256.Sum256(data)
+			digest = hex.EncodeToString(sum[:])
+		}
+		req.Body = io.NopCloser(bytes.NewReader(data))
+	}
+	if c.replay {
+		return c.serve(req, digest)
+	}
+
+	resp, err := c.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	in := httpInteraction{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Body:   digest,
+		Status: resp.StatusCode,
+		Header: resp.Header.Clone(),
+	}
+	in.Header.Del("Date")
+	if isBinary(string(body)) {
+		in.Response64 = base64.StdEncoding.EncodeToString(body)
+	} else {
+		in.Response = string(body)
+	}
+	c.mu.Lock()
+	c.interactions = append(c.interactions, in)
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// serve returns the first response not yet replayed recorded for the same
+// method, URL and request body.
+func (c *httpCassette) serve(req *http.Request, digest string) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	url := req.URL.String()
+	for i, in := range c.interactions {
+		if c.used[i] || in.Method != req.Method || in.URL != url || in.Body != digest {
+			continue
+		}
+		c.used[i] = true
+		body := []byte(in.Response)
+		if in.Response64 != "" {
+			var err error
+			if body, err = base64.StdEncoding.DecodeString(in.Response64); err != nil {
+				return nil, fmt.Errorf("%s: invalid response_base64: %v", httpCassetteFile, err)
+			}
+		}
+		header := in.Header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+			StatusCode:    in.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded response in %s; re-record with httpmode record", httpCassetteFile)
+}
+
+// CloseIdleConnections closes the idle connections of the transport it wraps.
+func (c *httpCassette) CloseIdleConnections() {
+	if t, ok := c.base.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// encode renders the recorded interactions, one JSON object per line.
+func (c *httpCassette) encode() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	for _, in := range c.interactions {
+		line, err := json.Marshal(in)
+		if err != nil {
+			return "", err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// parseHTTPCassette parses the lines of a cassette written by encode.
+func parseHTTPCassette(data []byte) ([]httpInteraction, error) {
+	var interactions []httpInteraction
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, len(data)+1)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var in httpInteraction
+		if err := json.Unmarshal([]byte(line), &in); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", httpCassetteFile, n, err)
+		}
+		interactions = append(interactions, in)
+	}
+	return interactions, sc.Err()
+}
+
+func (ts *TestScript) cmdHTTPMode(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: httpmode does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: httpmode live|record|replay", ts.lineno)
+		return
+	}
+	base := ts.httpClient.Transport
+	if c, ok := base.(*httpCassette); ok {
+		base = c.base
+	}
+	switch args[1] {
+	case "live":
+		ts.httpClient.Transport = base
+		ts.httpTape = nil
+	case "record":
+		if ts.params.Parser != nil && ts.params.Parser.Match(ts.file) {
+			ts.t.Fatalf("script:%d: httpmode: cannot record into %s: not a txtar script", ts.lineno, ts.file)
+			return
+		}
+		ts.httpTape = &httpCassette{base: base}
+		ts.httpClient.Transport = ts.httpTape
+	case "replay":
+		data, ok := ts.archiveData(httpCassetteFile)
+		if !ok {
+			ts.t.Fatalf("script:%d: httpmode: no %s in the script; record one with httpmode record", ts.lineno, httpCassetteFile)
+			return
+		}
+		interactions, err := parseHTTPCassette(data)
+		if err != nil {
+			ts.t.Fatalf("script:%d: httpmode: %v", ts.lineno, err)
+			return
+		}
+		ts.httpTape = &httpCassette{base: base, replay: true, interactions: interactions, used: make([]bool, len(interactions))}
+		ts.httpClient.Transport = ts.httpTape
+	default:
+		ts.t.Fatalf("script:%d: httpmode: unknown mode %q (want live, record or replay)", ts.lineno, args[1])
+	}
+}
+
+// archiveData returns the decoded content of the named file of the script's
+// archive, as written in the script.
+func (ts *TestScript) archiveData(name string) ([]byte, bool) {
+	if ts.archive == nil {
+		return nil, false
+	}
+	for _, f := range ts.archive.Files {
+		h, data, err := archiveFile(f)
+		if err == nil && h.Name == name {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// saveHTTPCassette schedules the interactions recorded by httpmode record to
+// be written into the script's archive by writeUpdates.
+func (ts *TestScript) saveHTTPCassette() error {
+	if ts.httpTape == nil || ts.httpTape.replay {
+		return nil
+	}
+	content, err := ts.httpTape.encode()
+	if err != nil {
+		return err
+	}
+	if ts.updates == nil {
+		ts.updates = make(map[string]string)
+	}
+	ts.updates[httpCassetteFile] = content
+	return nil
+}
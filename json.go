@@ -0,0 +1,195 @@
+package tsar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A dataPath is a parsed jq-style path, such as .items[0].name: a list of
+// object keys (string) and array indexes (int).
+type dataPath []any
+
+// parseDataPath parses a path made of .key, ["key"] and [index] steps; "."
+// alone is the whole document. Negative indexes count from the end.
+func parseDataPath(s string) (dataPath, error) {
+	if s == "." {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, ".") && !strings.HasPrefix(s, "[") {
+		return nil, fmt.Errorf("invalid path %q: want a path starting with . such as .items[0].name", s)
+	}
+	var path dataPath
+	for rest := s; rest != ""; {
+		switch {
+		case strings.HasPrefix(rest, ".["):
+			rest = rest[1:] // as in jq, .[0] is [0]
+		case strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest, `"]`)
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated [\"key\"]", s)
+			}
+			path, rest = append(path, rest[2:end]), rest[end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated [index]", s)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: invalid index %q", s, rest[1:end])
+			}
+			path, rest = append(path, n), rest[end+1:]
+		case strings.HasPrefix(rest, "."):
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("invalid path %q: empty key", s)
+			}
+			path, rest = append(path, key), rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path %q at %q", s, rest)
+		}
+	}
+	return path, nil
+}
+
+// lookup returns the value at p in v, a decoded document, and whether there
+// is one.
+func (p dataPath) lookup(v any) (any, bool) {
+	for _, step := range p {
+		switch step := step.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[step]; !ok {
+				return nil, false
+			}
+		case int:
+			a, ok := v.([]any)
+			if !ok {
+				return nil, false
+			}
+			if step < 0 {
+				step += len(a)
+			}
+			if step < 0 || step >= len(a) {
+				return nil, false
+			}
+			v = a[step]
+		}
+	}
+	return v, true
+}
+
+// renderValue formats a value as a command argument: strings as they are,
+// like jq -r, and anything else as compact JSON.
+func renderValue(v any) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // keep numbers as written
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("more than one JSON value")
+	}
+	return v, nil
+}
+
+func (ts *TestScript) cmdJSON(neg bool, args []string) {
+	ts.queryData(neg, args, decodeJSON)
+}
+
+// queryData runs a json-like command: it decodes a file, or the last
+// command's stdout, with decode and extracts the value at a path into a
+// variable, compares it with a value, or checks that it exists.
+func (ts *TestScript) queryData(neg bool, args []string, decode func([]byte) (any, error)) {
+	name := args[0]
+	usage := fmt.Sprintf("usage: %s [-o var] path [file] [==|!=|<|<=|>|>= value]", name)
+	args = args[1:]
+	output := ""
+	if len(args) > 0 && args[0] == "-o" {
+		if len(args) < 2 || !isVarName(args[1]) {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		output, args = args[1], args[2:]
+	}
+	var op, want string
+	// Empty values are dropped when the line is split, as for assert.
+	switch n := len(args); {
+	case n >= 3 && isAssertOp(args[n-2]):
+		op, want, args = args[n-2], args[n-1], args[:n-2]
+	case n >= 2 && isAssertOp(args[n-1]):
+		op, args = args[n-1], args[:n-1]
+	}
+	if len(args) < 1 || len(args) > 2 || output != "" && (neg || op != "") {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	path, err := parseDataPath(args[0])
+	if err != nil {
+		ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+		return
+	}
+	source := "stdout"
+	if len(args) == 2 {
+		source = args[1]
+	}
+	data, err := ts.readCmpFile(source)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+		return
+	}
+	doc, err := decode([]byte(data))
+	if err != nil {
+		ts.t.Fatalf("script:%d: %s: %s: %v", ts.lineno, name, source, err)
+		return
+	}
+
+	v, found := path.lookup(doc)
+	if !found {
+		if !neg || op != "" {
+			ts.t.Fatalf("script:%d: %s: %s: no value at %s", ts.lineno, name, source, args[0])
+		}
+		return
+	}
+	got, err := renderValue(v)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+		return
+	}
+	switch {
+	case output != "":
+		ts.Setenv(output, got)
+	case op != "":
+		if compareValues(got, op, want) == neg {
+			verb := "failed"
+			if neg {
+				verb = "unexpectedly holds"
+			}
+			ts.t.Fatalf("script:%d: %s %s %s %s %s\n%s", ts.lineno, name, args[0], op, strconv.Quote(want), verb, diffValues(got, want))
+		}
+	case neg:
+		ts.t.Fatalf("script:%d: %s: %s: unexpected value at %s: %s", ts.lineno, name, source, args[0], got)
+	}
+}
@@ -0,0 +1,104 @@
+package tsar
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leakSettle is how long the leak check waits for goroutines started by a
+// script to finish before counting them as leaked.
+const leakSettle = 200 * time.Millisecond
+
+// leakSnapshot records process resources that scripts may leak; see
+// Params.CheckLeaks.
+type leakSnapshot struct {
+	fds        map[string]string // open file descriptor → what it refers to
+	temps      map[string]bool   // entries of os.TempDir
+	goroutines int
+}
+
+func takeLeakSnapshot() leakSnapshot {
+	snap := leakSnapshot{
+		fds:        openFDs(),
+		temps:      make(map[string]bool),
+		goroutines: runtime.NumGoroutine(),
+	}
+	if entries, err := os.ReadDir(os.TempDir()); err == nil {
+		for _, e := range entries {
+			snap.temps[e.Name()] = true
+		}
+	}
+	return snap
+}
+
+// openFDs lists the process's open file descriptors, where the platform
+// exposes them. Descriptors that cannot be resolved, such as the one
+// used to list them, are left out.
+func openFDs() map[string]string {
+	dir := "/dev/fd"
+	if runtime.GOOS == "linux" {
+		dir = "/proc/self/fd"
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	fds := make(map[string]string)
+	for _, e := range entries {
+		target, err := os.Readlink(filepath.Join(dir, e.Name()))
+		if err != nil {
+			if runtime.GOOS == "linux" {
+				continue
+			}
+			target = "fd " + e.Name()
+		}
+		if strings.HasPrefix(target, "/proc/"+strconv.Itoa(os.Getpid())+"/fd") {
+			continue
+		}
+		fds[e.Name()] = target
+	}
+	return fds
+}
+
+// checkLeaks compares the resources held now with those held before the
+// script ran, and fails the script if it left any behind.
+func (ts *TestScript) checkLeaks(before leakSnapshot) {
+	ts.httpClient.CloseIdleConnections()
+	ts.closeProxy()
+	deadline := time.Now().Add(leakSettle)
+	for runtime.NumGoroutine() > before.goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	after := takeLeakSnapshot()
+
+	var leaks []string
+	if n := after.goroutines - before.goroutines; n > 0 {
+		leaks = append(leaks, fmt.Sprintf("%d goroutine(s) still running", n))
+	}
+	for fd, target := range after.fds {
+		if before.fds[fd] != target {
+			leaks = append(leaks, fmt.Sprintf("file descriptor %s left open: %s", fd, target))
+		}
+	}
+	for name := range after.temps {
+		path := filepath.Join(os.TempDir(), name)
+		if !before.temps[name] && path != ts.workdir {
+			leaks = append(leaks, fmt.Sprintf("temporary file left behind: %s", path))
+		}
+	}
+	if len(leaks) == 0 {
+		return
+	}
+	slices.Sort(leaks)
+	msg := fmt.Sprintf("leak check: %d leak(s):\n\t%s", len(leaks), strings.Join(leaks, "\n\t"))
+	if len(ts.customRan) > 0 {
+		msg += "\ncustom commands run: " + strings.Join(ts.customRan, ", ")
+	}
+	ts.t.Fatalf("%s", msg)
+}
@@ -0,0 +1,358 @@
+package tsar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An smtpServer is an SMTP sink started by mocksmtp start: it accepts
+// every message, with any credentials, and keeps it for mocksmtp assert.
+type smtpServer struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	msgs  []smtpMessage
+}
+
+// An smtpMessage is a message received by an smtpServer.
+type smtpMessage struct {
+	from    string   // envelope sender
+	to      []string // envelope recipients, including Bcc ones
+	subject string   // decoded Subject header
+	body    string   // text of the body, its text parts if multipart
+}
+
+func (m smtpMessage) String() string {
+	return fmt.Sprintf("from %s to %s: %q", m.from, strings.Join(m.to, ", "), m.subject)
+}
+
+func startSMTP() (*smtpServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &smtpServer{ln: ln, conns: make(map[net.Conn]bool)}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *smtpServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.session(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// session speaks enough SMTP for clients to deliver messages: HELO, EHLO,
+// AUTH PLAIN and LOGIN, MAIL, RCPT, DATA, RSET, NOOP and QUIT.
+func (s *smtpServer) session(conn net.Conn) {
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 tsar mocksmtp ready")
+	var msg *smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			tp.PrintfLine("250 tsar")
+		case "EHLO":
+			tp.PrintfLine("250-tsar\r\n250-8BITMIME\r\n250-SMTPUTF8\r\n250 AUTH PLAIN LOGIN")
+		case "AUTH":
+			mech, initial, _ := strings.Cut(arg, " ")
+			prompts := map[string][]string{"PLAIN": {""}, "LOGIN": {"VXNlcm5hbWU6", "UGFzc3dvcmQ6"}}[strings.ToUpper(mech)]
+			if prompts == nil {
+				tp.PrintfLine("504 unrecognized authentication type")
+				continue
+			}
+			if initial != "" {
+				prompts = prompts[1:]
+			}
+			for _, prompt := range prompts {
+				tp.PrintfLine("334 %s", prompt)
+				if _, err := tp.ReadLine(); err != nil {
+					return
+				}
+			}
+			tp.PrintfLine("235 authentication succeeded")
+		case "MAIL":
+			msg = &smtpMessage{from: smtpPath(arg, "FROM:")}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			if msg == nil {
+				tp.PrintfLine("503 MAIL first")
+				continue
+			}
+			msg.to = append(msg.to, smtpPath(arg, "TO:"))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			if msg == nil || len(msg.to) == 0 {
+				tp.PrintfLine("503 RCPT first")
+				continue
+			}
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.subject, msg.body = parseMessage(data)
+			s.mu.Lock()
+			s.msgs = append(s.msgs, *msg)
+			s.mu.Unlock()
+			msg = nil
+			tp.PrintfLine("250 OK: queued")
+		case "RSET":
+			msg = nil
+			tp.PrintfLine("250 OK")
+		case "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// smtpPath returns the address of a MAIL FROM:<a> or RCPT TO:<a> argument,
+// without its parameters.
+func smtpPath(arg, prefix string) string {
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = arg[len(prefix):]
+	}
+	arg, _, _ = strings.Cut(strings.TrimSpace(arg), " ")
+	return strings.Trim(arg, "<>")
+}
+
+// parseMessage returns the decoded subject and body text of a message, or
+// all of it as the body if it doesn't parse.
+func parseMessage(data []byte) (subject, body string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", string(data)
+	}
+	subject = msg.Header.Get("Subject")
+	if s, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = s
+	}
+	return subject, messageText(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+// messageText returns the text of a message body or part: decoded, and the
+// text parts of a multipart one only, separated by newlines.
+func messageText(h textproto.MIMEHeader, r io.Reader) string {
+	mediaType, params, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var texts []string
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if t := part.Header.Get("Content-Type"); t == "" || strings.HasPrefix(t, "text/") || strings.HasPrefix(t, "multipart/") {
+				texts = append(texts, messageText(part.Header, part))
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	data, _ := io.ReadAll(r)
+	return string(data)
+}
+
+func (s *smtpServer) messages() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.msgs...)
+}
+
+func (s *smtpServer) close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// cmdMockSMTP runs SMTP sinks for programs that send email: mocksmtp start
+// exports the address of a new one, and mocksmtp assert checks the messages
+// it received.
+func (ts *TestScript) cmdMockSMTP(neg bool, args []string) {
+	usage := "usage: mocksmtp start [&name&] | mocksmtp assert [-count N] [-from addr] [-to addr] [-subject pattern] [-body pattern] [&name&] | mocksmtp stop [&name&]"
+	if len(args) < 2 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	sub, args := args[1], args[2:]
+	name, args := cutNameSpecifier(args, "smtp")
+	if neg && sub != "assert" {
+		ts.t.Fatalf("script:%d: mocksmtp %s does not support negation", ts.lineno, sub)
+		return
+	}
+	switch sub {
+	case "start":
+		if len(args) != 0 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		if ts.smtpServers[name] != nil {
+			ts.t.Fatalf("script:%d: mocksmtp start: %q is already running; name another with &name&", ts.lineno, name)
+			return
+		}
+		s, err := startSMTP()
+		if err != nil {
+			ts.t.Fatalf("script:%d: mocksmtp start: %v", ts.lineno, err)
+			return
+		}
+		if ts.smtpServers == nil {
+			ts.smtpServers = make(map[string]*smtpServer)
+		}
+		ts.smtpServers[name] = s
+		host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+		prefix := strings.ToUpper(name)
+		ts.Setenv(prefix+"_ADDR", s.ln.Addr().String())
+		ts.Setenv(prefix+"_HOST", host)
+		ts.Setenv(prefix+"_PORT", port)
+		return
+	case "assert", "stop":
+	default:
+		ts.t.Fatalf("script:%d: mocksmtp: unknown subcommand %q; %s", ts.lineno, sub, usage)
+		return
+	}
+	s := ts.smtpServers[name]
+	if s == nil {
+		ts.t.Fatalf("script:%d: mocksmtp %s: no server %q; start one with mocksmtp start &%s&", ts.lineno, sub, name, name)
+		return
+	}
+	if sub == "stop" {
+		if len(args) != 0 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		s.close()
+		delete(ts.smtpServers, name)
+		return
+	}
+
+	count := -1
+	var from, to string
+	var subject, body *regexp.Regexp
+	for len(args) > 0 {
+		if len(args) < 2 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		flag, value := args[0], args[1]
+		args = args[2:]
+		var err error
+		switch flag {
+		case "-count":
+			count, err = strconv.Atoi(value)
+			if err != nil || count < 0 || neg {
+				ts.t.Fatalf("script:%d: mocksmtp assert: invalid count %q", ts.lineno, value)
+				return
+			}
+		case "-from":
+			from = value
+		case "-to":
+			to = value
+		case "-subject":
+			subject, err = regexp.Compile(value)
+		case "-body":
+			body, err = regexp.Compile(value)
+		default:
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		if err != nil {
+			ts.t.Fatalf("script:%d: mocksmtp assert: invalid pattern %q: %v", ts.lineno, value, err)
+			return
+		}
+	}
+
+	all := s.messages()
+	ts.stdout, ts.stderr = "", ""
+	var lines []string
+	matches := 0
+	for _, m := range all {
+		lines = append(lines, "\t"+m.String())
+		if from != "" && !strings.EqualFold(m.from, from) ||
+			to != "" && !containsFold(m.to, to) ||
+			subject != nil && !subject.MatchString(m.subject) ||
+			body != nil && !body.MatchString(m.body) {
+			continue
+		}
+		matches++
+		ts.stdout, ts.stderr = m.body, ""
+	}
+	received := "received messages:\n" + strings.Join(lines, "\n")
+	if len(all) == 0 {
+		received = "no messages received"
+	}
+	switch {
+	case count >= 0 && matches != count:
+		ts.t.Fatalf("script:%d: mocksmtp assert %s: %d messages match, want %d\n%s", ts.lineno, name, matches, count, received)
+	case count < 0 && neg && matches > 0:
+		ts.t.Fatalf("script:%d: mocksmtp assert %s: %d messages unexpectedly match\n%s", ts.lineno, name, matches, received)
+	case count < 0 && !neg && matches == 0:
+		ts.t.Fatalf("script:%d: mocksmtp assert %s: no message matches\n%s", ts.lineno, name, received)
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeSMTP stops the servers left running by mocksmtp start.
+func (ts *TestScript) closeSMTP() {
+	for _, s := range ts.smtpServers {
+		s.close()
+	}
+	ts.smtpServers = nil
+}
@@ -0,0 +1,215 @@
+package tsar
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// defaultMaxOutputBytes bounds each output stream when Params.MaxOutputBytes
+// is zero.
+const defaultMaxOutputBytes = 16 << 20
+
+// maxLogLine is the longest line streamed to the log in one piece; longer
+// lines are split.
+const maxLogLine = 4096
+
+// execOutput is a command's output, with stdout and stderr also interleaved
+// in the order they were written.
+type execOutput struct {
+	stdout, stderr, combined string
+}
+
+// outputCapture collects a running command's stdout and stderr.
+type outputCapture struct {
+	mu                       sync.Mutex
+	stdout, stderr, combined limitBuffer
+	logOut, logErr           *lineLogger // stream lines to the log, if non-nil
+}
+
+// setLimit bounds each stream to max bytes; see Params.MaxOutputBytes.
+func (c *outputCapture) setLimit(max int) {
+	c.stdout.max, c.stderr.max, c.combined.max = max, max, max
+}
+
+// stream logs each line of output with logf as it is written, up to max
+// bytes per stream.
+func (c *outputCapture) stream(logf func(format string, args ...any), max int) {
+	c.logOut = &lineLogger{logf: logf, prefix: "[stdout]", budget: max}
+	c.logErr = &lineLogger{logf: logf, prefix: "[stderr]", budget: max}
+}
+
+// flush logs any partial last lines left by stream.
+func (c *outputCapture) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.logOut != nil {
+		c.logOut.flush()
+		c.logErr.flush()
+	}
+}
+
+func (c *outputCapture) stdoutWriter() io.Writer {
+	return captureWriter{c, &c.stdout, c.logOut}
+}
+
+func (c *outputCapture) stderrWriter() io.Writer {
+	return captureWriter{c, &c.stderr, c.logErr}
+}
+
+func (c *outputCapture) result() execOutput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return execOutput{c.stdout.String(), c.stderr.String(), c.combined.String()}
+}
+
+type captureWriter struct {
+	c      *outputCapture
+	stream *limitBuffer
+	log    *lineLogger
+}
+
+func (w captureWriter) Write(p []byte) (int, error) {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	w.stream.Write(p)
+	if w.log != nil {
+		w.log.Write(p)
+	}
+	return w.c.combined.Write(p)
+}
+
+// limitBuffer retains at most max bytes of what is written to it: the first
+// half and, in a ring, the last half, dropping the middle. A negative max
+// keeps everything.
+type limitBuffer struct {
+	max     int
+	head    []byte
+	tail    []byte // the last max/2 bytes once full
+	next    int    // index of the oldest byte in a full tail
+	dropped int64  // bytes dropped between head and tail
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.max < 0 {
+		b.head = append(b.head, p...)
+		return n, nil
+	}
+	if room := b.max - b.max/2 - len(b.head); room > 0 {
+		k := min(room, len(p))
+		b.head = append(b.head, p[:k]...)
+		p = p[k:]
+	}
+	keep := b.max / 2
+	switch {
+	case len(p) == 0:
+	case keep == 0:
+		b.dropped += int64(len(p))
+	case len(p) >= keep:
+		// p alone fills the tail.
+		b.dropped += int64(len(b.tail) + len(p) - keep)
+		b.tail = append(b.tail[:0], p[len(p)-keep:]...)
+		b.next = 0
+	default:
+		if room := keep - len(b.tail); room > 0 {
+			k := min(room, len(p))
+			b.tail = append(b.tail, p[:k]...)
+			p = p[k:]
+		}
+		for len(p) > 0 {
+			k := copy(b.tail[b.next:], p)
+			b.dropped += int64(k)
+			b.next = (b.next + k) % keep
+			p = p[k:]
+		}
+	}
+	return n, nil
+}
+
+// String returns the retained output, with a marker where bytes were
+// dropped.
+func (b *limitBuffer) String() string {
+	tail := string(b.tail[b.next:]) + string(b.tail[:b.next])
+	if b.dropped == 0 {
+		return string(b.head) + tail
+	}
+	sep := "\n"
+	if len(b.head) == 0 || b.head[len(b.head)-1] == '\n' {
+		sep = ""
+	}
+	return fmt.Sprintf("%s%s[... %d bytes truncated ...]\n%s", b.head, sep, b.dropped, tail)
+}
+
+// lineLogger logs output line by line as it is written, stopping once
+// budget bytes have been logged; a negative budget never stops.
+type lineLogger struct {
+	logf    func(format string, args ...any)
+	prefix  string
+	budget  int
+	pending []byte
+	stopped bool
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	n := len(p)
+	if l.stopped {
+		return n, nil
+	}
+	l.pending = append(l.pending, p...)
+	rest := l.pending
+	for !l.stopped {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			if len(rest) < maxLogLine {
+				break
+			}
+			i = maxLogLine - 1
+		}
+		l.emit(rest[:i+1])
+		rest = rest[i+1:]
+	}
+	if l.stopped {
+		rest = nil
+	}
+	l.pending = append(l.pending[:0], rest...)
+	return n, nil
+}
+
+// flush logs a partial last line.
+func (l *lineLogger) flush() {
+	if len(l.pending) > 0 && !l.stopped {
+		l.emit(l.pending)
+	}
+	l.pending = nil
+}
+
+func (l *lineLogger) emit(line []byte) {
+	if l.budget >= 0 {
+		if len(line) > l.budget {
+			l.logf("%s [... further output not logged ...]", l.prefix)
+			l.stopped = true
+			return
+		}
+		l.budget -= len(line)
+	}
+	l.logf("%s %s", l.prefix, bytes.TrimSuffix(line, []byte("\n")))
+}
+
+// outputLimit returns the per-stream output bound for the script's commands;
+// see Params.MaxOutputBytes.
+func (ts *TestScript) outputLimit() int {
+	if ts.params.MaxOutputBytes == 0 {
+		return defaultMaxOutputBytes
+	}
+	return ts.params.MaxOutputBytes
+}
+
+// verbose reports whether tests run with -test.v, as the tsar CLI does with
+// --verbose.
+func verbose() bool {
+	return flag.Parsed() && testing.Verbose()
+}
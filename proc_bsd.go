@@ -0,0 +1,31 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tsar
+
+import "syscall"
+
+// awaitExit waits for the child process pid to exit, without reaping it:
+// until cmd.Wait does, its process ID, and that of the group it leads,
+// cannot be reused.
+func awaitExit(pid int) error {
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(kq)
+	ev := make([]syscall.Kevent_t, 1)
+	syscall.SetKevent(&ev[0], pid, syscall.EVFILT_PROC, syscall.EV_ADD|syscall.EV_ONESHOT)
+	ev[0].Fflags = syscall.NOTE_EXIT
+	for {
+		_, err := syscall.Kevent(kq, ev, ev, nil)
+		switch err {
+		case nil:
+			return nil
+		case syscall.ESRCH:
+			return nil // already exited: still unreaped, it is a zombie
+		case syscall.EINTR:
+			continue
+		}
+		return err
+	}
+}
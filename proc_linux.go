@@ -0,0 +1,26 @@
+//go:build linux
+
+package tsar
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// awaitExit waits for the child process pid to exit, without reaping it:
+// until cmd.Wait does, its process ID, and that of the group it leads,
+// cannot be reused.
+func awaitExit(pid int) error {
+	const pPID = 1     // P_PID
+	var info [128]byte // siginfo_t
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(pid),
+			uintptr(unsafe.Pointer(&info[0])), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno != syscall.EINTR {
+			if errno != 0 {
+				return errno
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !unix && !windows
+
+package tsar
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+)
+
+// setProcessGroup is a no-op where process groups are not supported.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// interruptProcessGroup interrupts a running command.
+func interruptProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Signal(os.Interrupt)
+}
+
+// killProcessGroup kills a running command.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// reapProcessGroup is a no-op where process groups are not supported.
+func reapProcessGroup(cmd *exec.Cmd) {}
+
+// awaitExit fails: a process cannot be waited for apart from cmd.Wait.
+func awaitExit(pid int) error {
+	return fmt.Errorf("wait: %w", errors.ErrUnsupported)
+}
+
+// startUmask fails: there is no file mode creation mask to set.
+func startUmask(cmd *exec.Cmd, mask int) error {
+	return fmt.Errorf("umask: %w", errors.ErrUnsupported)
+}
+
+// setUser fails: programs cannot be started as another user.
+func setUser(cmd *exec.Cmd, u *user.User) error {
+	return fmt.Errorf("-user: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,13 @@
+//go:build aix || solaris
+
+package tsar
+
+import (
+	"errors"
+	"fmt"
+)
+
+// awaitExit fails: a process cannot be waited for without reaping it.
+func awaitExit(pid int) error {
+	return fmt.Errorf("wait: %w", errors.ErrUnsupported)
+}
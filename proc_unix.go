@@ -0,0 +1,75 @@
+//go:build unix
+
+package tsar
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the leader of a new process group, so that the
+// processes it starts can be signalled along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// interruptProcessGroup asks a running command and its process group to
+// stop.
+func interruptProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+}
+
+// killProcessGroup kills a running command and its process group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// reapProcessGroup kills what is left of the process group of a command
+// that has exited: children that outlived it. The command must not have
+// been reaped yet, so that no other group can have taken its ID.
+func reapProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// umaskMu serializes the umask changes of startUmask.
+var umaskMu sync.Mutex
+
+// startUmask starts cmd with the file mode creation mask set to mask. The
+// mask is process-wide, so it is only changed while cmd starts; files the
+// test process creates meanwhile get it too.
+func startUmask(cmd *exec.Cmd, mask int) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return cmd.Start()
+}
+
+// setUser makes cmd run as u, with its primary and supplementary groups.
+func setUser(cmd *exec.Cmd, u *user.User) error {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("-user %s: invalid uid %q", u.Username, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("-user %s: invalid gid %q", u.Username, u.Gid)
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(g))
+			}
+		}
+	}
+	cmd.SysProcAttr.Credential = cred
+	return nil
+}
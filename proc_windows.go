@@ -0,0 +1,58 @@
+//go:build windows
+
+package tsar
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// interruptProcessGroup stops a running command and the processes it
+// started; Windows has no interrupt to send them.
+func interruptProcessGroup(cmd *exec.Cmd) error {
+	return killProcessGroup(cmd)
+}
+
+// killProcessGroup kills a running command and the processes it started.
+func killProcessGroup(cmd *exec.Cmd) error {
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	if err := kill.Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// reapProcessGroup does nothing: the processes a command started outlive
+// it without a link to its process ID, so they cannot be found safely.
+func reapProcessGroup(cmd *exec.Cmd) {}
+
+// awaitExit waits for the process pid to exit. The handle cmd.Wait
+// releases keeps the ID from being reused meanwhile.
+func awaitExit(pid int) error {
+	h, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+	_, err = syscall.WaitForSingleObject(h, syscall.INFINITE)
+	return err
+}
+
+// startUmask fails: there is no file mode creation mask to set.
+func startUmask(cmd *exec.Cmd, mask int) error {
+	return fmt.Errorf("umask: %w", errors.ErrUnsupported)
+}
+
+// setUser fails: programs cannot be started as another user.
+func setUser(cmd *exec.Cmd, u *user.User) error {
+	return fmt.Errorf("-user: %w", errors.ErrUnsupported)
+}
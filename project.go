@@ -1,10 +1,13 @@
 package tsar
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -20,9 +23,47 @@ type ProjectConfig struct {
 	Setup    string    `toml:"setup"`
 	Teardown string    `toml:"teardown"`
 	Test     TestHooks `toml:"test"`
-	dir      string    // resolved absolute base directory
+
+	// Interpreters maps file extensions in bin/, such as ".py", to the
+	// command that runs them, such as "python3 -u"; see DefaultInterpreters.
+	// It holds the defaults merged with the [interpreters] table.
+	Interpreters map[string]string `toml:"interpreters"`
+
+	dir     string                  // resolved absolute base directory
+	sources map[string]ConfigSource // where each set value came from, by key
+	unknown []string                // tsar.toml keys outside the schema
+}
+
+// DefaultInterpreters are the commands that run the files of bin/ by
+// extension, unless tsar.toml's [interpreters] table overrides them.
+var DefaultInterpreters = map[string]string{
+	".sh": "/bin/sh",
+	".py": "python3",
+	".js": "node",
+	".rb": "ruby",
 }
 
+// ConfigSource says where a project setting came from.
+type ConfigSource string
+
+const (
+	SourceUnset      ConfigSource = ""           // not set
+	SourceTOML       ConfigSource = "tsar.toml"  // set in tsar.toml
+	SourceConvention ConfigSource = "convention" // auto-detected (bin/, setup.sh, teardown.sh)
+)
+
+// Dir returns the project directory, as an absolute path.
+func (cfg *ProjectConfig) Dir() string { return cfg.dir }
+
+// Source reports where the setting with the given tsar.toml key ("bin",
+// "setup", "teardown", "test.setup" or "test.teardown") came from.
+func (cfg *ProjectConfig) Source(key string) ConfigSource { return cfg.sources[key] }
+
+// UnknownKeys returns the keys of tsar.toml that are not part of its
+// schema, such as misspelled hook names, as "key (line N)". They are
+// otherwise ignored.
+func (cfg *ProjectConfig) UnknownKeys() []string { return cfg.unknown }
+
 // TestHooks holds per-test setup/teardown script paths.
 type TestHooks struct {
 	Setup    string `toml:"setup"`
@@ -39,7 +80,7 @@ func LoadProjectConfig(dir string) (*ProjectConfig, error) {
 		return nil, fmt.Errorf("resolve dir: %w", err)
 	}
 
-	cfg := &ProjectConfig{dir: absDir}
+	cfg := &ProjectConfig{dir: absDir, sources: make(map[string]ConfigSource)}
 
 	// Track which fields were explicitly set by TOML
 	var fromTOML ProjectConfig
@@ -49,19 +90,34 @@ func LoadProjectConfig(dir string) (*ProjectConfig, error) {
 	data, err := os.ReadFile(tomlPath)
 	if err == nil {
 		hasTOML = true
-		if err := toml.Unmarshal(data, &fromTOML); err != nil {
-			return nil, fmt.Errorf("parse tsar.toml: %w", err)
+		dec := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields()
+		if err := dec.Decode(&fromTOML); err != nil {
+			var strict *toml.StrictMissingError
+			if !errors.As(err, &strict) {
+				return nil, fmt.Errorf("parse tsar.toml: %w", err)
+			}
+			for _, e := range strict.Errors {
+				line, _ := e.Position()
+				cfg.unknown = append(cfg.unknown, fmt.Sprintf("%s (line %d)", strings.Join(e.Key(), "."), line))
+			}
 		}
 	} else if !errors.Is(err, fs.ErrNotExist) {
 		return nil, fmt.Errorf("read tsar.toml: %w", err)
 	}
 
 	// Apply TOML values, then auto-detect missing ones
-	cfg.BinDir = resolveField(absDir, fromTOML.BinDir, "bin", isDir)
-	cfg.Setup = resolveField(absDir, fromTOML.Setup, "setup.sh", isFile)
-	cfg.Teardown = resolveField(absDir, fromTOML.Teardown, "teardown.sh", isFile)
-	cfg.Test.Setup = resolveExplicitOnly(absDir, fromTOML.Test.Setup)
-	cfg.Test.Teardown = resolveExplicitOnly(absDir, fromTOML.Test.Teardown)
+	cfg.BinDir = cfg.resolveField("bin", fromTOML.BinDir, "bin", isDir)
+	cfg.Setup = cfg.resolveField("setup", fromTOML.Setup, "setup.sh", isFile)
+	cfg.Teardown = cfg.resolveField("teardown", fromTOML.Teardown, "teardown.sh", isFile)
+	cfg.Test.Setup = cfg.resolveField("test.setup", fromTOML.Test.Setup, "", nil)
+	cfg.Test.Teardown = cfg.resolveField("test.teardown", fromTOML.Test.Teardown, "", nil)
+	cfg.Interpreters = maps.Clone(DefaultInterpreters)
+	for ext, interp := range fromTOML.Interpreters {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		cfg.Interpreters[ext] = interp
+	}
 
 	// Validate that all TOML-specified paths exist
 	if hasTOML {
@@ -73,27 +129,25 @@ func LoadProjectConfig(dir string) (*ProjectConfig, error) {
 	return cfg, nil
 }
 
-// resolveField applies TOML value if set, otherwise auto-detects the conventional path.
-func resolveField(base, tomlVal, convention string, check func(string) bool) string {
+// resolveField applies TOML value if set, otherwise auto-detects the
+// conventional path, if any, recording where the value came from under key.
+func (cfg *ProjectConfig) resolveField(key, tomlVal, convention string, check func(string) bool) string {
 	if tomlVal != "" {
-		return filepath.Join(base, tomlVal)
+		cfg.sources[key] = SourceTOML
+		return filepath.Join(cfg.dir, tomlVal)
+	}
+	if convention == "" {
+		return "" // explicit only
 	}
 	// Auto-detect conventional path
-	candidate := filepath.Join(base, convention)
+	candidate := filepath.Join(cfg.dir, convention)
 	if check(candidate) {
+		cfg.sources[key] = SourceConvention
 		return candidate
 	}
 	return ""
 }
 
-// resolveExplicitOnly resolves a path only if explicitly configured (no auto-detection).
-func resolveExplicitOnly(base, tomlVal string) string {
-	if tomlVal != "" {
-		return filepath.Join(base, tomlVal)
-	}
-	return ""
-}
-
 func (cfg *ProjectConfig) validateTOMLPaths(base string, from *ProjectConfig) error {
 	checks := []struct {
 		val  string
@@ -117,10 +171,12 @@ func (cfg *ProjectConfig) validateTOMLPaths(base string, from *ProjectConfig) er
 	return nil
 }
 
-// prepareBinDir creates wrapper scripts for .sh files in the project's bin directory
-// and returns PATH directory entries to prepend. The first entry is a temp dir with
-// wrappers (calling .sh files without extension), the second is the bin dir itself
-// (for non-.sh executables). Returns a cleanup function that removes the temp dir.
+// prepareBinDir creates wrapper scripts for the helper scripts in the project's
+// bin directory and returns PATH directory entries to prepend. The first entry is a
+// temp dir with wrappers, which call each script by its name without extension, the
+// second is the bin dir itself (for other executables). A script is run by the
+// interpreter for its extension in cfg.Interpreters, or else by its #! line.
+// Returns a cleanup function that removes the temp dir.
 func (cfg *ProjectConfig) prepareBinDir() (pathDirs []string, cleanup func(), err error) {
 	cleanup = func() {} // no-op default
 
@@ -139,18 +195,25 @@ func (cfg *ProjectConfig) prepareBinDir() (pathDirs []string, cleanup func(), er
 	}
 	cleanup = func() { os.RemoveAll(wrapperDir) }
 
+	wrapped := make(map[string]string) // wrapper name → script
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
 		name := entry.Name()
-		if filepath.Ext(name) != ".sh" {
+		absScript := filepath.Join(cfg.BinDir, name)
+		interp := cfg.interpreter(absScript, entry)
+		if interp == "" {
 			continue
 		}
-		// Create a wrapper script that invokes the .sh file
-		wrapperName := strings.TrimSuffix(name, ".sh")
-		absScript := filepath.Join(cfg.BinDir, name)
-		wrapper := fmt.Sprintf("#!/bin/sh\nexec /bin/sh %q \"$@\"\n", absScript)
+		// Create a wrapper script that invokes the script with its interpreter
+		wrapperName := strings.TrimSuffix(name, filepath.Ext(name))
+		if prev, ok := wrapped[wrapperName]; ok {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("bin: %s and %s would both be called %s", prev, name, wrapperName)
+		}
+		wrapped[wrapperName] = name
+		wrapper := fmt.Sprintf("#!/bin/sh\nexec %s %q \"$@\"\n", interp, absScript)
 		wrapperPath := filepath.Join(wrapperDir, wrapperName)
 		if err := os.WriteFile(wrapperPath, []byte(wrapper), 0755); err != nil {
 			cleanup()
@@ -161,6 +224,32 @@ func (cfg *ProjectConfig) prepareBinDir() (pathDirs []string, cleanup func(), er
 	return []string{wrapperDir, cfg.BinDir}, cleanup, nil
 }
 
+// interpreter returns the command that runs a bin/ script: the one for its
+// extension, or its #! line. It returns "" for files that need no wrapper:
+// those with neither, and executables without extension, which are found on
+// PATH as they are.
+func (cfg *ProjectConfig) interpreter(path string, entry fs.DirEntry) string {
+	ext := filepath.Ext(path)
+	if interp := cfg.Interpreters[ext]; interp != "" {
+		return interp
+	}
+	if ext == "" {
+		if info, err := entry.Info(); err != nil || info.Mode()&0111 != 0 {
+			return ""
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if interp, ok := strings.CutPrefix(strings.TrimSpace(line), "#!"); ok {
+		return strings.TrimSpace(interp)
+	}
+	return ""
+}
+
 // ---- Project-Aware Run Functions
 
 // RunWithProject runs test scripts from p.Dir with project structure support.
@@ -176,7 +265,7 @@ func RunWithProject(t *testing.T, p Params) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer cleanup()
+	defer func() { cleanup(t.Failed()) }()
 
 	Run(t, p)
 }
@@ -193,7 +282,7 @@ func RunStandaloneWithProject(t TestingT, p Params) error {
 	if err != nil {
 		return err
 	}
-	defer cleanup()
+	defer func() { cleanup(t.Failed()) }()
 
 	RunStandalone(t, p)
 	if t.Failed() {
@@ -213,7 +302,7 @@ func RunFilesStandaloneWithProject(t TestingT, p Params, filenames ...string) er
 	if err != nil {
 		return err
 	}
-	defer cleanup()
+	defer func() { cleanup(t.Failed()) }()
 
 	RunFilesStandalone(t, p, filenames...)
 	if t.Failed() {
@@ -222,11 +311,30 @@ func RunFilesStandaloneWithProject(t TestingT, p Params, filenames ...string) er
 	return nil
 }
 
+// PrepareProject prepares the project of p.Dir once, for a session of many
+// runs, as the project runners do for one: it builds the bin/ wrappers,
+// runs the global setup and returns p with the wrappers and per-test hooks
+// wired in, to pass to RunStandalone or RunFilesStandalone. Call cleanup
+// once, at the end of the session, to run the global teardown and remove
+// the wrappers.
+func PrepareProject(p Params) (prepared Params, cleanup func(failed bool), err error) {
+	cfg, err := LoadProjectConfig(p.Dir)
+	if err != nil {
+		return p, nil, fmt.Errorf("load project config: %w", err)
+	}
+	cleanup, err = prepareProject(cfg, &p)
+	if err != nil {
+		return p, nil, err
+	}
+	return p, cleanup, nil
+}
+
 // prepareProject sets up the project environment and returns a cleanup function.
 // It prepares bin/ wrappers, runs global setup, wires per-test hooks, and
-// returns a cleanup that runs global teardown and removes temp dirs.
-func prepareProject(cfg *ProjectConfig, p *Params) (cleanup func(), err error) {
-	cleanup = func() {} // no-op default
+// returns a cleanup that runs global teardown and removes temp dirs. The
+// cleanup is told whether the run failed, for the teardown's TSAR_STATUS.
+func prepareProject(cfg *ProjectConfig, p *Params) (cleanup func(failed bool), err error) {
+	cleanup = func(bool) {} // no-op default
 
 	// Prepare bin/ directory
 	binPathDirs, binCleanup, err := cfg.prepareBinDir()
@@ -261,20 +369,27 @@ func prepareProject(cfg *ProjectConfig, p *Params) (cleanup func(), err error) {
 		p.TestTeardown = cfg.Test.Teardown
 	}
 
-	// Run global setup
+	// Run global setup; a dry run executes nothing, not even hooks
+	if p.DryRun {
+		return func(bool) { binCleanup() }, nil
+	}
 	if cfg.Setup != "" {
-		if err := runGlobalScript(cfg.dir, cfg.Setup); err != nil {
+		if err := runGlobalScript(cfg.dir, cfg.Setup, ""); err != nil {
 			binCleanup()
-			return func() {}, fmt.Errorf("global setup failed: %w", err)
+			return cleanup, fmt.Errorf("global setup failed: %w", err)
 		}
 	}
 
 	// Build cleanup: global teardown (best-effort) + bin cleanup
 	projectDir := cfg.dir
 	teardownScript := cfg.Teardown
-	cleanup = func() {
+	cleanup = func(failed bool) {
 		if teardownScript != "" {
-			if err := runGlobalScript(projectDir, teardownScript); err != nil {
+			status := StatusPass
+			if failed {
+				status = StatusFail
+			}
+			if err := runGlobalScript(projectDir, teardownScript, status); err != nil {
 				log.Printf("warning: global teardown failed: %v", err)
 			}
 		}
@@ -284,10 +399,14 @@ func prepareProject(cfg *ProjectConfig, p *Params) (cleanup func(), err error) {
 	return cleanup, nil
 }
 
-// runGlobalScript runs a shell script in the project directory.
-func runGlobalScript(dir, scriptPath string) error {
+// runGlobalScript runs a shell script in the project directory, with
+// TSAR_STATUS set to the run's status if status is not empty.
+func runGlobalScript(dir, scriptPath string, status ScriptStatus) error {
 	cmd := exec.Command("/bin/sh", scriptPath)
 	cmd.Dir = dir
+	if status != "" {
+		cmd.Env = append(os.Environ(), "TSAR_STATUS="+string(status))
+	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("%s: %w\n%s", filepath.Base(scriptPath), err, output)
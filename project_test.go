@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -25,6 +26,33 @@ func (t *testResultCapture) Logf(format string, args ...any) {}
 func (t *testResultCapture) Failed() bool                    { return t.failed }
 func (t *testResultCapture) Helper()                         {}
 
+// logCapture is a testResultCapture that also records failure messages.
+type logCapture struct {
+	testResultCapture
+	fatals []string
+}
+
+func (t *logCapture) Fatal(args ...any) {
+	t.failed = true
+	t.fatals = append(t.fatals, fmt.Sprint(args...))
+}
+
+func (t *logCapture) Fatalf(format string, args ...any) {
+	t.failed = true
+	t.fatals = append(t.fatals, fmt.Sprintf(format, args...))
+}
+
+// logRecorder is a testResultCapture that also records log output.
+type logRecorder struct {
+	testResultCapture
+	logs []string
+}
+
+func (t *logRecorder) Log(args ...any) { t.logs = append(t.logs, fmt.Sprint(args...)) }
+func (t *logRecorder) Logf(format string, args ...any) {
+	t.logs = append(t.logs, fmt.Sprintf(format, args...))
+}
+
 func writeFile(t *testing.T, path string, content []byte, perm os.FileMode) {
 	t.Helper()
 	if err := os.WriteFile(path, content, perm); err != nil {
@@ -32,6 +60,35 @@ func writeFile(t *testing.T, path string, content []byte, perm os.FileMode) {
 	}
 }
 
+// expectFatal runs script as the only script of a fresh directory, with p
+// otherwise, and reports an error unless it fails once with a message
+// containing want.
+func expectFatal(t *testing.T, p Params, script, want string) {
+	t.Helper()
+	capture := runScript(t, p, script)
+	if len(capture.fatals) != 1 || !strings.Contains(capture.fatals[0], want) {
+		t.Errorf("script %q: fatals = %q, want %q", script, capture.fatals, want)
+	}
+}
+
+// expectPass runs script like expectFatal, and reports an error if it fails.
+func expectPass(t *testing.T, p Params, script string) {
+	t.Helper()
+	if capture := runScript(t, p, script); capture.failed {
+		t.Errorf("script %q: fatals = %q", script, capture.fatals)
+	}
+}
+
+// runScript runs script as a.tsar in a fresh directory, with p otherwise.
+func runScript(t *testing.T, p Params, script string) *logCapture {
+	t.Helper()
+	p.Dir = t.TempDir()
+	writeFile(t, filepath.Join(p.Dir, "a.tsar"), []byte(script), 0644)
+	capture := &logCapture{}
+	RunStandalone(capture, p)
+	return capture
+}
+
 func mkdirAll(t *testing.T, path string) {
 	t.Helper()
 	if err := os.MkdirAll(path, 0755); err != nil {
@@ -39,6 +96,43 @@ func mkdirAll(t *testing.T, path string) {
 	}
 }
 
+func TestLoadProjectConfig_Sources(t *testing.T) {
+	dir := t.TempDir()
+	toml := `setup = "init.sh"
+bin_dir = "tools"
+
+[test]
+setup = "before.sh"
+teardwon = "after.sh"
+`
+	writeFile(t, filepath.Join(dir, "tsar.toml"), []byte(toml), 0644)
+	writeFile(t, filepath.Join(dir, "init.sh"), []byte("#!/bin/sh\n"), 0755)
+	writeFile(t, filepath.Join(dir, "before.sh"), []byte("#!/bin/sh\n"), 0755)
+	writeFile(t, filepath.Join(dir, "teardown.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	cfg, err := LoadProjectConfig(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for key, want := range map[string]ConfigSource{
+		"bin":           SourceUnset,
+		"setup":         SourceTOML,
+		"teardown":      SourceConvention,
+		"test.setup":    SourceTOML,
+		"test.teardown": SourceUnset,
+	} {
+		if got := cfg.Source(key); got != want {
+			t.Errorf("Source(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if want := []string{"bin_dir (line 2)", "test.teardwon (line 6)"}; !slices.Equal(cfg.UnknownKeys(), want) {
+		t.Errorf("UnknownKeys() = %q, want %q", cfg.UnknownKeys(), want)
+	}
+	if filepath.Base(cfg.Test.Setup) != "before.sh" {
+		t.Errorf("Test.Setup = %q; known keys must still be decoded", cfg.Test.Setup)
+	}
+}
+
 func TestLoadProjectConfig_WithTOML(t *testing.T) {
 	dir := t.TempDir()
 
@@ -223,6 +317,58 @@ func TestPrepareBinDir_ShellWrappers(t *testing.T) {
 	}
 }
 
+func TestPrepareBinDir_Interpreters(t *testing.T) {
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, "bin")
+	mkdirAll(t, binDir)
+	writeFile(t, filepath.Join(dir, "tsar.toml"), []byte("[interpreters]\ntool = \"/bin/sh -e\"\n"), 0644)
+	writeFile(t, filepath.Join(binDir, "hello.tool"), []byte("echo \"tool $1\"\n"), 0644)
+	writeFile(t, filepath.Join(binDir, "banner.any"), []byte("#!/bin/sh\necho shebang\n"), 0644)
+	writeFile(t, filepath.Join(binDir, "notes.txt"), []byte("not a script\n"), 0644)
+
+	cfg, err := LoadProjectConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Interpreters[".tool"]; got != "/bin/sh -e" {
+		t.Errorf("Interpreters[.tool] = %q, want /bin/sh -e", got)
+	}
+	if got := cfg.Interpreters[".py"]; got != "python3" {
+		t.Errorf("Interpreters[.py] = %q, want the python3 default", got)
+	}
+	pathDirs, cleanup, err := cfg.prepareBinDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	entries, err := os.ReadDir(pathDirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !slices.Equal(names, []string{"banner", "hello"}) {
+		t.Errorf("wrappers = %v, want [banner hello]", names)
+	}
+	for name, want := range map[string]string{"hello": "tool world", "banner": "shebang"} {
+		out, err := exec.Command(filepath.Join(pathDirs[0], name), "world").Output()
+		if err != nil {
+			t.Fatalf("%s wrapper failed: %v", name, err)
+		}
+		if got := strings.TrimSpace(string(out)); got != want {
+			t.Errorf("%s output = %q, want %q", name, got, want)
+		}
+	}
+
+	writeFile(t, filepath.Join(binDir, "hello.sh"), []byte("echo sh\n"), 0644)
+	if _, _, err := cfg.prepareBinDir(); err == nil || !strings.Contains(err.Error(), "would both be called hello") {
+		t.Errorf("prepareBinDir with hello.sh and hello.tool: %v, want a name clash", err)
+	}
+}
+
 func TestPrepareBinDir_EmptyBin(t *testing.T) {
 	dir := t.TempDir()
 	binDir := filepath.Join(dir, "bin")
@@ -325,6 +471,37 @@ setup = "scripts/before.sh"
 	RunWithProject(t, Params{Dir: dir})
 }
 
+func TestRunWithProject_HookEnv(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(t.TempDir(), "hooks.log")
+
+	mkdirAll(t, filepath.Join(dir, "scripts"))
+	writeFile(t, filepath.Join(dir, "scripts", "before.sh"),
+		[]byte("#!/bin/sh\necho \"$TSAR_TEST_NAME $(basename \"$TSAR_SCRIPT_FILE\")\" > \"$TSAR_WORK/before-marker\"\n"), 0755)
+	writeFile(t, filepath.Join(dir, "scripts", "after.sh"),
+		[]byte("#!/bin/sh\necho \"$TSAR_TEST_NAME $TSAR_STATUS\" >> "+log+"\n"), 0755)
+	writeFile(t, filepath.Join(dir, "teardown.sh"),
+		[]byte("#!/bin/sh\necho \"global $TSAR_STATUS\" >> "+log+"\n"), 0755)
+	writeFile(t, filepath.Join(dir, "tsar.toml"),
+		[]byte("[test]\nsetup = \"scripts/before.sh\"\nteardown = \"scripts/after.sh\"\n"), 0644)
+
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("grep '^a a.tsar' before-marker\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b.tsar"), []byte("exec false\n"), 0644)
+	writeFile(t, filepath.Join(dir, "c.tsar"), []byte("skip\n"), 0644)
+
+	runner := &testResultCapture{}
+	if err := RunStandaloneWithProject(runner, Params{Dir: dir, ContinueOnError: true}); err == nil {
+		t.Fatal("expected b.tsar to fail")
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "a pass\nb fail\nc skip\nglobal fail\n"; got != want {
+		t.Errorf("hooks logged:\n%s\nwant:\n%s", got, want)
+	}
+}
+
 func TestLoadProjectConfig_EmptyDir(t *testing.T) {
 	dir := t.TempDir()
 
@@ -0,0 +1,453 @@
+package tsar
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scriptProxy is the HTTP proxy exec'd programs are pointed at through
+// HTTP_PROXY and HTTPS_PROXY. It sends connections to aliased hosts to
+// their targets (tsar cannot change how other processes resolve names)
+// and, with Params.CaptureHTTP, records every request, decrypting HTTPS
+// with certificates from a generated CA.
+type scriptProxy struct {
+	srv       *http.Server
+	url       string
+	transport *http.Transport
+	aliases   *hostAliases
+	ca        *proxyCA // nil unless capturing
+
+	mu       sync.Mutex
+	requests []capturedRequest
+}
+
+// capturedRequest is a request a program made through the proxy.
+type capturedRequest struct {
+	method string
+	url    string
+	status int // 0 if no response was received
+}
+
+func (r capturedRequest) String() string {
+	if r.status == 0 {
+		return r.method + " " + r.url + " (no response)"
+	}
+	return r.method + " " + r.url + " " + strconv.Itoa(r.status)
+}
+
+// startProxy starts a proxy on a loopback port. A non-nil ca makes it
+// capture requests.
+func startProxy(aliases *hostAliases, ca *proxyCA) (*scriptProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	p := &scriptProxy{
+		url:     "http://" + ln.Addr().String(),
+		aliases: aliases,
+		ca:      ca,
+		transport: &http.Transport{
+			DialContext: aliases.dialContext,
+			// Upstreams are test fixtures, typically with self-signed
+			// certificates; programs only see the proxy's.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: ca != nil},
+		},
+	}
+	p.srv = &http.Server{Handler: p}
+	go p.srv.Serve(ln)
+	return p, nil
+}
+
+// close stops the proxy and the connections it forwards.
+func (p *scriptProxy) close() {
+	p.srv.Close()
+	p.transport.CloseIdleConnections()
+}
+
+// captured returns the requests recorded so far.
+func (p *scriptProxy) captured() []capturedRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]capturedRequest(nil), p.requests...)
+}
+
+// hopHeaders are only meaningful between a client and its proxy.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func (p *scriptProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		if p.ca != nil {
+			p.intercept(w, r)
+		} else {
+			p.tunnel(w, r)
+		}
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "tsar proxy: absolute URL required", http.StatusBadRequest)
+		return
+	}
+	resp, err := p.forward(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// forward sends a request with an absolute URL upstream, recording it if
+// capturing.
+func (p *scriptProxy) forward(r *http.Request) (*http.Response, error) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	resp, err := p.transport.RoundTrip(out)
+	if p.ca != nil {
+		req := capturedRequest{method: r.Method, url: r.URL.String()}
+		if err == nil {
+			req.status = resp.StatusCode
+		}
+		p.mu.Lock()
+		p.requests = append(p.requests, req)
+		p.mu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	return resp, nil
+}
+
+// tunnel serves a CONNECT request, as used for HTTPS, by relaying bytes
+// to the possibly aliased host.
+func (p *scriptProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := p.aliases.dialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, buf, err := hijack(w)
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	go func() {
+		io.Copy(upstream, buf)
+		if c, ok := upstream.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+	upstream.Close()
+}
+
+// intercept serves a CONNECT request by terminating TLS itself, with a
+// certificate for the host signed by the proxy's CA, so that the requests
+// inside can be recorded and forwarded.
+func (p *scriptProxy) intercept(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "443"
+	}
+	conn, _, err := hijack(w)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.ca.certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	defer tlsConn.Close()
+
+	authority := host
+	if port != "443" {
+		authority = net.JoinHostPort(host, port)
+	}
+	br := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme, req.URL.Host = "https", authority
+		resp, err := p.forward(req.WithContext(r.Context()))
+		if err != nil {
+			resp = &http.Response{
+				StatusCode: http.StatusBadGateway,
+				ProtoMajor: 1, ProtoMinor: 1,
+				Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+				Body:          io.NopCloser(strings.NewReader(err.Error() + "\n")),
+				ContentLength: int64(len(err.Error()) + 1),
+			}
+		}
+		werr := resp.Write(tlsConn)
+		resp.Body.Close()
+		if werr != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// hijack takes over the connection of a CONNECT request, confirming it.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return nil, nil, fmt.Errorf("hijacking not supported")
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, buf, nil
+}
+
+// proxyCA issues the certificates the capturing proxy presents.
+type proxyCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+
+	mu    sync.Mutex
+	leafs map[string]*tls.Certificate
+}
+
+var (
+	sharedCAOnce sync.Once
+	sharedCA     *proxyCA
+	sharedCAErr  error
+)
+
+// testProxyCA returns the CA of the capturing proxy, generated once per
+// process.
+func testProxyCA() (*proxyCA, error) {
+	sharedCAOnce.Do(func() {
+		sharedCA, sharedCAErr = newProxyCA()
+	})
+	return sharedCA, sharedCAErr
+}
+
+func newProxyCA() (*proxyCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tsar test proxy CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(7 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyCA{
+		cert:  cert,
+		key:   key,
+		pem:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		leafs: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// certificate returns a certificate for host signed by the CA.
+func (ca *proxyCA) certificate(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if leaf, ok := ca.leafs[host]; ok {
+		return leaf, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     ca.cert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf := &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}
+	ca.leafs[host] = leaf
+	return leaf, nil
+}
+
+// captureHTTP reports whether the script's programs' requests are captured;
+// see Params.CaptureHTTP.
+func (ts *TestScript) captureHTTP() bool {
+	return ts.params.CaptureHTTP || ts.meta != nil && ts.meta.captureHTTP
+}
+
+// proxyEnv returns the environment pointing exec'd programs at the script's
+// proxy, starting it on first use, or nil if no proxy is needed. Variables
+// the script set itself are kept.
+func (ts *TestScript) proxyEnv() ([]string, error) {
+	capture := ts.captureHTTP()
+	if !capture && ts.aliases.empty() {
+		return nil, nil
+	}
+	vars := map[string]string{}
+	if ts.proxy == nil {
+		var ca *proxyCA
+		if capture {
+			var err error
+			if ca, err = testProxyCA(); err != nil {
+				return nil, fmt.Errorf("proxy CA: %v", err)
+			}
+		}
+		p, err := startProxy(ts.aliases, ca)
+		if err != nil {
+			return nil, err
+		}
+		ts.proxy = p
+	}
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		vars[key] = ts.proxy.url
+	}
+	if ts.proxy.ca != nil {
+		file := filepath.Join(ts.workdir, ".tsar", "proxy-ca.pem")
+		if _, err := os.Stat(file); err != nil {
+			if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(file, ts.proxy.ca.pem, 0644); err != nil {
+				return nil, err
+			}
+		}
+		for _, key := range []string{"TSAR_PROXY_CA", "SSL_CERT_FILE", "CURL_CA_BUNDLE", "REQUESTS_CA_BUNDLE", "NODE_EXTRA_CA_CERTS"} {
+			vars[key] = file
+		}
+	}
+	var env []string
+	for key, value := range vars {
+		if _, ok := ts.envMap[key]; !ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	return env, nil
+}
+
+// closeProxy stops the script's proxy, if started.
+func (ts *TestScript) closeProxy() {
+	if ts.proxy != nil {
+		ts.proxy.close()
+		ts.proxy = nil
+	}
+}
+
+func (ts *TestScript) cmdRequested(neg bool, args []string) {
+	usage := func() {
+		ts.t.Fatalf("script:%d: usage: requested [-count N] pattern", ts.lineno)
+	}
+	args = args[1:]
+	count := -1
+	if len(args) > 0 && args[0] == "-count" {
+		if len(args) < 2 || neg {
+			usage()
+			return
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			ts.t.Fatalf("script:%d: requested: invalid count %q", ts.lineno, args[1])
+			return
+		}
+		count, args = n, args[2:]
+	}
+	if len(args) != 1 {
+		usage()
+		return
+	}
+	if !ts.captureHTTP() {
+		ts.t.Fatalf("script:%d: requested: requests are not captured; set Params.CaptureHTTP or # tsar:capture-http", ts.lineno)
+		return
+	}
+	re, err := regexp.Compile(args[0])
+	if err != nil {
+		ts.t.Fatalf("script:%d: requested: invalid pattern %q: %v", ts.lineno, args[0], err)
+		return
+	}
+	var all []capturedRequest
+	if ts.proxy != nil {
+		all = ts.proxy.captured()
+	}
+	var lines []string
+	matches := 0
+	for _, req := range all {
+		lines = append(lines, "\t"+req.String())
+		if re.MatchString(req.String()) {
+			matches++
+		}
+	}
+	captured := "captured requests:\n" + strings.Join(lines, "\n")
+	if len(all) == 0 {
+		captured = "no requests captured"
+	}
+	switch {
+	case count >= 0 && matches != count:
+		ts.t.Fatalf("script:%d: %d request(s) match %q, want %d; %s", ts.lineno, matches, args[0], count, captured)
+	case count < 0 && !neg && matches == 0:
+		ts.t.Fatalf("script:%d: no request matches %q; %s", ts.lineno, args[0], captured)
+	case neg && matches > 0:
+		ts.t.Fatalf("script:%d: %d request(s) unexpectedly match %q; %s", ts.lineno, matches, args[0], captured)
+	}
+}
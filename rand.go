@@ -0,0 +1,133 @@
+package tsar
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+)
+
+// random returns the script's random number generator, seeded with
+// $TSAR_SEED when first used after setup.
+func (ts *TestScript) random() *rand.Rand {
+	if ts.rng != nil {
+		return ts.rng
+	}
+	seed, err := strconv.ParseUint(ts.envMap["TSAR_SEED"], 10, 64)
+	if err != nil {
+		ts.t.Fatalf("script:%d: invalid TSAR_SEED %q: want an unsigned integer", ts.lineno, ts.envMap["TSAR_SEED"])
+	}
+	ts.rng, ts.seed = rand.New(rand.NewPCG(seed, seed)), seed
+	ts.t.Logf("random seed: %d", seed)
+	return ts.rng
+}
+
+func (ts *TestScript) cmdRand(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: rand does not support negation", ts.lineno)
+		return
+	}
+	usage := "usage: rand int min max var | rand hex digits var"
+	if len(args) < 2 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	var value string
+	switch args[1] {
+	case "int":
+		if len(args) != 5 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		lo, err1 := strconv.ParseInt(args[2], 10, 64)
+		hi, err2 := strconv.ParseInt(args[3], 10, 64)
+		if err1 != nil || err2 != nil || lo > hi || hi-lo+1 <= 0 {
+			ts.t.Fatalf("script:%d: rand: invalid range %s %s", ts.lineno, args[2], args[3])
+			return
+		}
+		value = strconv.FormatInt(lo+ts.random().Int64N(hi-lo+1), 10)
+	case "hex":
+		if len(args) != 4 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 1 {
+			ts.t.Fatalf("script:%d: rand: invalid number of digits %q", ts.lineno, args[2])
+			return
+		}
+		b := make([]byte, (n+1)/2)
+		r := ts.random()
+		for i := range b {
+			b[i] = byte(r.UintN(256))
+		}
+		value = hex.EncodeToString(b)[:n]
+	default:
+		ts.t.Fatalf("script:%d: rand: unknown kind %q (want int or hex)", ts.lineno, args[1])
+		return
+	}
+	name := args[len(args)-1]
+	if !isVarName(name) {
+		ts.t.Fatalf("script:%d: rand: invalid variable name %q", ts.lineno, name)
+		return
+	}
+	ts.Setenv(name, value)
+}
+
+// uuid and randstr make unique names, such as of resources created on real
+// services, so unlike rand they do not draw from the seeded generator: runs
+// with the same seed, such as those of tsar stress, must not collide.
+func (ts *TestScript) cmdUUID(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: uuid does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: uuid var", ts.lineno)
+		return
+	}
+	if !isVarName(args[1]) {
+		ts.t.Fatalf("script:%d: uuid: invalid variable name %q", ts.lineno, args[1])
+		return
+	}
+	var b [16]byte
+	crand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+	ts.Setenv(args[1], fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]))
+}
+
+// randstrChars are the characters of randstr, valid in most resource names
+// and DNS labels.
+const randstrChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+func (ts *TestScript) cmdRandstr(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: randstr does not support negation", ts.lineno)
+		return
+	}
+	if len(args) < 2 || len(args) > 3 {
+		ts.t.Fatalf("script:%d: usage: randstr var [length]", ts.lineno)
+		return
+	}
+	if !isVarName(args[1]) {
+		ts.t.Fatalf("script:%d: randstr: invalid variable name %q", ts.lineno, args[1])
+		return
+	}
+	n := 12
+	if len(args) == 3 {
+		var err error
+		if n, err = strconv.Atoi(args[2]); err != nil || n < 1 {
+			ts.t.Fatalf("script:%d: randstr: invalid length %q", ts.lineno, args[2])
+			return
+		}
+	}
+	b := make([]byte, n)
+	crand.Read(b)
+	for i := range b {
+		// 256 is not a multiple of 36; the bias is harmless for names.
+		b[i] = randstrChars[int(b[i])%len(randstrChars)]
+	}
+	ts.Setenv(args[1], string(b))
+}
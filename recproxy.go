@@ -0,0 +1,264 @@
+package tsar
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A recProxy is a reverse proxy started by recproxy start: it forwards
+// requests to its upstream and records each exchange for recproxy assert.
+type recProxy struct {
+	srv *http.Server
+
+	mu        sync.Mutex
+	exchanges []recExchange
+}
+
+// A recExchange is a request forwarded by a recProxy, and its response.
+type recExchange struct {
+	method string
+	uri    string // path and query
+	header http.Header
+	body   []byte
+	status int
+}
+
+func (e recExchange) String() string {
+	if e.status == 0 {
+		return e.method + " " + e.uri + " (no response)"
+	}
+	return e.method + " " + e.uri + " " + strconv.Itoa(e.status)
+}
+
+// startRecProxy starts a proxy to upstream on a loopback port, dialing
+// through aliases.
+func startRecProxy(upstream *url.URL, aliases *hostAliases) (*recProxy, string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	p := &recProxy{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = aliases.dialContext
+	rp := &httputil.ReverseProxy{
+		Rewrite:   func(r *httputil.ProxyRequest) { r.SetURL(upstream) },
+		Transport: transport,
+	}
+	p.srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		// Record the request before the client can see its response.
+		p.mu.Lock()
+		i := len(p.exchanges)
+		p.exchanges = append(p.exchanges, recExchange{
+			method: r.Method,
+			uri:    r.URL.RequestURI(),
+			header: r.Header.Clone(),
+			body:   body,
+		})
+		p.mu.Unlock()
+		rp.ServeHTTP(&recordingWriter{ResponseWriter: w, record: func(status int) {
+			p.mu.Lock()
+			p.exchanges[i].status = status
+			p.mu.Unlock()
+		}}, r)
+	})}
+	go p.srv.Serve(ln)
+	return p, "http://" + ln.Addr().String(), nil
+}
+
+func (p *recProxy) recorded() []recExchange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]recExchange(nil), p.exchanges...)
+}
+
+// recordingWriter records the status of the response written through it
+// before sending it.
+type recordingWriter struct {
+	http.ResponseWriter
+	record   func(status int)
+	recorded bool
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if !w.recorded && status >= 200 {
+		w.record(status)
+		w.recorded = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if !w.recorded {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets the reverse proxy flush streamed responses.
+func (w *recordingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// recMatcher selects exchanges for recproxy assert.
+type recMatcher struct {
+	method  string
+	path    *regexp.Regexp
+	headers map[string]*regexp.Regexp // canonical name → value pattern
+	body    *regexp.Regexp
+	status  int
+}
+
+func (m *recMatcher) match(e recExchange) bool {
+	if m.method != "" && !strings.EqualFold(e.method, m.method) ||
+		m.path != nil && !m.path.MatchString(e.uri) ||
+		m.body != nil && !m.body.Match(e.body) ||
+		m.status != 0 && e.status != m.status {
+		return false
+	}
+	for name, re := range m.headers {
+		values, ok := e.header[name]
+		if !ok || !re.MatchString(strings.Join(values, ", ")) {
+			return false
+		}
+	}
+	return true
+}
+
+// cmdRecproxy runs recording reverse proxies: recproxy start sets a
+// variable to the URL of a proxy to an upstream, and recproxy assert checks
+// the requests it forwarded.
+func (ts *TestScript) cmdRecproxy(neg bool, args []string) {
+	usage := "usage: recproxy start upstream VAR_URL [&name&] | recproxy assert [-count N] [-method M] [-path pattern] [-header 'Name: pattern']... [-body pattern] [-status code] [&name&]"
+	if len(args) < 2 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	sub, args := args[1], args[2:]
+	name, args := cutNameSpecifier(args, "recproxy")
+	switch sub {
+	case "start":
+		if neg {
+			ts.t.Fatalf("script:%d: recproxy start does not support negation", ts.lineno)
+			return
+		}
+		if len(args) != 2 || !isVarName(args[1]) {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		upstream, err := url.Parse(args[0])
+		if err != nil || upstream.Scheme != "http" && upstream.Scheme != "https" || upstream.Host == "" {
+			ts.t.Fatalf("script:%d: recproxy start: invalid upstream %q: want an http or https URL", ts.lineno, args[0])
+			return
+		}
+		if ts.recProxies[name] != nil {
+			ts.t.Fatalf("script:%d: recproxy start: %q is already running; name another with &name&", ts.lineno, name)
+			return
+		}
+		p, proxyURL, err := startRecProxy(upstream, ts.aliases)
+		if err != nil {
+			ts.t.Fatalf("script:%d: recproxy start: %v", ts.lineno, err)
+			return
+		}
+		if ts.recProxies == nil {
+			ts.recProxies = make(map[string]*recProxy)
+		}
+		ts.recProxies[name] = p
+		ts.Setenv(args[1], proxyURL)
+		return
+	case "assert":
+	default:
+		ts.t.Fatalf("script:%d: recproxy: unknown subcommand %q; %s", ts.lineno, sub, usage)
+		return
+	}
+	p := ts.recProxies[name]
+	if p == nil {
+		ts.t.Fatalf("script:%d: recproxy assert: no proxy %q; start one with recproxy start upstream VAR_URL &%s&", ts.lineno, name, name)
+		return
+	}
+
+	count := -1
+	m := &recMatcher{headers: make(map[string]*regexp.Regexp)}
+	for len(args) > 0 {
+		if len(args) < 2 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		flag, value := args[0], args[1]
+		args = args[2:]
+		var err error
+		switch flag {
+		case "-count":
+			count, err = strconv.Atoi(value)
+			if err != nil || count < 0 || neg {
+				ts.t.Fatalf("script:%d: recproxy assert: invalid count %q", ts.lineno, value)
+				return
+			}
+		case "-status":
+			m.status, err = strconv.Atoi(value)
+			if err != nil || m.status < 100 || m.status > 999 {
+				ts.t.Fatalf("script:%d: recproxy assert: invalid status %q", ts.lineno, value)
+				return
+			}
+		case "-method":
+			m.method = value
+		case "-path":
+			m.path, err = regexp.Compile(value)
+		case "-header":
+			key, pattern, ok := strings.Cut(value, ":")
+			if !ok {
+				ts.t.Fatalf("script:%d: recproxy assert: invalid header %q: want 'Name: pattern'", ts.lineno, value)
+				return
+			}
+			m.headers[http.CanonicalHeaderKey(strings.TrimSpace(key))], err = regexp.Compile(strings.TrimSpace(pattern))
+		case "-body":
+			m.body, err = regexp.Compile(value)
+		default:
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		if err != nil {
+			ts.t.Fatalf("script:%d: recproxy assert: invalid pattern %q: %v", ts.lineno, value, err)
+			return
+		}
+	}
+
+	all := p.recorded()
+	ts.stdout, ts.stderr = "", ""
+	var lines []string
+	matches := 0
+	for _, e := range all {
+		lines = append(lines, "\t"+e.String())
+		if m.match(e) {
+			matches++
+			ts.stdout = string(e.body)
+		}
+	}
+	recorded := "recorded requests:\n" + strings.Join(lines, "\n")
+	if len(all) == 0 {
+		recorded = "no requests recorded"
+	}
+	switch {
+	case count >= 0 && matches != count:
+		ts.t.Fatalf("script:%d: recproxy assert %s: %d requests match, want %d\n%s", ts.lineno, name, matches, count, recorded)
+	case count < 0 && neg && matches > 0:
+		ts.t.Fatalf("script:%d: recproxy assert %s: %d requests unexpectedly match\n%s", ts.lineno, name, matches, recorded)
+	case count < 0 && !neg && matches == 0:
+		ts.t.Fatalf("script:%d: recproxy assert %s: no request matches\n%s", ts.lineno, name, recorded)
+	}
+}
+
+// closeRecProxies stops the proxies left running by recproxy start.
+func (ts *TestScript) closeRecProxies() {
+	for _, p := range ts.recProxies {
+		p.srv.Close()
+	}
+	ts.recProxies = nil
+}
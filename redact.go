@@ -0,0 +1,61 @@
+package tsar
+
+import (
+	"cmp"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// redactMask replaces the secrets of Params.Redact in logs and failures.
+const redactMask = "[REDACTED]"
+
+// compileRedact splits Params.Redact into the variables whose values are
+// secret and the patterns of secrets.
+func (ts *TestScript) compileRedact() {
+	ts.redactVars, ts.redactRes = nil, nil
+	for _, entry := range ts.params.Redact {
+		if isVarName(entry) {
+			ts.redactVars = append(ts.redactVars, entry)
+			continue
+		}
+		re, err := regexp.Compile(entry)
+		if err != nil {
+			ts.t.Fatalf("Params.Redact: invalid pattern %q: %v", entry, err)
+			continue
+		}
+		ts.redactRes = append(ts.redactRes, re)
+	}
+}
+
+// redact masks the secrets of Params.Redact in s: the values the named
+// variables have in the script, or on the host if the script doesn't set
+// them, as they are and as quoted with %q, then the matches of the
+// patterns.
+func (ts *TestScript) redact(s string) string {
+	var secrets []string
+	for _, name := range ts.redactVars {
+		v, ok := ts.envMap[name]
+		if !ok {
+			v = os.Getenv(name)
+		}
+		if v == "" {
+			continue
+		}
+		secrets = append(secrets, v)
+		if q := strconv.Quote(v); q[1:len(q)-1] != v {
+			secrets = append(secrets, q[1:len(q)-1])
+		}
+	}
+	// Longer secrets first, so that one containing another is masked whole.
+	slices.SortFunc(secrets, func(a, b string) int { return cmp.Compare(len(b), len(a)) })
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redactMask)
+	}
+	for _, re := range ts.redactRes {
+		s = re.ReplaceAllLiteralString(s, redactMask)
+	}
+	return s
+}
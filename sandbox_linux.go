@@ -0,0 +1,186 @@
+//go:build linux
+
+package tsar
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A sandboxed program starts as a copy of the running binary, which builds
+// the sandbox's filesystem view from inside its namespaces and then
+// executes the program; see sandboxInit. The variables below carry the
+// paths it needs, and are removed before the program runs.
+const (
+	sandboxArg0    = "tsar-sandbox"
+	sandboxWorkEnv = "TSAR_SANDBOX_WORK"
+	sandboxHomeEnv = "TSAR_SANDBOX_HOME"
+)
+
+func init() {
+	if len(os.Args) > 2 && os.Args[0] == sandboxArg0 {
+		if work, ok := os.LookupEnv(sandboxWorkEnv); ok {
+			sandboxInit(work, os.Getenv(sandboxHomeEnv))
+		}
+	}
+}
+
+// setSandbox makes cmd start in new mount, PID, network, IPC and UTS
+// namespaces, with a filesystem view in which only work is writable. Unless
+// tsar runs as root, a user namespace maps the current user to root, so
+// that the view can be mounted. The mount namespace is unshared, rather
+// than cloned, so that its mounts are made private and never propagate
+// back to the host.
+func setSandbox(cmd *exec.Cmd, work string) error {
+	attr := cmd.SysProcAttr
+	attr.Cloneflags |= syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	attr.Unshareflags |= syscall.CLONE_NEWNS
+	if uid := os.Geteuid(); uid != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+	}
+
+	work, err := filepath.Abs(work)
+	if err != nil {
+		return err
+	}
+	home, _ := os.UserHomeDir()
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, sandboxWorkEnv+"="+work, sandboxHomeEnv+"="+home)
+	cmd.Args = append([]string{sandboxArg0, cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	return nil
+}
+
+// sandboxInit runs in place of a sandboxed program, as PID 1 of its
+// namespaces: it builds the filesystem view and executes the program, whose
+// path and arguments follow os.Args[0]. It does not return.
+func sandboxInit(work, home string) {
+	env := slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, sandboxWorkEnv+"=") || strings.HasPrefix(kv, sandboxHomeEnv+"=")
+	})
+	err := mountSandbox(work, home)
+	if err == nil {
+		err = syscall.Exec(os.Args[1], os.Args[2:], env)
+	}
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(127)
+}
+
+// mountSandbox remounts every filesystem read-only, hides /tmp and home
+// under empty tmpfs mounts, mounts work back, writable, and /proc afresh
+// for the new PID namespace.
+func mountSandbox(work, home string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// work is opened first, so it can be mounted back once hidden.
+	dir, err := os.Open(work)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if m == "/proc" || strings.HasPrefix(m, "/proc/") {
+			continue // replaced below
+		}
+		if err := remount(m, syscall.MS_RDONLY); err != nil {
+			return fmt.Errorf("remount %s read-only: %v", m, err)
+		}
+	}
+	for _, tmp := range []struct{ dir, mode string }{{"/tmp", "mode=1777"}, {home, "mode=755"}} {
+		d := tmp.dir
+		if d == "" || d == "/" || work == d || strings.HasPrefix(d, work+"/") {
+			continue
+		}
+		if info, err := os.Stat(d); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := syscall.Mount("tmpfs", d, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, tmp.mode); err != nil {
+			return fmt.Errorf("mount tmpfs on %s: %v", d, err)
+		}
+	}
+	if err := os.MkdirAll(work, 0777); err != nil {
+		return err
+	}
+	src := "/proc/self/fd/" + strconv.Itoa(int(dir.Fd()))
+	if err := syscall.Mount(src, work, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mount %s: %v", work, err)
+	}
+	if err := remount(work, 0); err != nil {
+		return fmt.Errorf("remount %s writable: %v", work, err)
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /proc: %v", err)
+	}
+	return os.Chdir(wd)
+}
+
+// remount sets the flags of the mount at target, keeping those that a user
+// namespace may not clear.
+func remount(target string, flags uintptr) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return err
+	}
+	const locked = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+	flags |= uintptr(st.Flags) & locked
+	return syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|flags, "")
+}
+
+// mountPoints lists the mount points of the current mount namespace,
+// parents first.
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var points []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		points = append(points, unescapeMountPoint(fields[4]))
+	}
+	return points, sc.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes, such as \040 for a space,
+// of a mountinfo path.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package tsar
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// setSandbox fails: namespaces are Linux-only.
+func setSandbox(cmd *exec.Cmd, work string) error {
+	return fmt.Errorf("sandbox: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,107 @@
+package tsar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/txtar"
+)
+
+// parsedScript is a script file parsed once and shared, read-only, by every
+// run of it.
+type parsedScript struct {
+	archive *txtar.Archive // embedded files; nil if there are none
+	text    string         // the script lines
+	lines   []string       // text split into lines, for failure context
+	meta    *frontmatter
+}
+
+// scriptCache holds parsed scripts by file name, so a script run many times
+// (retries, repeated runs, benchmarks, watch mode) is parsed once. The file
+// is read every time: an entry is reused only while the SHA-256 of its
+// content is unchanged, since a rewrite may keep the size and modification
+// time. At most maxCachedScripts are kept, the oldest evicted first.
+var scriptCache struct {
+	sync.Mutex
+	entries map[string]cachedScript
+	order   []string // keys of entries, oldest first
+}
+
+const maxCachedScripts = 1024
+
+type cachedScript struct {
+	sum    [sha256.Size]byte
+	script *parsedScript
+}
+
+// loadScript reads and parses a script file, converting it with parser if
+// that matches the file. Native scripts are cached; see scriptCache.
+func loadScript(filename string, parser Parser) (*parsedScript, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if parser != nil && parser.Match(filename) {
+		ar, err := parser.Parse(filename, data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", filepath.Base(filename), err)
+		}
+		return parseScript(ar, ar.Comment)
+	}
+
+	key, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	scriptCache.Lock()
+	c, ok := scriptCache.entries[key]
+	scriptCache.Unlock()
+	if ok && c.sum == sum {
+		return c.script, nil
+	}
+
+	var ar *txtar.Archive
+	if bytes.Contains(data, []byte("-- ")) {
+		ar = txtar.Parse(data)
+		data = ar.Comment
+	}
+	sc, err := parseScript(ar, data)
+	if err != nil {
+		return nil, err
+	}
+
+	scriptCache.Lock()
+	defer scriptCache.Unlock()
+	if scriptCache.entries == nil {
+		scriptCache.entries = make(map[string]cachedScript)
+	}
+	if _, ok := scriptCache.entries[key]; !ok {
+		if len(scriptCache.order) >= maxCachedScripts {
+			delete(scriptCache.entries, scriptCache.order[0])
+			scriptCache.order = scriptCache.order[1:]
+		}
+		scriptCache.order = append(scriptCache.order, key)
+	}
+	scriptCache.entries[key] = cachedScript{sum, sc}
+	return sc, nil
+}
+
+func parseScript(ar *txtar.Archive, data []byte) (*parsedScript, error) {
+	text := string(data)
+	meta, err := parseFrontmatter(text)
+	if err != nil {
+		return nil, err
+	}
+	return &parsedScript{
+		archive: ar,
+		text:    text,
+		lines:   strings.Split(strings.TrimSuffix(text, "\n"), "\n"),
+		meta:    meta,
+	}, nil
+}
@@ -0,0 +1,142 @@
+package tsar
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpRoot serves a directory over SFTP as /: the paths of requests, which
+// pkg/sftp cleans, are resolved below it.
+type sftpRoot struct {
+	dir string
+}
+
+// serveSFTP serves dir on rw until the client is done. rw is left open, for
+// the caller to report an exit status on.
+func serveSFTP(rw io.ReadWriter, dir string) error {
+	root := &sftpRoot{dir: dir}
+	srv := sftp.NewRequestServer(nopCloser{rw}, sftp.Handlers{FileGet: root, FilePut: root, FileCmd: root, FileList: root})
+	err := srv.Serve()
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return err
+}
+
+type nopCloser struct{ io.ReadWriter }
+
+func (nopCloser) Close() error { return nil }
+
+func (r *sftpRoot) path(p string) string {
+	return filepath.Join(r.dir, filepath.FromSlash(p))
+}
+
+func (r *sftpRoot) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	return os.Open(r.path(req.Filepath))
+}
+
+func (r *sftpRoot) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	// Writes come with offsets, so O_APPEND, which WriteAt refuses, is
+	// left out.
+	flags := req.Pflags()
+	mode := os.O_WRONLY
+	if flags.Read {
+		mode = os.O_RDWR
+	}
+	if flags.Creat {
+		mode |= os.O_CREATE
+	}
+	if flags.Trunc {
+		mode |= os.O_TRUNC
+	}
+	if flags.Excl {
+		mode |= os.O_EXCL
+	}
+	return os.OpenFile(r.path(req.Filepath), mode, 0666)
+}
+
+func (r *sftpRoot) Filecmd(req *sftp.Request) error {
+	name := r.path(req.Filepath)
+	switch req.Method {
+	case "Setstat":
+		return r.setstat(name, req)
+	case "Rename", "PosixRename":
+		return os.Rename(name, r.path(req.Target))
+	case "Rmdir", "Remove":
+		return os.Remove(name)
+	case "Mkdir":
+		return os.Mkdir(name, 0777)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (r *sftpRoot) setstat(name string, req *sftp.Request) error {
+	flags, attrs := req.AttrFlags(), req.Attributes()
+	if flags.Size {
+		if err := os.Truncate(name, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(name, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(name, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sftpRoot) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	name := r.path(req.Filepath)
+	switch req.Method {
+	case "List":
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		infos := make(sftpListerAt, 0, len(entries))
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+	case "Stat":
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (r *sftpRoot) Lstat(req *sftp.Request) (sftp.ListerAt, error) {
+	info, err := os.Lstat(r.path(req.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return sftpListerAt{info}, nil
+}
+
+// sftpListerAt lists the entries of a directory, or a single file.
+type sftpListerAt []os.FileInfo
+
+func (l sftpListerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
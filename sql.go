@@ -0,0 +1,173 @@
+package tsar
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sqlDrivers maps DSN schemes to the names their drivers register under,
+// in order of preference, and the build tag of the tsar command that
+// includes one.
+var sqlDrivers = map[string]struct {
+	names []string
+	tag   string
+}{
+	"postgres":   {[]string{"postgres", "pgx"}, "postgres"},
+	"postgresql": {[]string{"postgres", "pgx"}, "postgres"},
+	"mysql":      {[]string{"mysql"}, "mysql"},
+	"sqlite":     {[]string{"sqlite", "sqlite3"}, "sqlite"},
+	"sqlite3":    {[]string{"sqlite", "sqlite3"}, "sqlite"},
+}
+
+// openSQL opens the database of a DSN of the form scheme://..., where the
+// scheme selects the driver: postgres URLs are passed as they are, mysql
+// ones without the scheme (user:pass@tcp(host:3306)/db), and sqlite ones
+// are a file path, relative to $WORK. Other schemes name a driver.
+func (ts *TestScript) openSQL(dsn string) (*sql.DB, error) {
+	scheme, rest, ok := strings.Cut(dsn, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid DSN %q: want scheme://..., such as postgres://user@host/db", dsn)
+	}
+	names, tag := []string{scheme}, ""
+	if d, ok := sqlDrivers[scheme]; ok {
+		names, tag = d.names, d.tag
+	}
+	registered := sql.Drivers()
+	i := slices.IndexFunc(names, func(name string) bool { return slices.Contains(registered, name) })
+	if i < 0 {
+		if tag != "" {
+			return nil, fmt.Errorf("no %s driver registered: import one, or build the tsar command with -tags %s", scheme, tag)
+		}
+		return nil, fmt.Errorf("no %s driver registered", scheme)
+	}
+	switch tag {
+	case "postgres":
+		rest = dsn
+	case "sqlite":
+		rest = ts.mkabs(rest)
+	}
+	return sql.Open(names[i], rest)
+}
+
+// cmdSQL runs a query against the database of a DSN env var and saves its
+// rows as stdout, one per line with tab-separated columns, or compares its
+// single value.
+func (ts *TestScript) cmdSQL(neg bool, args []string) {
+	usage := "usage: sql [-dsn var] query [args...] [==|!=|<|<=|>|>= value]"
+	args = args[1:]
+	dsnVar := "DATABASE_URL"
+	if len(args) > 0 && args[0] == "-dsn" {
+		if len(args) < 2 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		dsnVar, args = args[1], args[2:]
+	}
+	var op, want string
+	// Empty values are dropped when the line is split, as for assert.
+	switch n := len(args); {
+	case n >= 3 && isAssertOp(args[n-2]):
+		op, want, args = args[n-2], args[n-1], args[:n-2]
+	case n >= 2 && isAssertOp(args[n-1]):
+		op, args = args[n-1], args[:n-1]
+	}
+	if len(args) < 1 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	dsn := ts.envMap[dsnVar]
+	if dsn == "" {
+		ts.t.Fatalf("script:%d: sql: $%s is not set", ts.lineno, dsnVar)
+		return
+	}
+	query := args[0]
+	queryArgs := make([]any, len(args)-1)
+	for i, arg := range args[1:] {
+		queryArgs[i] = arg
+	}
+
+	db, err := ts.openSQL(dsn)
+	if err != nil {
+		ts.t.Fatalf("script:%d: sql: %v", ts.lineno, err)
+		return
+	}
+	defer db.Close()
+	rows, err := ts.queryRows(db, query, queryArgs)
+	if err != nil {
+		ts.t.Fatalf("script:%d: sql: %v", ts.lineno, err)
+		return
+	}
+	var out strings.Builder
+	for _, row := range rows {
+		out.WriteString(strings.Join(row, "\t") + "\n")
+	}
+	ts.stdout, ts.stderr = out.String(), ""
+
+	switch {
+	case op != "":
+		if len(rows) != 1 || len(rows[0]) != 1 {
+			ts.t.Fatalf("script:%d: sql: query returned %d rows of %d columns, want one value", ts.lineno, len(rows), columns(rows))
+			return
+		}
+		if got := rows[0][0]; compareValues(got, op, want) == neg {
+			verb := "failed"
+			if neg {
+				verb = "unexpectedly holds"
+			}
+			ts.t.Fatalf("script:%d: sql %s %s %s %s\n%s", ts.lineno, strings.Join(args, " "), op, want, verb, diffValues(got, want))
+		}
+	case neg && len(rows) > 0:
+		ts.t.Fatalf("script:%d: sql: query returned %d rows, want none:\n%s", ts.lineno, len(rows), ts.stdout)
+	}
+}
+
+// queryRows runs a query and returns its rows, each value as text: NULL for
+// null, and times in RFC 3339 format.
+func (ts *TestScript) queryRows(db *sql.DB, query string, args []any) ([][]string, error) {
+	rows, err := db.QueryContext(ts.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result [][]string
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(cols))
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+				row[i] = "NULL"
+			case []byte:
+				row[i] = string(v)
+			case time.Time:
+				row[i] = v.Format(time.RFC3339Nano)
+			default:
+				row[i] = fmt.Sprint(v)
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// columns returns the number of columns of rows, 0 if there are none.
+func columns(rows [][]string) int {
+	if len(rows) == 0 {
+		return 0
+	}
+	return len(rows[0])
+}
@@ -0,0 +1,407 @@
+package tsar
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// An sshServer is an SSH server started by sshserver start. It accepts the
+// script's client key for any user, runs exec'd commands in the work
+// directory and serves it over SFTP.
+type sshServer struct {
+	ln     net.Listener
+	config *ssh.ServerConfig
+	key    ssh.PublicKey // host key
+	root   string
+	env    []string
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func startSSH(root string, env []string, clientKey ssh.PublicKey) (*sshServer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	want := clientKey.Marshal()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), want) {
+				return nil, fmt.Errorf("key of %s is not the script's", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &sshServer{
+		ln:     ln,
+		config: config,
+		key:    hostKey.PublicKey(),
+		root:   root,
+		env:    env,
+		conns:  make(map[net.Conn]bool),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *sshServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.session(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *sshServer) close() {
+	s.cancel()
+	s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// session runs a connection until the client disconnects: its session
+// channels are served, and everything else refused.
+func (s *sshServer) session(conn net.Conn) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ssh.DiscardRequests(reqs)
+	}()
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.channel(ch, reqs)
+		}()
+	}
+}
+
+// channel serves a session channel: the first exec, shell or sftp
+// subsystem request starts what the channel runs. Environment requests are
+// accepted, but commands get the script's environment.
+func (s *sshServer) channel(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		var payload struct{ Value string }
+		switch req.Type {
+		case "env":
+			req.Reply(true, nil)
+			continue
+		case "exec", "subsystem":
+			if ssh.Unmarshal(req.Payload, &payload) != nil || req.Type == "subsystem" && payload.Value != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+		case "shell":
+		default:
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		// Requests that come once it runs are refused.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for req := range reqs {
+				req.Reply(req.Type == "env", nil)
+			}
+		}()
+		status := 0
+		if req.Type == "subsystem" {
+			serveSFTP(ch, s.root)
+		} else {
+			status = s.run(ch, payload.Value)
+		}
+		ch.CloseWrite()
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		ch.Close()
+		<-done
+		return
+	}
+}
+
+// run runs command, or an interactive shell reading commands from stdin,
+// with sh in the work directory, and returns its exit status.
+func (s *sshServer) run(ch ssh.Channel, command string) int {
+	args := []string{}
+	if command != "" {
+		args = append(args, "-c", command)
+	}
+	cmd := exec.CommandContext(s.ctx, "sh", args...)
+	cmd.Dir = s.root
+	cmd.Env = s.env
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		io.WriteString(cmd.Stderr, err.Error()+"\n")
+		return 127
+	}
+	// Not waited for: a command that exits without reading its input must
+	// not wait for the client to close it.
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return max(exitErr.ExitCode(), 1)
+	} else if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// An sshAgent is an in-process SSH agent holding the script's client key,
+// for programs that authenticate through SSH_AUTH_SOCK.
+type sshAgent struct {
+	ln  net.Listener
+	key ssh.PublicKey
+	wg  sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func startSSHAgent(sock string, key ed25519.PrivateKey) (*sshAgent, error) {
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "tsar"}); err != nil {
+		return nil, err
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	a := &sshAgent{ln: ln, key: pub, conns: make(map[net.Conn]bool)}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			a.mu.Lock()
+			a.conns[conn] = true
+			a.mu.Unlock()
+			a.wg.Add(1)
+			go func() {
+				defer a.wg.Done()
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+				a.mu.Lock()
+				delete(a.conns, conn)
+				a.mu.Unlock()
+			}()
+		}
+	}()
+	return a, nil
+}
+
+func (a *sshAgent) close() {
+	a.ln.Close()
+	a.mu.Lock()
+	for conn := range a.conns {
+		conn.Close()
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+}
+
+// sshDir returns the directory of the script's SSH files, creating them
+// with its client key and agent on first use: the private key id_ed25519
+// and its .pub, authorized_keys, known_hosts and the agent socket.
+func (ts *TestScript) sshDir() (string, error) {
+	dir := filepath.Join(ts.workdir, ".ssh")
+	if ts.sshAgent != nil {
+		return dir, nil
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "tsar")
+	if err != nil {
+		return "", err
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return "", err
+	}
+	authorized := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pub)), "\n") + " tsar\n"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	for name, data := range map[string][]byte{
+		"id_ed25519":      pem.EncodeToMemory(block),
+		"id_ed25519.pub":  []byte(authorized),
+		"authorized_keys": []byte(authorized),
+		"known_hosts":     nil,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			return "", err
+		}
+	}
+	a, err := startSSHAgent(filepath.Join(dir, "agent.sock"), key)
+	if err != nil {
+		return "", err
+	}
+	ts.sshAgent = a
+	ts.Setenv("SSH_AUTH_SOCK", filepath.Join(dir, "agent.sock"))
+	ts.Setenv("SSH_KNOWN_HOSTS", filepath.Join(dir, "known_hosts"))
+	ts.Setenv("SSH_IDENTITY", filepath.Join(dir, "id_ed25519"))
+	return dir, nil
+}
+
+// cmdSSHServer runs SSH servers for programs that work over SSH or SFTP:
+// sshserver start starts one accepting the script's throwaway key, run
+// commands in the work directory and serving it over SFTP.
+func (ts *TestScript) cmdSSHServer(neg bool, args []string) {
+	usage := "usage: sshserver start [&name&] | sshserver stop [&name&]"
+	if len(args) < 2 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	sub, args := args[1], args[2:]
+	name, args := cutNameSpecifier(args, "ssh")
+	if neg {
+		ts.t.Fatalf("script:%d: sshserver %s does not support negation", ts.lineno, sub)
+		return
+	}
+	if len(args) != 0 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	switch sub {
+	case "start":
+		if ts.sshServers[name] != nil {
+			ts.t.Fatalf("script:%d: sshserver start: %q is already running; name another with &name&", ts.lineno, name)
+			return
+		}
+		dir, err := ts.sshDir()
+		if err != nil {
+			ts.t.Fatalf("script:%d: sshserver start: %v", ts.lineno, err)
+			return
+		}
+		s, err := startSSH(ts.workdir, append([]string(nil), ts.env...), ts.sshAgent.key)
+		if err != nil {
+			ts.t.Fatalf("script:%d: sshserver start: %v", ts.lineno, err)
+			return
+		}
+		if ts.sshServers == nil {
+			ts.sshServers = make(map[string]*sshServer)
+		}
+		ts.sshServers[name] = s
+		addr := s.ln.Addr().String()
+		host, port, _ := net.SplitHostPort(addr)
+		f, err := os.OpenFile(filepath.Join(dir, "known_hosts"), os.O_APPEND|os.O_WRONLY, 0)
+		if err == nil {
+			_, err = f.WriteString(knownhosts.Line([]string{addr}, s.key) + "\n")
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			ts.t.Fatalf("script:%d: sshserver start: %v", ts.lineno, err)
+			return
+		}
+		prefix := strings.ToUpper(name)
+		ts.Setenv(prefix+"_ADDR", addr)
+		ts.Setenv(prefix+"_HOST", host)
+		ts.Setenv(prefix+"_PORT", port)
+	case "stop":
+		s := ts.sshServers[name]
+		if s == nil {
+			ts.t.Fatalf("script:%d: sshserver stop: no server %q; start one with sshserver start &%s&", ts.lineno, name, name)
+			return
+		}
+		s.close()
+		delete(ts.sshServers, name)
+	default:
+		ts.t.Fatalf("script:%d: sshserver: unknown subcommand %q; %s", ts.lineno, sub, usage)
+	}
+}
+
+// closeSSH stops the servers left running by sshserver start, and the
+// agent.
+func (ts *TestScript) closeSSH() {
+	for _, s := range ts.sshServers {
+		s.close()
+	}
+	ts.sshServers = nil
+	if ts.sshAgent != nil {
+		ts.sshAgent.close()
+		ts.sshAgent = nil
+	}
+}
@@ -0,0 +1,223 @@
+package tsar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tcpExpectTimeout bounds tcp expect and tcp connect without -timeout.
+const tcpExpectTimeout = 10 * time.Second
+
+// A tcpConn is a connection opened by tcp connect, with the data received
+// but not yet consumed by tcp expect.
+type tcpConn struct {
+	conn net.Conn
+	buf  []byte
+	eof  bool // the server closed its side
+}
+
+// cmdTCP talks to raw TCP servers: tcp connect opens a connection, tcp send
+// writes to it and tcp expect waits for the server to send a match.
+// Connections are named by a trailing &name&, like background execs, and
+// closed when the script ends.
+func (ts *TestScript) cmdTCP(neg bool, args []string) {
+	usage := "usage: tcp connect [-timeout d] host:port [&name&] | tcp send [-n] data... [&name&] | tcp expect [-timeout d] pattern [&name&] | tcp close [&name&]"
+	if len(args) < 2 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	sub, args := args[1], args[2:]
+	name, args := cutNameSpecifier(args, "tcp")
+	timeout := tcpExpectTimeout
+	if (sub == "connect" || sub == "expect") && len(args) > 0 && args[0] == "-timeout" {
+		if len(args) < 2 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			ts.t.Fatalf("script:%d: tcp %s: invalid timeout %q", ts.lineno, sub, args[1])
+			return
+		}
+		timeout, args = d, args[2:]
+	}
+	if neg && sub != "connect" && sub != "expect" {
+		ts.t.Fatalf("script:%d: tcp %s does not support negation", ts.lineno, sub)
+		return
+	}
+
+	switch sub {
+	case "connect":
+		if len(args) != 1 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		ts.tcpConnect(neg, name, args[0], timeout)
+		return
+	case "send", "expect", "close":
+	default:
+		ts.t.Fatalf("script:%d: tcp: unknown subcommand %q; %s", ts.lineno, sub, usage)
+		return
+	}
+	c := ts.tcpConns[name]
+	if c == nil {
+		ts.t.Fatalf("script:%d: tcp %s: no connection %q; open one with tcp connect host:port &%s&", ts.lineno, sub, name, name)
+		return
+	}
+	switch sub {
+	case "send":
+		newline := true
+		if len(args) > 0 && args[0] == "-n" {
+			newline, args = false, args[1:]
+		}
+		data, err := unescapeTCP(strings.Join(args, " "))
+		if err != nil {
+			ts.t.Fatalf("script:%d: tcp send: %v", ts.lineno, err)
+			return
+		}
+		if newline {
+			data += "\n"
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(tcpExpectTimeout))
+		if _, err := c.conn.Write([]byte(data)); err != nil {
+			ts.t.Fatalf("script:%d: tcp send %s: %v", ts.lineno, name, err)
+		}
+	case "expect":
+		if len(args) != 1 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			ts.t.Fatalf("script:%d: tcp expect: invalid pattern %q: %v", ts.lineno, args[0], err)
+			return
+		}
+		ts.tcpExpect(neg, name, c, re, timeout)
+	case "close":
+		if len(args) != 0 {
+			ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+			return
+		}
+		c.conn.Close()
+		delete(ts.tcpConns, name)
+	}
+}
+
+// tcpConnect opens connection name to addr, which dns aliases apply to, or
+// with neg checks that nothing accepts connections there.
+func (ts *TestScript) tcpConnect(neg bool, name, addr string, timeout time.Duration) {
+	if _, ok := ts.tcpConns[name]; ok && !neg {
+		ts.t.Fatalf("script:%d: tcp connect: connection %q is already open; close it first or name another with &name&", ts.lineno, name)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ts.ctx, timeout)
+	defer cancel()
+	conn, err := ts.aliases.dialContext(ctx, "tcp", addr)
+	switch {
+	case neg && err == nil:
+		conn.Close()
+		ts.t.Fatalf("script:%d: tcp connect %s: unexpectedly connected", ts.lineno, addr)
+	case neg:
+		ts.t.Logf("tcp connect %s: %v", addr, err)
+	case err != nil:
+		ts.t.Fatalf("script:%d: tcp connect: %v", ts.lineno, err)
+	default:
+		if ts.tcpConns == nil {
+			ts.tcpConns = make(map[string]*tcpConn)
+		}
+		ts.tcpConns[name] = &tcpConn{conn: conn}
+	}
+}
+
+// tcpExpect reads from c until the data received since the last expect
+// matches re, then consumes it up to the end of the match and saves it as
+// stdout. With neg, it checks that nothing matching arrives within timeout.
+func (ts *TestScript) tcpExpect(neg bool, name string, c *tcpConn, re *regexp.Regexp, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ts.ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	chunk := make([]byte, 4096)
+	for {
+		if loc := re.FindIndex(c.buf); loc != nil {
+			got := string(c.buf[:loc[1]])
+			c.buf = c.buf[loc[1]:]
+			ts.stdout, ts.stderr = got, ""
+			if neg {
+				ts.t.Fatalf("script:%d: tcp expect %s: unexpected match for %#q in %q", ts.lineno, name, re, got)
+			}
+			return
+		}
+		if c.eof {
+			break
+		}
+		c.conn.SetReadDeadline(deadline)
+		n, err := c.conn.Read(chunk)
+		c.buf = append(c.buf, chunk[:n]...)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		} else if err != nil {
+			c.eof = true
+		}
+	}
+	ts.stdout, ts.stderr = "", ""
+	if neg {
+		return
+	}
+	why := fmt.Sprintf("nothing matched within %v", timeout)
+	if c.eof {
+		why = "connection closed without a match"
+	}
+	ts.t.Fatalf("script:%d: tcp expect %s: %s for %#q; received %q", ts.lineno, name, why, re, c.buf)
+}
+
+// unescapeTCP interprets Go escape sequences, such as \r\n, \t and \x00, in
+// data to send.
+func unescapeTCP(s string) (string, error) {
+	var b strings.Builder
+	orig := s
+	for s != "" {
+		if s[0] != '\\' {
+			b.WriteByte(s[0])
+			s = s[1:]
+			continue
+		}
+		r, multibyte, tail, err := strconv.UnquoteChar(s, 0)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %q", orig)
+		}
+		if multibyte {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte(byte(r))
+		}
+		s = tail
+	}
+	return b.String(), nil
+}
+
+// cutNameSpecifier removes a trailing &name& from args, naming a server or
+// connection like a background command, and returns the name, or def.
+func cutNameSpecifier(args []string, def string) (string, []string) {
+	if n := len(args); n > 0 {
+		if m := backgroundSpecifier.FindStringSubmatch(args[n-1]); m != nil && m[1] != "" {
+			return m[1], args[:n-1]
+		}
+	}
+	return def, args
+}
+
+// closeTCP closes the connections left open by tcp connect.
+func (ts *TestScript) closeTCP() {
+	for _, c := range ts.tcpConns {
+		c.conn.Close()
+	}
+	ts.tcpConns = nil
+}
@@ -37,11 +37,15 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
+	"math/rand/v2"
 	"mime/multipart"
 	"net/http"
 	"net/http/cookiejar"
 	"os"
 	"os/exec"
+	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -53,6 +57,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gfanton/tsar/tsarscript"
 	"golang.org/x/tools/txtar"
 )
 
@@ -70,9 +75,29 @@ type TestingT interface {
 // Params holds parameters for a call to Run.
 type Params struct {
 	// Dir is the directory holding the test scripts.
-	// All files in the directory with a .tsar extension are considered to be test scripts.
+	// All files in the directory with a .tsar extension are considered to be test scripts;
+	// see Extensions.
 	Dir string
 
+	// Files lists the test scripts to run when Dir is empty, as in
+	// testscript.
+	Files []string
+
+	// Extensions lists the file extensions of the test scripts in Dir.
+	// If empty, it is .tsar, plus .txt and .txtar with Compat.
+	Extensions []string
+
+	// Compat, if true, runs scripts written for go-internal's testscript
+	// with its semantics rather than tsar's: lines are split by its quoting
+	// rules (single quotes only, with '' for a literal quote; # starts a
+	// comment; variables expanded per word, never inside quotes), several
+	// conditions may prefix a line, stdout, stderr and grep match multi-line
+	// regexps and accept -count=N, exec arguments are never redirections,
+	// every command must be a builtin or custom one, and $/, $:, $$ and
+	// $devnull are defined. tsar's own commands remain available, so suites
+	// can be migrated one script at a time.
+	Compat bool
+
 	// Commands holds a map of command names to their implementations.
 	// When a command 'foo' is invoked, the function is called with the TestScript
 	// context, a boolean indicating whether the command was invoked with '!',
@@ -88,6 +113,15 @@ type Params struct {
 	// If empty, the work directories will be created inside $TMPDIR.
 	WorkdirRoot string
 
+	// WorkdirMode selects how work directories are provided: fresh
+	// temporary directories (the default), directories on a memory-backed
+	// filesystem, pooled directories emptied and reused between scripts,
+	// or one directory reused by every script. See WorkdirMode. Kept work
+	// directories (TestWork or WorkdirRoot) are never emptied for another
+	// script: WorkdirPool then gives each script a fresh one, which is
+	// kept, and WorkdirReuse keeps the last script's files.
+	WorkdirMode WorkdirMode
+
 	// Setup is called, if non-nil, to complete any setup required for the test.
 	// The working directory and environment variables are set up
 	// before calling Setup; see the package documentation for details.
@@ -100,13 +134,21 @@ type Params struct {
 	// returns true or nil.
 	Condition func(cond string) (bool, error)
 
+	// UnknownCondition selects what happens when a script line, or a
+	// skip-on directive, uses a condition that is neither built in nor
+	// known to Condition: fail the script (the default), skip the line, or
+	// skip the whole script. Condition reports unknown conditions by
+	// returning an error wrapping ErrUnknownCondition.
+	UnknownCondition UnknownConditionPolicy
+
 	// RequireExplicitExec, if true, requires that commands be invoked
 	// through the 'exec' builtin, and causes simple command invocation
 	// to result in errors.
 	RequireExplicitExec bool
 
 	// RequireUniqueNames, if true, requires that all script files
-	// have unique base names (excluding extensions).
+	// have unique base names (excluding extensions). A script's
+	// "# tsar:unique-names" directive overrides it; see RequiresUniqueName.
 	RequireUniqueNames bool
 
 	// ContinueOnError causes Run to continue executing tests after an error.
@@ -114,6 +156,22 @@ type Params struct {
 	// of later tests.
 	ContinueOnError bool
 
+	// Timeout, if positive, bounds the total duration of a run. When it
+	// expires, in-flight commands are interrupted, the running script fails,
+	// and the remaining scripts are not run.
+	Timeout time.Duration
+
+	// Context, if non-nil, bounds the run like Timeout: once it is done,
+	// in-flight commands and their process groups are stopped, the running
+	// script fails, and the remaining scripts are not run. The tsar command
+	// cancels it on interrupt.
+	Context context.Context
+
+	// MaxFailures, if positive, makes the standalone runners stop after this
+	// many scripts have failed, regardless of ContinueOnError. Scripts that
+	// were not run are listed in the final failure message.
+	MaxFailures int
+
 	// TestSetup is the path to a shell script to run before each test,
 	// after the Params.Setup callback. The script runs via /bin/sh in the
 	// test's work directory with the test's environment.
@@ -122,7 +180,324 @@ type Params struct {
 	// TestTeardown is the path to a shell script to run after each test,
 	// before finalize. Runs even on failure; errors are logged but don't
 	// change the test result.
+	//
+	// Both hooks get TSAR_TEST_NAME, TSAR_SCRIPT_FILE and TSAR_WORK in their
+	// environment; TestTeardown also gets TSAR_STATUS, one of pass, fail or
+	// skip.
 	TestTeardown string
+
+	// DryRun, if true, checks scripts without executing them: frontmatter
+	// and lines are parsed, conditions evaluated, and each command resolved
+	// against the builtin and custom commands, the archive files and the
+	// test PATH. The Setup callback runs so the environment is complete, but
+	// archives are not extracted and hook scripts do not run.
+	DryRun bool
+
+	// Trace, if true, logs each script line just before it executes, after
+	// condition evaluation and environment expansion, with its line number.
+	Trace bool
+
+	// UpdateScripts, if true, rewrites mismatching golden files instead of
+	// failing: a tree command whose manifest is a file of the script's
+	// archive updates that file in the script.
+	UpdateScripts bool
+
+	// DownloadCache is the directory where the download command keeps files
+	// fetched with -sha256, named by digest. It defaults to tsar/downloads
+	// under os.UserCacheDir.
+	DownloadCache string
+
+	// Color, if true, colors the diffs of failing cmp and cmpenv commands
+	// with ANSI escapes.
+	Color bool
+
+	// ArtifactDir, if set, is where scripts save files too large to log,
+	// such as the full actual content of a failing cmp, each script in a
+	// subdirectory named after it. By default they are saved under
+	// $WORK/.tsar/artifacts and removed with the work directory unless
+	// TestWork is set.
+	ArtifactDir string
+
+	// FailOnLeakedBackground, if true, fails a script that ends with
+	// background commands it never waited for. Such commands are always
+	// killed, with their process group, and their output is logged.
+	FailOnLeakedBackground bool
+
+	// FailOnMissingRequires, if true, fails a script whose requires
+	// directive or command names a program missing from PATH, rather than
+	// skipping it.
+	FailOnMissingRequires bool
+
+	// EnvDiff, if true, logs on failure how the script's environment
+	// differs from the one tsar started it with, before Params.Setup: each
+	// variable added, removed or changed, and the script line (or
+	// Params.Setup) that last changed it.
+	EnvDiff bool
+
+	// HostAliases maps host names to the addresses, such as test servers'
+	// ("127.0.0.1:8080" or a URL), that connections to them go to, so
+	// scripts can use realistic URLs against local fixtures. An address
+	// without a port keeps the port being dialed. The http and download
+	// commands dial the aliased addresses directly; exec'd programs go
+	// through a local proxy set in HTTP_PROXY and HTTPS_PROXY, so only
+	// programs honoring those are covered. Scripts add aliases with dns.
+	HostAliases map[string]string
+
+	// CaptureHTTP, if true, points every exec'd program at a local proxy
+	// through HTTP_PROXY and HTTPS_PROXY that records the requests it
+	// makes, for the requested command. HTTPS is decrypted with
+	// certificates from a CA generated per run, written to
+	// $WORK/.tsar/proxy-ca.pem and set in SSL_CERT_FILE, CURL_CA_BUNDLE,
+	// REQUESTS_CA_BUNDLE, NODE_EXTRA_CA_CERTS and TSAR_PROXY_CA; programs
+	// trusting other roots fail their TLS handshakes. Upstream certificates
+	// are not verified. Scripts can enable it with "# tsar:capture-http".
+	CaptureHTTP bool
+
+	// ExecMode, if ExecRecord, records the result of every program the
+	// scripts exec (stdout, stderr and exit code, keyed by its arguments
+	// and a digest of its input) in a cassette, <script>.cassette.json in
+	// CassetteDir; with ExecReplay, programs are not run and their results
+	// are served from the cassette instead, for fast and deterministic
+	// runs without the tools installed. A script running a program in
+	// replay that it did not in recording fails, and requires is always
+	// satisfied. Only results are replayed, not the files programs write,
+	// and background programs always run. A cassette is only written when
+	// its script passes.
+	ExecMode ExecMode
+
+	// CassetteDir is the directory holding the cassettes of ExecMode. It
+	// defaults to each script's directory.
+	CassetteDir string
+
+	// Seed, if nonzero, is the $TSAR_SEED of every script, which seeds
+	// the random values of the rand command and $RANDOM; by default each
+	// script gets a random seed. The seed of a failed script that used
+	// random values is reported with its failure, to reproduce it.
+	Seed uint64
+
+	// Sandbox, if true, runs every exec'd program in new mount, PID,
+	// network, IPC and UTS namespaces, and a user namespace in which it is
+	// root when tsar is not, so it can mount, kill or reconfigure things
+	// without affecting the host. Only the work directory is writable: the
+	// other filesystems are read-only, /tmp and the home directory empty
+	// tmpfs mounts, and /proc shows the namespace's processes alone. Only
+	// loopback, down, is on its network.
+	// Scripts can enable it with a "# tsar:sandbox" directive, and single
+	// programs with exec -sandbox. It is only supported on Linux.
+	Sandbox bool
+
+	// CheckLeaks, if true, fails a script that leaves goroutines, open
+	// file descriptors or entries in os.TempDir behind, compared with just
+	// before its first line ran; the report lists the custom commands the
+	// script ran, the likely culprits. The counts are process-wide, so
+	// scripts should not run in parallel with other work.
+	CheckLeaks bool
+
+	// Parallel, if true, makes Run and RunT run scripts in parallel with
+	// each other, as parallel subtests; it needs a test type with Parallel
+	// and Cleanup methods, such as *testing.T, and is ignored with
+	// WorkdirReuse. OnStart and OnResult may then be called concurrently.
+	Parallel bool
+
+	// Count, if greater than 1, runs each script that many times, each
+	// time in a fresh work directory, as scripts named name#1, name#2 and
+	// so on, to reproduce intermittent failures. With Parallel, the runs
+	// of a script run in parallel with each other too. Once all the runs
+	// are done, each script's pass rate is logged; a standalone run stops
+	// after a failed script only once all its runs are done.
+	Count int
+
+	// OnStart, if non-nil, is called with the name of each script just
+	// before it starts.
+	OnStart func(name string)
+
+	// OnResult, if non-nil, is called with the outcome of each script once
+	// it has finished and its work directory has been cleaned up.
+	OnResult func(ScriptResult)
+
+	// Events, if non-nil, is called with an Event as each script starts and
+	// ends, and around each command it runs, for custom reporters and
+	// metrics. Like OnStart and OnResult, it may be called concurrently
+	// with Parallel.
+	Events func(Event)
+
+	// SaveOutput, if true, writes the stdout and stderr of every exec to
+	// numbered files under $WORK/.tsar/out (001.stdout, 001.stderr, ...) so
+	// later commands can check any earlier command's output. Scripts can
+	// also enable it with a "# tsar:save-output" directive.
+	SaveOutput bool
+
+	// MaxOutputBytes bounds how much of each exec's stdout and stderr is
+	// retained, logged and matched by later commands. Output beyond the
+	// limit keeps its first and last halves, joined by a
+	// "[... N bytes truncated ...]" marker. Zero means 16 MiB; a negative
+	// value keeps all output.
+	MaxOutputBytes int
+
+	// Home selects the home directory of scripts: $HOME is /no-home, which
+	// does not exist (HomeNone, the default), a writable directory under
+	// $WORK with XDG base directories in it (HomeTemp), or the user's own
+	// (HomeHost). See HomeMode.
+	Home HomeMode
+
+	// SharedGoCache, if true, points the GOCACHE and GOMODCACHE of every
+	// script at directories shared by all scripts and runs, tsar/go under
+	// os.UserCacheDir, so that scripts running go build don't each rebuild
+	// the standard library and their dependencies. GOPATH stays per script,
+	// in $WORK/gopath.
+	SharedGoCache bool
+
+	// GoProxyDir, if set, is a directory of Go module fixtures served to
+	// every script by a module proxy of its own, which GOPROXY points at,
+	// with GONOSUMDB=* so that the fixtures need no checksum database:
+	// scripts running go get or go mod download then resolve modules
+	// without the network. Each fixture is a txtar archive or directory
+	// named after the escaped module path, with slashes replaced by
+	// underscores, and the version, such as example.com_hello_v1.0.0.txtar.
+	// Its .mod file is the module's go.mod, defaulting to its go.mod file,
+	// an optional .info file its version info, and its other files the
+	// module's content. Scripts can serve fixtures of their own with
+	// goproxy start.
+	GoProxyDir string
+
+	// Env holds KEY=VALUE entries added to the initial environment of every
+	// script, overriding tsar's own, before Setup runs: configuration common
+	// to a suite that needs neither a Setup function nor env lines.
+	Env []string
+
+	// PassThroughEnv lists the host environment variables copied into the
+	// initial environment of every script, such as credentials and proxy
+	// settings, as names or path.Match patterns like AWS_*. They override
+	// tsar's own variables, except WORK, and are overridden by Env.
+	PassThroughEnv []string
+
+	// Redact lists secrets masked as [REDACTED] in everything scripts log,
+	// such as the output of exec'd programs and environment dumps, and in
+	// their failure messages, for suites that must use real credentials in
+	// CI. Each entry is the name of an environment variable, whose value in
+	// the script, or else on the host, is masked, or a regular expression
+	// matching secrets, such as `ghp_\w+`. Files, such as those saved to
+	// ArtifactDir, are not redacted.
+	Redact []string
+
+	// Locale is the LANG and LC_ALL of every script, and Timezone its TZ,
+	// so that programs whose output depends on them, such as sort, date or
+	// number formatting, produce reproducible golden files. They default
+	// to C and UTC; scripts can still change them with env.
+	Locale   string
+	Timezone string
+
+	// NormalizeNewlines, if true, turns \r\n line endings into \n in the
+	// output of exec'd programs, as soon as it is captured, and in the files
+	// that cmp, grep and the other matching commands read, so that scripts
+	// written on Unix pass on Windows. Files are not rewritten on disk.
+	NormalizeNewlines bool
+
+	// Parser, if non-nil, converts script files in other formats into tsar
+	// scripts before they run. Run and RunStandalone also collect the files
+	// in Dir that it matches, alongside *.tsar files.
+	Parser Parser
+
+	// Tags, if non-empty, restricts the run to scripts declaring at least
+	// one of these tags with a "# tsar:tags=..." frontmatter directive.
+	// Other scripts are skipped.
+	Tags []string
+}
+
+// A Parser converts script files in another on-disk format, such as
+// YAML-described steps, into tsar scripts so they can reuse the engine.
+type Parser interface {
+	// Match reports whether the parser handles the named file.
+	Match(filename string) bool
+
+	// Parse converts a file's contents. The archive's Comment holds the
+	// script lines, including any frontmatter, and its Files are extracted
+	// into the work directory.
+	Parse(filename string, data []byte) (*txtar.Archive, error)
+}
+
+// ScriptStatus is the outcome of a script.
+type ScriptStatus string
+
+const (
+	StatusPass ScriptStatus = "pass"
+	StatusFail ScriptStatus = "fail"
+	StatusSkip ScriptStatus = "skip"
+)
+
+// ScriptResult describes a finished script; see Params.OnResult.
+type ScriptResult struct {
+	Name     string
+	File     string
+	Run      int // which of the Params.Count runs, from 1; 0 without Count
+	Status   ScriptStatus
+	Duration time.Duration
+
+	// WorkDir is the script's work directory. It has already been removed,
+	// or emptied for reuse (see Params.WorkdirMode), unless Params.TestWork
+	// (or WorkdirRoot) was set.
+	WorkDir string
+
+	// Failure is the first failure message and FailureLine the script line
+	// being executed when it was reported. Both are zero unless Status is
+	// StatusFail.
+	Failure     string
+	FailureLine int
+
+	// Sections holds the outcome of each section the script started, in
+	// order; see the section command.
+	Sections []SectionResult
+
+	// Artifacts lists files the script saved because they were too large
+	// to log, such as the full actual content of a failing cmp; see
+	// Params.ArtifactDir.
+	Artifacts []string
+}
+
+// SectionResult describes a finished section of a script.
+type SectionResult struct {
+	Name     string
+	Status   ScriptStatus
+	Duration time.Duration
+}
+
+// EventKind identifies an Event.
+type EventKind string
+
+const (
+	EventScriptStart  EventKind = "script-start"
+	EventScriptEnd    EventKind = "script-end"
+	EventCommandStart EventKind = "command-start"
+	EventCommandEnd   EventKind = "command-end"
+)
+
+// An Event reports the progress of a script; see Params.Events.
+type Event struct {
+	Kind   EventKind
+	Time   time.Time
+	Script string // name of the script
+	File   string // path of the script file
+
+	// Line, Neg and Args describe the command of command events: its
+	// script line, whether it was negated with "!", and its expanded words,
+	// starting with the command name.
+	Line int
+	Neg  bool
+	Args []string
+
+	// Status and Duration are the outcome of end events. A command fails
+	// if it fails the script or, under check, records a soft failure.
+	Status   ScriptStatus
+	Duration time.Duration
+
+	// Failure is the first failure message of a failed script, for
+	// EventScriptEnd.
+	Failure string
+
+	// StdoutBytes and StderrBytes are the sizes of the output the last exec
+	// left for later commands, for EventCommandEnd.
+	StdoutBytes int
+	StderrBytes int
 }
 
 // An Env holds the environment variables to use for a test script invocation.
@@ -154,22 +529,34 @@ func (e *Env) Setenv(key, value string) {
 	e.Values = append(e.Values, entry)
 }
 
+// Defer arranges for f to be called when the script ends; see
+// [TestScript.Defer].
+func (e *Env) Defer(f func()) {
+	e.ts.Defer(f)
+}
+
 // TestScript holds execution state for a single test script.
 type TestScript struct {
 	t        TestingT
 	testDir  string // directory holding the test script
 	workdir  string // temporary work directory ($WORK)
 	log      bytes.Buffer
-	mark     int    // offset of next log truncation
-	cd       string // current directory during test execution; initially $WORK
-	name     string // short name of test ("foo")
-	file     string // full path to test file
-	lineno   int    // line number currently being processed
-	line     string // line currently being processed (for error messages)
+	mark     int      // offset of next log truncation
+	cd       string   // current directory during test execution; initially $WORK
+	dirStack []string // directories saved by pushd
+	name     string   // short name of test ("foo")
+	file     string   // full path to test file
+	runNum   int      // run number with Params.Count, or 0
+	lineno   int      // line number currently being processed
+	line     string   // line currently being processed (for error messages)
+	lines    []string // script lines, for failure context
+	running  string   // expanded command line being executed, if any
 	env      []string
 	envMap   map[string]string // memo of env var key → value mapping
+	vars     map[string]string // script-local variables set by 'set'; not exported
 	stdout   string            // standard output from last 'exec' command
 	stderr   string            // standard error from last 'exec' command
+	output   execOutput        // output of the last 'exec' or 'wait', interleaved
 	stopped  bool              // test wants to stop early
 	httpResp struct {
 		statusCode int
@@ -178,24 +565,76 @@ type TestScript struct {
 		body       string
 	}
 	start      time.Time
-	background []backgroundCmd // backgrounded 'exec' commands
-
-	logfiles []string // files registered via logfile command; dumped on failure
-
-	httpClient *http.Client // per-test HTTP client with cookie jar
+	background []*backgroundCmd // backgrounded 'exec' commands
+
+	runCtx   context.Context // bounds the whole run; see Params.Timeout
+	workdirs *workdirs       // provides workdir; see Params.WorkdirMode
+	ctx      context.Context // cancelled when the script times out or finishes
+	cancel   context.CancelFunc
+	meta     *frontmatter // directives from the script's frontmatter
+
+	logfiles []string        // files registered via logfile command; dumped on failure
+	checks   []string        // failures recorded by 'check', reported when the script ends
+	execs    int             // number of exec outputs saved; see Params.SaveOutput
+	exitCode int             // exit status of the last exec
+	exited   bool            // an exec has finished, so exitCode is set
+	umask    *int            // file mode creation mask for programs, set by umask
+	rest     string          // script lines not yet executed
+	section  string          // section started by the last command, not yet run
+	sections []SectionResult // finished sections
+
+	customRan []string // custom commands run, for leak reports; see Params.CheckLeaks
+	deferred  []func() // run by finalize; see Defer
+
+	baseEnv   map[string]string // environment before Params.Setup; see Params.EnvDiff
+	envOrigin map[string]string // variable → where it last changed, if tracked
+	envStack  [][]string        // environments saved by env push
+
+	artifacts []string // files saved for the result; see Params.ArtifactDir
+
+	archive *txtar.Archive    // the script's embedded files; shared, read-only
+	updates map[string]string // archive file → new content; see Params.UpdateScripts
+
+	httpClient  *http.Client           // per-test HTTP client with cookie jar
+	aliases     *hostAliases           // see Params.HostAliases and dns
+	proxy       *scriptProxy           // serves aliases and captures requests; nil until needed
+	cassette    *cassette              // execs recorded or replayed; see Params.ExecMode
+	httpTape    *httpCassette          // transport of the http commands under httpmode; nil if live
+	rng         *rand.Rand             // seeded from $TSAR_SEED on first use; see random
+	tcpConns    map[string]*tcpConn    // opened by tcp connect, by name
+	smtpServers map[string]*smtpServer // started by mocksmtp start, by name
+	recProxies  map[string]*recProxy   // started by recproxy start, by name
+	sshServers  map[string]*sshServer  // started by sshserver start, by name
+	sshAgent    *sshAgent              // holds the client key of sshserver; nil until needed
+	seed        uint64                 // seed of rng
 
 	builtin map[string]func(*TestScript, bool, []string)
 	user    map[string]func(*TestScript, bool, []string) // external test commands; see Params.Commands
 	params  Params                                       // original parameters
+	words   []tsarscript.Arg                             // words of the line being run, as written; see execWords
+
+	redactVars []string         // variables whose values are secret; see Params.Redact
+	redactRes  []*regexp.Regexp // patterns of secrets; see Params.Redact
 }
 
 type backgroundCmd struct {
-	name   string
-	cmd    *exec.Cmd
-	wait   <-chan struct{}
-	neg    bool
-	stdout strings.Builder
-	stderr strings.Builder
+	name      string
+	cmd       *exec.Cmd
+	err       error // error starting cmd; if set, it never ran
+	wait      <-chan struct{}
+	stop      func() // kills cmd and its process group, if still running
+	neg       bool
+	redirects []execRedirect
+	out       outputCapture
+}
+
+// execRedirect describes a shell-style redirection on an exec line,
+// such as <in.txt, >out.txt or 2>>err.txt.
+type execRedirect struct {
+	input  bool // feed the file to stdin instead of writing output to it
+	stderr bool // redirect stderr instead of stdout
+	append bool // append to the file instead of truncating it
+	file   string
 }
 
 type actionType int
@@ -210,7 +649,23 @@ var backgroundSpecifier = regexp.MustCompile(`^&([a-zA-Z_]\w*)?(&)?$`)
 
 // Run runs the test scripts in the given directory as subtests of t.
 func Run(t *testing.T, p Params) {
-	files := globTestFiles(t, p.Dir)
+	files := globTestFiles(t, p)
+	runFiles(t, p, files)
+}
+
+// SubtestRunner is a test that runs named subtests of its own type, as
+// *testing.T does.
+type SubtestRunner[T any] interface {
+	TestingT
+	Run(name string, f func(T)) bool
+}
+
+// RunT is like Run for any test type that can run subtests, such as a
+// custom harness: each script is a real subtest, failing or skipping on its
+// own. With Params.Parallel, scripts run in parallel if T also has Parallel
+// and Cleanup methods.
+func RunT[T SubtestRunner[T]](t T, p Params) {
+	files := globTestFiles(t, p)
 	runFiles(t, p, files)
 }
 
@@ -228,36 +683,135 @@ func RunFilesStandalone(t TestingT, p Params, filenames ...string) {
 
 // RunStandalone runs the test scripts in the given directory without using t.Run for subtest execution.
 // This is useful for command-line tools that don't need the full testing framework.
+// Each script records its own outcome: a skip stops only that script, and
+// failures are passed to t's Error method if it has one, as *testing.T does,
+// so that the remaining scripts still run.
 func RunStandalone(t TestingT, p Params) {
-	files := globTestFiles(t, p.Dir)
+	files := globTestFiles(t, p)
 	runFilesStandalone(t, p, files)
 }
 
 type testCase struct {
 	name string
 	file string
+	run  int // see ScriptResult.Run
+}
+
+// RequiresUniqueName reports whether no other script may share the name of
+// the script in filename: it may not if RequireUniqueNames is set, unless
+// the script's "# tsar:unique-names" directive says otherwise. A script
+// that cannot be loaded gets RequireUniqueNames; running it reports why.
+func (p Params) RequiresUniqueName(filename string) bool {
+	sc, err := loadScript(filename, p.Parser)
+	if err != nil || sc.meta.uniqueNames == nil {
+		return p.RequireUniqueNames
+	}
+	return *sc.meta.uniqueNames
 }
 
 func buildTestCases(t TestingT, p Params, filenames []string) []testCase {
 	var tests []testCase
-	seen := make(map[string]bool)
+	seen := make(map[string]string) // name → its first script
 	for _, filename := range filenames {
-		name := strings.TrimSuffix(filepath.Base(filename), ".tsar")
-		if p.RequireUniqueNames {
-			if seen[name] {
-				t.Fatalf("duplicate test name %q", name)
-			}
-			seen[name] = true
+		base := filepath.Base(filename)
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+		if first, ok := seen[name]; !ok {
+			seen[name] = filename
+		} else if p.RequiresUniqueName(first) || p.RequiresUniqueName(filename) {
+			t.Fatalf("duplicate test name %q", name)
+		}
+		if p.Count <= 1 {
+			tests = append(tests, testCase{name: name, file: filename})
+			continue
+		}
+		for run := 1; run <= p.Count; run++ {
+			tests = append(tests, testCase{name: fmt.Sprintf("%s#%d", name, run), file: filename, run: run})
 		}
-		tests = append(tests, testCase{name, filename})
 	}
 	return tests
 }
 
-func globTestFiles(t TestingT, dir string) []string {
-	files, err := filepath.Glob(filepath.Join(dir, "*.tsar"))
-	if err != nil {
-		t.Fatal(err)
+// passRates tallies the outcomes of the runs of each script for
+// Params.Count. It is safe for concurrent use.
+type passRates struct {
+	mu     sync.Mutex
+	order  []string // script files, in order
+	names  map[string]string
+	counts map[string]*[3]int // passed, failed and skipped runs
+}
+
+func newPassRates() *passRates {
+	return &passRates{names: make(map[string]string), counts: make(map[string]*[3]int)}
+}
+
+// add records the outcome of a run of the script of tc, and reports
+// whether it is the first failed run of that script.
+func (r *passRates) add(tc testCase, st *scriptT) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.counts[tc.file]
+	if !ok {
+		c = new([3]int)
+		r.counts[tc.file] = c
+		r.order = append(r.order, tc.file)
+		r.names[tc.file] = strings.TrimSuffix(tc.name, fmt.Sprintf("#%d", tc.run))
+	}
+	switch {
+	case st.failed:
+		c[1]++
+		return c[1] == 1
+	case st.skipped:
+		c[2]++
+	default:
+		c[0]++
+	}
+	return false
+}
+
+// log logs the pass rate of each script, as in
+// "hello: 9/10 runs passed (90%), 1 failed".
+func (r *passRates) log(t TestingT) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, file := range r.order {
+		c := r.counts[file]
+		msg := fmt.Sprintf("%s: %d/%d runs passed (%.0f%%)", r.names[file], c[0], c[0]+c[1]+c[2],
+			100*float64(c[0])/float64(c[0]+c[1]+c[2]))
+		if c[1] > 0 {
+			msg += fmt.Sprintf(", %d failed", c[1])
+		}
+		if c[2] > 0 {
+			msg += fmt.Sprintf(", %d skipped", c[2])
+		}
+		t.Logf("%s", msg)
+	}
+}
+
+func globTestFiles(t TestingT, p Params) []string {
+	if p.Dir == "" && len(p.Files) > 0 {
+		return p.Files
+	}
+	var files []string
+	for _, ext := range p.ScriptExtensions() {
+		matches, err := filepath.Glob(filepath.Join(p.Dir, "*"+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, matches...)
+	}
+	slices.Sort(files)
+	if p.Parser != nil {
+		entries, err := os.ReadDir(p.Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			file := filepath.Join(p.Dir, e.Name())
+			if !e.IsDir() && p.Parser.Match(file) && !slices.Contains(files, file) {
+				files = append(files, file)
+			}
+		}
+		slices.Sort(files)
 	}
 	if len(files) == 0 {
 		t.Fatal("no test script files found")
@@ -265,20 +819,49 @@ func globTestFiles(t TestingT, dir string) []string {
 	return files
 }
 
-func runFiles(t *testing.T, p Params, filenames []string) {
+// parallelT is a test that can run in parallel with its siblings, deferring
+// cleanup until they are all done, as *testing.T can.
+type parallelT interface {
+	Parallel()
+	Cleanup(func())
+}
+
+func runFiles[T SubtestRunner[T]](t T, p Params, filenames []string) {
 	tests := buildTestCases(t, p, filenames)
+	ctx, cancel := p.runContext()
+	workdirs := newWorkdirs(p)
+	// Parallel subtests only start once this function returns, so the run's
+	// resources are then released by Cleanup rather than deferred.
+	pt, parallel := any(t).(parallelT)
+	parallel = parallel && p.Parallel && p.WorkdirMode != WorkdirReuse
+	var rates *passRates
+	if p.Count > 1 {
+		rates = newPassRates()
+	}
+	if parallel {
+		pt.Cleanup(func() {
+			workdirs.close()
+			cancel()
+			if rates != nil {
+				rates.log(t)
+			}
+		})
+	} else {
+		defer cancel()
+		defer workdirs.close()
+		if rates != nil {
+			defer rates.log(t)
+		}
+	}
 	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			ts := &TestScript{
-				t:          t,
-				name:       tc.name,
-				file:       tc.file,
-				testDir:    filepath.Dir(tc.file),
-				params:     p,
-				builtin:    builtinCmds,
-				user:       p.Commands,
-				start:      time.Now(),
-				httpClient: newTestHTTPClient(),
+		t.Run(tc.name, func(t T) {
+			if parallel {
+				any(t).(parallelT).Parallel()
+			}
+			st := &scriptT{parent: t}
+			ts := newTestScript(ctx, st, p, tc, workdirs)
+			if rates != nil {
+				defer rates.add(tc, st)
 			}
 			defer ts.finalize()
 			ts.run()
@@ -288,75 +871,335 @@ func runFiles(t *testing.T, p Params, filenames []string) {
 
 func runFilesStandalone(t TestingT, p Params, filenames []string) {
 	tests := buildTestCases(t, p, filenames)
-	for _, tc := range tests {
+	ctx, cancel := p.runContext()
+	defer cancel()
+	workdirs := newWorkdirs(p)
+	defer workdirs.close()
+	var rates *passRates
+	if p.Count > 1 {
+		rates = newPassRates()
+		defer rates.log(t)
+	}
+	failures := 0
+	for i, tc := range tests {
+		st := &scriptT{parent: t, standalone: true}
 		func() {
 			t.Logf("=== RUN   %s", tc.name)
-			ts := &TestScript{
-				t:          t,
-				name:       tc.name,
-				file:       tc.file,
-				testDir:    filepath.Dir(tc.file),
-				params:     p,
-				builtin:    builtinCmds,
-				user:       p.Commands,
-				start:      time.Now(),
-				httpClient: newTestHTTPClient(),
-			}
+			start := time.Now()
+			ts := newTestScript(ctx, st, p, tc, workdirs)
 			defer ts.finalize()
 			ts.run()
 
-			if t.Failed() {
-				t.Logf("--- FAIL: %s", tc.name)
-			} else {
-				t.Logf("--- PASS: %s", tc.name)
+			status := "PASS"
+			switch {
+			case st.failed:
+				status = "FAIL"
+			case st.skipped:
+				status = "SKIP"
 			}
+			t.Logf("--- %s: %s (%.2fs)", status, tc.name, time.Since(start).Seconds())
 		}()
-		if t.Failed() && !p.ContinueOnError {
+		if ctx.Err() != nil {
+			rest := tests[i+1:]
+			names := make([]string, len(rest))
+			for j, tc := range rest {
+				names[j] = tc.name
+			}
+			msg := context.Cause(ctx).Error()
+			if st.Failed() {
+				msg += "; killed " + tc.name
+			}
+			if len(rest) > 0 {
+				msg += fmt.Sprintf("; %d not run: %s", len(rest), strings.Join(names, ", "))
+			}
+			t.Fatalf("%s", msg)
+			return
+		}
+		// With Count, a script counts as failed once, whichever its runs.
+		if rates != nil {
+			if rates.add(tc, st) {
+				failures++
+			}
+		} else if st.Failed() {
+			failures++
+		}
+		if tc.run > 0 && tc.run < p.Count {
+			continue // the script's remaining runs go first
+		}
+		if p.stopAfter(failures) {
+			if rest := tests[i+1:]; len(rest) > 0 {
+				names := make([]string, len(rest))
+				for j, tc := range rest {
+					names[j] = tc.name
+				}
+				t.Fatalf("stopped after %d failed script(s); %d not run: %s",
+					failures, len(rest), strings.Join(names, ", "))
+			}
 			return
 		}
 	}
 }
 
+// newTestScript returns the execution state for a single script. ctx bounds
+// the whole run the script belongs to, and workdirs provides its work
+// directory.
+func newTestScript(ctx context.Context, t TestingT, p Params, tc testCase, workdirs *workdirs) *TestScript {
+	ts := &TestScript{
+		t:        t,
+		name:     tc.name,
+		file:     tc.file,
+		runNum:   tc.run,
+		testDir:  filepath.Dir(tc.file),
+		params:   p,
+		builtin:  builtinCmds,
+		user:     p.Commands,
+		start:    time.Now(),
+		aliases:  &hostAliases{},
+		runCtx:   ctx,
+		workdirs: workdirs,
+	}
+	ts.httpClient = newTestHTTPClient(ts.aliases)
+	if st, ok := t.(*scriptT); ok {
+		st.context = ts.failureContext
+		if len(p.Redact) > 0 {
+			st.redact = ts.redact
+		}
+	}
+	return ts
+}
+
+// runContext returns the context bounding a whole run, honouring p.Context
+// and p.Timeout.
+func (p Params) runContext() (context.Context, context.CancelFunc) {
+	parent := p.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	if p.Timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeoutCause(parent, p.Timeout,
+		fmt.Errorf("run timed out after %v", p.Timeout))
+}
+
+// stopAfter reports whether a standalone run should stop once the given
+// number of scripts have failed.
+func (p Params) stopAfter(failures int) bool {
+	if failures == 0 {
+		return false
+	}
+	if p.MaxFailures > 0 {
+		return failures >= p.MaxFailures
+	}
+	return !p.ContinueOnError
+}
+
+// scriptT is the TestingT given to each script. It forwards to the parent
+// but records the script's own outcome, so that in the standalone runner one
+// failing script does not cut short the ones that follow it.
+type scriptT struct {
+	parent     TestingT
+	standalone bool // parent is shared by all the scripts of a standalone run
+	failed     bool
+	skipped    bool
+	failure    string              // first failure message
+	context    func() string       // appended to the first failure message, if set
+	redact     func(string) string // masks secrets in what is reported, if set
+}
+
+// Skip marks the script skipped. In a standalone run, the shared parent is
+// not skipped itself: the reason is logged and the script stops at its next
+// line.
+func (st *scriptT) Skip(args ...any) {
+	st.skipped = true
+	if !st.standalone {
+		st.parent.Skip(args...)
+		return
+	}
+	if len(args) > 0 {
+		st.Log(args...)
+	}
+}
+
+func (st *scriptT) Fatal(args ...any) {
+	st.report(st.fail(st.clean(fmt.Sprint(args...))))
+}
+
+func (st *scriptT) Fatalf(format string, args ...any) {
+	st.report(st.fail(st.clean(fmt.Sprintf(format, args...))))
+}
+
+// clean masks the secrets of Params.Redact in a message.
+func (st *scriptT) clean(msg string) string {
+	if st.redact == nil {
+		return msg
+	}
+	return st.redact(msg)
+}
+
+// report passes a failure on to the parent. In a standalone run it uses the
+// parent's Error method if it has one, as *testing.T does, so that the
+// parent is not stopped before the remaining scripts run.
+func (st *scriptT) report(msg string) {
+	if e, ok := st.parent.(interface{ Error(args ...any) }); ok && st.standalone {
+		e.Error(msg)
+		return
+	}
+	st.parent.Fatal(msg)
+}
+
+// fail records a failure and returns the message to report, with context
+// added to the first one.
+func (st *scriptT) fail(msg string) string {
+	if st.failed {
+		return msg
+	}
+	st.failed = true
+	st.failure = msg
+	if st.context != nil {
+		msg += st.clean(st.context())
+	}
+	return msg
+}
+
+func (st *scriptT) Log(args ...any) {
+	if st.redact == nil {
+		st.parent.Log(args...)
+		return
+	}
+	st.parent.Log(st.redact(strings.TrimSuffix(fmt.Sprintln(args...), "\n")))
+}
+
+func (st *scriptT) Logf(format string, args ...any) {
+	if st.redact == nil {
+		st.parent.Logf(format, args...)
+		return
+	}
+	st.parent.Logf("%s", st.redact(fmt.Sprintf(format, args...)))
+}
+func (st *scriptT) Failed() bool { return st.failed }
+func (st *scriptT) Helper()      { st.parent.Helper() }
+
+// The locale and timezone of scripts without Params.Locale and Timezone.
+const (
+	defaultLocale   = "C"
+	defaultTimezone = "UTC"
+)
+
 // setup sets up the test execution temporary directory and environment.
 func (ts *TestScript) setup() {
 	startTime := time.Now()
 	ts.log.Reset()
 	ts.mark = 0
 	ts.cd = ""
+	ts.dirStack = nil
 	ts.stdout = ""
 	ts.stderr = ""
+	ts.output = execOutput{}
 	ts.stopped = false
 	ts.start = startTime
 	ts.background = nil
 	ts.logfiles = nil
+	ts.checks = nil
+	ts.execs = 0
+	ts.exitCode, ts.exited = 0, false
+	ts.umask = nil
+	ts.vars = nil
+	ts.section = ""
+	ts.sections = nil
+	ts.customRan = nil
+	ts.deferred = nil
+	ts.baseEnv, ts.envOrigin = nil, nil
+	ts.artifacts = nil
+	ts.archive, ts.updates = nil, nil
+	if ts.httpTape != nil {
+		ts.httpClient.Transport, ts.httpTape = ts.httpTape.base, nil
+	}
+	ts.ctx, ts.cancel = context.WithCancel(ts.runCtx)
+	ts.compileRedact()
 
-	root := os.TempDir()
 	if ts.params.WorkdirRoot != "" {
-		root = ts.params.WorkdirRoot
 		ts.params.TestWork = true
-		if err := os.MkdirAll(root, 0755); err != nil {
-			ts.t.Fatal(err)
-		}
 	}
 	var err error
-	ts.workdir, err = os.MkdirTemp(root, "tsar-*")
+	ts.workdir, err = ts.workdirs.get(ts.name)
 	if err != nil {
 		ts.t.Fatal(err)
 	}
 	ts.cd = ts.workdir
 
 	// Set up environment.
+	homeEnv, err := ts.homeEnv()
+	if err != nil {
+		ts.t.Fatalf("home directory: %v", err)
+	}
 	ts.env = []string{
 		"WORK=" + ts.workdir,
 		"PATH=" + os.Getenv("PATH"),
-		homeEnvName() + "=/no-home",
 		tempEnvName() + "=" + filepath.Join(ts.workdir, "tmp"),
 	}
+	ts.env = append(ts.env, homeEnv...)
+	goEnv, err := ts.goCacheEnv()
+	if err != nil {
+		ts.t.Fatalf("shared Go cache: %v", err)
+	}
+	ts.env = append(ts.env, goEnv...)
+	if ts.params.GoProxyDir != "" {
+		p, err := startGoProxy(ts.params.GoProxyDir)
+		if err != nil {
+			ts.t.Fatalf("Go module proxy: %v", err)
+		} else {
+			ts.Defer(func() { p.srv.Close() })
+			ts.env = append(ts.env, p.env()...)
+		}
+	}
+	locale, timezone := ts.params.Locale, ts.params.Timezone
+	if locale == "" {
+		locale = defaultLocale
+	}
+	if timezone == "" {
+		timezone = defaultTimezone
+	}
+	ts.env = append(ts.env, "LANG="+locale, "LC_ALL="+locale, "TZ="+timezone)
 	if runtime.GOOS == "windows" {
 		ts.env = append(ts.env, "exe=.exe")
 	} else {
 		ts.env = append(ts.env, "exe=")
 	}
+	if ts.params.Compat {
+		ts.env = append(ts.env, compatEnv()...)
+	}
+	seed := ts.params.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	ts.env = append(ts.env, "TSAR_SEED="+strconv.FormatUint(seed, 10))
+	setBase := func(k, kv string) {
+		ts.env = slices.DeleteFunc(ts.env, func(e string) bool { return strings.HasPrefix(e, k+"=") })
+		ts.env = append(ts.env, kv)
+	}
+	for _, pattern := range ts.params.PassThroughEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			ts.t.Fatalf("Params.PassThroughEnv: invalid pattern %q", pattern)
+			continue
+		}
+		for _, kv := range os.Environ() {
+			k, _, _ := strings.Cut(kv, "=")
+			if ok, _ := path.Match(pattern, k); ok && k != "WORK" {
+				setBase(k, kv)
+			}
+		}
+	}
+	for _, kv := range ts.params.Env {
+		k, _, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			ts.t.Fatalf("Params.Env: invalid entry %q: want KEY=VALUE", kv)
+			continue
+		}
+		setBase(k, kv)
+	}
+	ts.rng = nil
+	ts.envStack = nil
 	ts.envMap = make(map[string]string)
 	for _, kv := range ts.env {
 		if k, v, ok := strings.Cut(kv, "="); ok {
@@ -367,26 +1210,46 @@ func (ts *TestScript) setup() {
 	if err := os.MkdirAll(filepath.Join(ts.workdir, "tmp"), 0755); err != nil {
 		ts.t.Fatal(err)
 	}
+	if err := ts.aliases.reset(ts.params.HostAliases); err != nil {
+		ts.t.Fatalf("host aliases: %v", err)
+	}
 }
 
 // run executes the test script.
 func (ts *TestScript) run() {
+	if ts.params.OnStart != nil {
+		ts.params.OnStart(ts.name)
+	}
+	ts.emit(Event{Kind: EventScriptStart})
 	ts.setup()
 
 	// Read and parse the test script.
-	filename := ts.file
-	data, err := os.ReadFile(filename)
+	sc, err := loadScript(ts.file, ts.params.Parser)
 	if err != nil {
 		ts.t.Fatal(err)
+		return
 	}
-
-	// Check if this is a txtar archive.
-	var ar *txtar.Archive
-	if bytes.Contains(data, []byte("-- ")) {
-		ar = txtar.Parse(data)
-		data = ar.Comment
+	ar, data := sc.archive, sc.text
+	ts.archive = ar
+	ts.lines = sc.lines
+	ts.meta = sc.meta
+	if ts.meta.explicitExec != nil {
+		ts.params.RequireExplicitExec = *ts.meta.explicitExec
+	}
+	ts.params.RequireExplicitExec = ts.params.RequireExplicitExec || ts.params.Compat
+	if skip, reason := ts.skipByFrontmatter(); skip {
+		ts.t.Skip(reason)
+		return
+	}
+	if ts.meta.timeout > 0 {
+		ts.ctx, ts.cancel = context.WithTimeoutCause(ts.ctx, ts.meta.timeout,
+			fmt.Errorf("script timed out after %v", ts.meta.timeout))
 	}
 
+	if ts.params.EnvDiff {
+		ts.baseEnv = maps.Clone(ts.envMap)
+		ts.envOrigin = make(map[string]string)
+	}
 	if ts.params.Setup != nil {
 		env := &Env{
 			WorkDir: ts.workdir,
@@ -398,11 +1261,31 @@ func (ts *TestScript) run() {
 		}
 		ts.env = env.Values
 		ts.refreshEnvMap()
+		if ts.envOrigin != nil {
+			for k := range ts.envDiffKeys() {
+				ts.envOrigin[k] = "Params.Setup"
+			}
+		}
+	}
+
+	if missing := ts.missingTools(ts.meta.requires); len(missing) > 0 {
+		ts.missingRequires("tsar:requires", missing)
+		return
+	}
+
+	if ts.params.DryRun {
+		ts.dryRun(ar, data)
+		return
+	}
+
+	if err := ts.loadCassette(); err != nil {
+		ts.t.Fatalf("exec cassette: %v", err)
+		return
 	}
 
 	// Run per-test setup script
 	if ts.params.TestSetup != "" {
-		if err := ts.runHookScript(ts.params.TestSetup); err != nil {
+		if err := ts.runHookScript(ts.params.TestSetup, ""); err != nil {
 			ts.t.Fatalf("test setup script failed: %v", err)
 		}
 	}
@@ -410,7 +1293,7 @@ func (ts *TestScript) run() {
 	// Schedule per-test teardown script (runs even on failure)
 	if ts.params.TestTeardown != "" {
 		defer func() {
-			if err := ts.runHookScript(ts.params.TestTeardown); err != nil {
+			if err := ts.runHookScript(ts.params.TestTeardown, ts.hookStatus()); err != nil {
 				ts.t.Logf("warning: test teardown script failed: %v", err)
 			}
 		}()
@@ -418,115 +1301,456 @@ func (ts *TestScript) run() {
 
 	// Extract archive files if present.
 	if ar != nil {
-		for _, f := range ar.Files {
-			name := f.Name
-			dir := filepath.Dir(ts.mkabs(name))
-			if err := os.MkdirAll(dir, 0777); err != nil {
-				ts.t.Fatal(err)
-			}
-			if err := os.WriteFile(ts.mkabs(name), f.Data, 0666); err != nil {
-				ts.t.Fatal(err)
-			}
+		if err := ts.extractArchive(ar); err != nil {
+			ts.t.Fatal(err)
+			return
+		}
+	}
+
+	var resources leakSnapshot
+	if ts.params.CheckLeaks {
+		resources = takeLeakSnapshot()
+	}
+
+	// Execute script line by line, then section by section.
+	ts.rest = data
+	ts.runLines()
+	for ts.section != "" && !ts.t.Failed() && !ts.skipped() && !ts.stopped {
+		ts.runSection()
+	}
+	ts.reapBackground(true)
+	if err := ts.saveHTTPCassette(); err != nil {
+		ts.t.Fatalf("recording HTTP: %v", err)
+	}
+	if err := ts.writeUpdates(); err != nil {
+		ts.t.Fatalf("updating script: %v", err)
+	}
+	if ts.params.CheckLeaks && !ts.t.Failed() {
+		ts.checkLeaks(resources)
+	}
+	if len(ts.checks) > 0 && !ts.t.Failed() {
+		ts.t.Fatalf("%d check(s) failed:\n%s", len(ts.checks), strings.Join(ts.checks, "\n"))
+	}
+	if !ts.t.Failed() && !ts.skipped() {
+		if err := ts.writeCassette(); err != nil {
+			ts.t.Fatalf("exec cassette: %v", err)
 		}
 	}
+}
 
-	script := string(data)
-	// Execute script line by line.
-	for script != "" {
-		line, rest := getLine(script)
-		script = rest
+// runLines executes script lines until the script ends, fails, is skipped or
+// stops, or a section begins.
+func (ts *TestScript) runLines() {
+	for ts.rest != "" {
+		if ts.ctx.Err() != nil {
+			ts.t.Fatalf("script:%d: %v", ts.lineno, context.Cause(ts.ctx))
+			return
+		}
+		var line string
+		line, ts.rest = getLine(ts.rest)
 		ts.parseLine(line)
-		if ts.t.Failed() || ts.stopped {
-			break
+		if ts.t.Failed() || ts.skipped() || ts.stopped || ts.section != "" {
+			return
 		}
 	}
 }
 
-// parseLine parses and executes a single script line.
-func (ts *TestScript) parseLine(line string) {
-	ts.lineno++
-	line = strings.TrimSpace(line)
-	if line == "" || line[0] == '#' {
-		return
+// runSection runs the lines of the pending section, as a subtest when the
+// script runs under a *testing.T, and records its outcome.
+func (ts *TestScript) runSection() {
+	res := SectionResult{Name: ts.section, Status: StatusPass}
+	ts.section = ""
+	start := time.Now()
+
+	st, _ := ts.t.(*scriptT)
+	skipped := st != nil && st.skipped
+	if parent, ok := ts.testingT(); ok {
+		parent.Run(res.Name, func(t *testing.T) {
+			st.parent = t
+			defer func() { st.parent = parent }()
+			ts.runLines()
+		})
+	} else {
+		ts.t.Logf("section %s", res.Name)
+		ts.runLines()
+	}
+
+	res.Duration = time.Since(start)
+	switch {
+	case ts.t.Failed():
+		res.Status = StatusFail
+	case st != nil && st.skipped && !skipped:
+		// A skip only skips the rest of its section.
+		res.Status = StatusSkip
+		st.skipped = false
+		if ts.section == "" {
+			ts.skipSection()
+		}
 	}
+	ts.sections = append(ts.sections, res)
+}
 
-	// Handle conditions like [short] or [!windows]
-	var cond string
-	if line[0] == '[' {
-		i := strings.Index(line, "]")
-		if i < 0 {
-			ts.t.Fatalf("script:%d: unterminated condition", ts.lineno)
-		}
-		cond = line[1:i]
-		line = strings.TrimSpace(line[i+1:])
-		if line == "" {
+// testingT returns the *testing.T the script reports to, if any.
+func (ts *TestScript) testingT() (*testing.T, bool) {
+	st, ok := ts.t.(*scriptT)
+	if !ok {
+		return nil, false
+	}
+	t, ok := st.parent.(*testing.T)
+	return t, ok
+}
+
+// skipSection discards the rest of a skipped section, up to the next
+// section command.
+func (ts *TestScript) skipSection() {
+	for ts.rest != "" {
+		var line string
+		line, ts.rest = getLine(ts.rest)
+		ts.lineno++
+		_, args, err := ts.splitLine(line)
+		if err == nil && len(args) == 2 && args[0] == "section" {
+			ts.section = args[1]
 			return
 		}
 	}
+}
 
-	if cond != "" {
+// skipByFrontmatter reports whether the script's frontmatter excludes it
+// from this run, and why.
+func (ts *TestScript) skipByFrontmatter() (bool, string) {
+	for _, cond := range ts.meta.skipOn {
 		ok, err := ts.condition(cond)
+		if errors.Is(err, ErrUnknownCondition) && ts.params.UnknownCondition == UnknownConditionSkipScript {
+			return true, fmt.Sprintf("tsar:skip-on: %v", err)
+		}
 		if err != nil {
-			ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+			if ts.unknownCondition(err) {
+				continue
+			}
+			ts.t.Fatalf("tsar:skip-on: %v", err)
+			return false, ""
 		}
-		if !ok {
-			return
+		if ok {
+			return true, fmt.Sprintf("skipped on [%s]", cond)
 		}
 	}
+	if len(ts.params.Tags) > 0 && !slices.ContainsFunc(ts.meta.tags, func(tag string) bool {
+		return slices.Contains(ts.params.Tags, tag)
+	}) {
+		return true, fmt.Sprintf("no tag matching %s", strings.Join(ts.params.Tags, ","))
+	}
+	return false, ""
+}
 
-	// Parse command line.
-	args := ts.parse(line)
+// parseLine parses and executes a single script line.
+func (ts *TestScript) parseLine(line string) {
+	ts.lineno++
+	neg, args, err := ts.splitLine(line)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		return
+	}
 	if len(args) == 0 {
 		return
 	}
 
-	// Check for negation prefix.
+	// Execute the command.
+	ts.line = strings.TrimSpace(line)
+	ts.running = formatArgs(neg, args)
+	defer func() { ts.running = "" }()
+	if ts.params.Trace {
+		ts.t.Logf("+ script:%d: %s", ts.lineno, ts.running)
+	}
+	defer ts.emitCommand(neg, args)()
+	if args[0] == "?" {
+		ts.bestEffort(args[1:])
+		return
+	}
+	ts.cmdExec(neg, args)
+}
+
+// bestEffort runs a command prefixed with "?": a failure is logged but does
+// not fail the script. The command may itself be negated with "? !".
+func (ts *TestScript) bestEffort(args []string) {
 	neg := false
 	if args[0] == "!" {
 		neg = true
 		args = args[1:]
-		if len(args) == 0 {
-			ts.t.Fatalf("script:%d: ! on line by itself", ts.lineno)
-		}
 	}
-
-	// Execute the command.
-	ts.line = line
+	parent := ts.t
+	soft := &softT{parent: parent}
+	ts.t = soft
+	defer func() { ts.t = parent }()
 	ts.cmdExec(neg, args)
-}
+	ts.t = parent
 
-// cmdExec executes a command with the given arguments.
-func (ts *TestScript) cmdExec(neg bool, args []string) {
-	cmd := args[0]
-	if ts.builtin[cmd] != nil {
-		ts.builtin[cmd](ts, neg, args)
-		return
-	}
-	if ts.user != nil && ts.user[cmd] != nil {
-		ts.user[cmd](ts, neg, args)
-		return
+	if soft.failed {
+		ts.t.Logf("? ignoring failure: %s", soft.failure)
 	}
+}
 
-	if !ts.params.RequireExplicitExec {
-		ts.cmdExecBuiltin(neg, append([]string{"exec"}, args...))
-		return
+// failureContext is appended to a script's first failure: the lineContext,
+// and the random seed if the script used random values.
+func (ts *TestScript) failureContext() string {
+	context := ts.lineContext()
+	if ts.rng != nil {
+		context += fmt.Sprintf("\nrandom seed: %d (set TSAR_SEED to reproduce)", ts.seed)
 	}
-
-	ts.t.Fatalf("script:%d: unknown command %q", ts.lineno, cmd)
+	return context
 }
 
-// finalize cleans up after script execution.
+// lineContext renders the script lines around the running command, with a
+// caret under it, followed by its expanded form. It is empty when no command
+// is running.
+func (ts *TestScript) lineContext() string {
+	if ts.running == "" || ts.lineno < 1 || ts.lineno > len(ts.lines) {
+		return ""
+	}
+	from, to := max(ts.lineno-2, 1), min(ts.lineno+2, len(ts.lines))
+	width := len(strconv.Itoa(to))
+	var b strings.Builder
+	b.WriteString("\n")
+	for n := from; n <= to; n++ {
+		line := strings.TrimRight(ts.lines[n-1], "\r")
+		if n != ts.lineno {
+			fmt.Fprintf(&b, "  %*d | %s\n", width, n, line)
+			continue
+		}
+		fmt.Fprintf(&b, "> %*d | %s\n", width, n, line)
+		fmt.Fprintf(&b, "  %*s | %s^\n", width, "", caretIndent(line))
+	}
+	fmt.Fprintf(&b, "expanded: %s", ts.running)
+	return b.String()
+}
+
+// caretIndent returns the blanks that align a caret under the command of a
+// script line, past its indentation and condition. Tabs are kept so the
+// caret lines up however they are displayed.
+func caretIndent(line string) string {
+	trimmed := strings.TrimLeft(line, " \t")
+	col := len(line) - len(trimmed)
+	if _, rest, err := tsarscript.CutCondition(strings.TrimSpace(trimmed)); err == nil {
+		col += len(strings.TrimSpace(trimmed)) - len(rest)
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, line[:col])
+}
+
+// splitLine evaluates a script line's condition, if any, and splits the rest
+// into words after environment expansion. It returns no args for blank and
+// comment lines and for lines whose condition does not hold.
+func (ts *TestScript) splitLine(line string) (neg bool, args []string, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return false, nil, nil
+	}
+
+	ts.words = nil
+	if ts.params.Compat {
+		ok, rest, err := ts.cutConditionsCompat(line)
+		if !ok || err != nil {
+			return false, nil, err
+		}
+		if args, err = ts.splitCompat(rest); err != nil || len(args) == 0 {
+			return false, nil, err
+		}
+		return splitNegation(args)
+	}
+
+	// Handle conditions like [short] or [!windows]
+	cond, line, err := tsarscript.CutCondition(line)
+	if err != nil || line == "" {
+		return false, nil, err
+	}
+	if cond != "" {
+		ok, err := ts.condition(cond)
+		if err != nil {
+			if ts.unknownCondition(err) {
+				return false, nil, nil
+			}
+			return false, nil, err
+		}
+		if !ok {
+			return false, nil, nil
+		}
+	}
+
+	// Parse command line.
+	ts.words, err = tsarscript.SplitArgs(ts.expandEnvVars(line))
+	if err != nil || len(ts.words) == 0 {
+		return false, nil, err
+	}
+	for _, w := range ts.words {
+		args = append(args, w.Value)
+	}
+
+	return splitNegation(args)
+}
+
+// splitNegation cuts the negation prefix "!" from a command line. The
+// best-effort prefix "?" is left in args for parseLine.
+func splitNegation(args []string) (neg bool, _ []string, err error) {
+	if args[0] == "!" {
+		if len(args) == 1 {
+			return false, nil, fmt.Errorf("! on line by itself")
+		}
+		if args[1] == "?" {
+			return false, nil, fmt.Errorf("! ? is not allowed; use ? ! to negate a best-effort command")
+		}
+		return true, args[1:], nil
+	}
+	if args[0] == "?" && (len(args) == 1 || len(args) == 2 && args[1] == "!") {
+		return false, nil, fmt.Errorf("? on line by itself")
+	}
+	return false, args, nil
+}
+
+// formatArgs renders a parsed command line, quoting arguments that would
+// not survive re-parsing as-is.
+func formatArgs(neg bool, args []string) string {
+	var b strings.Builder
+	if neg {
+		b.WriteString("! ")
+	}
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\") {
+			arg = strconv.Quote(arg)
+		}
+		b.WriteString(arg)
+	}
+	return b.String()
+}
+
+// cmdExec executes a command with the given arguments.
+func (ts *TestScript) cmdExec(neg bool, args []string) {
+	cmd := args[0]
+	if ts.builtin[cmd] != nil {
+		ts.builtin[cmd](ts, neg, args)
+		return
+	}
+	if ts.user != nil && ts.user[cmd] != nil {
+		if ts.params.CheckLeaks && !slices.Contains(ts.customRan, cmd) {
+			ts.customRan = append(ts.customRan, cmd)
+		}
+		ts.user[cmd](ts, neg, args)
+		return
+	}
+
+	if !ts.params.RequireExplicitExec {
+		ts.cmdExecBuiltin(neg, append([]string{"exec"}, args...))
+		return
+	}
+
+	ts.t.Fatalf("script:%d: unknown command %q", ts.lineno, cmd)
+}
+
+// finalize cleans up after script execution.
 func (ts *TestScript) finalize() {
+	if ts.cancel != nil {
+		ts.cancel()
+	}
+	ts.reapBackground(false)
+	ts.closeProxy()
+	ts.closeTCP()
+	ts.closeSMTP()
+	ts.closeRecProxies()
+	ts.closeSSH()
+	for i := len(ts.deferred) - 1; i >= 0; i-- {
+		ts.deferred[i]()
+	}
 	if ts.t.Failed() {
 		ts.dumpLogfiles()
+		if ts.baseEnv != nil {
+			if diff := ts.envDiff(); diff != "" {
+				ts.t.Logf("environment changes:\n%s", diff)
+			} else {
+				ts.t.Logf("environment unchanged")
+			}
+		}
 	}
 	if !ts.params.TestWork {
-		removeAll(ts.workdir)
-	} else {
+		ts.workdirs.put(ts.workdir)
+	} else if ts.workdir != "" {
 		ts.t.Logf("work directory: %s", ts.workdir)
+		if err := ts.workdirs.writeIndex(ts.workdir, ts.result()); err != nil {
+			ts.t.Logf("warning: indexing work directory: %v", err)
+		}
+	}
+	if ts.params.OnResult != nil || ts.params.Events != nil {
+		r := ts.result()
+		ts.emit(Event{Kind: EventScriptEnd, Status: r.Status, Duration: r.Duration, Failure: r.Failure, Line: r.FailureLine})
+		if ts.params.OnResult != nil {
+			ts.params.OnResult(r)
+		}
+	}
+}
+
+// emit sends e, stamped with the time and the script, to Params.Events.
+func (ts *TestScript) emit(e Event) {
+	if ts.params.Events == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Script, e.File = ts.name, ts.file
+	ts.params.Events(e)
+}
+
+// emitCommand sends the start event of the command being run, and returns
+// a function sending its end event.
+func (ts *TestScript) emitCommand(neg bool, args []string) func() {
+	if ts.params.Events == nil {
+		return func() {}
+	}
+	start := Event{Kind: EventCommandStart, Line: ts.lineno, Neg: neg, Args: slices.Clone(args)}
+	ts.emit(start)
+	begin, checks := time.Now(), len(ts.checks)
+	return func() {
+		end := start
+		end.Kind, end.Duration, end.Status = EventCommandEnd, time.Since(begin), StatusPass
+		switch {
+		case ts.t.Failed() || len(ts.checks) > checks:
+			end.Status = StatusFail
+		case ts.skipped():
+			end.Status = StatusSkip
+		}
+		end.StdoutBytes, end.StderrBytes = len(ts.stdout), len(ts.stderr)
+		ts.emit(end)
 	}
 }
 
+// result summarizes the script's outcome.
+func (ts *TestScript) result() ScriptResult {
+	r := ScriptResult{
+		Name:     ts.name,
+		File:     ts.file,
+		Run:      ts.runNum,
+		Status:   StatusPass,
+		Duration: time.Since(ts.start),
+		WorkDir:  ts.workdir,
+		Sections: ts.sections,
+
+		Artifacts: ts.artifacts,
+	}
+	if st, ok := ts.t.(*scriptT); ok {
+		switch {
+		case st.failed:
+			r.Status = StatusFail
+			r.Failure = st.failure
+			r.FailureLine = ts.lineno
+		case st.skipped:
+			r.Status = StatusSkip
+		}
+	}
+	return r
+}
+
 // dumpLogfiles writes the contents of registered logfiles to test output.
 func (ts *TestScript) dumpLogfiles() {
 	for _, path := range ts.logfiles {
@@ -546,26 +1770,150 @@ func (ts *TestScript) dumpLogfiles() {
 
 // Built-in commands
 var builtinCmds = map[string]func(*TestScript, bool, []string){
+	"assert":     (*TestScript).cmdAssert,
 	"cd":         (*TestScript).cmdCD,
+	"check":      (*TestScript).cmdCheck,
+	"chmod":      (*TestScript).cmdChmod,
+	"cmp":        (*TestScript).cmdCmp,
+	"cmpenv":     (*TestScript).cmdCmpenv,
 	"cp":         (*TestScript).cmdCp,
+	"dns":        (*TestScript).cmdDNS,
+	"download":   (*TestScript).cmdDownload,
 	"env":        (*TestScript).cmdEnv,
 	"envfile":    (*TestScript).cmdEnvfile,
+	"eventually": (*TestScript).cmdEventually,
 	"exec":       (*TestScript).cmdExecBuiltin,
 	"exists":     (*TestScript).cmdExists,
+	"fileserver": (*TestScript).cmdFileserver,
+	"gitcommit":  (*TestScript).cmdGitcommit,
+	"gitinit":    (*TestScript).cmdGitinit,
+	"gitserver":  (*TestScript).cmdGitserver,
+	"goproxy":    (*TestScript).cmdGoproxy,
+	"filesize":   (*TestScript).cmdFilesize,
+	"fstat":      (*TestScript).cmdFstat,
 	"grep":       (*TestScript).cmdGrep,
+	"head":       (*TestScript).cmdHead,
 	"http":       (*TestScript).cmdHTTP,
 	"httpbody":   (*TestScript).cmdHTTPBody,
 	"httpheader": (*TestScript).cmdHTTPHeader,
+	"httpmode":   (*TestScript).cmdHTTPMode,
 	"httpstatus": (*TestScript).cmdHTTPStatus,
+	"json":       (*TestScript).cmdJSON,
 	"logfile":    (*TestScript).cmdLogfile,
+	"md5":        (*TestScript).cmdDigest,
 	"mkdir":      (*TestScript).cmdMkdir,
+	"mocksmtp":   (*TestScript).cmdMockSMTP,
+	"newer":      (*TestScript).cmdNewer,
+	"output":     (*TestScript).cmdOutput,
+	"path":       (*TestScript).cmdPath,
+	"popd":       (*TestScript).cmdPopd,
+	"pushd":      (*TestScript).cmdPushd,
+	"recproxy":   (*TestScript).cmdRecproxy,
 	"repeat":     (*TestScript).cmdRepeat,
+	"replace":    (*TestScript).cmdReplace,
+	"requested":  (*TestScript).cmdRequested,
+	"requires":   (*TestScript).cmdRequires,
+	"rand":       (*TestScript).cmdRand,
+	"randstr":    (*TestScript).cmdRandstr,
 	"rm":         (*TestScript).cmdRm,
+	"section":    (*TestScript).cmdSection,
+	"set":        (*TestScript).cmdSet,
+	"sha1":       (*TestScript).cmdDigest,
+	"sha256":     (*TestScript).cmdDigest,
 	"skip":       (*TestScript).cmdSkip,
+	"sshserver":  (*TestScript).cmdSSHServer,
+	"sort":       (*TestScript).cmdSort,
+	"sql":        (*TestScript).cmdSQL,
+	"status":     (*TestScript).cmdStatus,
 	"stderr":     (*TestScript).cmdStderr,
 	"stdout":     (*TestScript).cmdStdout,
 	"stop":       (*TestScript).cmdStop,
+	"tail":       (*TestScript).cmdTail,
+	"tcp":        (*TestScript).cmdTCP,
+	"tree":       (*TestScript).cmdTree,
+	"umask":      (*TestScript).cmdUmask,
+	"uniq":       (*TestScript).cmdUniq,
+	"uuid":       (*TestScript).cmdUUID,
 	"wait":       (*TestScript).cmdWait,
+	"waitstable": (*TestScript).cmdWaitstable,
+	"yaml":       (*TestScript).cmdYAML,
+}
+
+// builtinUsage holds a one-line usage summary for each builtin command.
+var builtinUsage = map[string]string{
+	"assert":     "assert <value> ==|!=|<|<=|>|>= <value> -- compare two values, numerically if both are numbers",
+	"cd":         "cd <dir> -- change directory",
+	"check":      "check [!] <command> [args...] -- run a command as a soft assertion; failures are reported when the script ends",
+	"chmod":      "chmod <perm> <file>... -- set the permission bits of files (octal, such as 0755)",
+	"cmp":        "cmp [-w] [-b] [-crlf] <file1> <file2> -- check that two files are identical (file1 may be stdout or stderr), ignoring trailing whitespace with -w, runs of blanks with -b and \\r\\n line endings with -crlf",
+	"cmpenv":     "cmpenv [-w] [-b] [-crlf] <file1> <file2> -- like cmp, after expanding environment variables in file2",
+	"cp":         "cp <src>... <dst> -- copy files (src may be stdout or stderr, or a glob pattern)",
+	"dns":        "dns <host> <address> -- make host resolve to address (host[:port] or URL) for http and exec'd programs",
+	"download":   "download URL <dest> [-sha256 hex] -- fetch a file, checking and caching it by digest",
+	"env":        "env [-u] [key=value...|key...|pattern...] | env push|pop -- set, remove or print (sorted) environment variables, or save and restore them all",
+	"envfile":    "envfile <file> -- load key=value pairs from file into env",
+	"eventually": "eventually [-t duration] [-every duration] [!] <command> [args...] -- re-run a command until it passes (default: every 250ms, for up to 30s)",
+	"exec":       "exec [-timeout duration] [-umask mode] [-user name] [-sandbox] <cmd> [args...] [<file] [>file] [2>file] [&] -- execute external command",
+	"exists":     "exists <file> -- check that file, or a file matching a glob pattern, exists",
+	"fileserver": "fileserver start <dir> <var> -- serve dir over HTTP on a free port until the script ends, setting var to its URL",
+	"gitcommit":  "gitcommit <dir> <message> -- commit all the changes of the git repository dir with a fixed author and date, saving the commit hash as stdout",
+	"gitinit":    "gitinit <dir> [message] -- make dir a git repository with its files committed by a fixed author and date, saving the commit hash as stdout",
+	"gitserver":  "gitserver start <dir> <var> -- serve the git repositories in dir over smart HTTP until the script ends, setting var to its URL",
+	"goproxy":    "goproxy start <dir> -- serve the Go module fixtures of dir as a module proxy until the script ends, setting GOPROXY and GONOSUMDB",
+	"filesize":   "filesize <file> <size>|[min]..[max] -- check a file's size (units: B, KB, MB, GB, KiB, MiB, GiB)",
+	"fstat":      "fstat <file> type=file|dir|symlink|mode=PERM|exec|newer=FILE|newer-than=DURATION... -- check file metadata",
+	"grep":       "grep [-count=N] [-i] [-m] <pattern> <file>... -- check that a file (or glob match) contains pattern, case-insensitively with -i, multiline with -m, exactly N times in all with -count",
+	"head":       "head [-n N] <file> [out] -- keep the first N lines (default 10) of file, stdout or stderr, as stdout or in out",
+	"http":       "http METHOD URL [-body FILE] [-upload FIELD=FILE]... [-header \"Key: Value\"]... -- perform an HTTP request",
+	"httpbody":   "httpbody FILE -- write last HTTP response body to file",
+	"httpheader": "httpheader NAME VALUE -- assert last HTTP response header contains value",
+	"httpmode":   "httpmode live|record|replay -- record the http commands' responses into the script, or replay them",
+	"httpstatus": "httpstatus CODE -- assert last HTTP response status code",
+	"json":       "json [-o var] <path> [file] [==|!=|<|<=|>|>= value] -- extract a value at a jq-style path (.a.b[0]) of a JSON file (default: stdout) into var, compare it, or check it exists",
+	"logfile":    "logfile <file> -- register file to dump on test failure",
+	"md5":        "md5 <file> <hex> -- check the MD5 digest of a file (or stdout or stderr)",
+	"mkdir":      "mkdir <dir>... -- create directories",
+	"mocksmtp":   "mocksmtp start [&name&] | mocksmtp assert [-count N] [-from addr] [-to addr] [-subject pattern] [-body pattern] [&name&] | mocksmtp stop [&name&] -- run an SMTP sink, exporting $SMTP_ADDR, $SMTP_HOST and $SMTP_PORT (upper-cased name), and check the messages it received",
+	"newer":      "newer <file1> <file2> -- check that file1 was modified after file2",
+	"output":     "output <pattern> -- assert last command stdout and stderr, interleaved, contain pattern",
+	"path":       "path prepend|append <dir>... -- add directories to PATH",
+	"popd":       "popd -- return to the directory saved by the matching pushd",
+	"pushd":      "pushd <dir> -- change directory like cd, saving the current one for popd",
+	"recproxy":   "recproxy start <upstream> <var> [&name&] | recproxy assert [-count N] [-method M] [-path pattern] [-header 'Name: pattern']... [-body pattern] [-status code] [&name&] -- proxy to upstream, setting var to the proxy's URL, and check the requests it forwarded",
+	"repeat":     "repeat [-all] [-parallel N] [-timeout duration] COUNT COMMAND... -- run a command COUNT times",
+	"replace":    "replace <pattern> <replacement> <file>... -- replace regexp matches in files (or stdout, stderr) in place; \\1 refers to a group",
+	"requested":  "requested [-count N] <pattern> -- check the captured HTTP requests (\"METHOD URL STATUS\") for a match",
+	"requires":   "requires <program>... -- skip the test unless every program is on PATH",
+	"rand":       "rand int <min> <max> <var> | rand hex <digits> <var> -- set var to a value from the script's seeded random numbers",
+	"randstr":    "randstr <var> [length] -- set var to a unique random string of lowercase letters and digits (default length 12)",
+	"rm":         "rm <file>... -- remove files/directories (files may be glob patterns)",
+	"section":    "section <name> -- report the following commands, up to the next section, as a sub-test",
+	"set":        "set <name> [value] -- set a script-local variable, expanded like env vars but not exported",
+	"sha1":       "sha1 <file> <hex> -- check the SHA-1 digest of a file (or stdout or stderr)",
+	"sha256":     "sha256 <file> <hex> -- check the SHA-256 digest of a file (or stdout or stderr)",
+	"skip":       "skip [message] -- skip the test",
+	"sshserver":  "sshserver start|stop [&name&] -- run an SSH and SFTP server of the work directory accepting a throwaway key, exporting $SSH_ADDR, $SSH_HOST, $SSH_PORT, $SSH_AUTH_SOCK, $SSH_KNOWN_HOSTS and $SSH_IDENTITY",
+	"sort":       "sort <file> [out] -- sort the lines of file, stdout or stderr by byte value, as stdout or in out",
+	"sql":        "sql [-dsn var] <query> [args...] [==|!=|<|<=|>|>= value] -- query the database of $DATABASE_URL, saving the rows as stdout, or compare the single value",
+	"status":     "status <code> -- assert the exit status of the last exec (also available as $exit)",
+	"stderr":     "stderr <pattern> -- assert last command stderr contains pattern",
+	"stdout":     "stdout <pattern> -- assert last command stdout contains pattern",
+	"stop":       "stop -- stop test execution",
+	"tail":       "tail [-n N] <file> [out] -- keep the last N lines (default 10) of file, stdout or stderr, as stdout or in out",
+	"tcp":        "tcp connect [-timeout d] host:port [&name&] | tcp send [-n] data... [&name&] | tcp expect [-timeout d] <pattern> [&name&] | tcp close [&name&] -- talk to a raw TCP server; send appends a newline unless -n, expect saves what it read as stdout",
+	"tree":       "tree [-mode] [-size] <dir> <manifest> -- check a directory's recursive listing against a manifest",
+	"umask":      "umask <mode> -- set the file mode creation mask of programs run later, such as 077",
+	"uniq":       "uniq <file> [out] -- drop lines of file, stdout or stderr repeating the previous one, as stdout or in out",
+	"uuid":       "uuid <var> -- set var to a new random (version 4) UUID",
+	"wait":       "wait [name...] -- wait for background commands",
+	"waitstable": "waitstable [-timeout duration] <file> [quiet-period] -- wait until file exists and stops changing for quiet-period (default 500ms)",
+	"yaml":       "yaml [-o var] <path> [file] [==|!=|<|<=|>|>= value] -- like json, for a YAML file (default: stdout); several documents are an array",
+}
+
+// BuiltinUsage returns a one-line usage summary for each builtin command,
+// keyed by command name, for tools such as editors.
+func BuiltinUsage() map[string]string {
+	return maps.Clone(builtinUsage)
 }
 
 // Helper functions and remaining method implementations...
@@ -579,78 +1927,19 @@ func getLine(s string) (line, rest string) {
 	return s[:i], s[i+1:]
 }
 
-// parse parses a command line into words, handling quotes and environment variables.
-func (ts *TestScript) parse(line string) []string {
-	expandedLine := ts.expandEnvVars(line)
-	args, err := splitArgs(expandedLine)
-	if err != nil {
-		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
-	}
-	return args
-}
-
-// splitArgs splits a line into arguments, respecting quoted strings.
-// Double quotes support backslash escapes (\", \\).
-// Single quotes are literal (no escape processing).
-// Whitespace inside quotes is preserved exactly (no collapsing).
-func splitArgs(line string) ([]string, error) {
-	var args []string
-	var current strings.Builder
-	inDouble := false
-	inSingle := false
-	escaped := false
-
-	for i := 0; i < len(line); i++ {
-		c := line[i]
-		if escaped {
-			current.WriteByte(c)
-			escaped = false
-			continue
-		}
-		if inSingle {
-			if c == '\'' {
-				inSingle = false
-			} else {
-				current.WriteByte(c)
-			}
-			continue
-		}
-		if c == '\\' && inDouble {
-			escaped = true
-			continue
-		}
-		if c == '"' {
-			inDouble = !inDouble
-			continue
-		}
-		if c == '\'' && !inDouble {
-			inSingle = true
-			continue
-		}
-		if !inDouble && (c == ' ' || c == '\t') {
-			if current.Len() > 0 {
-				args = append(args, current.String())
-				current.Reset()
-			}
-			continue
-		}
-		current.WriteByte(c)
-	}
-	if inDouble || inSingle {
-		return nil, fmt.Errorf("unclosed quote")
-	}
-	if current.Len() > 0 {
-		args = append(args, current.String())
-	}
-	return args, nil
-}
-
-// expandEnvVars expands environment variables in the form $VAR or ${VAR}
+// expandEnvVars expands environment variables in the form $VAR or ${VAR}.
+// Script-local variables take precedence over the environment.
 func (ts *TestScript) expandEnvVars(s string) string {
 	return os.Expand(s, func(key string) string {
+		if value, ok := ts.vars[key]; ok {
+			return value
+		}
 		if value, ok := ts.envMap[key]; ok {
 			return value
 		}
+		if key == "RANDOM" {
+			return strconv.Itoa(ts.random().IntN(32768))
+		}
 		return os.Getenv(key)
 	})
 }
@@ -671,13 +1960,60 @@ func (ts *TestScript) condition(cond string) (bool, error) {
 		return runtime.GOOS == "darwin", nil
 	case "linux":
 		return runtime.GOOS == "linux", nil
+	case "root":
+		return os.Geteuid() == 0, nil
 	default:
 		if strings.HasPrefix(cond, "!") {
 			ok, err := ts.condition(cond[1:])
 			return !ok, err
 		}
-		return false, fmt.Errorf("unknown condition %q", cond)
+		return false, fmt.Errorf("%w %q", ErrUnknownCondition, cond)
+	}
+}
+
+// ErrUnknownCondition is returned, wrapped, for a condition that is neither
+// built in nor known to Params.Condition; see Params.UnknownCondition.
+var ErrUnknownCondition = errors.New("unknown condition")
+
+// UnknownConditionPolicy says how to handle unknown conditions; see
+// Params.UnknownCondition.
+type UnknownConditionPolicy string
+
+const (
+	UnknownConditionFail       UnknownConditionPolicy = ""            // fail the script (the default)
+	UnknownConditionSkipLine   UnknownConditionPolicy = "skip-line"   // skip the line, or ignore the skip-on entry
+	UnknownConditionSkipScript UnknownConditionPolicy = "skip-script" // skip the rest of the script
+)
+
+// ParseUnknownConditionPolicy parses the name of an UnknownConditionPolicy;
+// "fail" and the empty string both mean UnknownConditionFail.
+func ParseUnknownConditionPolicy(s string) (UnknownConditionPolicy, error) {
+	switch p := UnknownConditionPolicy(s); p {
+	case "fail", UnknownConditionFail:
+		return UnknownConditionFail, nil
+	case UnknownConditionSkipLine, UnknownConditionSkipScript:
+		return p, nil
 	}
+	return "", fmt.Errorf("unknown condition policy %q (want fail, skip-line or skip-script)", s)
+}
+
+// unknownCondition applies Params.UnknownCondition to a condition error. It
+// reports whether the error was handled, in which case the line is not run,
+// negated or not; for skip-script, the script is also skipped and stopped.
+func (ts *TestScript) unknownCondition(err error) bool {
+	if !errors.Is(err, ErrUnknownCondition) {
+		return false
+	}
+	switch ts.params.UnknownCondition {
+	case UnknownConditionSkipLine:
+		ts.t.Logf("script:%d: %v; skipping line", ts.lineno, err)
+		return true
+	case UnknownConditionSkipScript:
+		ts.stopped = true
+		ts.t.Skip(fmt.Sprintf("script:%d: %v", ts.lineno, err))
+		return true
+	}
+	return false
 }
 
 // mkabs returns an absolute path for the given file within the test's work directory.
@@ -743,12 +2079,18 @@ func (ts *TestScript) Setenv(key, value string) {
 	ts.cmdEnv(false, []string{"env", key + "=" + value})
 }
 
-// Exec runs the named program with the given arguments.
+// Exec runs the named program with the given arguments, saving its stdout
+// and stderr for later commands. Unlike the exec command, a failure does not
+// fail the script: it is returned.
 func (ts *TestScript) Exec(name string, args ...string) error {
 	cmdArgs := append([]string{"exec", name}, args...)
+	parent := ts.t
+	soft := &softT{parent: parent}
+	ts.t = soft
+	defer func() { ts.t = parent }()
 	ts.cmdExecBuiltin(false, cmdArgs)
-	if ts.t.Failed() {
-		return errors.New("exec failed")
+	if soft.failed {
+		return errors.New(soft.failure)
 	}
 	return nil
 }
@@ -758,6 +2100,42 @@ func (ts *TestScript) MkAbs(file string) string {
 	return ts.mkabs(file)
 }
 
+// Stdout returns the stdout of the last command.
+func (ts *TestScript) Stdout() string {
+	return ts.stdout
+}
+
+// Stderr returns the stderr of the last command.
+func (ts *TestScript) Stderr() string {
+	return ts.stderr
+}
+
+// Defer arranges for f to be called when the script ends, before its work
+// directory is removed. Deferred functions run in reverse order.
+func (ts *TestScript) Defer(f func()) {
+	ts.deferred = append(ts.deferred, f)
+}
+
+// Name returns the script's name: its file name without the extension.
+func (ts *TestScript) Name() string {
+	return ts.name
+}
+
+// ScriptFile returns the path of the script file.
+func (ts *TestScript) ScriptFile() string {
+	return ts.file
+}
+
+// WorkDir returns the script's work directory ($WORK).
+func (ts *TestScript) WorkDir() string {
+	return ts.workdir
+}
+
+// Lineno returns the number of the script line being executed.
+func (ts *TestScript) Lineno() int {
+	return ts.lineno
+}
+
 // SetStdout sets the stdout result for the current command.
 func (ts *TestScript) SetStdout(s string) {
 	ts.stdout = s
@@ -770,54 +2148,334 @@ func (ts *TestScript) SetStderr(s string) {
 
 // Built-in command implementations
 
+// cmdAssert compares two values: numerically if both parse as numbers,
+// otherwise as strings.
+func (ts *TestScript) cmdAssert(neg bool, args []string) {
+	// Empty values are dropped when the line is split, so "assert $X == ''"
+	// arrives as two arguments.
+	args = args[1:]
+	switch {
+	case len(args) == 1 && isAssertOp(args[0]):
+		args = []string{"", args[0], ""}
+	case len(args) == 2 && isAssertOp(args[0]):
+		args = append([]string{""}, args...)
+	case len(args) == 2 && isAssertOp(args[1]):
+		args = append(args, "")
+	}
+	if len(args) != 3 || !isAssertOp(args[1]) {
+		ts.t.Fatalf("script:%d: usage: assert value ==|!=|<|<=|>|>= value", ts.lineno)
+		return
+	}
+	left, op, right := args[0], args[1], args[2]
+	if compareValues(left, op, right) == neg {
+		verb := "failed"
+		if neg {
+			verb = "unexpectedly holds"
+		}
+		ts.t.Fatalf("script:%d: assert %s %s %s %s\n%s", ts.lineno, strconv.Quote(left), op, strconv.Quote(right), verb, diffValues(left, right))
+	}
+}
+
+// compareValues reports whether left op right holds, comparing numerically
+// if both values are numbers, and as strings otherwise.
+func compareValues(left, op, right string) bool {
+	var cmp int
+	l, lerr := strconv.ParseFloat(left, 64)
+	r, rerr := strconv.ParseFloat(right, 64)
+	if lerr == nil && rerr == nil {
+		cmp = compareFloat(l, r)
+	} else {
+		cmp = strings.Compare(left, right)
+	}
+	return map[string]bool{
+		"==": cmp == 0, "!=": cmp != 0,
+		"<": cmp < 0, "<=": cmp <= 0,
+		">": cmp > 0, ">=": cmp >= 0,
+	}[op]
+}
+
+func isAssertOp(s string) bool {
+	switch s {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// diffValues shows two compared values: side by side when they fit on one
+// line, otherwise as a line-by-line diff of left (-) against right (+).
+func diffValues(left, right string) string {
+	if !strings.Contains(left, "\n") && !strings.Contains(right, "\n") {
+		return fmt.Sprintf("\tleft:  %s\n\tright: %s", left, right)
+	}
+	l := strings.Split(left, "\n")
+	r := strings.Split(right, "\n")
+	var b strings.Builder
+	b.WriteString("\t--- left\n\t+++ right")
+	for i := range max(len(l), len(r)) {
+		switch {
+		case i < len(l) && i < len(r) && l[i] == r[i]:
+			fmt.Fprintf(&b, "\n\t  %s", l[i])
+			continue
+		case i < len(l):
+			fmt.Fprintf(&b, "\n\t- %s", l[i])
+		}
+		if i < len(r) {
+			fmt.Fprintf(&b, "\n\t+ %s", r[i])
+		}
+	}
+	return b.String()
+}
+
+// cmdCheck runs a command as a soft assertion: a failure is logged and
+// recorded, and the script keeps running. Recorded failures fail the script
+// once it ends.
+func (ts *TestScript) cmdCheck(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: check: negate the command instead: check ! command", ts.lineno)
+		return
+	}
+	args = args[1:]
+	if len(args) > 0 && args[0] == "!" {
+		neg = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		ts.t.Fatalf("script:%d: usage: check [!] command [args...]", ts.lineno)
+		return
+	}
+
+	parent := ts.t
+	soft := &softT{parent: parent}
+	ts.t = soft
+	defer func() { ts.t = parent }()
+	ts.cmdExec(neg, args)
+	ts.t = parent
+
+	if soft.failed {
+		msg := soft.failure + ts.failureContext()
+		ts.checks = append(ts.checks, msg)
+		ts.t.Logf("check failed: %s", msg)
+	}
+}
+
+// softT records the first failure of a command run by 'check' or with the
+// "?" prefix instead of failing the script.
+type softT struct {
+	parent  TestingT
+	failed  bool
+	failure string
+}
+
+func (st *softT) Skip(args ...any)                  { st.parent.Skip(args...) }
+func (st *softT) Fatal(args ...any)                 { st.fail(fmt.Sprint(args...)) }
+func (st *softT) Fatalf(format string, args ...any) { st.fail(fmt.Sprintf(format, args...)) }
+func (st *softT) Log(args ...any)                   { st.parent.Log(args...) }
+func (st *softT) Logf(format string, args ...any)   { st.parent.Logf(format, args...) }
+func (st *softT) Failed() bool                      { return st.failed }
+func (st *softT) Helper()                           { st.parent.Helper() }
+
+func (st *softT) fail(msg string) {
+	if !st.failed {
+		st.failed = true
+		st.failure = msg
+	}
+}
+
 func (ts *TestScript) cmdCD(neg bool, args []string) {
 	if len(args) != 2 {
 		ts.t.Fatalf("script:%d: usage: cd dir", ts.lineno)
+		return
 	}
-	dir := args[1]
-	if !filepath.IsAbs(dir) {
-		if ts.cd == "" {
-			if ts.workdir == "" {
-				ts.t.Fatalf("script:%d: workdir not initialized", ts.lineno)
-			}
-			ts.cd = ts.workdir
+	if dir, ok := ts.lookupDir(args[1]); ok {
+		ts.cd = dir
+	}
+}
+
+// cmdPushd changes directory like cd, saving the current one for popd.
+func (ts *TestScript) cmdPushd(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: pushd does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: pushd dir", ts.lineno)
+		return
+	}
+	if dir, ok := ts.lookupDir(args[1]); ok {
+		ts.dirStack = append(ts.dirStack, ts.cd)
+		ts.cd = dir
+	}
+}
+
+// cmdPopd returns to the directory saved by the matching pushd.
+func (ts *TestScript) cmdPopd(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: popd does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 1 {
+		ts.t.Fatalf("script:%d: usage: popd", ts.lineno)
+		return
+	}
+	if len(ts.dirStack) == 0 {
+		ts.t.Fatalf("script:%d: popd: directory stack empty", ts.lineno)
+		return
+	}
+	ts.cd = ts.dirStack[len(ts.dirStack)-1]
+	ts.dirStack = ts.dirStack[:len(ts.dirStack)-1]
+}
+
+// lookupDir returns the absolute path of dir, relative to the current
+// directory, failing the script unless it is an existing directory.
+func (ts *TestScript) lookupDir(dir string) (string, bool) {
+	if ts.cd == "" {
+		if ts.workdir == "" {
+			ts.t.Fatalf("script:%d: workdir not initialized", ts.lineno)
+			return "", false
 		}
+		ts.cd = ts.workdir
+	}
+	if !filepath.IsAbs(dir) {
 		dir = filepath.Join(ts.cd, dir)
 	}
 	info, err := os.Stat(dir)
 	if errors.Is(err, fs.ErrNotExist) {
 		ts.t.Fatalf("script:%d: directory %s does not exist", ts.lineno, dir)
+		return "", false
 	}
 	if err != nil {
 		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		return "", false
 	}
 	if !info.IsDir() {
 		ts.t.Fatalf("script:%d: %s is not a directory", ts.lineno, dir)
+		return "", false
 	}
-	ts.cd = dir
+	return dir, true
 }
 
+// cmdCp copies files. A source of "stdout" or "stderr" copies the output of
+// the last command instead of a file.
 func (ts *TestScript) cmdCp(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: cp does not support negation", ts.lineno)
+	}
 	if len(args) < 3 {
 		ts.t.Fatalf("script:%d: usage: cp src... dst", ts.lineno)
 	}
-	// Implementation would copy files
-	ts.t.Fatalf("script:%d: cp command not fully implemented", ts.lineno)
+	dst := ts.mkabs(args[len(args)-1])
+	info, err := os.Stat(dst)
+	dstDir := err == nil && info.IsDir()
+	var srcs []string
+	for _, arg := range args[1 : len(args)-1] {
+		if arg == "stdout" || arg == "stderr" {
+			srcs = append(srcs, arg)
+			continue
+		}
+		files, err := ts.globFiles([]string{arg})
+		if err != nil {
+			ts.t.Fatalf("script:%d: cp: %v", ts.lineno, err)
+			return
+		}
+		srcs = append(srcs, files...)
+	}
+	if len(srcs) > 1 && !dstDir {
+		ts.t.Fatalf("script:%d: cp: destination %s is not a directory", ts.lineno, dst)
+		return
+	}
+
+	for _, arg := range srcs {
+		var (
+			src  string
+			data []byte
+			mode os.FileMode
+		)
+		switch arg {
+		case "stdout":
+			src, data, mode = arg, []byte(ts.stdout), 0666
+		case "stderr":
+			src, data, mode = arg, []byte(ts.stderr), 0666
+		default:
+			src = ts.mkabs(arg)
+			info, err := os.Stat(src)
+			if err != nil {
+				ts.t.Fatalf("script:%d: cp: %v", ts.lineno, err)
+				return
+			}
+			if info.IsDir() {
+				ts.t.Fatalf("script:%d: cp: %s is a directory", ts.lineno, src)
+				return
+			}
+			mode = info.Mode() & 0777
+			data, err = os.ReadFile(src)
+			if err != nil {
+				ts.t.Fatalf("script:%d: cp: %v", ts.lineno, err)
+				return
+			}
+		}
+		target := dst
+		if dstDir {
+			target = filepath.Join(dst, filepath.Base(src))
+		}
+		if err := os.WriteFile(target, data, mode); err != nil {
+			ts.t.Fatalf("script:%d: cp: %v", ts.lineno, err)
+			return
+		}
+	}
 }
 
+// cmdEnv sets, unsets, or prints environment variables.
+//
+//	env                  print all variables, sorted
+//	env KEY=VALUE...     set variables
+//	env PATTERN...       print variables whose name matches a glob pattern
+//	env -u KEY...        remove variables
 func (ts *TestScript) cmdEnv(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: env does not support negation", ts.lineno)
+	}
 	if len(args) == 1 {
-		// Print all environment variables
-		for _, env := range ts.env {
-			ts.t.Log(env)
+		for _, kv := range filterEnv(ts.env, "*") {
+			ts.t.Log(kv)
 		}
 		return
 	}
-	if len(args) != 2 {
-		ts.t.Fatalf("script:%d: usage: env [key=value]", ts.lineno)
+	if len(args) == 2 && (args[1] == "push" || args[1] == "pop") {
+		ts.envStackOp(args[1])
+		return
+	}
+	if args[1] == "-u" {
+		if len(args) < 3 {
+			ts.t.Fatalf("script:%d: usage: env -u key...", ts.lineno)
+		}
+		for _, k := range args[2:] {
+			ts.unsetenv(k)
+		}
+		return
 	}
-	kv := args[1]
-	if k, v, ok := strings.Cut(kv, "="); ok {
+	for _, arg := range args[1:] {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			if _, err := path.Match(arg, ""); err != nil {
+				ts.t.Fatalf("script:%d: env: invalid pattern %q: %v", ts.lineno, arg, err)
+				return
+			}
+			for _, kv := range filterEnv(ts.env, arg) {
+				ts.t.Log(kv)
+			}
+			continue
+		}
 		entry := k + "=" + v
 		replaced := false
 		for i, existing := range ts.env {
@@ -831,9 +2489,119 @@ func (ts *TestScript) cmdEnv(neg bool, args []string) {
 			ts.env = append(ts.env, entry)
 		}
 		ts.envMap[k] = v
-	} else {
-		ts.t.Fatalf("script:%d: env: no '=' in argument", ts.lineno)
+		ts.envChanged(k)
+	}
+}
+
+// envStackOp runs env push, which saves the whole environment, or env pop,
+// which restores the one saved by the matching push.
+func (ts *TestScript) envStackOp(op string) {
+	if op == "push" {
+		ts.envStack = append(ts.envStack, slices.Clone(ts.env))
+		return
+	}
+	if len(ts.envStack) == 0 {
+		ts.t.Fatalf("script:%d: env pop without env push", ts.lineno)
+		return
+	}
+	saved := ts.envStack[len(ts.envStack)-1]
+	ts.envStack = ts.envStack[:len(ts.envStack)-1]
+	old := ts.envMap
+	ts.env = saved
+	ts.envMap = make(map[string]string, len(saved))
+	for _, kv := range saved {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			ts.envMap[k] = v
+		}
+	}
+	for k, v := range old {
+		if nv, ok := ts.envMap[k]; !ok || nv != v {
+			ts.envChanged(k)
+		}
 	}
+	for k := range ts.envMap {
+		if _, ok := old[k]; !ok {
+			ts.envChanged(k)
+		}
+	}
+}
+
+// envChanged records the current line as where a variable last changed,
+// when tracking for Params.EnvDiff.
+func (ts *TestScript) envChanged(key string) {
+	if ts.envOrigin != nil {
+		ts.envOrigin[key] = fmt.Sprintf("script:%d", ts.lineno)
+	}
+}
+
+// envDiffKeys returns the variables whose value differs from the base
+// environment.
+func (ts *TestScript) envDiffKeys() map[string]bool {
+	keys := make(map[string]bool)
+	for k, v := range ts.envMap {
+		if base, ok := ts.baseEnv[k]; !ok || base != v {
+			keys[k] = true
+		}
+	}
+	for k := range ts.baseEnv {
+		if _, ok := ts.envMap[k]; !ok {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// envDiff renders how the environment differs from the base environment,
+// one variable per line: + added, - removed, ~ changed, with where it last
+// changed.
+func (ts *TestScript) envDiff() string {
+	keys := slices.Sorted(maps.Keys(ts.envDiffKeys()))
+	var b strings.Builder
+	for _, k := range keys {
+		v, ok := ts.envMap[k]
+		base, inBase := ts.baseEnv[k]
+		switch {
+		case !ok:
+			fmt.Fprintf(&b, "\t- %s (was %q)", k, base)
+		case !inBase:
+			fmt.Fprintf(&b, "\t+ %s=%s", k, v)
+		default:
+			fmt.Fprintf(&b, "\t~ %s=%s (was %q)", k, v, base)
+		}
+		if origin := ts.envOrigin[k]; origin != "" {
+			fmt.Fprintf(&b, " [%s]", origin)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// unsetenv removes a variable from the script environment.
+func (ts *TestScript) unsetenv(key string) {
+	ts.env = slices.DeleteFunc(ts.env, func(kv string) bool {
+		k, _, _ := strings.Cut(kv, "=")
+		return k == key
+	})
+	delete(ts.envMap, key)
+	ts.envChanged(key)
+}
+
+// filterEnv returns the key=value entries of env whose key matches the glob
+// pattern, sorted by key.
+func filterEnv(env []string, pattern string) []string {
+	var matched []string
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if ok, _ := path.Match(pattern, k); ok {
+			matched = append(matched, kv)
+		}
+	}
+	slices.SortFunc(matched, func(a, b string) int {
+		ak, _, _ := strings.Cut(a, "=")
+		bk, _, _ := strings.Cut(b, "=")
+		return strings.Compare(ak, bk)
+	})
+	return matched
 }
 
 // cmdEnvfile loads environment variables from a key=value file.
@@ -876,18 +2644,33 @@ func (ts *TestScript) cmdLogfile(neg bool, args []string) {
 }
 
 func (ts *TestScript) cmdExecBuiltin(neg bool, args []string) {
+	// Parse the flags before the program name.
+	flags, args, err := cutExecFlags(args)
+	if err != nil {
+		ts.t.Fatalf("script:%d: exec: %v", ts.lineno, err)
+		return
+	}
 	if len(args) < 2 {
-		ts.t.Fatalf("script:%d: usage: exec [-timeout duration] program [args...]", ts.lineno)
+		ts.t.Fatalf("script:%d: usage: %s", ts.lineno, execUsage)
+		return
 	}
 
-	// Parse -timeout flag before command name.
-	timeout, args := ts.parseExecTimeout(args)
-
-	if len(args) < 2 {
-		ts.t.Fatalf("script:%d: usage: exec [-timeout duration] program [args...]", ts.lineno)
+	// Strip redirections; the program name itself is never one.
+	cmdArgs, redirects, err := parseRedirects(args[2:], ts.execWords(args[2:]))
+	if ts.params.Compat {
+		cmdArgs, redirects, err = args[2:], nil, nil
+	}
+	if err != nil {
+		ts.t.Fatalf("script:%d: exec: %v", ts.lineno, err)
+		return
+	}
+	args = append(args[:2:2], cmdArgs...)
+	stdin, err := ts.redirectStdin(redirects)
+	if err != nil {
+		ts.t.Fatalf("script:%d: exec: %v", ts.lineno, err)
+		return
 	}
 
-	var err error
 	if len(args) > 2 && backgroundSpecifier.MatchString(args[len(args)-1]) {
 		// Background execution
 		bgName := strings.TrimSuffix(strings.TrimPrefix(args[len(args)-1], "&"), "&")
@@ -898,35 +2681,66 @@ func (ts *TestScript) cmdExecBuiltin(neg bool, args []string) {
 			ts.t.Fatalf("script:%d: duplicate background process name %q", ts.lineno, bgName)
 		}
 
-		cmd, execErr := ts.buildExecCmd(args[1], args[2:len(args)-1])
+		cmd, execErr := ts.buildExecCmd(flags, args[1], args[2:len(args)-1])
 		if execErr != nil {
 			err = execErr
 		} else {
-			bg := backgroundCmd{
-				name: bgName,
-				cmd:  cmd,
-				neg:  neg,
+			bg := &backgroundCmd{
+				name:      bgName,
+				cmd:       cmd,
+				neg:       neg,
+				redirects: redirects,
 			}
-			cmd.Stdout = &bg.stdout
-			cmd.Stderr = &bg.stderr
+			bg.out.setLimit(ts.outputLimit())
+			cmd.Stdin = stdin
+			cmd.Stdout = bg.out.stdoutWriter()
+			cmd.Stderr = bg.out.stderrWriter()
+			// The command is started here, not by the waiting goroutine,
+			// so that cmd.Process is set before the script goes on and may
+			// kill it.
 			wait := make(chan struct{})
-			go func() {
-				ts.waitOrStop(context.Background(), cmd, -1)
+			bg.err = ts.startExec(cmd, flags)
+			if bg.err == nil && cmd.Process == nil {
+				bg.err = cmd.Start()
+			}
+			if bg.err != nil {
 				close(wait)
-			}()
+			} else {
+				ctx, stop := context.WithCancel(context.Background())
+				go func() {
+					ts.waitOrStop(ctx, cmd, 0)
+					stop()
+					close(wait)
+				}()
+				bg.stop = stop
+			}
 			bg.wait = wait
 			ts.background = append(ts.background, bg)
 		}
 		ts.stdout, ts.stderr = "", ""
 	} else {
 		// Foreground execution
-		ts.stdout, ts.stderr, err = ts.execWithTimeout(timeout, args[1], args[2:]...)
-		if ts.stdout != "" {
+		// In verbose mode output is logged line by line as it arrives;
+		// otherwise it is logged once the command is done.
+		stream := verbose()
+		ts.output, err = ts.execCapture(flags, stdin, stream, args[1], args[2:]...)
+		ts.output = ts.normalizeOutput(ts.output)
+		ts.stdout, ts.stderr = ts.output.stdout, ts.output.stderr
+		ts.setExitCode(exitCode(err))
+		if ts.stdout != "" && !stream {
 			ts.t.Logf("[stdout]\n%s", ts.stdout)
 		}
-		if ts.stderr != "" {
+		if ts.stderr != "" && !stream {
 			ts.t.Logf("[stderr]\n%s", ts.stderr)
 		}
+		if rerr := ts.writeRedirects(redirects, ts.stdout, ts.stderr); rerr != nil {
+			ts.t.Fatalf("script:%d: exec: %v", ts.lineno, rerr)
+			return
+		}
+		if serr := ts.saveOutput(ts.stdout, ts.stderr); serr != nil {
+			ts.t.Fatalf("script:%d: exec: %v", ts.lineno, serr)
+			return
+		}
 	}
 
 	if err != nil {
@@ -944,6 +2758,47 @@ func (ts *TestScript) cmdExecBuiltin(neg bool, args []string) {
 	}
 }
 
+// exitCode returns the exit status of a finished command: 0 on success, -1
+// if it could not be started or was killed by a signal.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr interface{ ExitCode() int } // *exec.ExitError or replayedExit
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// setExitCode records the exit status of the last exec and exposes it as
+// the script-local variable $exit.
+func (ts *TestScript) setExitCode(code int) {
+	ts.exitCode, ts.exited = code, true
+	if ts.vars == nil {
+		ts.vars = make(map[string]string)
+	}
+	ts.vars["exit"] = strconv.Itoa(code)
+}
+
+// saveOutput writes an exec's output to the next numbered files under
+// $WORK/.tsar/out, if enabled.
+func (ts *TestScript) saveOutput(stdout, stderr string) error {
+	if !ts.params.SaveOutput && (ts.meta == nil || !ts.meta.saveOutput) {
+		return nil
+	}
+	dir := filepath.Join(ts.workdir, ".tsar", "out")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	ts.execs++
+	base := filepath.Join(dir, fmt.Sprintf("%03d", ts.execs))
+	if err := os.WriteFile(base+".stdout", []byte(stdout), 0666); err != nil {
+		return err
+	}
+	return os.WriteFile(base+".stderr", []byte(stderr), 0666)
+}
+
 func (ts *TestScript) cmdExists(neg bool, args []string) {
 	if len(args) != 2 {
 		ts.t.Fatalf("script:%d: usage: exists file", ts.lineno)
@@ -951,6 +2806,19 @@ func (ts *TestScript) cmdExists(neg bool, args []string) {
 	file := ts.mkabs(args[1])
 	_, err := os.Stat(file)
 	exists := err == nil
+	if !exists && strings.ContainsAny(args[1], "*?[") {
+		matches, err := filepath.Glob(file)
+		if err != nil {
+			ts.t.Fatalf("script:%d: exists: invalid pattern %q: %v", ts.lineno, args[1], err)
+			return
+		}
+		if len(matches) == 0 && !neg {
+			ts.t.Fatalf("script:%d: no files match %s", ts.lineno, args[1])
+			return
+		}
+		exists = len(matches) > 0
+		file = strings.Join(matches, ", ")
+	}
 	if neg {
 		exists = !exists
 	}
@@ -963,31 +2831,140 @@ func (ts *TestScript) cmdExists(neg bool, args []string) {
 	}
 }
 
-func (ts *TestScript) cmdGrep(neg bool, args []string) {
-	if len(args) != 3 {
-		ts.t.Fatalf("script:%d: usage: grep pattern file", ts.lineno)
+// cmdGrep checks that a file matches a pattern: with several files or glob
+// patterns, that any of them does, and negated, that none does. Flags:
+//
+//	-count=N  exactly N matches in all the files together
+//	-i        match case-insensitively
+//	-m        multiline mode: ^ and $ match at line boundaries
+//
+// Failures list the matched lines, with their file and line number.
+func (ts *TestScript) cmdGrep(neg bool, args []string) {
+	if ts.params.Compat {
+		ts.matchCompat(neg, args, "")
+		return
+	}
+	usage := "usage: grep [-count=N] [-i] [-m] pattern file..."
+	args = args[1:]
+	count := -1
+	var flags string
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch flag := args[0]; {
+		case strings.HasPrefix(flag, "-count="):
+			n, err := strconv.Atoi(strings.TrimPrefix(flag, "-count="))
+			if err != nil || n < 0 {
+				ts.t.Fatalf("script:%d: grep: bad %s", ts.lineno, flag)
+				return
+			}
+			if neg {
+				ts.t.Fatalf("script:%d: grep: cannot use -count= with negated match", ts.lineno)
+				return
+			}
+			count = n
+		case flag == "-i":
+			flags += "i"
+		case flag == "-m":
+			flags += "m"
+		default:
+			ts.t.Fatalf("script:%d: grep: unknown flag %s; %s", ts.lineno, flag, usage)
+			return
+		}
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	pattern := args[0]
+	expr := pattern
+	if flags != "" {
+		expr = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		ts.t.Fatalf("script:%d: grep: invalid pattern %q: %v", ts.lineno, pattern, err)
+		return
+	}
+	files, err := ts.globFiles(args[1:])
+	if err != nil {
+		ts.t.Fatalf("script:%d: grep: %v", ts.lineno, err)
+		return
+	}
+
+	var matched []string // file:line: text
+	matches, matchedFiles := 0, 0
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			ts.t.Fatalf("script:%d: grep %s: %v", ts.lineno, filename, err)
+			return
+		}
+		data = []byte(ts.normalizeNewlines(string(data)))
+		locs := re.FindAllIndex(data, -1)
+		if len(locs) > 0 {
+			matchedFiles++
+		}
+		matches += len(locs)
+		matched = append(matched, matchedLines(ts.relWork(filename), data, locs)...)
+	}
+	what := "file " + ts.relWork(files[0])
+	if len(files) > 1 {
+		what = fmt.Sprintf("%d files", len(files))
+	}
+	switch {
+	case count >= 0 && matches != count:
+		ts.t.Fatalf("script:%d: %s: have %d matches for %q, want %d%s", ts.lineno, what, matches, pattern, count, listMatched(matched))
+	case count < 0 && neg && matches > 0 && len(files) > 1:
+		ts.t.Fatalf("script:%d: %d of %d files unexpectedly match %q%s", ts.lineno, matchedFiles, len(files), pattern, listMatched(matched))
+	case count < 0 && neg && matches > 0:
+		ts.t.Fatalf("script:%d: %s unexpectedly matches %q%s", ts.lineno, what, pattern, listMatched(matched))
+	case count < 0 && !neg && matches == 0 && len(files) > 1:
+		ts.t.Fatalf("script:%d: none of %d files matches %q", ts.lineno, len(files), pattern)
+	case count < 0 && !neg && matches == 0:
+		ts.t.Fatalf("script:%d: %s does not match %q", ts.lineno, what, pattern)
+	}
+}
+
+// matchedLines returns the lines of data where the matches at locs start,
+// each once, as "name:line: text".
+func matchedLines(name string, data []byte, locs [][]int) []string {
+	var lines []string
+	last := 0
+	for _, loc := range locs {
+		n := bytes.Count(data[:loc[0]], []byte("\n")) + 1
+		if n == last {
+			continue
+		}
+		last = n
+		start := bytes.LastIndexByte(data[:loc[0]], '\n') + 1
+		end := bytes.IndexByte(data[start:], '\n')
+		if end < 0 {
+			end = len(data) - start
+		}
+		lines = append(lines, fmt.Sprintf("%s:%d: %s", name, n, data[start:start+end]))
 	}
-	pattern := args[1]
-	filename := ts.mkabs(args[2])
+	return lines
+}
 
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		ts.t.Fatalf("script:%d: grep %s: %v", ts.lineno, filename, err)
+// listMatched formats matched lines for a failure, up to 20 of them.
+func listMatched(lines []string) string {
+	if len(lines) == 0 {
+		return ""
 	}
-
-	content := string(data)
-	re, err2 := regexp.Compile(pattern)
-	if err2 != nil {
-		ts.t.Fatalf("script:%d: grep: invalid pattern %q: %v", ts.lineno, pattern, err2)
+	const max = 20
+	s := "\nmatched lines:\n\t" + strings.Join(lines[:min(len(lines), max)], "\n\t")
+	if len(lines) > max {
+		s += fmt.Sprintf("\n\t... and %d more", len(lines)-max)
 	}
-	match := re.MatchString(content)
-	if match == neg {
-		if neg {
-			ts.t.Fatalf("script:%d: file %s unexpectedly matches %q", ts.lineno, filename, pattern)
-		} else {
-			ts.t.Fatalf("script:%d: file %s does not match %q", ts.lineno, filename, pattern)
-		}
+	return s
+}
+
+// relWork returns file relative to $WORK if it is inside it.
+func (ts *TestScript) relWork(file string) string {
+	if rel, err := filepath.Rel(ts.workdir, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
 	}
+	return file
 }
 
 func (ts *TestScript) cmdMkdir(neg bool, args []string) {
@@ -1002,18 +2979,121 @@ func (ts *TestScript) cmdMkdir(neg bool, args []string) {
 	}
 }
 
+// cmdPath adds directories to the front or back of the script's PATH.
+// Relative directories are resolved against $WORK, and directories already
+// present in PATH are moved rather than duplicated.
+func (ts *TestScript) cmdPath(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: path does not support negation", ts.lineno)
+	}
+	if len(args) < 3 {
+		ts.t.Fatalf("script:%d: usage: path prepend|append dir...", ts.lineno)
+		return
+	}
+
+	var dirs []string
+	for _, dir := range args[2:] {
+		dirs = append(dirs, filepath.Clean(ts.mkabs(dir)))
+	}
+	var entries []string
+	for _, dir := range filepath.SplitList(ts.Getenv("PATH")) {
+		if dir != "" && !slices.Contains(dirs, filepath.Clean(dir)) {
+			entries = append(entries, dir)
+		}
+	}
+
+	switch args[1] {
+	case "prepend":
+		entries = append(dirs, entries...)
+	case "append":
+		entries = append(entries, dirs...)
+	default:
+		ts.t.Fatalf("script:%d: path: unknown operation %q (want prepend or append)", ts.lineno, args[1])
+		return
+	}
+	ts.Setenv("PATH", strings.Join(entries, string(os.PathListSeparator)))
+}
+
 func (ts *TestScript) cmdRm(neg bool, args []string) {
 	if len(args) < 2 {
 		ts.t.Fatalf("script:%d: usage: rm file...", ts.lineno)
 	}
-	for _, arg := range args[1:] {
-		file := ts.mkabs(arg)
+	files, err := ts.globFiles(args[1:])
+	if err != nil {
+		ts.t.Fatalf("script:%d: rm: %v", ts.lineno, err)
+		return
+	}
+	for _, file := range files {
 		if err := removeAll(file); err != nil {
 			ts.t.Fatalf("script:%d: rm %s: %v", ts.lineno, file, err)
 		}
 	}
 }
 
+func (ts *TestScript) cmdRequires(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: requires does not support negation", ts.lineno)
+		return
+	}
+	if len(args) < 2 {
+		ts.t.Fatalf("script:%d: usage: requires program...", ts.lineno)
+		return
+	}
+	if missing := ts.missingTools(args[1:]); len(missing) > 0 {
+		ts.missingRequires(fmt.Sprintf("script:%d: requires", ts.lineno), missing)
+	}
+}
+
+// missingTools returns the programs in names that are not found in the test
+// environment's PATH. Names containing a path separator are checked as
+// paths, relative to the current directory. Nothing is missing when
+// programs are replayed rather than run.
+func (ts *TestScript) missingTools(names []string) []string {
+	if ts.params.ExecMode == ExecReplay {
+		return nil
+	}
+	var missing []string
+	for _, name := range names {
+		if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+			if info, err := os.Stat(ts.mkabs(name)); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+				continue
+			}
+		} else if _, err := ts.lookPath(name); err == nil {
+			continue
+		}
+		missing = append(missing, name)
+	}
+	return missing
+}
+
+// missingRequires skips the script, or fails it with
+// Params.FailOnMissingRequires, for the missing programs.
+func (ts *TestScript) missingRequires(prefix string, missing []string) {
+	msg := fmt.Sprintf("%s: missing required program(s) on PATH: %s", prefix, strings.Join(missing, ", "))
+	if ts.params.FailOnMissingRequires {
+		ts.t.Fatalf("%s", msg)
+		return
+	}
+	ts.t.Skip(msg)
+}
+
+func (ts *TestScript) cmdUmask(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: umask does not support negation", ts.lineno)
+		return
+	}
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: umask mode", ts.lineno)
+		return
+	}
+	mask, err := parseUmask(args[1])
+	if err != nil {
+		ts.t.Fatalf("script:%d: umask: %v", ts.lineno, err)
+		return
+	}
+	ts.umask = &mask
+}
+
 func (ts *TestScript) cmdSkip(neg bool, args []string) {
 	if len(args) > 1 {
 		ts.t.Skip(args[1])
@@ -1023,6 +3103,10 @@ func (ts *TestScript) cmdSkip(neg bool, args []string) {
 }
 
 func (ts *TestScript) cmdStderr(neg bool, args []string) {
+	if ts.params.Compat {
+		ts.matchCompat(neg, args, ts.stderr)
+		return
+	}
 	if len(args) != 2 {
 		ts.t.Fatalf("script:%d: usage: stderr text", ts.lineno)
 	}
@@ -1042,6 +3126,10 @@ func (ts *TestScript) cmdStderr(neg bool, args []string) {
 }
 
 func (ts *TestScript) cmdStdout(neg bool, args []string) {
+	if ts.params.Compat {
+		ts.matchCompat(neg, args, ts.stdout)
+		return
+	}
 	if len(args) != 2 {
 		ts.t.Fatalf("script:%d: usage: stdout text", ts.lineno)
 	}
@@ -1060,17 +3148,122 @@ func (ts *TestScript) cmdStdout(neg bool, args []string) {
 	}
 }
 
+// cmdSection starts a named section: the following commands, up to the next
+// section, are reported as a sub-test.
+func (ts *TestScript) cmdSection(neg bool, args []string) {
+	if neg || len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: section name", ts.lineno)
+		return
+	}
+	ts.section = args[1]
+}
+
+// cmdSet sets a script-local variable. It is expanded like an environment
+// variable, shadowing any of the same name, but is not passed to programs.
+func (ts *TestScript) cmdSet(neg bool, args []string) {
+	if neg || len(args) < 2 || len(args) > 3 {
+		ts.t.Fatalf("script:%d: usage: set name [value]", ts.lineno)
+		return
+	}
+	name := args[1]
+	if !isVarName(name) {
+		ts.t.Fatalf("script:%d: set: invalid variable name %q", ts.lineno, name)
+		return
+	}
+	value := ""
+	if len(args) == 3 {
+		value = args[2]
+	}
+	if ts.vars == nil {
+		ts.vars = make(map[string]string)
+	}
+	ts.vars[name] = value
+}
+
+// isVarName reports whether name can be expanded with $name.
+func isVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// cmdStatus asserts the exit status of the last exec.
+func (ts *TestScript) cmdStatus(neg bool, args []string) {
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: status code", ts.lineno)
+		return
+	}
+	want, err := strconv.Atoi(args[1])
+	if err != nil {
+		ts.t.Fatalf("script:%d: status: invalid exit code %q", ts.lineno, args[1])
+		return
+	}
+	if !ts.exited {
+		ts.t.Fatalf("script:%d: status: no command has run", ts.lineno)
+		return
+	}
+	if (ts.exitCode == want) == neg {
+		if neg {
+			ts.t.Fatalf("script:%d: exit status is unexpectedly %d", ts.lineno, want)
+		} else {
+			ts.t.Fatalf("script:%d: exit status is %d, want %d\nstderr: %s", ts.lineno, ts.exitCode, want, ts.stderr)
+		}
+	}
+}
+
+// cmdOutput matches a pattern against the last command's stdout and stderr
+// together, interleaved as they were written.
+func (ts *TestScript) cmdOutput(neg bool, args []string) {
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: output pattern", ts.lineno)
+		return
+	}
+	pattern := args[1]
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		ts.t.Fatalf("script:%d: output: invalid pattern %q: %v", ts.lineno, pattern, err)
+		return
+	}
+	output := ts.combinedOutput()
+	if re.MatchString(output) == neg {
+		if neg {
+			ts.t.Fatalf("script:%d: output unexpectedly matches %q", ts.lineno, pattern)
+		} else {
+			ts.t.Fatalf("script:%d: output does not match %q\noutput: %s", ts.lineno, pattern, output)
+		}
+	}
+}
+
+// combinedOutput returns the last command's stdout and stderr interleaved as
+// written when it was an exec or wait, and stdout followed by stderr for
+// other commands.
+func (ts *TestScript) combinedOutput() string {
+	if ts.output.stdout == ts.stdout && ts.output.stderr == ts.stderr {
+		return ts.output.combined
+	}
+	return ts.stdout + ts.stderr
+}
+
 func (ts *TestScript) cmdStop(neg bool, args []string) {
 	ts.stopped = true
 }
 
 // ---- HTTP Commands
 
-func newTestHTTPClient() *http.Client {
+func newTestHTTPClient(aliases *hostAliases) *http.Client {
 	jar, _ := cookiejar.New(nil)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = aliases.dialContext
 	return &http.Client{
-		Timeout: 30 * time.Second,
-		Jar:     jar,
+		Timeout:   30 * time.Second,
+		Jar:       jar,
+		Transport: transport,
 	}
 }
 
@@ -1214,7 +3407,7 @@ func (ts *TestScript) doHTTP(method, url string, flags []string) (int, error) {
 		body = bytes.NewReader(data)
 	}
 
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ts.ctx, method, url, body)
 	if err != nil {
 		return 0, err
 	}
@@ -1326,7 +3519,7 @@ func (ts *TestScript) doHTTPRaw(method, url string, bodyData []byte, headers []s
 		body = bytes.NewReader(bodyData)
 	}
 
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ts.ctx, method, url, body)
 	if err != nil {
 		return 0, err
 	}
@@ -1486,7 +3679,7 @@ func (ts *TestScript) repeatExec(neg bool, count int, runAll bool, timeout time.
 		ts.t.Fatalf("script:%d: repeat exec: missing command", ts.lineno)
 	}
 
-	ctx := context.Background()
+	ctx := ts.ctx
 	var cancel context.CancelFunc
 	if timeout > 0 {
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -1538,7 +3731,7 @@ func (ts *TestScript) repeatHTTP(neg bool, count int, runAll bool, timeout time.
 	url := args[1]
 	flags := args[2:]
 
-	ctx := context.Background()
+	ctx := ts.ctx
 	var cancel context.CancelFunc
 	if timeout > 0 {
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -1606,7 +3799,7 @@ func (ts *TestScript) repeatHTTPParallel(neg bool, count int, runAll bool, timeo
 		return
 	}
 
-	ctx := context.Background()
+	ctx := ts.ctx
 	var cancel context.CancelFunc
 	if timeout > 0 {
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -1680,10 +3873,7 @@ func (ts *TestScript) cmdWait(neg bool, args []string) {
 	var bgcmds []*backgroundCmd
 	if len(args) == 1 {
 		// Wait for all background commands
-		bgcmds = make([]*backgroundCmd, len(ts.background))
-		for i := range ts.background {
-			bgcmds[i] = &ts.background[i]
-		}
+		bgcmds = slices.Clone(ts.background)
 	} else {
 		// Wait for specific background commands
 		for _, name := range args[1:] {
@@ -1695,23 +3885,32 @@ func (ts *TestScript) cmdWait(neg bool, args []string) {
 		}
 	}
 
-	var stdouts, stderrs []string
+	var stdouts, stderrs, combined []string
 	for _, bg := range bgcmds {
 		<-bg.wait
 
 		// Collect output
-		if bg.stdout.Len() > 0 {
-			stdouts = append(stdouts, bg.stdout.String())
+		out := bg.out.result()
+		stdouts = append(stdouts, out.stdout)
+		stderrs = append(stderrs, out.stderr)
+		combined = append(combined, out.combined)
+		if err := ts.writeRedirects(bg.redirects, out.stdout, out.stderr); err != nil {
+			ts.t.Fatalf("script:%d: wait %s: %v", ts.lineno, bg.name, err)
 		}
-		if bg.stderr.Len() > 0 {
-			stderrs = append(stderrs, bg.stderr.String())
+		if err := ts.saveOutput(out.stdout, out.stderr); err != nil {
+			ts.t.Fatalf("script:%d: wait %s: %v", ts.lineno, bg.name, err)
 		}
 
 		// Check exit status
-		var err error
+		err := bg.err
 		if bg.cmd.ProcessState != nil && !bg.cmd.ProcessState.Success() {
 			err = &exec.ExitError{ProcessState: bg.cmd.ProcessState}
 		}
+		if bg.cmd.ProcessState != nil {
+			ts.setExitCode(bg.cmd.ProcessState.ExitCode())
+		} else if bg.err != nil {
+			ts.setExitCode(exitCode(bg.err))
+		}
 
 		success := err == nil
 		if success != !bg.neg {
@@ -1726,6 +3925,8 @@ func (ts *TestScript) cmdWait(neg bool, args []string) {
 	// Update stdout/stderr with combined output
 	ts.stdout = strings.Join(stdouts, "")
 	ts.stderr = strings.Join(stderrs, "")
+	ts.output = ts.normalizeOutput(execOutput{ts.stdout, ts.stderr, strings.Join(combined, "")})
+	ts.stdout, ts.stderr = ts.output.stdout, ts.output.stderr
 
 	// Remove completed background commands
 	if len(args) == 1 {
@@ -1766,50 +3967,250 @@ func tempEnvName() string {
 	}
 }
 
-// parseExecTimeout extracts a -timeout flag from exec args.
-// Returns the timeout duration (0 means no timeout) and the remaining args.
-// args[0] is always the command name ("exec"), preserved in the returned slice.
-func (ts *TestScript) parseExecTimeout(args []string) (time.Duration, []string) {
-	// args = ["exec", "-timeout", "30s", "push", ...]
-	//   or   ["exec", "push", ...]
-	if len(args) >= 4 && args[1] == "-timeout" {
-		d, err := time.ParseDuration(args[2])
+// execUsage is the usage message of exec.
+const execUsage = "exec [-timeout duration] [-umask mode] [-user name] [-sandbox] program [args...]"
+
+// execFlags holds the flags given to exec before the program name.
+type execFlags struct {
+	timeout time.Duration
+	umask   *int   // file mode creation mask; nil for the script's own
+	user    string // user to run the program as, if set
+	sandbox bool   // run the program in new namespaces; see Params.Sandbox
+}
+
+// cutExecFlags extracts the flags of exec args, which come before the
+// program name:
+//
+//	["exec", "-timeout", "30s", "-umask", "077", "push", ...]
+func cutExecFlags(args []string) (execFlags, []string, error) {
+	var flags execFlags
+	i := 1
+	for ; i < len(args); i++ {
+		if args[i] == "-sandbox" {
+			flags.sandbox = true
+			continue
+		}
+		if i+1 == len(args) {
+			break
+		}
+		value := args[i+1]
+		switch args[i] {
+		case "-timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return flags, nil, fmt.Errorf("invalid timeout %q: %v", value, err)
+			}
+			flags.timeout = d
+		case "-umask":
+			mask, err := parseUmask(value)
+			if err != nil {
+				return flags, nil, err
+			}
+			flags.umask = &mask
+		case "-user":
+			flags.user = value
+		default:
+			return flags, append(args[:1:1], args[i:]...), nil
+		}
+		i++
+	}
+	return flags, append(args[:1:1], args[i:]...), nil
+}
+
+// parseUmask parses an octal file mode creation mask, such as 022.
+func parseUmask(s string) (int, error) {
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("invalid umask %q (want octal, 000 to 777)", s)
+	}
+	return int(mask), nil
+}
+
+// execWords returns the words args were split from, as written, if they
+// end the line being run, as the arguments of exec do even when it runs
+// under repeat or ?; otherwise it returns nil.
+func (ts *TestScript) execWords(args []string) []string {
+	n := len(ts.words) - len(args)
+	if n < 0 {
+		return nil
+	}
+	raw := make([]string, len(args))
+	for i, w := range ts.words[n:] {
+		if w.Value != args[i] {
+			return nil
+		}
+		raw[i] = w.Raw
+	}
+	return raw
+}
+
+// parseRedirects extracts redirections (<file, >file, >>file, 2>file, 2>>file)
+// from exec arguments. A redirection target may be attached to the operator
+// or given as the following argument. The remaining arguments are returned
+// in order. If raw holds the arguments as written, only those starting with
+// a bare operator are redirections, so that quoted words such as '<html>'
+// stay literal.
+func parseRedirects(args, raw []string) ([]string, []execRedirect, error) {
+	var rest []string
+	var redirects []execRedirect
+	for i := 0; i < len(args); i++ {
+		arg, word := args[i], args[i]
+		if raw != nil {
+			word = raw[i]
+		}
+		var r execRedirect
+		var op string
+		switch {
+		case strings.HasPrefix(word, "2>>"):
+			r.stderr, r.append, op = true, true, "2>>"
+		case strings.HasPrefix(word, "2>"):
+			r.stderr, op = true, "2>"
+		case strings.HasPrefix(word, ">>"):
+			r.append, op = true, ">>"
+		case strings.HasPrefix(word, ">"):
+			op = ">"
+		case strings.HasPrefix(word, "<"):
+			r.input, op = true, "<"
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+		r.file = arg[len(op):]
+		if r.file == "" {
+			i++
+			if i >= len(args) {
+				return nil, nil, fmt.Errorf("redirection %q requires a file", arg)
+			}
+			r.file = args[i]
+		}
+		if strings.HasPrefix(r.file, "&") {
+			return nil, nil, fmt.Errorf("unsupported redirection %q", arg)
+		}
+		redirects = append(redirects, r)
+	}
+	return rest, redirects, nil
+}
+
+// redirectStdin returns the contents of the input redirection, if any,
+// as a reader suitable for a command's stdin.
+func (ts *TestScript) redirectStdin(redirects []execRedirect) (io.Reader, error) {
+	var stdin io.Reader
+	for _, r := range redirects {
+		if !r.input {
+			continue
+		}
+		if stdin != nil {
+			return nil, fmt.Errorf("multiple input redirections")
+		}
+		data, err := os.ReadFile(ts.mkabs(r.file))
+		if err != nil {
+			return nil, err
+		}
+		stdin = bytes.NewReader(data)
+	}
+	return stdin, nil
+}
+
+// writeRedirects writes captured command output to the files named by redirects.
+func (ts *TestScript) writeRedirects(redirects []execRedirect, stdout, stderr string) error {
+	for _, r := range redirects {
+		if r.input {
+			continue
+		}
+		data := stdout
+		if r.stderr {
+			data = stderr
+		}
+		flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if r.append {
+			flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		f, err := os.OpenFile(ts.mkabs(r.file), flag, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
 		if err != nil {
-			ts.t.Fatalf("script:%d: exec: invalid timeout %q: %v", ts.lineno, args[2], err)
+			return err
 		}
-		return d, append(args[:1], args[3:]...)
 	}
-	return 0, args
+	return nil
 }
 
 // exec executes a command and returns stdout, stderr, and any error.
 func (ts *TestScript) exec(name string, args ...string) (stdout, stderr string, err error) {
-	return ts.execWithTimeout(0, name, args...)
+	return ts.execWithTimeout(0, nil, name, args...)
+}
+
+// execWithTimeout executes a command with an optional timeout, feeding it
+// stdin if non-nil.
+func (ts *TestScript) execWithTimeout(timeout time.Duration, stdin io.Reader, name string, args ...string) (stdout, stderr string, err error) {
+	out, err := ts.execCapture(execFlags{timeout: timeout}, stdin, false, name, args...)
+	return out.stdout, out.stderr, err
+}
+
+// execCapture is like execWithTimeout but also returns stdout and stderr
+// interleaved. If stream is set, output lines are logged as they arrive.
+func (ts *TestScript) execCapture(flags execFlags, stdin io.Reader, stream bool, name string, args ...string) (execOutput, error) {
+	if ts.cassette == nil {
+		return ts.execRun(flags, stdin, stream, name, args)
+	}
+	key, digest, stdin, err := ts.cassetteKey(stdin, name, args)
+	if err != nil {
+		return execOutput{}, err
+	}
+	if ts.params.ExecMode == ExecReplay {
+		out, err := ts.replay(key, digest)
+		if stream {
+			if out.stdout != "" {
+				ts.t.Logf("[stdout]\n%s", out.stdout)
+			}
+			if out.stderr != "" {
+				ts.t.Logf("[stderr]\n%s", out.stderr)
+			}
+		}
+		return out, err
+	}
+	out, err := ts.execRun(flags, stdin, stream, name, args)
+	ts.record(key, digest, out, err)
+	return out, err
 }
 
-// execWithTimeout executes a command with an optional timeout.
-func (ts *TestScript) execWithTimeout(timeout time.Duration, name string, args ...string) (stdout, stderr string, err error) {
-	cmd, err := ts.buildExecCmd(name, args)
+// execRun runs a program for execCapture.
+func (ts *TestScript) execRun(flags execFlags, stdin io.Reader, stream bool, name string, args []string) (execOutput, error) {
+	cmd, err := ts.buildExecCmd(flags, name, args)
 	if err != nil {
-		return "", "", err
+		return execOutput{}, err
 	}
+	cmd.Stdin = stdin
 
-	var stdoutBuf, stderrBuf strings.Builder
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	var out outputCapture
+	out.setLimit(ts.outputLimit())
+	if stream {
+		out.stream(ts.t.Logf, ts.outputLimit())
+	}
+	cmd.Stdout = out.stdoutWriter()
+	cmd.Stderr = out.stderrWriter()
 
-	if timeout > 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if err := ts.startExec(cmd, flags); err != nil {
+		return execOutput{}, err
+	}
+	ctx := ts.ctx
+	if flags.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flags.timeout)
 		defer cancel()
-		err = ts.waitOrStop(ctx, cmd, 2*time.Second)
-	} else {
-		err = cmd.Run()
 	}
-	return stdoutBuf.String(), stderrBuf.String(), err
+	err = ts.waitOrStop(ctx, cmd, 2*time.Second)
+	out.flush()
+	return out.result(), err
 }
 
 // buildExecCmd creates an exec.Cmd for the given command and arguments
-func (ts *TestScript) buildExecCmd(name string, args []string) (*exec.Cmd, error) {
+func (ts *TestScript) buildExecCmd(flags execFlags, name string, args []string) (*exec.Cmd, error) {
 	var cmd *exec.Cmd
 
 	// If name contains path separators, use it as is
@@ -1824,12 +4225,67 @@ func (ts *TestScript) buildExecCmd(name string, args []string) (*exec.Cmd, error
 		cmd = exec.Command(path, args...)
 	}
 
+	proxyEnv, err := ts.proxyEnv()
+	if err != nil {
+		return nil, err
+	}
 	cmd.Dir = ts.cd
-	cmd.Env = append(ts.env, "PWD="+ts.cd)
-
+	cmd.Env = slices.Concat(ts.env, proxyEnv, []string{"PWD=" + ts.cd})
+	// Each command leads its own process group, so the processes it starts
+	// are stopped with it; see waitOrStop.
+	setProcessGroup(cmd)
+	cmd.WaitDelay = execWaitDelay
+
+	if flags.sandbox || ts.params.Sandbox || ts.meta != nil && ts.meta.sandbox {
+		if flags.user != "" {
+			return nil, fmt.Errorf("-user %s: cannot run sandboxed programs as another user", flags.user)
+		}
+		if err := setSandbox(cmd, ts.workdir); err != nil {
+			return nil, err
+		}
+	}
+	if flags.user != "" {
+		u, err := lookupUser(flags.user)
+		if err != nil {
+			return nil, err
+		}
+		if euid := os.Geteuid(); euid != 0 && u.Uid != strconv.Itoa(euid) {
+			return nil, fmt.Errorf("-user %s: only root can run programs as another user", flags.user)
+		}
+		if err := setUser(cmd, u); err != nil {
+			return nil, err
+		}
+	}
 	return cmd, nil
 }
 
+// lookupUser finds a user by name or numeric ID.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, numErr := strconv.Atoi(name); numErr == nil {
+			u, err = user.LookupId(name)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-user %s: %v", name, err)
+	}
+	return u, nil
+}
+
+// startExec starts a command built by buildExecCmd if a umask applies to
+// it, from its flags or the umask command; otherwise waitOrStop starts it.
+func (ts *TestScript) startExec(cmd *exec.Cmd, flags execFlags) error {
+	mask := flags.umask
+	if mask == nil {
+		mask = ts.umask
+	}
+	if mask == nil {
+		return nil
+	}
+	return startUmask(cmd, *mask)
+}
+
 // lookPath searches for an executable in the test environment's PATH.
 func (ts *TestScript) lookPath(name string) (string, error) {
 	pathEnv := ts.envMap["PATH"]
@@ -1849,7 +4305,14 @@ func (ts *TestScript) lookPath(name string) (string, error) {
 	return "", fmt.Errorf("executable file not found in test PATH")
 }
 
-// waitOrStop waits for a command to complete or stops it after timeout
+// execWaitDelay bounds how long waiting for an exited command may block on
+// output pipes held open by processes it started.
+const execWaitDelay = time.Second
+
+// waitOrStop waits for a command to complete or, once ctx is done, stops it
+// and its process group: an interrupt first, then a kill after the interrupt
+// delay, or a kill at once if the delay is zero. Processes left in the group
+// when the command exits are killed.
 func (ts *TestScript) waitOrStop(ctx context.Context, cmd *exec.Cmd, interrupt time.Duration) error {
 	if cmd.Process == nil {
 		if err := cmd.Start(); err != nil {
@@ -1857,47 +4320,96 @@ func (ts *TestScript) waitOrStop(ctx context.Context, cmd *exec.Cmd, interrupt t
 		}
 	}
 
+	g := &processGroup{cmd: cmd}
 	done := make(chan error, 1)
 	go func() {
-		done <- cmd.Wait()
+		err := g.wait()
+		if errors.Is(err, exec.ErrWaitDelay) {
+			// The command succeeded; only processes it left behind held
+			// its output open, and they have been killed.
+			err = nil
+		}
+		done <- err
 	}()
 
-	if interrupt < 0 {
-		// No timeout, just wait
-		return <-done
-	}
-
 	select {
 	case err := <-done:
 		return err
 	case <-ctx.Done():
-		// Context cancelled, try to stop the process
-		if cmd.Process != nil {
-			if runtime.GOOS == "windows" {
-				cmd.Process.Kill()
-			} else {
-				cmd.Process.Signal(os.Interrupt)
-				// Give it time to stop gracefully
-				select {
-				case waitErr := <-done:
-					if waitErr != nil {
-						return waitErr
-					}
-					return ctx.Err()
-				case <-time.After(interrupt):
-					cmd.Process.Kill()
-				}
+		// Context cancelled, stop the process group
+		if interrupt == 0 {
+			g.signal(killProcessGroup)
+			<-done
+			return ctx.Err()
+		}
+		g.signal(interruptProcessGroup)
+		select {
+		case waitErr := <-done:
+			if waitErr != nil {
+				return waitErr
 			}
+			return ctx.Err()
+		case <-time.After(interrupt):
+			g.signal(killProcessGroup)
+			<-done
 		}
 		return ctx.Err()
 	}
 }
 
+// A processGroup is the process group led by a started command. Its ID is
+// the leader's process ID, which may be reused once the leader is reaped, so
+// the group is only signalled until the leader exits: wait then kills what
+// is left of it, before reaping the leader.
+type processGroup struct {
+	cmd    *exec.Cmd
+	mu     sync.Mutex
+	exited bool
+}
+
+// signal calls f, interruptProcessGroup or killProcessGroup, on the group
+// unless its leader has exited.
+func (g *processGroup) signal(f func(*exec.Cmd) error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.exited {
+		f(g.cmd)
+	}
+}
+
+// wait waits for the leader to exit, kills the rest of the group, and
+// reaps the leader. Where its exit cannot be awaited apart from the
+// reaping, the group is signalled until cmd.Wait returns and the rest of
+// it is left alone.
+func (g *processGroup) wait() error {
+	if awaitExit(g.cmd.Process.Pid) == nil {
+		g.mu.Lock()
+		g.exited = true
+		reapProcessGroup(g.cmd)
+		g.mu.Unlock()
+	}
+	err := g.cmd.Wait()
+	g.mu.Lock()
+	g.exited = true
+	g.mu.Unlock()
+	return err
+}
+
 // runHookScript executes a shell script in the test's work directory with its environment.
-func (ts *TestScript) runHookScript(scriptPath string) error {
+// The hook also gets TSAR_TEST_NAME, TSAR_SCRIPT_FILE and TSAR_WORK, and, for
+// a teardown, TSAR_STATUS set to the test's status so far.
+func (ts *TestScript) runHookScript(scriptPath string, status ScriptStatus) error {
 	cmd := exec.Command("/bin/sh", scriptPath)
 	cmd.Dir = ts.workdir
-	cmd.Env = append(ts.env, "PWD="+ts.workdir)
+	cmd.Env = append(ts.env,
+		"PWD="+ts.workdir,
+		"TSAR_TEST_NAME="+ts.name,
+		"TSAR_SCRIPT_FILE="+ts.file,
+		"TSAR_WORK="+ts.workdir,
+	)
+	if status != "" {
+		cmd.Env = append(cmd.Env, "TSAR_STATUS="+string(status))
+	}
 	output, err := cmd.CombinedOutput()
 	if len(output) > 0 {
 		ts.t.Logf("[hook %s]\n%s", filepath.Base(scriptPath), output)
@@ -1905,11 +4417,62 @@ func (ts *TestScript) runHookScript(scriptPath string) error {
 	return err
 }
 
+// hookStatus reports the test's status for a teardown hook: fail or skip
+// if it has failed or been skipped, pass otherwise.
+func (ts *TestScript) hookStatus() ScriptStatus {
+	switch {
+	case ts.t.Failed():
+		return StatusFail
+	case ts.skipped():
+		return StatusSkip
+	}
+	return StatusPass
+}
+
+// skipped reports whether the test has been skipped.
+func (ts *TestScript) skipped() bool {
+	if st, ok := ts.t.(*scriptT); ok {
+		return st.skipped
+	}
+	if t, ok := ts.t.(interface{ Skipped() bool }); ok {
+		return t.Skipped()
+	}
+	return false
+}
+
+// reapBackground kills the background commands the script never waited
+// for, with their process groups, and logs their output. If report is set
+// and Params.FailOnLeakedBackground is true, a script that has not already
+// failed then fails.
+func (ts *TestScript) reapBackground(report bool) {
+	if len(ts.background) == 0 {
+		return
+	}
+	var names []string
+	for _, bg := range ts.background {
+		state := "exited"
+		select {
+		case <-bg.wait:
+		default:
+			state = "killed"
+			bg.stop()
+			<-bg.wait
+		}
+		names = append(names, bg.name)
+		out := bg.out.result()
+		ts.t.Logf("background %s not waited for (%s)\n[stdout]\n%s[stderr]\n%s", bg.name, state, out.stdout, out.stderr)
+	}
+	ts.background = nil
+	if report && ts.params.FailOnLeakedBackground && !ts.t.Failed() {
+		ts.t.Fatalf("%d background command(s) not waited for: %s", len(names), strings.Join(names, ", "))
+	}
+}
+
 // findBackground finds a background command by name
 func (ts *TestScript) findBackground(name string) *backgroundCmd {
 	for i := range ts.background {
 		if ts.background[i].name == name {
-			return &ts.background[i]
+			return ts.background[i]
 		}
 	}
 	return nil
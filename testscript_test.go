@@ -1,15 +1,37 @@
 package tsar
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/smtp"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/gfanton/tsar/tsarscript"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/tools/txtar"
+	_ "modernc.org/sqlite"
 )
 
 func TestTsarBasic(t *testing.T) {
@@ -64,85 +86,98 @@ func TestPerTestSetupTeardown(t *testing.T) {
 	// the work dir is cleaned up. We verify it by ensuring no error occurred.
 }
 
-func TestSplitArgs(t *testing.T) {
+func TestFilterEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "B=2", "A1=3", "A=1", "PATHEXT=.exe"}
 	tests := []struct {
-		name    string
-		line    string
+		pattern string
 		want    []string
-		wantErr bool
 	}{
-		{
-			name: "no quotes",
-			line: "hello world",
-			want: []string{"hello", "world"},
-		},
-		{
-			name: "single quoted arg without spaces",
-			line: `"hello"`,
-			want: []string{"hello"},
-		},
-		{
-			name: "quoted arg with spaces",
-			line: `"hello world"`,
-			want: []string{"hello world"},
-		},
-		{
-			name: "mixed quoted and unquoted",
-			line: `foo "hello world" bar`,
-			want: []string{"foo", "hello world", "bar"},
-		},
-		{
-			name:    "unclosed quote",
-			line:    `"hello world`,
-			wantErr: true,
-		},
-		{
-			name: "escaped quote inside",
-			line: `"hello \"world\""`,
-			want: []string{`hello "world"`},
-		},
-		{
-			name: "empty input",
-			line: "",
-			want: nil,
-		},
-		{
-			name: "multiple quoted segments",
-			line: `"foo bar" "baz qux"`,
-			want: []string{"foo bar", "baz qux"},
-		},
-		{
-			name: "preserves multiple spaces inside quotes",
-			line: `"hello  world"`,
-			want: []string{"hello  world"},
-		},
-		{
-			name: "tabs as separators",
-			line: "foo\tbar",
-			want: []string{"foo", "bar"},
-		},
-		{
-			name: "quoted with tabs inside",
-			line: "\"foo\tbar\"",
-			want: []string{"foo\tbar"},
-		},
-		{
-			name: "escaped backslash",
-			line: `"hello\\world"`,
-			want: []string{`hello\world`},
-		},
+		{"*", []string{"A=1", "A1=3", "B=2", "PATH=/bin", "PATHEXT=.exe"}},
+		{"PATH*", []string{"PATH=/bin", "PATHEXT=.exe"}},
+		{"A?", []string{"A1=3"}},
+		{"MISSING", nil},
+	}
+	for _, tt := range tests {
+		if got := filterEnv(env, tt.pattern); !slices.Equal(got, tt.want) {
+			t.Errorf("filterEnv(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
 	}
+}
 
+func TestFormatArgs(t *testing.T) {
+	tests := []struct {
+		neg  bool
+		args []string
+		want string
+	}{
+		{false, []string{"exec", "echo", "hello"}, "exec echo hello"},
+		{true, []string{"exec", "false"}, "! exec false"},
+		{false, []string{"stdout", "hello world"}, `stdout "hello world"`},
+		{false, []string{"env", ""}, `env ""`},
+		{false, []string{"grep", `a"b`, "f"}, `grep "a\"b" f`},
+	}
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := splitArgs(tt.line)
-			if (err != nil) != tt.wantErr {
-				t.Fatalf("splitArgs(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
-			}
-			if !tt.wantErr && !slices.Equal(got, tt.want) {
-				t.Errorf("splitArgs(%q) = %v, want %v", tt.line, got, tt.want)
+		got := formatArgs(tt.neg, tt.args)
+		if got != tt.want {
+			t.Errorf("formatArgs(%v, %q) = %s, want %s", tt.neg, tt.args, got, tt.want)
+		}
+		// Split drops empty arguments, so only non-empty ones round-trip.
+		if !tt.neg && !slices.Contains(tt.args, "") {
+			if back, err := tsarscript.Split(got); err != nil || !slices.Equal(back, tt.args) {
+				t.Errorf("Split(%s) = %q, %v; want %q", got, back, err, tt.args)
 			}
-		})
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	dir := t.TempDir()
+	script := "env NAME='a b'\n[!windows] exec echo $NAME\n[windows] exec never\n"
+	writeFile(t, filepath.Join(dir, "trace.tsar"), []byte(script), 0644)
+
+	runner := &logRecorder{}
+	RunStandalone(runner, Params{Dir: dir, Trace: true})
+	if runner.Failed() {
+		t.Fatal("unexpected failure")
+	}
+
+	var traced []string
+	for _, line := range runner.logs {
+		if strings.HasPrefix(line, "+ ") {
+			traced = append(traced, line)
+		}
+	}
+	want := []string{
+		`+ script:1: env "NAME=a b"`,
+	}
+	if runtime.GOOS != "windows" {
+		want = append(want, `+ script:2: exec echo a b`)
+	}
+	if !slices.Equal(traced, want) {
+		t.Errorf("traced lines = %q, want %q", traced, want)
+	}
+}
+
+func TestScriptAccessors(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "where.tsar")
+	writeFile(t, file, []byte("# comment\n\nwhere\n"), 0644)
+
+	var name, script, work string
+	var lineno int
+	Run(t, Params{
+		Dir: dir,
+		Commands: map[string]func(*TestScript, bool, []string){
+			"where": func(ts *TestScript, neg bool, args []string) {
+				name, script, work, lineno = ts.Name(), ts.ScriptFile(), ts.WorkDir(), ts.Lineno()
+				if got := ts.Getenv("WORK"); work != got {
+					t.Errorf("WorkDir() = %q, want $WORK %q", work, got)
+				}
+			},
+		},
+	})
+	if name != "where" || script != file || work == "" || lineno != 3 {
+		t.Errorf("Name, ScriptFile, WorkDir, Lineno = %q, %q, %q, %d; want where, %q, $WORK, 3", name, script, work, lineno, file)
 	}
 }
 
@@ -176,10 +211,302 @@ func TestExec(t *testing.T) {
 	Run(t, Params{Dir: "testdata/exec"})
 }
 
+func TestCutExecFlags(t *testing.T) {
+	flags, args, err := cutExecFlags([]string{"exec", "-umask", "027", "-sandbox", "-timeout", "1s", "-user", "nobody", "ls", "-l"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.timeout != time.Second || flags.umask == nil || *flags.umask != 027 || flags.user != "nobody" || !flags.sandbox {
+		t.Errorf("flags = %+v, want 1s timeout, umask 027, user nobody, sandbox", flags)
+	}
+	if !slices.Equal(args, []string{"exec", "ls", "-l"}) {
+		t.Errorf("args = %q, want [exec ls -l]", args)
+	}
+	for _, bad := range []string{"-umask 8", "-umask 1000", "-timeout soon"} {
+		if _, _, err := cutExecFlags(append([]string{"exec"}, append(strings.Fields(bad), "ls")...)); err == nil {
+			t.Errorf("cutExecFlags(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	cmd := exec.Command("true")
+	cmd.Dir = t.TempDir()
+	setProcessGroup(cmd)
+	if err := setSandbox(cmd, cmd.Dir); err != nil {
+		t.Skip(err)
+	}
+	if err := cmd.Run(); err != nil {
+		t.Skipf("namespaces not available: %v", err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	// A file in the real home directory, which sandboxed programs must not see.
+	f, err := os.CreateTemp(home, ".tsar-sandbox-")
+	if err != nil {
+		t.Skip(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	Run(t, Params{
+		Dir: "testdata/sandbox",
+		Setup: func(env *Env) error {
+			env.Setenv("HOST_HOME", home)
+			env.Setenv("HOST_FILE", filepath.Base(f.Name()))
+			return nil
+		},
+	})
+}
+
+func TestCp(t *testing.T) {
+	Run(t, Params{Dir: "testdata/cp"})
+}
+
 func TestEnvfile(t *testing.T) {
 	Run(t, Params{Dir: "testdata/envfile"})
 }
 
+func TestEnv(t *testing.T) {
+	Run(t, Params{Dir: "testdata/env"})
+
+	expectFatal(t, Params{}, "env push\nenv pop\nenv pop\n", "script:3: env pop without env push")
+}
+
+func TestLocale(t *testing.T) {
+	expectPass(t, Params{Locale: "fr_FR.UTF-8", Timezone: "Europe/Paris"},
+		"assert $LANG == fr_FR.UTF-8\nassert $LC_ALL == fr_FR.UTF-8\nassert $TZ == Europe/Paris\n")
+}
+
+func TestParamsEnv(t *testing.T) {
+	expectPass(t, Params{Env: []string{"API_URL=http://api.test", "TZ=Asia/Tokyo", "EMPTY="}},
+		"assert $API_URL == http://api.test\nassert $TZ == Asia/Tokyo\nassert $EMPTY == ''\n")
+
+	capture := runScript(t, Params{Env: []string{"API_URL"}}, "exec true\n")
+	if want := `Params.Env: invalid entry "API_URL": want KEY=VALUE`; len(capture.fatals) == 0 || capture.fatals[0] != want {
+		t.Errorf("with invalid Env: fatals = %q, want %q first", capture.fatals, want)
+	}
+}
+
+func TestPassThroughEnv(t *testing.T) {
+	t.Setenv("TSAR_TEST_TOKEN", "secret")
+	t.Setenv("TSAR_TEST_REGION", "eu")
+	t.Setenv("TSAR_TEST_HIDDEN", "x")
+	p := Params{
+		PassThroughEnv: []string{"TSAR_TEST_TOK*", "TSAR_TEST_REGION"},
+		Env:            []string{"TSAR_TEST_REGION=us"},
+	}
+	expectPass(t, p, "exec sh show.sh\nstdout '^secret us \\[\\]\\n'\n-- show.sh --\necho \"$TSAR_TEST_TOKEN $TSAR_TEST_REGION [$TSAR_TEST_HIDDEN]\"\n")
+}
+
+// redactCapture records both the logs and the failures of a run.
+type redactCapture struct {
+	logRecorder
+	fatals []string
+}
+
+func (t *redactCapture) Fatal(args ...any) {
+	t.failed = true
+	t.fatals = append(t.fatals, fmt.Sprint(args...))
+}
+
+func (t *redactCapture) Fatalf(format string, args ...any) {
+	t.failed = true
+	t.fatals = append(t.fatals, fmt.Sprintf(format, args...))
+}
+
+func TestRedact(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TSAR_TEST_HOST_SECRET", "h0st-s3cr3t")
+	script := "env\n" +
+		"exec echo token=$TSAR_TEST_TOKEN key=ghp_abc123 host=h0st-s3cr3t\n" +
+		"stdout '^token=s3cr3t-value key=ghp_abc123 host=h0st-s3cr3t\\n'\n" +
+		"exists $TSAR_TEST_TOKEN\n"
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte(script), 0644)
+	capture := &redactCapture{}
+	RunStandalone(capture, Params{
+		Dir:    dir,
+		Env:    []string{"TSAR_TEST_TOKEN=s3cr3t-value"},
+		Redact: []string{"TSAR_TEST_TOKEN", "TSAR_TEST_HOST_SECRET", `ghp_\w+`},
+	})
+	if len(capture.fatals) != 1 || !strings.Contains(capture.fatals[0], "exists [REDACTED]") {
+		t.Fatalf("fatals = %q, want the exists failure, redacted", capture.fatals)
+	}
+	out := strings.Join(append(capture.logs, capture.fatals...), "\n")
+	for _, secret := range []string{"s3cr3t-value", "ghp_abc123", "h0st-s3cr3t"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("output contains %q:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{"TSAR_TEST_TOKEN=[REDACTED]", "token=[REDACTED] key=[REDACTED] host=[REDACTED]"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+
+	invalid := &logCapture{}
+	RunStandalone(invalid, Params{Dir: dir, Redact: []string{"a["}})
+	if want := `Params.Redact: invalid pattern "a[": `; len(invalid.fatals) == 0 || !strings.HasPrefix(invalid.fatals[0], want) {
+		t.Errorf("with invalid pattern: fatals = %q, want %q first", invalid.fatals, want)
+	}
+}
+
+func TestHome(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("HOME is not the home directory variable")
+	}
+	Run(t, Params{Dir: "testdata/home", Home: HomeTemp})
+
+	host, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	for mode, want := range map[HomeMode]string{HomeNone: "/no-home", HomeHost: host} {
+		expectPass(t, Params{Home: mode}, "assert $HOME == "+want+"\n")
+	}
+}
+
+func TestSharedGoCache(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("os.UserCacheDir only follows XDG_CACHE_HOME on Linux")
+	}
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	build := filepath.Join(cache, "tsar", "go", "build")
+	expectPass(t, Params{SharedGoCache: true},
+		"assert $GOCACHE == "+build+"\n"+
+			"assert $GOMODCACHE == "+filepath.Join(cache, "tsar", "go", "mod")+"\n"+
+			"assert $GOPATH == $WORK/gopath\n"+
+			"requires go\n"+
+			"exec go env GOCACHE\n"+
+			"stdout "+build+"\n")
+	if _, err := os.Stat(build); err != nil {
+		t.Errorf("build cache not created: %v", err)
+	}
+}
+
+func TestPushd(t *testing.T) {
+	Run(t, Params{Dir: "testdata/pushd"})
+
+	for script, want := range map[string]string{
+		"popd\n":                         "script:1: popd: directory stack empty",
+		"pushd missing\n":                "missing does not exist",
+		"mkdir a\npushd a\npopd\npopd\n": "script:4: popd: directory stack empty",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	Run(t, Params{Dir: "testdata/glob"})
+
+	for script, want := range map[string]string{
+		"rm build/*.o\n":      "rm: no files match build/*.o",
+		"exists logs/*.log\n": "no files match logs/*.log",
+		"cp *.txt out\n":      "cp: no files match *.txt",
+		"cp *.txt out.txt\n-- a.txt --\n-- b.txt --\n": "out.txt is not a directory",
+		"chmod 0644 [\n":                 "chmod: invalid pattern",
+		"chmod u+x a.txt\n-- a.txt --\n": `chmod: invalid mode "u+x"`,
+		"! exists *.txt\n-- a.txt --\n":  "a.txt exists unexpectedly",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	Run(t, Params{Dir: "testdata/grep"})
+
+	for script, want := range map[string]string{
+		"grep -count=1 b a.txt\n-- a.txt --\nb\nc\nb\n":       "file a.txt: have 2 matches for \"b\", want 1\nmatched lines:\n\ta.txt:1: b\n\ta.txt:3: b",
+		"! grep x *.txt\n-- a.txt --\nx\n-- b.txt --\ny\nx\n": "2 of 2 files unexpectedly match \"x\"\nmatched lines:\n\ta.txt:1: x\n\tb.txt:2: x",
+		"grep z *.txt\n-- a.txt --\n-- b.txt --\n":            `none of 2 files matches "z"`,
+		"! grep -i A a.txt\n-- a.txt --\nxa\n":                "file a.txt unexpectedly matches \"A\"\nmatched lines:\n\ta.txt:1: xa",
+		"grep -i missing.txt\n":                               "usage: grep",
+		"! grep -count=1 x a.txt\n-- a.txt --\n":              "cannot use -count= with negated match",
+		"grep -x y a.txt\n-- a.txt --\n":                      "grep: unknown flag -x",
+		"grep y logs/*.log\n":                                 "grep: no files match logs/*.log",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	Run(t, Params{Dir: "testdata/replace"})
+
+	for script, want := range map[string]string{
+		"replace x y a.txt\n-- a.txt --\nz\n":   `replace: "x" matches nothing in a.txt`,
+		"replace ( y a.txt\n-- a.txt --\n":      "replace: invalid pattern",
+		"replace x y *.txt\n":                   "replace: no files match *.txt",
+		"! replace x y a.txt\n-- a.txt --\nx\n": "replace does not support negation",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestHeadTail(t *testing.T) {
+	Run(t, Params{Dir: "testdata/headtail"})
+
+	for script, want := range map[string]string{
+		"head -n x a.txt\n-- a.txt --\n": `head: invalid line count "x"`,
+		"tail -n\n":                      "usage: tail [-n N] file [out]",
+		"head missing.txt\n":             "head: open",
+		"! tail a.txt\n-- a.txt --\n":    "tail does not support negation",
+		"tail a.txt b c\n-- a.txt --\n":  "usage: tail [-n N] file [out]",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestSortUniq(t *testing.T) {
+	Run(t, Params{Dir: "testdata/sort"})
+
+	for script, want := range map[string]string{
+		"sort\n":                        "usage: sort file [out]",
+		"uniq missing.txt\n":            "uniq: open",
+		"! sort a.txt\n-- a.txt --\n":   "sort does not support negation",
+		"uniq a.txt b c\n-- a.txt --\n": "usage: uniq file [out]",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestNewer(t *testing.T) {
+	Run(t, Params{Dir: "testdata/newer"})
+
+	expectFatal(t, Params{}, "newer a.txt missing.txt\n-- a.txt --\n", "missing.txt: no such file")
+}
+
+func TestWaitstable(t *testing.T) {
+	Run(t, Params{Dir: "testdata/waitstable"})
+
+	for script, want := range map[string]string{
+		"waitstable -timeout 200ms missing.log\n": "missing.log did not appear within 200ms",
+		"exec sh -c 'while :; do echo x >>busy.log; sleep 0.02; done' &\nwaitstable -timeout 300ms busy.log 200ms\n": "busy.log still changing after 300ms",
+		"waitstable a.log soon\n": `invalid quiet period "soon"`,
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestEventually(t *testing.T) {
+	Run(t, Params{Dir: "testdata/eventually"})
+
+	for script, want := range map[string]string{
+		"eventually -t 200ms -every 50ms exists nope\n":     "nope does not exist",
+		"eventually -t 100ms ! exists a.txt\n-- a.txt --\n": "script:1: eventually: still failing after 100ms (",
+		"eventually -t soon exists a.txt\n":                 `invalid -t duration "soon"`,
+		"! eventually exists a.txt\n":                       "negate the command instead",
+		"eventually\n":                                      "usage: eventually",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestPath(t *testing.T) {
+	Run(t, Params{Dir: "testdata/path"})
+}
+
 func TestLogfile(t *testing.T) {
 	dir := t.TempDir()
 
@@ -213,26 +540,61 @@ func TestHTTP(t *testing.T) {
 	})
 }
 
-func TestHTTPRepeat(t *testing.T) {
-	var flakyCount atomic.Int32
+func TestHTTPMode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(testHTTPHandler))
+	dir := t.TempDir()
+	script := `httpmode record
+http GET $SERVER/api/info
+stdout '"version"'
+`
+	writeFile(t, filepath.Join(dir, "rec.tsar"), []byte(script), 0644)
+	p := Params{
+		Dir: dir,
+		Setup: func(env *Env) error {
+			env.Setenv("SERVER", srv.URL)
+			return nil
+		},
+	}
+	capture := &logCapture{}
+	RunStandalone(capture, p)
+	if capture.failed {
+		t.Fatalf("record: %q", capture.fatals)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "rec.tsar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), script+"-- .tsar/http.cassette --\n") || !strings.Contains(string(data), `"url":"`+srv.URL+`/api/info"`) {
+		t.Fatalf("recorded script:\n%s", data)
+	}
+
+	// Replays work with the server gone.
+	srv.Close()
+	writeFile(t, filepath.Join(dir, "rec.tsar"), []byte(strings.Replace(string(data), "httpmode record", "httpmode replay", 1)), 0644)
+	capture = &logCapture{}
+	RunStandalone(capture, p)
+	if capture.failed {
+		t.Fatalf("replay: %q", capture.fatals)
+	}
+
+	for script, want := range map[string]string{
+		"httpmode replay\n": "no .tsar/http.cassette in the script",
+		"httpmode replay\nhttp GET $SERVER/x\n-- .tsar/http.cassette --\n": "no recorded response in .tsar/http.cassette",
+		"httpmode tape\n": `unknown mode "tape"`,
+	} {
+		expectFatal(t, p, script, want)
+	}
+}
+
+func TestHostAliases(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.URL.Path {
-		case "/flaky":
-			n := flakyCount.Add(1)
-			if n%3 == 0 {
-				w.WriteHeader(500)
-				fmt.Fprint(w, "server error")
-				return
-			}
-			fmt.Fprint(w, "ok")
-		default:
-			fmt.Fprint(w, "ok")
-		}
+		fmt.Fprint(w, r.Host)
 	}))
 	defer srv.Close()
 
 	Run(t, Params{
-		Dir: "testdata/http_repeat",
+		Dir:         "testdata/hosts",
+		HostAliases: map[string]string{"api.example.com": srv.Listener.Addr().String()},
 		Setup: func(env *Env) error {
 			env.Setenv("SERVER", srv.URL)
 			return nil
@@ -240,74 +602,2010 @@ func TestHTTPRepeat(t *testing.T) {
 	})
 }
 
-// ---- Error meta-tests (assert the framework itself fails correctly)
+func TestCaptureHTTP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, r.Method, r.URL.Path)
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
 
-func TestHTTPStatusWithoutPriorHTTP(t *testing.T) {
-	dir := t.TempDir()
-	tsarContent := "httpstatus 200\n"
-	writeFile(t, filepath.Join(dir, "test_no_http.tsar"), []byte(tsarContent), 0644)
+	Run(t, Params{
+		Dir: "testdata/capture",
+		HostAliases: map[string]string{
+			"api.example.com":    srv.Listener.Addr().String(),
+			"secure.example.com": tlsSrv.Listener.Addr().String(),
+		},
+	})
 
-	runner := &testResultCapture{}
-	RunFilesStandalone(runner, Params{Dir: dir}, filepath.Join(dir, "test_no_http.tsar"))
-	if !runner.Failed() {
-		t.Fatal("expected failure when httpstatus called without prior http")
+	for script, want := range map[string]string{
+		"requested .\n":                                 "requests are not captured",
+		"# tsar:capture-http\nrequested GET\n":          "no request matches \"GET\"; no requests captured",
+		"# tsar:capture-http\nrequested -count x .\n":   "invalid count",
+		"# tsar:capture-http\n! requested -count 1 .\n": "usage: requested",
+	} {
+		expectFatal(t, Params{}, script, want)
 	}
 }
 
-func TestRepeatUnsupportedCommand(t *testing.T) {
+func TestRand(t *testing.T) {
+	Run(t, Params{Dir: "testdata/rand"})
+
+	// The same seed gives the same values.
 	dir := t.TempDir()
-	tsarContent := "repeat 5 exists foo\n"
-	writeFile(t, filepath.Join(dir, "test_repeat_bad.tsar"), []byte(tsarContent), 0644)
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("rand int 1 1000000 A\nrand hex 16 B\nrecord $A $B $RANDOM\n"), 0644)
+	var got []string
+	record := map[string]func(*TestScript, bool, []string){
+		"record": func(ts *TestScript, neg bool, args []string) { got = append(got, strings.Join(args[1:], " ")) },
+	}
+	for range 2 {
+		RunStandalone(&testResultCapture{}, Params{Dir: dir, Seed: 7, Commands: record})
+	}
+	RunStandalone(&testResultCapture{}, Params{Dir: dir, Seed: 8, Commands: record})
+	if len(got) != 3 || got[0] != got[1] || got[0] == got[2] {
+		t.Errorf("values = %q, want the first two equal and the third different", got)
+	}
 
-	runner := &testResultCapture{}
-	RunFilesStandalone(runner, Params{Dir: dir}, filepath.Join(dir, "test_repeat_bad.tsar"))
-	if !runner.Failed() {
-		t.Fatal("expected failure for unsupported repeat command")
+	for script, want := range map[string]string{
+		"rand int 1 6 X\nexec false\n":         "random seed: 7",
+		"rand int 3 1 X\n":                     "invalid range 3 1",
+		"rand hex 0 X\n":                       "invalid number of digits",
+		"rand float 1 X\n":                     "unknown kind",
+		"rand int 1 2 -X\n":                    "invalid variable name",
+		"! rand int 1 2 X\n":                   "does not support negation",
+		"env TSAR_SEED=x\nexec echo $RANDOM\n": "invalid TSAR_SEED",
+		"uuid\n":                               "usage: uuid var",
+		"randstr X 0\n":                        "invalid length",
+		"randstr 1-X\n":                        "invalid variable name",
+	} {
+		expectFatal(t, Params{Seed: 7}, script, want)
 	}
 }
 
-func TestTsarWithCommands(t *testing.T) {
-	Run(t, Params{
-		Dir: "examples/testdata",
-		Commands: map[string]func(*TestScript, bool, []string){
-			"custom": func(ts *TestScript, neg bool, args []string) {
-				ts.Logf("Custom command executed with args: %v", args[1:])
-			},
+func TestJSON(t *testing.T) {
+	Run(t, Params{Dir: "testdata/json"})
+
+	for script, want := range map[string]string{
+		"exec echo '{\"a\": 1}'\njson .b\n":        "no value at .b",
+		"exec echo '{\"a\": 1}'\njson .a == 2\n":   "json .a == \"2\" failed",
+		"exec echo '{\"a\": 1}'\n! json .a\n":      "unexpected value at .a: 1",
+		"exec echo '{\"a\": 1}'\njson a\n":         "invalid path",
+		"exec echo '{\"a\": 1}'\njson .a[x]\n":     "invalid index",
+		"exec echo '{\"a\": 1}'\njson -o .a\n":     "usage: json",
+		"exec echo '{\"a\": 1}'\n! json -o A .a\n": "usage: json",
+		"exec echo 'not json'\njson .a\n":          "stdout: invalid character",
+		"json .a missing.json\n":                   "missing.json: no such file",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestYAML(t *testing.T) {
+	Run(t, Params{Dir: "testdata/yaml"})
+
+	for script, want := range map[string]string{
+		"exec echo 'a: 1'\nyaml .b\n":      "no value at .b",
+		"exec echo 'a: 1'\nyaml .a != 1\n": "yaml .a != \"1\" failed",
+		"exec echo 'a: [1'\nyaml .a\n":     "stdout: yaml:",
+		"yaml .a\n":                        "no YAML document",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestSQL(t *testing.T) {
+	Run(t, Params{Dir: "testdata/sql"})
+
+	for script, want := range map[string]string{
+		"sql 'SELECT 1'\n":                                                  "$DATABASE_URL is not set",
+		"env DATABASE_URL=app.db\nsql 'SELECT 1'\n":                         "invalid DSN",
+		"env DATABASE_URL=mysql://u@tcp(db)/app\nsql 'SELECT 1'\n":          "build the tsar command with -tags mysql",
+		"env DATABASE_URL=sqlite://a.db\nsql 'SELECT * FROM nope'\n":        "no such table",
+		"env DATABASE_URL=sqlite://a.db\nsql 'SELECT 1, 2' == 1\n":          "1 rows of 2 columns, want one value",
+		"env DATABASE_URL=sqlite://a.db\nsql 'SELECT 1' == 2\n":             "sql SELECT 1 == 2 failed",
+		"env DATABASE_URL=sqlite://a.db\n! sql 'SELECT 1 UNION SELECT 2'\n": "query returned 2 rows, want none",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveLines(ln)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	p := Params{
+		Dir: "testdata/tcp",
+		Setup: func(env *Env) error {
+			env.Setenv("TCP_ADDR", ln.Addr().String())
+			env.Setenv("DEAD_ADDR", dead.Addr().String())
+			return nil
 		},
-	})
+	}
+	Run(t, p)
+
+	for script, want := range map[string]string{
+		"tcp send PING\n":                                         `no connection "tcp"`,
+		"tcp connect $DEAD_ADDR\n":                                "connection refused",
+		"! tcp connect $TCP_ADDR\n":                               "unexpectedly connected",
+		"tcp connect $TCP_ADDR\ntcp connect $TCP_ADDR\n":          `connection "tcp" is already open`,
+		"tcp connect $TCP_ADDR\ntcp expect -timeout 100ms nope\n": "nothing matched within 100ms for `nope`; received \"HELLO tsar\\r\\n\"",
+		"tcp connect $TCP_ADDR\ntcp send QUIT\ntcp expect nope\n": "connection closed without a match",
+		"tcp connect $TCP_ADDR\n! tcp expect HELLO\n":             "unexpected match for `HELLO`",
+		"tcp connect $TCP_ADDR\ntcp send 'bad\\q'\n":              "invalid escape sequence",
+		"tcp listen :0\n":                                         `unknown subcommand "listen"`,
+	} {
+		expectFatal(t, p, script, want)
+	}
 }
 
-// ---- Test HTTP handler
+// serveLines serves a line protocol on ln: it greets each connection,
+// answers PING with PONG, echoes other lines and closes on QUIT.
+func serveLines(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			fmt.Fprint(conn, "HELLO tsar\r\n")
+			sc := bufio.NewScanner(conn)
+			for sc.Scan() {
+				switch line := strings.TrimSuffix(sc.Text(), "\r"); line {
+				case "PING":
+					fmt.Fprint(conn, "PONG\r\n")
+				case "QUIT":
+					fmt.Fprint(conn, "BYE\r\n")
+					return
+				default:
+					fmt.Fprintf(conn, "ECHO %s\r\n", line)
+				}
+			}
+		}()
+	}
+}
 
-func testHTTPHandler(w http.ResponseWriter, r *http.Request) {
-	switch {
-	case r.Method == "GET" && r.URL.Path == "/health":
-		fmt.Fprint(w, "ok")
-	case r.Method == "GET" && r.URL.Path == "/api/info":
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"status":"healthy","version":"1.0.0"}`)
-	case r.Method == "POST" && r.URL.Path == "/api/echo":
-		if ct := r.Header.Get("Content-Type"); ct != "" {
-			w.Header().Set("Content-Type", ct)
+func TestMockSMTP(t *testing.T) {
+	sendmail := func(ts *TestScript, neg bool, args []string) {
+		if len(args) != 6 {
+			ts.Fatalf("usage: sendmail addr from to subject body")
 		}
-		body, _ := io.ReadAll(r.Body)
-		w.Write(body)
-	case r.URL.Path == "/created":
-		w.WriteHeader(201)
-		fmt.Fprint(w, "body")
-	case r.URL.Path == "/echo/headers":
-		w.Header().Set("Content-Type", "text/plain")
-		for _, name := range []string{"Authorization", "Accept"} {
-			if v := r.Header.Get(name); v != "" {
-				fmt.Fprintf(w, "%s: %s\n", name, v)
+		addr, from, to := args[1], args[2], args[3]
+		host, _, _ := net.SplitHostPort(addr)
+		msg := "To: " + to + "\r\nSubject: " + args[4] + "\r\n\r\n" + args[5] + "\r\n"
+		if err := smtp.SendMail(addr, smtp.PlainAuth("", "user", "secret", host), from, []string{to}, []byte(msg)); err != nil {
+			ts.Fatalf("sendmail: %v", err)
+		}
+	}
+	p := Params{
+		Dir:      "testdata/mocksmtp",
+		Commands: map[string]func(*TestScript, bool, []string){"sendmail": sendmail},
+	}
+	Run(t, p)
+
+	for script, want := range map[string]string{
+		"mocksmtp assert\n":                          `no server "smtp"`,
+		"mocksmtp start\nmocksmtp start\n":           `"smtp" is already running`,
+		"mocksmtp start\nmocksmtp assert -to a@b\n":  "no message matches\nno messages received",
+		"mocksmtp start\nmocksmtp assert -count 1\n": "0 messages match, want 1",
+		"mocksmtp start\nsendmail $SMTP_ADDR a@b.c d@e.f Hi Hello\n! mocksmtp assert -to d@e.f\n": "1 messages unexpectedly match\nreceived messages:\n\tfrom a@b.c to d@e.f: \"Hi\"",
+		"mocksmtp start\nmocksmtp assert -body '('\n":                                             "invalid pattern",
+		"! mocksmtp start\n": "mocksmtp start does not support negation",
+	} {
+		expectFatal(t, p, script, want)
+	}
+}
+
+func TestFileserver(t *testing.T) {
+	Run(t, Params{Dir: "testdata/fileserver"})
+
+	for script, want := range map[string]string{
+		"fileserver start site URL\n":               "no such file or directory",
+		"fileserver start a.txt URL\n-- a.txt --\n": "a.txt is not a directory",
+		"fileserver start . SITE-URL\n":             "usage: fileserver start dir VAR_URL",
+		"! fileserver start . URL\n":                "fileserver does not support negation",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestSSHServer(t *testing.T) {
+	Run(t, Params{Dir: "testdata/sshserver"})
+
+	for script, want := range map[string]string{
+		"sshserver\n":                        "usage: sshserver start [&name&] | sshserver stop [&name&]",
+		"sshserver start now\n":              "usage: sshserver start",
+		"sshserver restart\n":                `sshserver: unknown subcommand "restart"`,
+		"! sshserver start\n":                "sshserver start does not support negation",
+		"sshserver start\nsshserver start\n": `sshserver start: "ssh" is already running`,
+		"sshserver stop &git&\n":             `sshserver stop: no server "git"; start one with sshserver start &git&`,
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+// TestSSHServerClient drives the server with Go's SSH and SFTP clients, so
+// that it is covered without ssh on the host.
+func TestSSHServerClient(t *testing.T) {
+	root := t.TempDir()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := startSSH(root, os.Environ(), signer.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", s.ln.Addr().String(), &ssh.ClientConfig{
+			User:            "tsar",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.FixedHostKey(s.key),
+		})
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := ssh.NewSignerFromKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial(otherSigner); err == nil {
+		t.Errorf("dial with another key: no error")
+	}
+	client, err := dial(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	t.Run("exec", func(t *testing.T) {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+		var stdout, stderr strings.Builder
+		sess.Stdout, sess.Stderr = &stdout, &stderr
+		sess.Stdin = strings.NewReader("in\n")
+		err = sess.Run("cat; pwd; echo oops >&2; exit 3")
+		var exitErr *ssh.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+			t.Errorf("Run: %v, want exit status 3", err)
+		}
+		if want := "in\n" + root + "\n"; stdout.String() != want {
+			t.Errorf("stdout = %q, want %q", stdout.String(), want)
+		}
+		if stderr.String() != "oops\n" {
+			t.Errorf("stderr = %q, want %q", stderr.String(), "oops\n")
+		}
+	})
+
+	t.Run("channels", func(t *testing.T) {
+		if _, _, err := client.OpenChannel("direct-tcpip", nil); err == nil {
+			t.Errorf("direct-tcpip channel: no error")
+		}
+	})
+
+	t.Run("sftp", func(t *testing.T) {
+		c, err := sftp.NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if wd, err := c.Getwd(); err != nil || wd != "/" {
+			t.Errorf("Getwd = %q, %v, want /", wd, err)
+		}
+		f, err := c.Create("/../a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(filepath.Join(root, "a.txt")); err != nil || string(data) != "hello\n" {
+			t.Errorf("a.txt = %q, %v, want %q", data, err, "hello\n")
+		}
+		if err := c.Rename("a.txt", "b.txt"); err != nil {
+			t.Fatal(err)
+		}
+		f, err = c.Open("b.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != "hello\n" {
+			t.Errorf("read b.txt = %q, %v, want %q", data, err, "hello\n")
+		}
+		infos, err := c.ReadDir("/")
+		if err != nil || len(infos) != 1 || infos[0].Name() != "b.txt" {
+			t.Errorf("ReadDir / = %v, %v, want b.txt", infos, err)
+		}
+		if _, err := c.ReadLink("b.txt"); err == nil {
+			t.Errorf("ReadLink: no error")
+		}
+	})
+}
+
+func TestGit(t *testing.T) {
+	Run(t, Params{Dir: "testdata/git"})
+
+	for script, want := range map[string]string{
+		"gitinit repo\n":               "no such file or directory",
+		"gitinit a.txt\n-- a.txt --\n": "a.txt is not a directory",
+		"gitinit\n":                    "usage: gitinit dir [message]",
+		"! gitinit .\n":                "gitinit does not support negation",
+		"gitinit repo\ngitinit repo\n-- repo/a.txt --\n": "repo is already a git repository",
+		"gitcommit repo 'add'\n-- repo/a.txt --\n":       "repo is not a git repository",
+		"gitcommit repo\n":       "usage: gitcommit dir message",
+		"! gitcommit repo add\n": "gitcommit does not support negation",
+		"env PATH=$WORK/bin\ngitinit repo\n-- repo/a.txt --\n": "git: executable file not found in test PATH",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestGitserver(t *testing.T) {
+	Run(t, Params{Dir: "testdata/gitserver"})
+
+	for script, want := range map[string]string{
+		"gitserver start repos URL\n":                 "no such file or directory",
+		"gitserver start . GIT-URL\n":                 "usage: gitserver start dir VAR_URL",
+		"! gitserver start . URL\n":                   "gitserver does not support negation",
+		"env PATH=$WORK/bin\ngitserver start . URL\n": "gitserver: executable file not found in test PATH",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestGoProxy(t *testing.T) {
+	Run(t, Params{Dir: "testdata/goproxy", GoProxyDir: "testdata/goproxy/modules"})
+
+	for script, want := range map[string]string{
+		"goproxy start proxy\n":                              "no such file or directory",
+		"goproxy start proxy\n-- proxy/hello/go.mod --\n":    "module fixture hello: want name <path>_<version>",
+		"goproxy start proxy\n-- proxy/hello_v1/go.mod --\n": `module fixture hello_v1: invalid escaped module path "hello"`,
+		"goproxy start\n":                                    "usage: goproxy start dir",
+		"! goproxy start proxy\n":                            "goproxy does not support negation",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+
+	capture := &logCapture{}
+	RunStandalone(capture, Params{Dir: "testdata/fileserver", GoProxyDir: "testdata/missing"})
+	if len(capture.fatals) == 0 || !strings.Contains(capture.fatals[0], "Go module proxy:") {
+		t.Errorf("fatals = %q, want a Go module proxy error", capture.fatals)
+	}
+}
+
+func TestRecproxy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(testHTTPHandler))
+	defer srv.Close()
+	p := Params{
+		Dir: "testdata/recproxy",
+		Setup: func(env *Env) error {
+			env.Setenv("SERVER", srv.URL)
+			return nil
+		},
+	}
+	Run(t, p)
+
+	for script, want := range map[string]string{
+		"recproxy assert\n":                                                                   `no proxy "recproxy"`,
+		"recproxy start localhost:80 URL\n":                                                   "invalid upstream",
+		"recproxy start $SERVER URL\nrecproxy assert -path /\n":                               "no request matches\nno requests recorded",
+		"recproxy start $SERVER URL\nhttp GET $URL/health\nrecproxy assert -count 2\n":        "1 requests match, want 2\nrecorded requests:\n\tGET /health 200",
+		"recproxy start $SERVER URL\nhttp GET $URL/health\n! recproxy assert -path /health\n": "1 requests unexpectedly match",
+		"recproxy start $SERVER URL\nrecproxy assert -header Accept\n":                        "want 'Name: pattern'",
+		"recproxy start $SERVER URL\nrecproxy start $SERVER URL\n":                            `"recproxy" is already running`,
+	} {
+		expectFatal(t, p, script, want)
+	}
+}
+
+func TestExecCassette(t *testing.T) {
+	// The cassette of testdata/cassette was recorded with programs that
+	// are not installed.
+	Run(t, Params{Dir: "testdata/cassette", ExecMode: ExecReplay})
+
+	dir, cassettes := t.TempDir(), t.TempDir()
+	runs := filepath.Join(t.TempDir(), "runs")
+	script := `exec sh ./tool.sh hello <in.txt
+stdout '^hello from $WORK: input\n'
+! exec sh ./tool.sh fail
+stderr '^boom\n'
+status 3
+-- in.txt --
+input
+-- tool.sh --
+echo run >>` + runs + `
+[ "$1" = fail ] && { echo boom >&2; exit 3; }
+echo "$1 from $PWD: $(cat)"
+`
+	writeFile(t, filepath.Join(dir, "tool.tsar"), []byte(script), 0644)
+	p := Params{Dir: dir, CassetteDir: cassettes}
+	ranTimes := func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run\n")
+	}
+
+	p.ExecMode = ExecReplay
+	capture := &logCapture{}
+	RunStandalone(capture, p)
+	if len(capture.fatals) != 1 || !strings.Contains(capture.fatals[0], "no cassette") {
+		t.Fatalf("replay without cassette: fatals = %q", capture.fatals)
+	}
+
+	p.ExecMode = ExecRecord
+	capture = &logCapture{}
+	RunStandalone(capture, p)
+	if capture.failed {
+		t.Fatalf("record: %q", capture.fatals)
+	}
+	data, err := os.ReadFile(filepath.Join(cassettes, "tool.cassette.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "hello from $WORK: input") || !strings.Contains(string(data), `"exit": 3`) {
+		t.Errorf("cassette:\n%s", data)
+	}
+
+	p.ExecMode = ExecReplay
+	capture = &logCapture{}
+	RunStandalone(capture, p)
+	if capture.failed {
+		t.Fatalf("replay: %q", capture.fatals)
+	}
+	if n := ranTimes(); n != 2 {
+		t.Errorf("tool ran %d times, want 2 (only when recording)", n)
+	}
+
+	// Different input is not in the cassette.
+	writeFile(t, filepath.Join(dir, "tool.tsar"), []byte(strings.Replace(script, "\ninput\n", "\nother\n", 1)), 0644)
+	capture = &logCapture{}
+	RunStandalone(capture, p)
+	if len(capture.fatals) != 1 || !strings.Contains(capture.fatals[0], `no recorded run of "sh ./tool.sh hello"`) {
+		t.Errorf("replay with other input: fatals = %q", capture.fatals)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path != "/artifact.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "artifact\n")
+	}))
+	defer srv.Close()
+
+	p := Params{
+		Dir:           "testdata/download",
+		DownloadCache: t.TempDir(),
+		Setup: func(env *Env) error {
+			env.Setenv("SERVER", srv.URL)
+			return nil
+		},
+	}
+	Run(t, p)
+	Run(t, p)
+	if n := hits.Load(); n != 1 {
+		t.Errorf("server hit %d times, want once", n)
+	}
+
+	for script, want := range map[string]string{
+		"download $SERVER/artifact.txt a.txt -sha256 " + strings.Repeat("0", 64) + "\n": "sha256 is 5b3513f580c8397212ff2c8f459c199efc0c90e4354a5f3533adf0a3fff3a530, want 0000",
+		"download $SERVER/missing a.txt\n":                                              "status 404 Not Found",
+		"download $SERVER/artifact.txt\n":                                               "usage: download",
+	} {
+		expectFatal(t, p, script, want)
+	}
+}
+
+func TestHTTPRepeat(t *testing.T) {
+	var flakyCount atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			n := flakyCount.Add(1)
+			if n%3 == 0 {
+				w.WriteHeader(500)
+				fmt.Fprint(w, "server error")
+				return
 			}
+			fmt.Fprint(w, "ok")
+		default:
+			fmt.Fprint(w, "ok")
 		}
-	case r.URL.Path == "/with-headers":
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.Header().Set("X-Request-Id", "abc-123")
+	}))
+	defer srv.Close()
+
+	Run(t, Params{
+		Dir: "testdata/http_repeat",
+		Setup: func(env *Env) error {
+			env.Setenv("SERVER", srv.URL)
+			return nil
+		},
+	})
+}
+
+// ---- Error meta-tests (assert the framework itself fails correctly)
+
+func TestHTTPStatusWithoutPriorHTTP(t *testing.T) {
+	dir := t.TempDir()
+	tsarContent := "httpstatus 200\n"
+	writeFile(t, filepath.Join(dir, "test_no_http.tsar"), []byte(tsarContent), 0644)
+
+	runner := &testResultCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir}, filepath.Join(dir, "test_no_http.tsar"))
+	if !runner.Failed() {
+		t.Fatal("expected failure when httpstatus called without prior http")
+	}
+}
+
+func TestRepeatUnsupportedCommand(t *testing.T) {
+	dir := t.TempDir()
+	tsarContent := "repeat 5 exists foo\n"
+	writeFile(t, filepath.Join(dir, "test_repeat_bad.tsar"), []byte(tsarContent), 0644)
+
+	runner := &testResultCapture{}
+	RunFilesStandalone(runner, Params{Dir: dir}, filepath.Join(dir, "test_repeat_bad.tsar"))
+	if !runner.Failed() {
+		t.Fatal("expected failure for unsupported repeat command")
+	}
+}
+
+func TestMaxFailures(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("mark\nexec false\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b.tsar"), []byte("mark\nexec false\n"), 0644)
+	writeFile(t, filepath.Join(dir, "c.tsar"), []byte("mark\nmark\n"), 0644)
+	writeFile(t, filepath.Join(dir, "d.tsar"), []byte("mark\n"), 0644)
+
+	tests := []struct {
+		name      string
+		params    Params
+		wantMarks int
+	}{
+		{"fail fast", Params{}, 1},
+		{"continue on error", Params{ContinueOnError: true}, 5},
+		{"max failures reached", Params{MaxFailures: 2}, 2},
+		{"max failures not reached", Params{MaxFailures: 3}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var marks int
+			p := tt.params
+			p.Dir = dir
+			p.Commands = map[string]func(*TestScript, bool, []string){
+				"mark": func(ts *TestScript, neg bool, args []string) { marks++ },
+			}
+
+			runner := &testResultCapture{}
+			RunStandalone(runner, p)
+			if !runner.Failed() {
+				t.Error("expected the run to fail")
+			}
+			if marks != tt.wantMarks {
+				t.Errorf("mark ran %d times, want %d", marks, tt.wantMarks)
+			}
+		})
+	}
+}
+
+func TestCount(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("flaky\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b.tsar"), []byte("flaky\n"), 0644)
+
+	var runs int
+	var results []ScriptResult
+	runner := &logRecorder{}
+	RunStandalone(runner, Params{
+		Dir:   dir,
+		Count: 4,
+		Commands: map[string]func(*TestScript, bool, []string){
+			"flaky": func(ts *TestScript, neg bool, args []string) {
+				if runs++; runs%2 == 0 {
+					ts.Fatalf("flaked")
+				}
+			},
+		},
+		OnResult: func(r ScriptResult) { results = append(results, r) },
+	})
+	if !runner.Failed() {
+		t.Error("expected the run to fail")
+	}
+	// a fails, but only after all its runs: b is not run.
+	var got []string
+	for _, r := range results {
+		got = append(got, fmt.Sprintf("%s %d %s", r.Name, r.Run, r.Status))
+	}
+	want := []string{"a#1 1 pass", "a#2 2 fail", "a#3 3 pass", "a#4 4 fail"}
+	if !slices.Equal(got, want) {
+		t.Errorf("results = %q, want %q", got, want)
+	}
+	if !slices.Contains(runner.logs, "a: 2/4 runs passed (50%), 2 failed") {
+		t.Errorf("logs = %q, want a's pass rate", runner.logs)
+	}
+
+	var started atomic.Int32
+	t.Run("parallel", func(t *testing.T) {
+		Run(t, Params{
+			Dir:      dir,
+			Count:    3,
+			Parallel: true,
+			Commands: map[string]func(*TestScript, bool, []string){
+				"flaky": func(ts *TestScript, neg bool, args []string) {},
+			},
+			OnStart: func(string) { started.Add(1) },
+		})
+	})
+	if n := started.Load(); n != 6 {
+		t.Errorf("started %d runs, want 6", n)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a_fast.tsar"), []byte("exec true\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b_slow.tsar"), []byte("exec sleep 10\n"), 0644)
+	writeFile(t, filepath.Join(dir, "c_after.tsar"), []byte("mark\n"), 0644)
+
+	ran := false
+	runner := &logCapture{}
+	start := time.Now()
+	RunStandalone(runner, Params{
+		Dir:             dir,
+		Timeout:         300 * time.Millisecond,
+		ContinueOnError: true,
+		Commands: map[string]func(*TestScript, bool, []string){
+			"mark": func(ts *TestScript, neg bool, args []string) { ran = true },
+		},
+	})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %v, want it bounded near the 300ms timeout", elapsed)
+	}
+	if !runner.Failed() {
+		t.Fatal("expected the run to fail on timeout")
+	}
+	if ran {
+		t.Error("script after the timeout should not run")
+	}
+	want := "run timed out after 300ms; killed b_slow; 1 not run: c_after"
+	if !slices.ContainsFunc(runner.fatals, func(s string) bool { return s == want }) {
+		t.Errorf("failures = %q, want one to be %q", runner.fatals, want)
+	}
+}
+
+func TestOnStartAndResult(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a_pass.tsar"), []byte("exec true\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b_fail.tsar"), []byte("# comment\nexec true\n! exec true\n"), 0644)
+	writeFile(t, filepath.Join(dir, "c_skip.tsar"), []byte("skip 'not today'\n"), 0644)
+
+	var started []string
+	var results []ScriptResult
+	RunStandalone(&testResultCapture{}, Params{
+		Dir:             dir,
+		ContinueOnError: true,
+		OnStart:         func(name string) { started = append(started, name) },
+		OnResult:        func(r ScriptResult) { results = append(results, r) },
+	})
+
+	if want := []string{"a_pass", "b_fail", "c_skip"}; !slices.Equal(started, want) {
+		t.Errorf("started = %v, want %v", started, want)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	want := []struct {
+		name   string
+		status ScriptStatus
+		line   int
+	}{
+		{"a_pass", StatusPass, 0},
+		{"b_fail", StatusFail, 3},
+		{"c_skip", StatusSkip, 0},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Name != w.name || r.Status != w.status || r.FailureLine != w.line {
+			t.Errorf("result %d = {%s %s line %d}, want {%s %s line %d}",
+				i, r.Name, r.Status, r.FailureLine, w.name, w.status, w.line)
+		}
+		if r.WorkDir == "" {
+			t.Errorf("result %d: empty WorkDir", i)
+		}
+	}
+	if got := results[1].Failure; got != "script:3: unexpected command success" {
+		t.Errorf("failure = %q", got)
+	}
+}
+
+func TestTsarWithCommands(t *testing.T) {
+	Run(t, Params{
+		Dir: "examples/testdata",
+		Commands: map[string]func(*TestScript, bool, []string){
+			"custom": func(ts *TestScript, neg bool, args []string) {
+				ts.Logf("Custom command executed with args: %v", args[1:])
+			},
+		},
+	})
+}
+
+// ---- Test HTTP handler
+
+func testHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/health":
+		fmt.Fprint(w, "ok")
+	case r.Method == "GET" && r.URL.Path == "/api/info":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"healthy","version":"1.0.0"}`)
+	case r.Method == "POST" && r.URL.Path == "/api/echo":
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	case r.URL.Path == "/created":
+		w.WriteHeader(201)
+		fmt.Fprint(w, "body")
+	case r.URL.Path == "/echo/headers":
+		w.Header().Set("Content-Type", "text/plain")
+		for _, name := range []string{"Authorization", "Accept"} {
+			if v := r.Header.Get(name); v != "" {
+				fmt.Fprintf(w, "%s: %s\n", name, v)
+			}
+		}
+	case r.URL.Path == "/with-headers":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Request-Id", "abc-123")
 		fmt.Fprint(w, "ok")
 	default:
 		w.WriteHeader(404)
 		fmt.Fprint(w, "not found")
 	}
 }
+
+func TestDryRun(t *testing.T) {
+	marks := 0
+	Run(t, Params{
+		Dir:    "testdata/dryrun",
+		DryRun: true,
+		Commands: map[string]func(*TestScript, bool, []string){
+			"mark": func(ts *TestScript, neg bool, args []string) { marks++ },
+		},
+	})
+	if marks != 0 {
+		t.Errorf("mark ran %d times in a dry run, want 0", marks)
+	}
+}
+
+func TestDryRunProblems(t *testing.T) {
+	dir := t.TempDir()
+	script := "exec no-such-program\n" +
+		"[nosuchcond] exec true\n" +
+		"exec ./missing.sh\n" +
+		"echo 'unterminated\n" +
+		"eventually -every 1s no-such-probe\n" +
+		"exec true\n"
+	writeFile(t, filepath.Join(dir, "bad.tsar"), []byte(script), 0644)
+
+	runner := &logCapture{}
+	RunStandalone(runner, Params{Dir: dir, DryRun: true, RequireExplicitExec: true})
+	if !runner.Failed() {
+		t.Fatal("expected the dry run to fail")
+	}
+	got := strings.Join(runner.fatals, "\n")
+	for _, want := range []string{
+		"dry run: 5 problem(s)",
+		`script:1: command "no-such-program" not found`,
+		"script:2: unknown condition",
+		`script:3: program "./missing.sh" not found in archive`,
+		"script:4: ",
+		`script:5: unknown command "no-such-probe"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("failure message missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "script:6:") {
+		t.Errorf("valid line reported as a problem:\n%s", got)
+	}
+}
+
+// jsonSteps is a test Parser for scripts described as JSON steps.
+type jsonSteps struct{}
+
+func (jsonSteps) Match(filename string) bool { return strings.HasSuffix(filename, ".json") }
+
+func (jsonSteps) Parse(filename string, data []byte) (*txtar.Archive, error) {
+	var doc struct {
+		Steps []string          `json:"steps"`
+		Files map[string]string `json:"files"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	ar := &txtar.Archive{Comment: []byte(strings.Join(doc.Steps, "\n") + "\n")}
+	for name, content := range doc.Files {
+		ar.Files = append(ar.Files, txtar.File{Name: name, Data: []byte(content)})
+	}
+	return ar, nil
+}
+
+func TestParser(t *testing.T) {
+	var names []string
+	Run(t, Params{
+		Dir:      "testdata/parser",
+		Parser:   jsonSteps{},
+		OnResult: func(r ScriptResult) { names = append(names, r.Name) },
+	})
+	if want := []string{"greet", "native"}; !slices.Equal(names, want) {
+		t.Errorf("ran %v, want %v", names, want)
+	}
+}
+
+func TestParserError(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "bad.json"), []byte("{"), 0644)
+
+	runner := &logCapture{}
+	RunStandalone(runner, Params{Dir: dir, Parser: jsonSteps{}})
+	if !runner.Failed() || len(runner.fatals) == 0 || !strings.HasPrefix(runner.fatals[0], "parse bad.json: ") {
+		t.Errorf("fatals = %q, want a parse error", runner.fatals)
+	}
+}
+
+func TestBuiltinUsage(t *testing.T) {
+	usage := BuiltinUsage()
+	for name := range builtinCmds {
+		if !strings.HasPrefix(usage[name], name) {
+			t.Errorf("builtin %q has no usage line", name)
+		}
+	}
+	for name := range usage {
+		if builtinCmds[name] == nil {
+			t.Errorf("usage line for unknown builtin %q", name)
+		}
+	}
+}
+
+func TestFailureContext(t *testing.T) {
+	dir := t.TempDir()
+	script := "# greet\n" +
+		"env NAME=world\n" +
+		"exec echo hello $NAME\n" +
+		"[!windows]   stdout 'bye $NAME'\n" +
+		"exec true\n" +
+		"exec true\n" +
+		"exec true\n"
+	writeFile(t, filepath.Join(dir, "ctx.tsar"), []byte(script), 0644)
+
+	runner := &logCapture{}
+	var result ScriptResult
+	RunStandalone(runner, Params{Dir: dir, OnResult: func(r ScriptResult) { result = r }})
+	if len(runner.fatals) == 0 {
+		t.Fatal("expected a failure")
+	}
+	want := "\n" +
+		"  2 | env NAME=world\n" +
+		"  3 | exec echo hello $NAME\n" +
+		"> 4 | [!windows]   stdout 'bye $NAME'\n" +
+		"    |              ^\n" +
+		"  5 | exec true\n" +
+		"  6 | exec true\n" +
+		`expanded: stdout "bye world"`
+	if got := runner.fatals[0]; !strings.HasSuffix(got, want) {
+		t.Errorf("failure = %s\nwant suffix:%s", got, want)
+	}
+	if strings.Contains(result.Failure, "expanded:") {
+		t.Errorf("ScriptResult.Failure includes context: %q", result.Failure)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	Run(t, Params{Dir: "testdata/check"})
+}
+
+func TestCheckFailures(t *testing.T) {
+	dir := t.TempDir()
+	script := "exec echo hello\n" +
+		"check stdout bye\n" +
+		"check ! stdout hello\n" +
+		"check stdout hello\n" +
+		"mark\n"
+	writeFile(t, filepath.Join(dir, "soft.tsar"), []byte(script), 0644)
+
+	marks := 0
+	runner := &logCapture{}
+	RunStandalone(runner, Params{
+		Dir: dir,
+		Commands: map[string]func(*TestScript, bool, []string){
+			"mark": func(ts *TestScript, neg bool, args []string) { marks++ },
+		},
+	})
+	if marks != 1 {
+		t.Errorf("mark ran %d times, want 1: script should continue after failed checks", marks)
+	}
+	if len(runner.fatals) != 1 {
+		t.Fatalf("fatals = %q, want a single final failure", runner.fatals)
+	}
+	got := runner.fatals[0]
+	for _, want := range []string{
+		"2 check(s) failed:",
+		`script:2: stdout does not match "bye"`,
+		`script:3: stdout unexpectedly matches "hello"`,
+		"> 3 | check ! stdout hello",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("failure missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestSection(t *testing.T) {
+	var sections []SectionResult
+	Run(t, Params{
+		Dir:      "testdata/section",
+		OnResult: func(r ScriptResult) { sections = r.Sections },
+	})
+	var got []string
+	for _, s := range sections {
+		got = append(got, s.Name+":"+string(s.Status))
+	}
+	want := []string{"build:pass", "optional:skip", "verify:pass"}
+	if !slices.Equal(got, want) {
+		t.Errorf("sections = %v, want %v", got, want)
+	}
+}
+
+func TestSectionFailureStandalone(t *testing.T) {
+	dir := t.TempDir()
+	script := "section one\nexec true\nsection two\nexec false\nsection three\nmark\n"
+	writeFile(t, filepath.Join(dir, "s.tsar"), []byte(script), 0644)
+
+	var result ScriptResult
+	marks := 0
+	runner := &logRecorder{}
+	RunStandalone(runner, Params{
+		Dir:      dir,
+		OnResult: func(r ScriptResult) { result = r },
+		Commands: map[string]func(*TestScript, bool, []string){
+			"mark": func(ts *TestScript, neg bool, args []string) { marks++ },
+		},
+	})
+	if result.Status != StatusFail || marks != 0 {
+		t.Errorf("status = %s, marks = %d; want fail and no later sections", result.Status, marks)
+	}
+	var got []string
+	for _, s := range result.Sections {
+		got = append(got, s.Name+":"+string(s.Status))
+	}
+	if want := []string{"one:pass", "two:fail"}; !slices.Equal(got, want) {
+		t.Errorf("sections = %v, want %v", got, want)
+	}
+	if !slices.Contains(runner.logs, "section two") {
+		t.Errorf("logs = %q, want section headers", runner.logs)
+	}
+}
+
+func TestSet(t *testing.T) {
+	Run(t, Params{Dir: "testdata/set"})
+}
+
+func TestAssert(t *testing.T) {
+	Run(t, Params{Dir: "testdata/assert"})
+}
+
+func TestAssertFailure(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("set N 4\nassert $N == 3\n"), 0644)
+
+	runner := &logCapture{}
+	RunStandalone(runner, Params{Dir: dir})
+	want := "script:2: assert \"4\" == \"3\" failed\n\tleft:  4\n\tright: 3\n"
+	if len(runner.fatals) != 1 || !strings.HasPrefix(runner.fatals[0], want) {
+		t.Errorf("fatals = %q, want prefix %q", runner.fatals, want)
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	got := diffValues("a\nb\nc", "a\nx\nc\nd")
+	want := "\t--- left\n\t+++ right\n\t  a\n\t- b\n\t+ x\n\t  c\n\t+ d"
+	if got != want {
+		t.Errorf("diffValues = %q, want %q", got, want)
+	}
+}
+
+func TestSaveOutput(t *testing.T) {
+	Run(t, Params{Dir: "testdata/saveoutput"})
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("exec echo hi\nexists .tsar/out/001.stdout\n"), 0644)
+	RunStandalone(t, Params{Dir: dir, SaveOutput: true})
+}
+
+func TestStatus(t *testing.T) {
+	Run(t, Params{Dir: "testdata/status"})
+}
+
+func TestStatusBeforeExec(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("status 0\n"), 0644)
+
+	runner := &logCapture{}
+	RunStandalone(runner, Params{Dir: dir})
+	if len(runner.fatals) == 0 || !strings.HasPrefix(runner.fatals[0], "script:1: status: no command has run") {
+		t.Errorf("fatals = %q", runner.fatals)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	Run(t, Params{Dir: "testdata/output"})
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	Run(t, Params{Dir: "testdata/maxoutput", MaxOutputBytes: 18})
+}
+
+func TestLimitBuffer(t *testing.T) {
+	tests := []struct {
+		max    int
+		writes []string
+		want   string
+	}{
+		{-1, []string{"hello ", "world"}, "hello world"},
+		{0, []string{"hello"}, "[... 5 bytes truncated ...]\n"},
+		{10, []string{"hello"}, "hello"},
+		{10, []string{"0123456789"}, "0123456789"},
+		{4, []string{"0123456789"}, "01\n[... 6 bytes truncated ...]\n89"},
+		{4, []string{"0", "1", "2", "3", "4", "5"}, "01\n[... 2 bytes truncated ...]\n45"},
+		{6, []string{"abcd", "efgh", "ij"}, "abc\n[... 4 bytes truncated ...]\nhij"},
+		{6, []string{"abcd", "e", "f", "g", "h", "ij"}, "abc\n[... 4 bytes truncated ...]\nhij"},
+		{6, []string{"abc", "de", "fgh"}, "abc\n[... 2 bytes truncated ...]\nfgh"},
+	}
+	for _, tt := range tests {
+		var b limitBuffer
+		b.max = tt.max
+		for _, w := range tt.writes {
+			b.Write([]byte(w))
+		}
+		if got := b.String(); got != tt.want {
+			t.Errorf("max %d, writes %q: got %q, want %q", tt.max, tt.writes, got, tt.want)
+		}
+	}
+}
+
+func TestLineLogger(t *testing.T) {
+	var logs []string
+	l := &lineLogger{
+		logf:   func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) },
+		prefix: "[stdout]",
+		budget: 12,
+	}
+	l.Write([]byte("one\ntw"))
+	l.Write([]byte("o\nthree\nfour\n"))
+	l.flush()
+	want := []string{"[stdout] one", "[stdout] two", "[stdout] [... further output not logged ...]"}
+	if !slices.Equal(logs, want) {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+
+	logs = nil
+	l = &lineLogger{logf: l.logf, prefix: "[stderr]", budget: -1}
+	l.Write([]byte("partial"))
+	l.flush()
+	if want := []string{"[stderr] partial"}; !slices.Equal(logs, want) {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+}
+
+func TestWorkdirMode(t *testing.T) {
+	for _, mode := range []WorkdirMode{WorkdirTemp, WorkdirTmpfs, WorkdirPool, WorkdirReuse} {
+		t.Run(string(mode), func(t *testing.T) {
+			t.Setenv("TMPDIR", t.TempDir())
+			var dirs []string
+			Run(t, Params{
+				Dir:         "testdata/workdir",
+				WorkdirMode: mode,
+				OnResult:    func(r ScriptResult) { dirs = append(dirs, r.WorkDir) },
+			})
+			if len(dirs) != 2 {
+				t.Fatalf("got %d results, want 2", len(dirs))
+			}
+			reused := dirs[0] == dirs[1]
+			if want := mode == WorkdirPool || mode == WorkdirReuse; reused != want {
+				t.Errorf("work directories %q: reused = %v, want %v", dirs, reused, want)
+			}
+			entries, err := os.ReadDir(dirs[1])
+			switch mode {
+			case WorkdirReuse:
+				if err != nil || len(entries) != 0 {
+					t.Errorf("reused directory after run: %v, %v; want kept and empty", entries, err)
+				}
+			default:
+				if !os.IsNotExist(err) {
+					t.Errorf("work directory after run: %v; want removed", err)
+				}
+			}
+		})
+	}
+}
+
+func TestWorkdirReuseLock(t *testing.T) {
+	root := t.TempDir()
+	get := func(w *workdirs) string {
+		t.Helper()
+		dir, err := w.get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	// Concurrent runs get their own directories, each emptied only by its
+	// run, and a later run takes the first one released.
+	p := Params{WorkdirRoot: root, WorkdirMode: WorkdirReuse}
+	first, second := newWorkdirs(p), newWorkdirs(p)
+	a, b := get(first), get(second)
+	if a == b {
+		t.Fatalf("concurrent runs share %s", a)
+	}
+	writeFile(t, filepath.Join(b, "b.txt"), []byte("b"), 0644)
+	if get(first) != a {
+		t.Errorf("a run's second script got another directory")
+	}
+	if _, err := os.Stat(filepath.Join(b, "b.txt")); err != nil {
+		t.Errorf("another run emptied %s: %v", b, err)
+	}
+	first.close()
+	third := newWorkdirs(p)
+	if c := get(third); c != a {
+		t.Errorf("third run got %s, want the released %s", c, a)
+	}
+	second.close()
+	third.close()
+
+	// The per-user directory must be private.
+	if runtime.GOOS != "windows" {
+		shared := t.TempDir()
+		base := filepath.Join(shared, "tsar-work-"+strconv.Itoa(os.Getuid()))
+		mkdirAll(t, base)
+		if err := os.Chmod(base, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newWorkdirs(Params{WorkdirRoot: shared, WorkdirMode: WorkdirReuse}).get("a"); err == nil || !strings.Contains(err.Error(), "not a directory private to the current user") {
+			t.Errorf("get with a shared %s: %v", base, err)
+		}
+	}
+}
+
+func TestWorkdirPoolKept(t *testing.T) {
+	root := t.TempDir()
+	var dirs []string
+	Run(t, Params{
+		Dir:         "testdata/workdir",
+		WorkdirRoot: root,
+		WorkdirMode: WorkdirPool,
+		OnResult:    func(r ScriptResult) { dirs = append(dirs, r.WorkDir) },
+	})
+	// Kept directories are not handed on: each script has its own, named
+	// after it.
+	if len(dirs) != 2 || dirs[0] == dirs[1] {
+		t.Fatalf("work directories %q, want two", dirs)
+	}
+	for _, dir := range dirs {
+		if !strings.HasPrefix(filepath.Base(dir), "tsar-") || strings.HasPrefix(filepath.Base(dir), "tsar-pool-") {
+			t.Errorf("work directory %s not named after its script", dir)
+		}
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("work directory not kept: %v", err)
+		}
+	}
+}
+
+func TestParseWorkdirMode(t *testing.T) {
+	for in, want := range map[string]WorkdirMode{"": WorkdirTemp, "temp": WorkdirTemp, "tmpfs": WorkdirTmpfs, "pool": WorkdirPool, "reuse": WorkdirReuse} {
+		if got, err := ParseWorkdirMode(in); err != nil || got != want {
+			t.Errorf("ParseWorkdirMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseWorkdirMode("ramdisk"); err == nil {
+		t.Error("ParseWorkdirMode(ramdisk) succeeded, want error")
+	}
+}
+
+func TestScriptCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.tsar")
+	writeFile(t, file, []byte("exec cat in.txt\n-- in.txt --\nhi\n"), 0644)
+
+	first, err := loadScript(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadScript(file, nil); again != first {
+		t.Error("unchanged script was parsed again")
+	}
+
+	writeFile(t, file, []byte("exec cat in.txt\n-- in.txt --\nhello\n"), 0644)
+	changed, err := loadScript(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == first || string(changed.archive.Files[0].Data) != "hello\n" {
+		t.Errorf("changed script: got files %q, want reparsed", changed.archive.Files)
+	}
+
+	// A rewrite keeping the size and modification time is seen too.
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, file, []byte("exec cat in.txt\n-- in.txt --\nhallo\n"), 0644)
+	if err := os.Chtimes(file, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := loadScript(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rewritten.archive.Files[0].Data) != "hallo\n" {
+		t.Errorf("same-size rewrite: got files %q, want reparsed", rewritten.archive.Files)
+	}
+
+	// The cache is bounded, evicting the oldest scripts first.
+	dir := t.TempDir()
+	var oldest *parsedScript
+	for i := range maxCachedScripts + 1 {
+		name := filepath.Join(dir, fmt.Sprintf("s%d.tsar", i))
+		writeFile(t, name, []byte("exec true\n"), 0644)
+		sc, err := loadScript(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			oldest = sc
+		}
+	}
+	scriptCache.Lock()
+	n := len(scriptCache.entries)
+	scriptCache.Unlock()
+	if n > maxCachedScripts {
+		t.Errorf("cache holds %d scripts, want at most %d", n, maxCachedScripts)
+	}
+	if again, _ := loadScript(filepath.Join(dir, "s0.tsar"), nil); again == oldest {
+		t.Error("oldest script was not evicted")
+	}
+
+	// Runs of a cached script still get freshly extracted files.
+	for range 2 {
+		RunFilesStandalone(t, Params{}, file)
+	}
+}
+
+func TestExplicitExecOverride(t *testing.T) {
+	Run(t, Params{Dir: "testdata/explicitexec", RequireExplicitExec: true})
+}
+
+func TestUnknownCondition(t *testing.T) {
+	Run(t, Params{Dir: "testdata/unknowncond", UnknownCondition: UnknownConditionSkipLine})
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("exec true\n[from-other-project] exec true\nexec false\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b.tsar"), []byte("# tsar:skip-on=from-other-project\nexec false\n"), 0644)
+	for _, tt := range []struct {
+		policy UnknownConditionPolicy
+		want   ScriptStatus
+	}{
+		{UnknownConditionFail, StatusFail},
+		{UnknownConditionSkipScript, StatusSkip},
+	} {
+		var results []ScriptResult
+		runner := &logCapture{}
+		RunStandalone(runner, Params{
+			Dir:              dir,
+			ContinueOnError:  true,
+			UnknownCondition: tt.policy,
+			OnResult:         func(r ScriptResult) { results = append(results, r) },
+		})
+		for _, r := range results {
+			if r.Status != tt.want {
+				t.Errorf("policy %q: %s status = %s, want %s (%s)", tt.policy, r.Name, r.Status, tt.want, r.Failure)
+			}
+			if tt.want == StatusFail && !strings.Contains(r.Failure, `unknown condition "from-other-project"`) {
+				t.Errorf("policy %q: %s failure = %q, want unknown condition", tt.policy, r.Name, r.Failure)
+			}
+		}
+	}
+
+	// A custom Condition reports unknown conditions with ErrUnknownCondition.
+	var status ScriptStatus
+	RunStandalone(&logCapture{}, Params{
+		Dir:              dir,
+		UnknownCondition: UnknownConditionSkipScript,
+		Condition: func(cond string) (bool, error) {
+			return false, fmt.Errorf("%w %q", ErrUnknownCondition, cond)
+		},
+		OnResult: func(r ScriptResult) { status = r.Status },
+	})
+	if status != StatusSkip {
+		t.Errorf("custom condition: status = %s, want skip", status)
+	}
+}
+
+func TestBestEffort(t *testing.T) {
+	Run(t, Params{Dir: "testdata/besteffort"})
+
+	for script, want := range map[string]string{
+		"? exec false\n":             "",
+		"?\n":                        "? on line by itself",
+		"! ? exec true\n":            "! ? is not allowed",
+		"? exec false\nexec false\n": "false failed",
+	} {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "a.tsar"), []byte(script), 0644)
+		runner := &logCapture{}
+		RunStandalone(runner, Params{Dir: dir})
+		got := strings.Join(runner.fatals, "\n")
+		if want == "" && runner.failed || !strings.Contains(got, want) {
+			t.Errorf("script %q: failures %q, want %q", script, got, want)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte(
+		"exec echo hello\n"+
+			"! exec false\n"+
+			"check exists missing\n"), 0644)
+
+	var events []string
+	var ends []Event
+	RunStandalone(&testResultCapture{}, Params{Dir: dir, Events: func(e Event) {
+		events = append(events, fmt.Sprintf("%s %s:%d %q %s", e.Kind, e.Script, e.Line, e.Args, e.Status))
+		if e.Kind == EventCommandEnd || e.Kind == EventScriptEnd {
+			ends = append(ends, e)
+		}
+	}})
+	want := []string{
+		`script-start a:0 [] `,
+		`command-start a:1 ["exec" "echo" "hello"] `,
+		`command-end a:1 ["exec" "echo" "hello"] pass`,
+		`command-start a:2 ["exec" "false"] `,
+		`command-end a:2 ["exec" "false"] pass`,
+		`command-start a:3 ["check" "exists" "missing"] `,
+		`command-end a:3 ["check" "exists" "missing"] fail`,
+		`script-end a:3 [] fail`,
+	}
+	if !slices.Equal(events, want) {
+		t.Fatalf("events:\n%s\nwant:\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+	if ends[0].StdoutBytes != len("hello\n") || ends[0].Duration <= 0 {
+		t.Errorf("exec end event = %+v, want 6 stdout bytes and a duration", ends[0])
+	}
+	if !ends[1].Neg {
+		t.Error("negated command event has Neg false")
+	}
+	if !strings.Contains(ends[3].Failure, "check(s) failed") {
+		t.Errorf("script end Failure = %q, want the check failure", ends[3].Failure)
+	}
+}
+
+func TestLeakedBackground(t *testing.T) {
+	dir := t.TempDir()
+	script := "exec sh -c 'echo serving; sleep 30 & wait' &srv\n" +
+		"exec echo quick &done\n" +
+		"exec sleep 0.1\n"
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte(script), 0644)
+
+	start := time.Now()
+	runner := &logRecorder{}
+	RunStandalone(runner, Params{Dir: dir})
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("run took %v; leaked background command was not killed", elapsed)
+	}
+	if runner.failed {
+		t.Error("leaked background failed the script without FailOnLeakedBackground")
+	}
+	logs := strings.Join(runner.logs, "\n")
+	for _, want := range []string{"background srv not waited for (killed)", "serving", "background done not waited for (exited)"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("logs missing %q:\n%s", want, logs)
+		}
+	}
+
+	expectFatal(t, Params{FailOnLeakedBackground: true}, script, "2 background command(s) not waited for: srv, done")
+}
+
+// TestLeakedBackgroundLastLine checks that a background command started on
+// the last line, which the script ends right after, is reaped safely.
+func TestLeakedBackgroundLastLine(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("exec sleep 5 &\n"), 0644)
+
+	for range 20 {
+		runner := &logRecorder{}
+		RunStandalone(runner, Params{Dir: dir})
+		if runner.failed {
+			t.Fatal("leaked background failed the script without FailOnLeakedBackground")
+		}
+		if logs := strings.Join(runner.logs, "\n"); !strings.Contains(logs, "background bg0 not waited for (killed)") {
+			t.Fatalf("logs missing the killed background command:\n%s", logs)
+		}
+	}
+}
+
+func TestEnvDiff(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte(
+		"env MODE=ci\n"+
+			"env -u HOME\n"+
+			"env GOOS=plan9\n"+
+			"env MODE=local\n"+
+			"exec false\n"), 0644)
+
+	setup := func(env *Env) error {
+		env.Setenv("FROM_SETUP", "1")
+		return nil
+	}
+	runner := &logRecorder{}
+	RunStandalone(runner, Params{Dir: dir, EnvDiff: true, Setup: setup})
+	if !runner.failed {
+		t.Fatal("script did not fail")
+	}
+	logs := strings.Join(runner.logs, "\n")
+	for _, want := range []string{
+		"\t+ FROM_SETUP=1 [Params.Setup]\n",
+		"\t+ GOOS=plan9 [script:3]\n",
+		"\t- HOME (was \"/no-home\") [script:2]\n",
+		"\t+ MODE=local [script:4]\n",
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("logs missing %q:\n%s", want, logs)
+		}
+	}
+
+	runner = &logRecorder{}
+	RunStandalone(runner, Params{Dir: dir})
+	if logs := strings.Join(runner.logs, "\n"); strings.Contains(logs, "environment changes") {
+		t.Errorf("environment diff logged without EnvDiff:\n%s", logs)
+	}
+}
+
+func TestCmp(t *testing.T) {
+	Run(t, Params{Dir: "testdata/cmp"})
+
+	dir := t.TempDir()
+	long := strings.Repeat("line\n", 300)
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte(
+		"exec echo one\n"+
+			"cmp stdout want.txt\n"+
+			"-- want.txt --\n"+
+			"two\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b.tsar"), []byte(
+		"cp big.txt got.txt\n"+
+			"cmp got.txt empty.txt\n"+
+			"-- big.txt --\n"+long+
+			"-- empty.txt --\n"), 0644)
+
+	artifacts := t.TempDir()
+	capture := &logCapture{}
+	var results []ScriptResult
+	RunStandalone(capture, Params{
+		Dir:             dir,
+		ContinueOnError: true,
+		ArtifactDir:     artifacts,
+		OnResult:        func(r ScriptResult) { results = append(results, r) },
+	})
+	if len(capture.fatals) != 2 {
+		t.Fatalf("fatals = %q, want 2", capture.fatals)
+	}
+	want := "script:2: stdout and want.txt differ (1 line(s) removed, 1 added):\n" +
+		"--- stdout\n" +
+		"+++ want.txt\n" +
+		"@@ -1,1 +1,1 @@\n" +
+		"1   - one\n" +
+		"  1 + two"
+	if !strings.HasPrefix(capture.fatals[0], want+"\n") {
+		t.Errorf("fatal = %q, want %q", capture.fatals[0], want)
+	}
+	path := filepath.Join(artifacts, "b", "002-got.txt.actual")
+	if !strings.Contains(capture.fatals[1], "[... 103 more diff lines ...]\nfull got.txt saved to "+path) {
+		t.Errorf("fatal = %q, want truncated diff saved to %s", capture.fatals[1], path)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != long {
+		t.Errorf("artifact = %d bytes, %v; want the actual content", len(data), err)
+	}
+	if len(results) != 2 || !slices.Equal(results[1].Artifacts, []string{path}) {
+		t.Errorf("results = %+v, want b's artifact recorded", results)
+	}
+}
+
+func TestCmpWhitespace(t *testing.T) {
+	for script, want := range map[string]string{
+		"exec printf 'a\\r\\n'\ncmp stdout want.txt\n-- want.txt --\na\n": "they differ only in whitespace or line endings, which cmp -w, -b and -crlf ignore",
+		"cmp -x a.txt a.txt\n": "cmp: unknown flag -x",
+		"cmpenv -w a.txt\n":    "usage: cmpenv [-w] [-b] [-crlf] file1 file2",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	script := "exec printf 'a\\r\\nb\\r\\n'\n" +
+		"stdout '^a\\nb\\n$'\n" +
+		"cmp stdout want.txt\n" +
+		"exec printf 'x\\r\\n' >got.txt\n" +
+		"grep -m '^x$' got.txt\n" +
+		"exec sh -c 'printf \"y\\\\r\\\\n\" >&2' &bg&\n" +
+		"wait bg\n" +
+		"stderr '^y\\n$'\n" +
+		"-- want.txt --\n" +
+		"a\nb\n"
+	expectPass(t, Params{NormalizeNewlines: true}, script)
+	expectFatal(t, Params{}, script, "script:2: stdout does not match")
+}
+
+func TestCmpBinary(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte(
+		"cmp got.bin got.bin\n"+
+			"cmp got.bin want.bin\n"+
+			"-- got.bin --\n"+
+			"\x89PNG\x00\x00\x00\x0dIHDR\x00\x01\n"+
+			"-- want.bin --\n"+
+			"\x89PNG\x00\x00\x00\x0dIHDR\x00\x02\n"), 0644)
+
+	capture := &logCapture{}
+	RunStandalone(capture, Params{Dir: dir})
+	if len(capture.fatals) != 1 {
+		t.Fatalf("fatals = %q, want 1", capture.fatals)
+	}
+	want := "script:2: got.bin and want.bin differ (binary, 15 bytes, want 15; first difference at offset 0xd):\n" +
+		"offset    expected                            actual\n" +
+		"00000008  49 48 44 52 00 02 0a    |IHDR... |  49 48 44 52 00 01 0a    |IHDR... |\n"
+	if !strings.HasPrefix(capture.fatals[0], want) {
+		t.Errorf("fatal = %q, want %q", capture.fatals[0], want)
+	}
+}
+
+func TestHexDiff(t *testing.T) {
+	actual := strings.Repeat("\x00", 64)
+	expected := strings.Repeat("\x01", 60)
+	summary, out, cut := hexDiff(actual, expected, false, 3)
+	if want := "binary, 64 bytes, want 60; first difference at offset 0x0"; summary != want {
+		t.Errorf("summary = %q, want %q", summary, want)
+	}
+	if cut != 5 {
+		t.Errorf("cut = %d, want 5", cut)
+	}
+	if n := strings.Count(out, "\n"); n != 4 {
+		t.Errorf("rendered %d lines, want header and 3 rows:\n%s", n, out)
+	}
+
+	_, out, _ = hexDiff("ab", "ac", true, 10)
+	if !strings.Contains(out, "61 \x1b[32m63\x1b[0m") || !strings.Contains(out, "61 \x1b[31m62\x1b[0m") {
+		t.Errorf("colored hex diff = %q", out)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	Run(t, Params{Dir: "testdata/digest"})
+
+	for script, want := range map[string]string{
+		"sha256 a.txt e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n-- a.txt --\nhello\n": "sha256 of a.txt is 5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03, want e3b0",
+		"md5 a.txt abc\n-- a.txt --\n":                       `"abc" is not a md5 digest`,
+		"sha1 missing.txt " + strings.Repeat("0", 40) + "\n": "sha1: open",
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestFileAttrs(t *testing.T) {
+	Run(t, Params{Dir: "testdata/fileattr"})
+
+	for script, want := range map[string]string{
+		"filesize a.txt ..3\n-- a.txt --\nhello\n":      "size of a.txt is 6 bytes, want ..3",
+		"filesize a.txt 5..1\n-- a.txt --\n":            `empty range "5..1"`,
+		"filesize a.txt 2XB\n-- a.txt --\n":             `invalid size "2XB"`,
+		"fstat a.txt type=dir mode=0600\n-- a.txt --\n": "a.txt: type is file, want dir; mode is 0",
+		"fstat a.txt size=1\n-- a.txt --\n":             `unknown check "size=1"`,
+	} {
+		expectFatal(t, Params{}, script, want)
+	}
+}
+
+func TestParseSizeRange(t *testing.T) {
+	for s, want := range map[string][2]int64{
+		"12":        {12, 12},
+		"1.5KB":     {1500, 1500},
+		"2KiB..":    {2048, -1},
+		"..20MB":    {0, 20e6},
+		"1MiB..1GB": {1 << 20, 1e9},
+	} {
+		lo, hi, err := parseSizeRange(s)
+		if err != nil || lo != want[0] || hi != want[1] {
+			t.Errorf("parseSizeRange(%q) = %d, %d, %v; want %d, %d", s, lo, hi, err, want[0], want[1])
+		}
+	}
+}
+
+func TestTree(t *testing.T) {
+	Run(t, Params{Dir: "testdata/tree"})
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "a.tsar")
+	writeFile(t, script, []byte(
+		"mkdir out/sub\n"+
+			"cp want.txt out/sub/file.txt\n"+
+			"tree out want.txt\n"+
+			"-- want.txt --\n"+
+			"sub/\n"+
+			"old.txt\n"), 0644)
+
+	capture := &logCapture{}
+	RunStandalone(capture, Params{Dir: dir})
+	want := "script:3: tree out does not match want.txt (1 line(s) removed, 1 added):\n" +
+		"--- out\n" +
+		"+++ want.txt\n" +
+		"@@ -1,2 +1,2 @@\n" +
+		"1 1   sub/\n" +
+		"2   - sub/file.txt\n" +
+		"  2 + old.txt\n"
+	if len(capture.fatals) != 1 || !strings.HasPrefix(capture.fatals[0], want) {
+		t.Fatalf("fatals = %q, want %q", capture.fatals, want)
+	}
+
+	runner := &logRecorder{}
+	RunStandalone(runner, Params{Dir: dir, UpdateScripts: true})
+	if runner.failed {
+		t.Fatal("update run failed")
+	}
+	data, err := os.ReadFile(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "-- want.txt --\nsub/\nsub/file.txt\n") {
+		t.Errorf("updated script:\n%s", data)
+	}
+
+	capture = &logCapture{}
+	RunStandalone(capture, Params{Dir: dir})
+	if capture.failed {
+		t.Errorf("updated script fails: %q", capture.fatals)
+	}
+}
+
+func TestArchiveAnnotations(t *testing.T) {
+	Run(t, Params{
+		Dir: "testdata/archive",
+		Setup: func(env *Env) error {
+			env.Setenv("SERVER", "https://example.test")
+			return nil
+		},
+	})
+
+	for script, want := range map[string]string{
+		"exec true\n-- a.bin [base64] --\n!!!\n": "-- a.bin [base64] --: invalid base64",
+		"exec true\n-- a.bin [gzip] --\n":        "-- a.bin [gzip] --: unknown file annotation [gzip]",
+		"exec true\n-- link -> a.txt --\nhi\n":   "-- link -> a.txt --: symlink cannot have content",
+	} {
+		for _, dryRun := range []bool{false, true} {
+			expectFatal(t, Params{DryRun: dryRun}, script, want)
+		}
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	b := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk"
+	d := newLineDiff("got", a, "want", b)
+	if got, want := d.summary(), "1 line(s) removed, 2 added"; got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+	out, cut := d.render(false, 100)
+	want := "--- got\n" +
+		"+++ want\n" +
+		"@@ -1,5 +1,5 @@\n" +
+		" 1  1   a\n" +
+		" 2    - b\n" +
+		"    2 + B\n" +
+		" 3  3   c\n" +
+		" 4  4   d\n" +
+		" 5  5   e\n" +
+		"@@ -8,3 +8,4 @@\n" +
+		" 8  8   h\n" +
+		" 9  9   i\n" +
+		"10 10   j\n" +
+		"   11 + k\n" +
+		"\\ No newline at end of file\n"
+	if out != want || cut != 0 {
+		t.Errorf("render = %d cut,\n%s\nwant:\n%s", cut, out, want)
+	}
+
+	out, _ = d.render(true, 100)
+	if !strings.Contains(out, "\x1b[31m 2    - b\x1b[0m\n\x1b[32m    2 + B\x1b[0m\n") {
+		t.Errorf("colored render = %q", out)
+	}
+	if _, cut := d.render(false, 4); cut != 11 {
+		t.Errorf("render cut %d lines, want 11", cut)
+	}
+}
+
+func TestProcessGroups(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	// A timed-out command's children are killed with it, and children left
+	// behind by a command that exits do not hold the script up.
+	start := time.Now()
+	expectPass(t, Params{},
+		"! exec -timeout 200ms sh -c 'sleep 30 & wait'\n"+
+			"exec sh -c 'sleep 30 &'\n")
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("run took %v; child processes outlived their commands", elapsed)
+	}
+}
+
+func TestOrphanKilled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	// The grandchild is orphaned when the shell exits, and is killed with
+	// what is left of the shell's process group.
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	p := Params{Setup: func(e *Env) error {
+		e.Setenv("TSAR_PID", pidFile)
+		return nil
+	}}
+	expectPass(t, p,
+		"exec sh orphan.sh\n"+
+			"-- orphan.sh --\n"+
+			"sleep 30 >/dev/null 2>&1 &\n"+
+			"echo $! >\"$TSAR_PID\"\n")
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The orphan is reaped by init, which may take a moment.
+	deadline := time.Now().Add(10 * time.Second)
+	for proc.Signal(syscall.Signal(0)) == nil {
+		if time.Now().After(deadline) {
+			proc.Kill()
+			t.Fatalf("orphaned grandchild %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("exec sleep 10\n"), 0644)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(200*time.Millisecond, func() { cancel(errors.New("interrupted")) })
+	runner := &logCapture{}
+	start := time.Now()
+	RunStandalone(runner, Params{Dir: dir, Context: ctx})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %v, want it stopped by the cancelled context", elapsed)
+	}
+	if !slices.ContainsFunc(runner.fatals, func(s string) bool { return strings.HasPrefix(s, "interrupted") }) {
+		t.Errorf("failures = %q, want interrupted", runner.fatals)
+	}
+}
+
+func TestCheckLeaks(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "clean.tsar"), []byte("exec echo hi\nexec sleep 0.01 &\nwait\ntidy\n"), 0644)
+	writeFile(t, filepath.Join(dir, "leaky.tsar"), []byte("tidy\nleak\n"), 0644)
+
+	var leaked *os.File
+	stop := make(chan struct{})
+	defer close(stop)
+	defer func() { leaked.Close() }()
+	var results []ScriptResult
+	RunStandalone(&logCapture{}, Params{
+		Dir:             dir,
+		CheckLeaks:      true,
+		ContinueOnError: true,
+		Commands: map[string]func(*TestScript, bool, []string){
+			"tidy": func(ts *TestScript, neg bool, args []string) {},
+			"leak": func(ts *TestScript, neg bool, args []string) {
+				f, err := os.CreateTemp("", "leak-*")
+				if err != nil {
+					ts.Fatalf("%v", err)
+				}
+				leaked = f
+				go func() { <-stop }()
+			},
+		},
+		OnResult: func(r ScriptResult) { results = append(results, r) },
+	})
+
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if r := results[0]; r.Status != StatusPass {
+		t.Errorf("clean script: %s: %s", r.Status, r.Failure)
+	}
+	failure := results[1].Failure
+	for _, want := range []string{"1 goroutine(s) still running", "file descriptor", "leak-", "temporary file left behind", "custom commands run: tidy, leak"} {
+		if !strings.Contains(failure, want) {
+			t.Errorf("leaky script failure missing %q:\n%s", want, failure)
+		}
+	}
+}
+
+// harness is a minimal custom test type with nested subtests, for RunT.
+type harness struct {
+	name            string
+	failed, skipped bool
+	subs            []*harness
+}
+
+func (h *harness) Skip(args ...any)                  { h.skipped = true }
+func (h *harness) Fatal(args ...any)                 { h.failed = true }
+func (h *harness) Fatalf(format string, args ...any) { h.failed = true }
+func (h *harness) Log(args ...any)                   {}
+func (h *harness) Logf(format string, args ...any)   {}
+func (h *harness) Failed() bool                      { return h.failed }
+func (h *harness) Helper()                           {}
+
+func (h *harness) Run(name string, f func(*harness)) bool {
+	sub := &harness{name: h.name + "/" + name}
+	h.subs = append(h.subs, sub)
+	f(sub)
+	if sub.failed {
+		h.failed = true
+	}
+	return !sub.failed
+}
+
+func TestRunT(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("exec echo a\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b.tsar"), []byte("exec false\n"), 0644)
+	writeFile(t, filepath.Join(dir, "c.tsar"), []byte("skip\n"), 0644)
+
+	h := &harness{name: "top"}
+	RunT(h, Params{Dir: dir, ContinueOnError: true})
+	var got []string
+	for _, sub := range h.subs {
+		got = append(got, fmt.Sprintf("%s failed=%t skipped=%t", sub.name, sub.failed, sub.skipped))
+	}
+	want := []string{
+		"top/a failed=false skipped=false",
+		"top/b failed=true skipped=false",
+		"top/c failed=false skipped=true",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("subtests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !h.failed {
+		t.Errorf("parent not failed with a failing subtest")
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		writeFile(t, filepath.Join(dir, name+".tsar"), []byte("exec echo "+name+"\nstdout "+name+"\n"), 0644)
+	}
+	// Parallel subtests start only once their parent's function returns,
+	// whatever the -parallel limit.
+	var mu sync.Mutex
+	var returned bool
+	var early, ran []string
+	t.Run("scripts", func(t *testing.T) {
+		RunT(t, Params{
+			Dir:      dir,
+			Parallel: true,
+			OnStart: func(name string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if !returned {
+					early = append(early, name)
+				}
+			},
+			OnResult: func(r ScriptResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				ran = append(ran, r.Name)
+			},
+		})
+		mu.Lock()
+		returned = true
+		mu.Unlock()
+	})
+	if len(early) > 0 {
+		t.Errorf("scripts %v started before RunT returned, want parallel subtests", early)
+	}
+	if slices.Sort(ran); !slices.Equal(ran, []string{"a", "b", "c"}) {
+		t.Errorf("ran %v, want a, b, c", ran)
+	}
+}
+
+// errorRecorder is a standalone runner that, like *testing.T, has an Error
+// method that does not stop it.
+type errorRecorder struct {
+	logRecorder
+	errors []string
+	fatal  bool
+}
+
+func (t *errorRecorder) Error(args ...any) {
+	t.failed = true
+	t.errors = append(t.errors, fmt.Sprint(args...))
+}
+
+func (t *errorRecorder) Fatal(args ...any) { t.fatal = true }
+
+func TestStandaloneIsolation(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.tsar"), []byte("exec false\n"), 0644)
+	writeFile(t, filepath.Join(dir, "b.tsar"), []byte("skip 'not today'\nexec false\n"), 0644)
+	writeFile(t, filepath.Join(dir, "c.tsar"), []byte("exec echo c\n"), 0644)
+
+	runner := &errorRecorder{}
+	var results []ScriptResult
+	RunStandalone(runner, Params{
+		Dir:             dir,
+		ContinueOnError: true,
+		OnResult:        func(r ScriptResult) { results = append(results, r) },
+	})
+
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Name+" "+string(r.Status))
+	}
+	if want := []string{"a fail", "b skip", "c pass"}; !slices.Equal(got, want) {
+		t.Errorf("results = %q, want %q", got, want)
+	}
+	if runner.fatal || len(runner.errors) != 1 || !strings.Contains(runner.errors[0], "false failed") {
+		t.Errorf("fatal = %t, errors = %q; want a's failure reported with Error only", runner.fatal, runner.errors)
+	}
+	for _, want := range []string{`--- FAIL: a \(\d+\.\d\ds\)`, "not today", `--- SKIP: b \(`, `--- PASS: c \(`} {
+		re := regexp.MustCompile(want)
+		if !slices.ContainsFunc(runner.logs, re.MatchString) {
+			t.Errorf("logs lack %q:\n%s", want, strings.Join(runner.logs, "\n"))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package tsar
+
+import (
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// cmdReplace rewrites files in place, replacing each match of a regexp, so
+// that nondeterministic parts of outputs can be normalized before cmp. The
+// replacement refers to groups as \1 to \9, and to the whole match as \0:
+// unlike $1, they are not expanded as variables. The files may be glob
+// patterns, or stdout and stderr to rewrite the last command's output.
+func (ts *TestScript) cmdReplace(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: replace does not support negation", ts.lineno)
+		return
+	}
+	if len(args) < 4 {
+		ts.t.Fatalf("script:%d: usage: replace pattern replacement file...", ts.lineno)
+		return
+	}
+	re, err := regexp.Compile(args[1])
+	if err != nil {
+		ts.t.Fatalf("script:%d: replace: invalid pattern %q: %v", ts.lineno, args[1], err)
+		return
+	}
+	repl := expandTemplate(args[2])
+
+	replaced := false
+	for _, arg := range args[3:] {
+		switch arg {
+		case "stdout", "stderr":
+			out := &ts.stdout
+			if arg == "stderr" {
+				out = &ts.stderr
+			}
+			replaced = replaced || re.MatchString(*out)
+			*out = re.ReplaceAllString(*out, repl)
+			continue
+		}
+		files, err := ts.globFiles([]string{arg})
+		if err != nil {
+			ts.t.Fatalf("script:%d: replace: %v", ts.lineno, err)
+			return
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				ts.t.Fatalf("script:%d: replace: %v", ts.lineno, err)
+				return
+			}
+			if !re.Match(data) {
+				continue
+			}
+			replaced = true
+			info, err := os.Stat(file)
+			if err == nil {
+				err = os.WriteFile(file, re.ReplaceAll(data, []byte(repl)), info.Mode())
+			}
+			if err != nil {
+				ts.t.Fatalf("script:%d: replace: %v", ts.lineno, err)
+				return
+			}
+		}
+	}
+	// A pattern that matches nothing has most likely gone stale.
+	if !replaced {
+		ts.t.Fatalf("script:%d: replace: %q matches nothing in %s", ts.lineno, args[1], strings.Join(args[3:], " "))
+	}
+}
+
+// expandTemplate turns a replacement with \N group references into one for
+// regexp.Expand: \N becomes ${N}, \\ a backslash and $ a literal $.
+func expandTemplate(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			b.WriteString("$$")
+		case c == '\\' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			b.WriteString("${" + s[i+1:i+2] + "}")
+			i++
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\\':
+			b.WriteByte('\\')
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// cmdHead keeps the first lines of a file, or of stdout or stderr: as
+// stdout, or written to an output file.
+func (ts *TestScript) cmdHead(neg bool, args []string) {
+	ts.cutLines(neg, args, func(lines []string, n int) []string { return lines[:min(n, len(lines))] })
+}
+
+// cmdTail keeps the last lines of a file, or of stdout or stderr, like head.
+func (ts *TestScript) cmdTail(neg bool, args []string) {
+	ts.cutLines(neg, args, func(lines []string, n int) []string { return lines[max(len(lines)-n, 0):] })
+}
+
+// cutLines implements head and tail, which keep -n lines, 10 by default.
+func (ts *TestScript) cutLines(neg bool, args []string, cut func(lines []string, n int) []string) {
+	name := args[0]
+	n := 10
+	args = args[1:]
+	if len(args) > 0 && args[0] == "-n" {
+		if len(args) < 2 {
+			args = nil
+		} else {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+				ts.t.Fatalf("script:%d: %s: invalid line count %q", ts.lineno, name, args[1])
+				return
+			}
+			args = args[2:]
+		}
+	}
+	ts.rewriteLines(neg, name, "[-n N] ", args, func(lines []string) []string { return cut(lines, n) })
+}
+
+// rewriteLines runs a command transforming the lines of a file, or of
+// stdout or stderr, given as args: file [out]. The result is written to out
+// or, without one, saved as stdout for the following assertions.
+func (ts *TestScript) rewriteLines(neg bool, name, flags string, args []string, f func(lines []string) []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: %s does not support negation", ts.lineno, name)
+		return
+	}
+	if len(args) < 1 || len(args) > 2 {
+		ts.t.Fatalf("script:%d: usage: %s %sfile [out]", ts.lineno, name, flags)
+		return
+	}
+	text, err := ts.readCmpFile(args[0])
+	if err != nil {
+		ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+		return
+	}
+	out := strings.Join(f(splitLines(text)), "")
+	if len(args) == 1 {
+		ts.stdout, ts.stderr = out, ""
+		return
+	}
+	if err := os.WriteFile(ts.mkabs(args[1]), []byte(out), 0666); err != nil {
+		ts.t.Fatalf("script:%d: %s: %v", ts.lineno, name, err)
+	}
+}
+
+// cmdSort sorts the lines of a file, or of stdout or stderr, by byte value
+// whatever the locale: as stdout, or written to an output file.
+func (ts *TestScript) cmdSort(neg bool, args []string) {
+	ts.rewriteLines(neg, args[0], "", args[1:], func(lines []string) []string {
+		lines = terminateLines(lines)
+		slices.Sort(lines)
+		return lines
+	})
+}
+
+// cmdUniq drops the lines of a file, or of stdout or stderr, that repeat
+// the line before them, like uniq(1): as stdout, or written to an output
+// file.
+func (ts *TestScript) cmdUniq(neg bool, args []string) {
+	ts.rewriteLines(neg, args[0], "", args[1:], func(lines []string) []string {
+		return slices.Compact(terminateLines(lines))
+	})
+}
+
+// terminateLines adds the final newline lines may lack, so that they can be
+// reordered or compared.
+func terminateLines(lines []string) []string {
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += "\n"
+	}
+	return lines
+}
@@ -0,0 +1,203 @@
+package tsar
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gfanton/tsar/tsarscript"
+	"golang.org/x/tools/txtar"
+)
+
+// cmdTree compares the recursive listing of a directory with a manifest
+// file holding one entry per line: a slash-separated path relative to the
+// directory, with a trailing slash for directories and " -> target" for
+// symlinks. With -mode and -size, entries also carry "mode=PERM" and, for
+// regular files, "size=N". Blank lines and lines starting with # are
+// ignored. With Params.UpdateScripts, a mismatching manifest in the script's
+// archive is rewritten instead.
+func (ts *TestScript) cmdTree(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: tree does not support negation", ts.lineno)
+		return
+	}
+	var withMode, withSize bool
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-mode":
+			withMode = true
+		case "-size":
+			withSize = true
+		default:
+			ts.t.Fatalf("script:%d: tree: unknown flag %s", ts.lineno, args[0])
+			return
+		}
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: usage: tree [-mode] [-size] dir manifest", ts.lineno)
+		return
+	}
+	dir, manifest := args[0], args[1]
+
+	got, err := ts.listTree(ts.mkabs(dir), withMode, withSize)
+	if err != nil {
+		ts.t.Fatalf("script:%d: tree: %v", ts.lineno, err)
+		return
+	}
+	data, err := os.ReadFile(ts.mkabs(manifest))
+	if err != nil {
+		ts.t.Fatalf("script:%d: tree: %v", ts.lineno, err)
+		return
+	}
+	var want []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			want = append(want, line)
+		}
+	}
+	if slices.Equal(got, want) {
+		return
+	}
+
+	listing, wantText := manifestText(got), manifestText(want)
+	if ts.params.UpdateScripts {
+		if err := ts.updateArchiveFile(manifest, listing); err != nil {
+			ts.t.Fatalf("script:%d: tree: %v", ts.lineno, err)
+		}
+		return
+	}
+	d := newLineDiff(dir, listing, manifest, wantText)
+	out, cut := d.render(ts.params.Color, maxInlineDiff)
+	msg := fmt.Sprintf("script:%d: tree %s does not match %s (%s):\n%s", ts.lineno, dir, manifest, d.summary(), out)
+	if cut > 0 {
+		msg += fmt.Sprintf("[... %d more diff lines ...]\n", cut)
+	}
+	ts.t.Fatalf("%s", strings.TrimSuffix(msg, "\n"))
+}
+
+// manifestText renders manifest entries one per line.
+func manifestText(entries []string) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	return strings.Join(entries, "\n") + "\n"
+}
+
+// listTree returns the manifest entries for the tree rooted at root, in
+// lexical order. tsar's own $WORK/.tsar directory is left out.
+func (ts *TestScript) listTree(root string, withMode, withSize bool) ([]string, error) {
+	var entries []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if d.IsDir() && path == filepath.Join(ts.workdir, ".tsar") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entry := filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry+" -> "+filepath.ToSlash(target))
+			return nil
+		case d.IsDir():
+			entry += "/"
+		}
+		if withMode {
+			entry += fmt.Sprintf(" mode=%#o", info.Mode().Perm())
+		}
+		if withSize && info.Mode().IsRegular() {
+			entry += fmt.Sprintf(" size=%d", info.Size())
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// updateArchiveFile replaces the content of a file from the script's
+// archive, both in the work directory and, once the script has run, in the
+// script file itself; see Params.UpdateScripts.
+func (ts *TestScript) updateArchiveFile(name, content string) error {
+	if ts.params.Parser != nil && ts.params.Parser.Match(ts.file) {
+		return fmt.Errorf("cannot update %s: %s is not a txtar script", name, filepath.Base(ts.file))
+	}
+	rel, err := filepath.Rel(ts.workdir, ts.mkabs(name))
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	if ts.archive == nil || !slices.ContainsFunc(ts.archive.Files, func(f txtar.File) bool {
+		h, err := tsarscript.ParseFileHeader(f.Name)
+		return err == nil && h.Name == rel
+	}) {
+		return fmt.Errorf("cannot update %s: not a file in the script's archive", name)
+	}
+	if err := os.WriteFile(ts.mkabs(name), []byte(content), 0666); err != nil {
+		return err
+	}
+	if ts.updates == nil {
+		ts.updates = make(map[string]string)
+	}
+	ts.updates[rel] = content
+	ts.t.Logf("script:%d: updating %s", ts.lineno, rel)
+	return nil
+}
+
+// writeUpdates rewrites the script file with the archive files updated while
+// it ran, adding those it did not have at the end. The parsed archive is
+// shared through the script cache, so it is copied rather than modified.
+func (ts *TestScript) writeUpdates() error {
+	if len(ts.updates) == 0 {
+		return nil
+	}
+	ar := &txtar.Archive{}
+	seen := make(map[string]bool)
+	if ts.archive != nil {
+		ar.Comment = ts.archive.Comment
+		for _, f := range ts.archive.Files {
+			h, _ := tsarscript.ParseFileHeader(f.Name)
+			if content, ok := ts.updates[h.Name]; ok {
+				f.Data = encodeArchiveData(h, []byte(content))
+				seen[h.Name] = true
+			}
+			ar.Files = append(ar.Files, f)
+		}
+	} else {
+		data, err := os.ReadFile(ts.file)
+		if err != nil {
+			return err
+		}
+		ar.Comment = data
+	}
+	for _, name := range slices.Sorted(maps.Keys(ts.updates)) {
+		if !seen[name] {
+			ar.Files = append(ar.Files, txtar.File{Name: name, Data: []byte(ts.updates[name])})
+		}
+	}
+	info, err := os.Stat(ts.file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ts.file, txtar.Format(ar), info.Mode().Perm())
+}
@@ -0,0 +1,363 @@
+// Package tsarscript parses tsar scripts into a syntax tree.
+//
+// It is the grammar used by the tsar engine, exposed for tools such as
+// formatters, linters and editors that need to understand scripts without
+// running them. Parsing is purely syntactic: environment variables are not
+// expanded and conditions are not evaluated. When a script runs, variables
+// are expanded before a line is split into words, so an Arg holding "$VAR"
+// may become several words at run time.
+package tsarscript
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/txtar"
+)
+
+// Pos is a position in a script file. Line and Col are 1-based; Col counts
+// bytes.
+type Pos struct {
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// LineKind classifies a script line.
+type LineKind int
+
+const (
+	Blank   LineKind = iota // empty or whitespace only
+	Comment                 // starts with '#'
+	Command                 // optional condition, optional "!", then words
+)
+
+// Script is a parsed script file.
+type Script struct {
+	Lines []*Line // every line of the script section, in order
+	Files []*File // archive files following the script section, in order
+}
+
+// Line is a single line of the script section.
+type Line struct {
+	Pos  Pos    // start of the line; Col is always 1
+	Text string // the line as written, without its newline
+	Kind LineKind
+
+	// Command lines only.
+	Cond *Cond // nil if the line has no [condition] prefix
+	Neg  bool  // the command is prefixed with "!"
+	Args []Arg // the command name followed by its arguments
+}
+
+// Cond is the [condition] prefix of a command line.
+type Cond struct {
+	Pos  Pos    // position of the opening '['
+	Text string // text between the brackets, e.g. "short" or "!windows"
+}
+
+// Arg is a single word of a command line.
+type Arg struct {
+	Pos   Pos    // position of the first byte of the word
+	Raw   string // the word as written, including quotes
+	Value string // the word with quotes removed and escapes applied
+}
+
+// File is an embedded archive file.
+type File struct {
+	Pos Pos // position of the "-- name --" marker line
+	FileHeader
+	Data []byte // the content as written, before any decoding
+}
+
+// FileHeader is the parsed marker line of an archive file: a path relative
+// to $WORK, optionally followed by space-separated annotations, as in
+// "-- logo.png [base64] --" or "-- bin/run.sh 0755 --". A header
+// "-- name -> target --" declares a symlink instead of a file.
+type FileHeader struct {
+	Name     string
+	Encoding string      // "base64" if annotated [base64]; "" for plain content
+	Mode     fs.FileMode // permission bits from an octal annotation; 0 if none
+	Target   string      // symlink target, as written; "" for regular files
+	Expand   bool        // annotated [expand]: ${VAR} is expanded on extraction
+}
+
+// ParseFileHeader parses an archive file name as txtar reports it, the text
+// between "-- " and " --". Annotations are recognized from the end, so a
+// path may contain spaces.
+func ParseFileHeader(header string) (FileHeader, error) {
+	var h FileHeader
+	fields := strings.Fields(header)
+	for len(fields) > 1 {
+		last := fields[len(fields)-1]
+		if isFileMode(last) {
+			if h.Mode != 0 {
+				return h, fmt.Errorf("duplicate mode %s", last)
+			}
+			mode, _ := strconv.ParseUint(last, 8, 32)
+			if mode == 0 {
+				return h, fmt.Errorf("invalid mode %s", last)
+			}
+			h.Mode = fs.FileMode(mode)
+			fields = fields[:len(fields)-1]
+			continue
+		}
+		if !strings.HasPrefix(last, "[") || !strings.HasSuffix(last, "]") {
+			break
+		}
+		switch enc := last[1 : len(last)-1]; enc {
+		case "base64":
+			if h.Encoding != "" {
+				return h, fmt.Errorf("duplicate encoding [%s]", enc)
+			}
+			h.Encoding = enc
+		case "expand":
+			h.Expand = true
+		default:
+			return h, fmt.Errorf("unknown file annotation %s", last)
+		}
+		fields = fields[:len(fields)-1]
+	}
+	h.Name = strings.Join(fields, " ")
+	if i := slices.Index(fields, "->"); i >= 0 {
+		h.Name, h.Target = strings.Join(fields[:i], " "), strings.Join(fields[i+1:], " ")
+		if h.Target == "" {
+			return h, fmt.Errorf("symlink %s has no target", h.Name)
+		}
+		if h.Encoding != "" || h.Mode != 0 || h.Expand {
+			return h, fmt.Errorf("symlink %s cannot have annotations", h.Name)
+		}
+	}
+	if h.Name == "" {
+		return h, fmt.Errorf("archive file has no name")
+	}
+	return h, nil
+}
+
+// isFileMode reports whether s is a mode annotation: four octal digits
+// with a leading zero, such as 0755.
+func isFileMode(s string) bool {
+	if len(s) != 4 || s[0] != '0' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '7' {
+			return false
+		}
+	}
+	return true
+}
+
+// Error is a syntax error at a position in a script.
+type Error struct {
+	Filename string
+	Pos      Pos
+	Msg      string
+}
+
+func (e *Error) Error() string {
+	if e.Filename == "" {
+		return fmt.Sprintf("%v: %s", e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("%s:%v: %s", e.Filename, e.Pos, e.Msg)
+}
+
+// ErrorList is the list of syntax errors found in a script.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Parse parses the script in data. The filename is only used in errors.
+// A Script is always returned, with every line that could be parsed; if any
+// line is malformed, the error is an ErrorList and that line has Kind Command
+// with no Args.
+func Parse(filename string, data []byte) (*Script, error) {
+	s := &Script{}
+	script := data
+	var errs, fileErrs ErrorList
+	if bytes.Contains(data, []byte("-- ")) {
+		ar := txtar.Parse(data)
+		script = ar.Comment
+		line := bytes.Count(script, []byte("\n")) + 1
+		for _, f := range ar.Files {
+			h, err := ParseFileHeader(f.Name)
+			if err != nil {
+				fileErrs = append(fileErrs, &Error{Filename: filename, Pos: Pos{line, 1}, Msg: err.Error()})
+			}
+			s.Files = append(s.Files, &File{Pos: Pos{line, 1}, FileHeader: h, Data: f.Data})
+			line += 1 + bytes.Count(f.Data, []byte("\n"))
+		}
+	}
+
+	text := string(script)
+	for n := 1; text != ""; n++ {
+		var raw string
+		raw, text, _ = strings.Cut(text, "\n")
+		l, err := parseLine(n, raw)
+		if err != nil {
+			err.Filename = filename
+			errs = append(errs, err)
+		}
+		s.Lines = append(s.Lines, l)
+	}
+	errs = append(errs, fileErrs...)
+	if len(errs) > 0 {
+		return s, errs
+	}
+	return s, nil
+}
+
+// parseLine parses line n of the script section.
+func parseLine(n int, raw string) (*Line, *Error) {
+	l := &Line{Pos: Pos{n, 1}, Text: raw}
+	line := strings.TrimLeft(raw, " \t")
+	col := 1 + len(raw) - len(line)
+	line = strings.TrimRight(line, " \t")
+	switch {
+	case line == "":
+		l.Kind = Blank
+		return l, nil
+	case line[0] == '#':
+		l.Kind = Comment
+		return l, nil
+	}
+	l.Kind = Command
+
+	cond, rest, err := CutCondition(line)
+	if err != nil {
+		return l, &Error{Pos: Pos{n, col}, Msg: err.Error()}
+	}
+	if cond != "" {
+		l.Cond = &Cond{Pos: Pos{n, col}, Text: cond}
+		col += len(line) - len(rest)
+	}
+
+	args, err := scan(rest)
+	if err != nil {
+		return l, &Error{Pos: Pos{n, col}, Msg: err.Error()}
+	}
+	if len(args) > 0 && args[0].Value == "!" {
+		if len(args) == 1 {
+			return l, &Error{Pos: Pos{n, col}, Msg: "! on line by itself"}
+		}
+		l.Neg = true
+		args = args[1:]
+	}
+	for i := range args {
+		args[i].Pos = Pos{n, col + args[i].Pos.Col}
+	}
+	l.Args = args
+	return l, nil
+}
+
+// CutCondition splits a trimmed command line into its [condition] prefix, if
+// any, and the rest of the line. The condition is returned without brackets;
+// it is empty if the line has none.
+func CutCondition(line string) (cond, rest string, err error) {
+	if line == "" || line[0] != '[' {
+		return "", line, nil
+	}
+	i := strings.Index(line, "]")
+	if i < 0 {
+		return "", "", fmt.Errorf("unterminated condition")
+	}
+	return line[1:i], strings.TrimSpace(line[i+1:]), nil
+}
+
+// Split splits a line into words, respecting quoted strings.
+// Double quotes support backslash escapes (\", \\).
+// Single quotes are literal (no escape processing).
+// Whitespace inside quotes is preserved exactly (no collapsing).
+// Empty words, such as "", are dropped.
+func Split(line string) ([]string, error) {
+	args, err := scan(line)
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	for _, a := range args {
+		words = append(words, a.Value)
+	}
+	return words, nil
+}
+
+// SplitArgs splits a line into words like Split, keeping how each was
+// written in Arg.Raw, so that callers can tell quoted words from bare ones.
+// Each Arg's Pos.Col is the 0-based byte offset of the word in line;
+// Pos.Line is left unset.
+func SplitArgs(line string) ([]Arg, error) {
+	return scan(line)
+}
+
+// scan splits line into words like Split. Each Arg's Pos.Col is the 0-based
+// byte offset of the word in line; Pos.Line is left unset.
+func scan(line string) ([]Arg, error) {
+	var args []Arg
+	var current strings.Builder
+	inDouble := false
+	inSingle := false
+	escaped := false
+	start := -1
+
+	flush := func(end int) {
+		if current.Len() > 0 {
+			args = append(args, Arg{Pos: Pos{Col: start}, Raw: line[start:end], Value: current.String()})
+			current.Reset()
+		}
+		start = -1
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if start < 0 && (inDouble || inSingle || (c != ' ' && c != '\t')) {
+			start = i
+		}
+		if escaped {
+			current.WriteByte(c)
+			escaped = false
+			continue
+		}
+		if inSingle {
+			if c == '\'' {
+				inSingle = false
+			} else {
+				current.WriteByte(c)
+			}
+			continue
+		}
+		if c == '\\' && inDouble {
+			escaped = true
+			continue
+		}
+		if c == '"' {
+			inDouble = !inDouble
+			continue
+		}
+		if c == '\'' && !inDouble {
+			inSingle = true
+			continue
+		}
+		if !inDouble && (c == ' ' || c == '\t') {
+			flush(i)
+			continue
+		}
+		current.WriteByte(c)
+	}
+	if inDouble || inSingle {
+		return nil, fmt.Errorf("unclosed quote")
+	}
+	flush(len(line))
+	return args, nil
+}
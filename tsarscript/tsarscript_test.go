@@ -0,0 +1,221 @@
+package tsarscript
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "no quotes",
+			line: "hello world",
+			want: []string{"hello", "world"},
+		},
+		{
+			name: "single quoted arg without spaces",
+			line: `"hello"`,
+			want: []string{"hello"},
+		},
+		{
+			name: "quoted arg with spaces",
+			line: `"hello world"`,
+			want: []string{"hello world"},
+		},
+		{
+			name: "mixed quoted and unquoted",
+			line: `foo "hello world" bar`,
+			want: []string{"foo", "hello world", "bar"},
+		},
+		{
+			name:    "unclosed quote",
+			line:    `"hello world`,
+			wantErr: true,
+		},
+		{
+			name: "escaped quote inside",
+			line: `"hello \"world\""`,
+			want: []string{`hello "world"`},
+		},
+		{
+			name: "empty input",
+			line: "",
+			want: nil,
+		},
+		{
+			name: "multiple quoted segments",
+			line: `"foo bar" "baz qux"`,
+			want: []string{"foo bar", "baz qux"},
+		},
+		{
+			name: "preserves multiple spaces inside quotes",
+			line: `"hello  world"`,
+			want: []string{"hello  world"},
+		},
+		{
+			name: "tabs as separators",
+			line: "foo\tbar",
+			want: []string{"foo", "bar"},
+		},
+		{
+			name: "quoted with tabs inside",
+			line: "\"foo\tbar\"",
+			want: []string{"foo\tbar"},
+		},
+		{
+			name: "escaped backslash",
+			line: `"hello\\world"`,
+			want: []string{`hello\world`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Split(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Split(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Errorf("Split(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	got, err := SplitArgs(`echo '<html>' >"out file" 2>err`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Arg{
+		{Pos: Pos{Col: 0}, Raw: "echo", Value: "echo"},
+		{Pos: Pos{Col: 5}, Raw: "'<html>'", Value: "<html>"},
+		{Pos: Pos{Col: 14}, Raw: `>"out file"`, Value: ">out file"},
+		{Pos: Pos{Col: 26}, Raw: "2>err", Value: "2>err"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("SplitArgs = %+v, want %+v", got, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := []byte(`# a comment
+
+exec echo "hello world"
+[!windows] ! stdout  'x y'
+-- a.txt --
+one
+two
+-- b.txt --
+three
+`)
+	s, err := Parse("test.tsar", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []LineKind
+	for _, l := range s.Lines {
+		kinds = append(kinds, l.Kind)
+	}
+	if want := []LineKind{Comment, Blank, Command, Command}; !slices.Equal(kinds, want) {
+		t.Fatalf("line kinds = %v, want %v", kinds, want)
+	}
+
+	exec := s.Lines[2]
+	want := []Arg{
+		{Pos{3, 1}, "exec", "exec"},
+		{Pos{3, 6}, "echo", "echo"},
+		{Pos{3, 11}, `"hello world"`, "hello world"},
+	}
+	if !slices.Equal(exec.Args, want) {
+		t.Errorf("args = %+v, want %+v", exec.Args, want)
+	}
+
+	stdout := s.Lines[3]
+	if stdout.Cond == nil || stdout.Cond.Text != "!windows" || stdout.Cond.Pos != (Pos{4, 1}) {
+		t.Errorf("cond = %+v, want !windows at 4:1", stdout.Cond)
+	}
+	if !stdout.Neg {
+		t.Error("expected negated command")
+	}
+	want = []Arg{
+		{Pos{4, 14}, "stdout", "stdout"},
+		{Pos{4, 22}, "'x y'", "x y"},
+	}
+	if !slices.Equal(stdout.Args, want) {
+		t.Errorf("args = %+v, want %+v", stdout.Args, want)
+	}
+
+	if len(s.Files) != 2 {
+		t.Fatalf("got %d files, want 2", len(s.Files))
+	}
+	if f := s.Files[0]; f.Name != "a.txt" || f.Pos.Line != 5 || string(f.Data) != "one\ntwo\n" {
+		t.Errorf("file 0 = %s at %v: %q", f.Name, f.Pos, f.Data)
+	}
+	if f := s.Files[1]; f.Name != "b.txt" || f.Pos.Line != 8 {
+		t.Errorf("file 1 = %s at %v", f.Name, f.Pos)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	s, err := Parse("bad.tsar", []byte("exec true\n  [short exec true\necho 'open\n!\n"))
+	var errs ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("err = %v, want ErrorList", err)
+	}
+	want := []string{
+		"bad.tsar:2:3: unterminated condition",
+		"bad.tsar:3:1: unclosed quote",
+		"bad.tsar:4:1: ! on line by itself",
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("errors = %q, want %q", got, want)
+	}
+	if len(s.Lines) != 4 || len(s.Lines[0].Args) != 2 {
+		t.Errorf("expected all lines to be returned, got %d", len(s.Lines))
+	}
+}
+
+func TestParseFileHeader(t *testing.T) {
+	for header, want := range map[string]FileHeader{
+		"a.txt":                 {Name: "a.txt"},
+		"logo.png [base64]":     {Name: "logo.png", Encoding: "base64"},
+		"my notes.txt":          {Name: "my notes.txt"},
+		"my logo.png  [base64]": {Name: "my logo.png", Encoding: "base64"},
+		"[base64]":              {Name: "[base64]"},
+		"bin/run.sh 0755":       {Name: "bin/run.sh", Mode: 0755},
+		"key.bin 0600 [base64]": {Name: "key.bin", Encoding: "base64", Mode: 0600},
+		"notes 2024":            {Name: "notes 2024"},
+		"lib/current -> v1.2":   {Name: "lib/current", Target: "v1.2"},
+		"config.toml [expand]":  {Name: "config.toml", Expand: true},
+		"link -> ../a b.txt":    {Name: "link", Target: "../a b.txt"},
+	} {
+		got, err := ParseFileHeader(header)
+		if err != nil || got != want {
+			t.Errorf("ParseFileHeader(%q) = %+v, %v; want %+v", header, got, err, want)
+		}
+	}
+	for header, want := range map[string]string{
+		"a.bin [gzip]":            "unknown file annotation [gzip]",
+		"a.bin [base64] [base64]": "duplicate encoding [base64]",
+		"run.sh 0755 0700":        "duplicate mode 0755",
+		"link -> ":                "symlink link has no target",
+		"link -> target 0755":     "symlink link cannot have annotations",
+		"":                        "archive file has no name",
+	} {
+		if _, err := ParseFileHeader(header); err == nil || err.Error() != want {
+			t.Errorf("ParseFileHeader(%q) error = %v, want %q", header, err, want)
+		}
+	}
+}
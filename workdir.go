@@ -0,0 +1,327 @@
+package tsar
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WorkdirMode selects how scripts' work directories are provided; see
+// Params.WorkdirMode.
+type WorkdirMode string
+
+const (
+	// WorkdirTemp creates a fresh directory for each script and removes it
+	// when the script ends. It is the default.
+	WorkdirTemp WorkdirMode = ""
+
+	// WorkdirTmpfs is like WorkdirTemp, but roots the directories on a
+	// memory-backed filesystem (/dev/shm on Linux) unless WorkdirRoot is
+	// set. Where none is available, $TMPDIR is used.
+	WorkdirTmpfs WorkdirMode = "tmpfs"
+
+	// WorkdirPool reuses directories across the scripts of a run: when a
+	// script ends its directory is emptied and handed to the next script.
+	// The pooled directories are removed when the run ends. Directories
+	// kept with TestWork or WorkdirRoot are never handed on, so then each
+	// script gets a fresh one, as with WorkdirTemp.
+	WorkdirPool WorkdirMode = "pool"
+
+	// WorkdirReuse runs every script of a run in one directory, emptied
+	// before each script and kept across runs. It is tsar-work-UID/N under
+	// the root: tsar-work-UID is private to the user, and N the first
+	// directory not locked by another run, so concurrent runs never share
+	// one.
+	WorkdirReuse WorkdirMode = "reuse"
+)
+
+// ParseWorkdirMode parses the name of a WorkdirMode; "temp" and the empty
+// string both mean WorkdirTemp.
+func ParseWorkdirMode(s string) (WorkdirMode, error) {
+	switch m := WorkdirMode(s); m {
+	case "temp", WorkdirTemp:
+		return WorkdirTemp, nil
+	case WorkdirTmpfs, WorkdirPool, WorkdirReuse:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown workdir mode %q (want temp, tmpfs, pool or reuse)", s)
+}
+
+// workdirs hands out work directories to the scripts of one run.
+type workdirs struct {
+	mode WorkdirMode
+	root string
+	keep bool   // directories are kept for inspection; see Params.TestWork
+	run  string // identifies the run in the index of kept directories
+
+	mu     sync.Mutex
+	ready  bool     // root has been created
+	free   []string // emptied pool directories
+	pooled []string // every pool directory, removed by close
+	reused string   // the WorkdirReuse directory, once locked
+	unlock func()   // releases reused
+}
+
+func newWorkdirs(p Params) *workdirs {
+	w := &workdirs{
+		mode: p.WorkdirMode,
+		root: os.TempDir(),
+		keep: p.TestWork || p.WorkdirRoot != "",
+		run:  time.Now().Format("20060102-150405") + "-" + strconv.Itoa(os.Getpid()),
+	}
+	if p.WorkdirMode == WorkdirTmpfs {
+		w.root = memoryTempDir()
+	}
+	if p.WorkdirRoot != "" {
+		w.root = p.WorkdirRoot
+	}
+	return w
+}
+
+// get returns an empty work directory for the named script. Kept
+// directories are named after it.
+func (w *workdirs) get(name string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.ready {
+		if err := os.MkdirAll(w.root, 0755); err != nil {
+			return "", err
+		}
+		w.ready = true
+	}
+	switch w.mode {
+	case WorkdirPool:
+		if w.keep {
+			break
+		}
+		if n := len(w.free); n > 0 {
+			dir := w.free[n-1]
+			w.free = w.free[:n-1]
+			return dir, nil
+		}
+		dir, err := os.MkdirTemp(w.root, "tsar-pool-*")
+		if err == nil {
+			w.pooled = append(w.pooled, dir)
+		}
+		return dir, err
+	case WorkdirReuse:
+		if w.reused == "" {
+			dir, unlock, err := lockReuseDir(w.root)
+			if err != nil {
+				return "", err
+			}
+			w.reused, w.unlock = dir, unlock
+		}
+		return w.reused, emptyDir(w.reused)
+	}
+	if w.keep {
+		return os.MkdirTemp(w.root, "tsar-"+unsafeNameChars.ReplaceAllString(name, "_")+"-*")
+	}
+	return os.MkdirTemp(w.root, "tsar-*")
+}
+
+// maxReuseDirs bounds the WorkdirReuse directories of a user under a root,
+// and so the runs using them at once.
+const maxReuseDirs = 64
+
+// errLocked reports a lock held by another process; see lockFile.
+var errLocked = errors.New("locked by another process")
+
+// lockReuseDir returns the WorkdirReuse directory of root for this run,
+// and a function releasing it: the first of tsar-work-UID/0, 1... whose
+// lock file no other run holds. Only the user may write in tsar-work-UID,
+// so no one else can plant files or links in the directories.
+func lockReuseDir(root string) (dir string, unlock func(), err error) {
+	base := filepath.Join(root, "tsar-work")
+	if uid := os.Getuid(); uid >= 0 {
+		base += "-" + strconv.Itoa(uid)
+	}
+	if err := os.Mkdir(base, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", nil, err
+	}
+	info, err := os.Lstat(base)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.IsDir() || !privateToUser(info) {
+		return "", nil, fmt.Errorf("%s is not a directory private to the current user", base)
+	}
+	for n := range maxReuseDirs {
+		dir := filepath.Join(base, strconv.Itoa(n))
+		unlock, err := lockFile(dir + ".lock")
+		if errors.Is(err, errLocked) {
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			unlock()
+			return "", nil, err
+		}
+		return dir, unlock, nil
+	}
+	return "", nil, fmt.Errorf("%s: all %d work directories are in use", base, maxReuseDirs)
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// put releases a script's work directory once the script has ended. Kept
+// directories are left alone; in pool mode, they are not reused.
+func (w *workdirs) put(dir string) {
+	if w.keep || dir == "" {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch w.mode {
+	case WorkdirPool:
+		if emptyDir(dir) == nil {
+			w.free = append(w.free, dir)
+		}
+	case WorkdirReuse:
+		// Emptied by the next get, or by close.
+	default:
+		removeAll(dir)
+	}
+}
+
+// close cleans up the directories left at the end of a run, and releases
+// the WorkdirReuse directory.
+func (w *workdirs) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.reused != "" {
+		if !w.keep {
+			emptyDir(w.reused)
+		}
+		w.unlock()
+		w.reused, w.unlock = "", nil
+	}
+	if w.keep {
+		return
+	}
+	for _, dir := range w.pooled {
+		removeAll(dir)
+	}
+	w.free, w.pooled = nil, nil
+}
+
+// emptyDir removes everything inside dir.
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := removeAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryTempDir returns a directory on a memory-backed filesystem, or
+// os.TempDir if there is none.
+func memoryTempDir() string {
+	if runtime.GOOS == "linux" {
+		if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+			return "/dev/shm"
+		}
+	}
+	return os.TempDir()
+}
+
+// workdirIndex is the file of a kept work directory recording which script
+// and run it belongs to; see ListWorkdirs.
+const workdirIndex = ".tsar/workdir.json"
+
+// WorkdirInfo describes a work directory kept after its script ended,
+// because Params.TestWork or WorkdirRoot was set.
+type WorkdirInfo struct {
+	Dir      string       `json:"-"`
+	Script   string       `json:"script"`
+	File     string       `json:"file"`
+	Run      string       `json:"run"` // shared by the scripts of one run, ordered by start time
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Status   ScriptStatus `json:"status"`
+	Failure  string       `json:"failure,omitempty"`
+}
+
+// writeIndex records in a kept work directory the script that used it.
+func (w *workdirs) writeIndex(dir string, r ScriptResult) error {
+	info := WorkdirInfo{
+		Script:   r.Name,
+		File:     r.File,
+		Run:      w.run,
+		Started:  time.Now().Add(-r.Duration).Round(time.Millisecond),
+		Finished: time.Now().Round(time.Millisecond),
+		Status:   r.Status,
+		Failure:  r.Failure,
+	}
+	if abs, err := filepath.Abs(r.File); err == nil {
+		info.File = abs
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, filepath.FromSlash(workdirIndex))
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0666)
+}
+
+// ListWorkdirs returns the kept work directories directly under root, or
+// under the default roots (os.TempDir and, on Linux, /dev/shm) if root is
+// empty, most recent first. Directories without an index, such as those of
+// scripts still running, are not listed.
+func ListWorkdirs(root string) ([]WorkdirInfo, error) {
+	roots, explicit := []string{root}, root != ""
+	if !explicit {
+		roots = []string{os.TempDir()}
+		if shm := memoryTempDir(); shm != roots[0] {
+			roots = append(roots, shm)
+		}
+	}
+	var infos []WorkdirInfo
+	for _, root := range roots {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && !explicit {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			dir := filepath.Join(root, e.Name())
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(workdirIndex)))
+			if err != nil {
+				continue
+			}
+			var info WorkdirInfo
+			if err := json.Unmarshal(data, &info); err != nil {
+				continue
+			}
+			info.Dir = dir
+			infos = append(infos, info)
+		}
+	}
+	slices.SortStableFunc(infos, func(a, b WorkdirInfo) int {
+		return b.Finished.Compare(a.Finished)
+	})
+	return infos, nil
+}
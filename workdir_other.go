@@ -0,0 +1,30 @@
+//go:build !unix || aix || solaris
+
+package tsar
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// lockFile creates the file at path as a lock, failing with errLocked if
+// it exists. The lock is released by unlock; a process that dies holding it
+// leaves it behind, and later runs then use another directory.
+func lockFile(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, errLocked
+	} else if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return func() { os.Remove(path) }, nil
+}
+
+// privateToUser reports whether info describes a file of the current user
+// that no one else may access. Without Unix file ownership, it trusts the
+// per-user temporary directory.
+func privateToUser(info os.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,61 @@
+package tsar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeYAML decodes a YAML document for queryData. A stream of several
+// documents, separated by ---, decodes as an array of them.
+func decodeYAML(data []byte) (any, error) {
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	var docs []any
+	for {
+		var v any
+		err := dec.Decode(&v)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, normalizeYAML(v))
+	}
+	switch len(docs) {
+	case 0:
+		return nil, fmt.Errorf("no YAML document")
+	case 1:
+		return docs[0], nil
+	}
+	return docs, nil
+}
+
+// normalizeYAML turns the maps with non-string keys that YAML allows into
+// maps keyed by their keys' text, so values have the shapes of JSON ones.
+func normalizeYAML(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalizeYAML(e)
+		}
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalizeYAML(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = normalizeYAML(e)
+		}
+	}
+	return v
+}
+
+func (ts *TestScript) cmdYAML(neg bool, args []string) {
+	ts.queryData(neg, args, decodeYAML)
+}